@@ -1,8 +1,10 @@
 package config
 
 import (
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,11 +20,63 @@ type Config struct {
 	WebSocket WebSocketConfig
 	JWT       JWTConfig
 	NATS      NATSConfig
+	Snapshot  SnapshotConfig
+	Log       LogConfig
+	Webhook   WebhookConfig
 }
 
+// WebhookConfig holds the delivery of document events to an external HTTP endpoint
+type WebhookConfig struct {
+	// URL receives a POST per event; empty disables the webhook
+	URL string
+	// QueueSize bounds the events waiting for delivery; more are dropped
+	QueueSize int
+	// MaxRetries is how many times a failed delivery is retried, waiting RetryBackoff, then twice as long each time
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// Timeout bounds each delivery attempt
+	Timeout time.Duration
+}
+
+// LogConfig holds logging verbosity
+type LogConfig struct {
+	// Level is the default level; Levels overrides it per category, as in "broadcast=warn,auth=debug"
+	Level  string
+	Levels string
+}
+
+// SnapshotConfig holds document snapshot persistence configuration
+type SnapshotConfig struct {
+	// Dir is where snapshots are stored; empty disables persistence
+	Dir      string
+	Compress bool
+}
+
+// NATSConfig holds NATS connection and subscription configuration
 type NATSConfig struct {
 	URL     string
 	Timeout time.Duration
+	// SubscriptionIdleTTL keeps a document subscription alive this long after its last connection
+	// leaves, 0 removes it right away
+	SubscriptionIdleTTL time.Duration
+	// MaxSubscriptions caps the number of document subscriptions, 0 means unlimited
+	MaxSubscriptions int
+	// FlushTimeout bounds how long Close waits for buffered publishes to reach the server
+	FlushTimeout time.Duration
+	// PublishTimeout is how long an event waits for room in the queue forwarding it to NATS before it is rejected
+	PublishTimeout time.Duration
+	// AllowFallback runs on an in-process, instance-local broker when NATS is unreachable
+	AllowFallback bool
+	// AdminSubject prefixes the subjects carrying admin commands to all instances; AdminSecret
+	// authenticates them, and admin commands are disabled while it is empty
+	AdminSubject string
+	AdminSecret  string
+	// ReconcileInterval is how often subscriptions are checked against open connections, 0 disables it
+	ReconcileInterval time.Duration
+	// ReplayStream names the JetStream stream document edits are kept in, so a resubscribed document
+	// gets the edits it missed meanwhile; empty disables replay. ReplayMaxAge is how long edits are kept.
+	ReplayStream string
+	ReplayMaxAge time.Duration
 }
 
 // ServerConfig holds HTTP server configuration
@@ -31,6 +85,14 @@ type ServerConfig struct {
 	Host         string
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
+	// H2C enables HTTP/2 over cleartext alongside HTTP/1.1
+	H2C bool
+	// MaxBodyBytes limits the request body size accepted by POST endpoints
+	MaxBodyBytes int
+	// ConnectionDrainTimeout is how long WebSocket connections may keep reading once shutdown begins
+	ConnectionDrainTimeout time.Duration
+	// UnixSocket is the path of a Unix domain socket to listen on instead of the TCP port, when set
+	UnixSocket string
 }
 
 // WebSocketConfig holds WebSocket-specific configuration
@@ -40,6 +102,66 @@ type WebSocketConfig struct {
 	WriteBufferSize   int
 	HandshakeTimeout  time.Duration
 	EnableCompression bool
+	// AllowAnonymousView enables the unauthenticated read-only document endpoint
+	AllowAnonymousView bool
+	// PingInterval is how often the server pings each connection
+	PingInterval time.Duration
+	// PongTimeout is how long a connection may go without answering a ping before it is dropped
+	PongTimeout time.Duration
+	// MaxMessageSize is the largest inbound message in bytes; larger ones close the connection with 1009
+	MaxMessageSize int64
+	// AppKeepalive also sends {"type":"ping"} messages every AppKeepaliveInterval, closing connections
+	// that don't answer {"type":"pong"} within AppKeepaliveTimeout; for proxies stripping control frames
+	AppKeepalive         bool
+	AppKeepaliveInterval time.Duration
+	AppKeepaliveTimeout  time.Duration
+	// DrainMode is "reject" or "queue", deciding what happens to edits on a draining document
+	DrainMode string
+	// UnauthorizedStrategy is "reject" or "downgrade_readonly", deciding what happens to a user
+	// the document authorizer denies
+	UnauthorizedStrategy string
+	// SingleSessionPerUser closes a user's open connection when they open a new one
+	SingleSessionPerUser bool
+	// PresenceTTL is how long a participant stays present without a heartbeat
+	PresenceTTL time.Duration
+	// SlowConsumerGrace is how long a broadcast waits on a full send buffer before dropping the connection; zero drops it at once
+	SlowConsumerGrace time.Duration
+	// OverflowPolicy is "close" or "drop_message", deciding what happens once the grace passed:
+	// dropped messages are followed by a resync_required message telling the client to catch up
+	OverflowPolicy string
+	// StatsInterval is how often clients subscribed to document stats receive them
+	StatsInterval time.Duration
+	// BinaryPassthrough fans binary frames out untouched instead of parsing them as JSON edits (CRDT updates)
+	BinaryPassthrough bool
+	// TransientRateLimit caps cursor and presence messages per connection per second, 0 means unlimited
+	TransientRateLimit int
+	// LowPriorityQueueLimit is the send buffer fill above which cursor and presence broadcasts are dropped, keeping room for edits
+	LowPriorityQueueLimit int
+	// MaxConcurrentUpgrades caps upgrades and joins in flight at once, 0 means unlimited; excess
+	// requests wait up to UpgradeQueueTimeout for a slot before being refused with 503
+	MaxConcurrentUpgrades int
+	UpgradeQueueTimeout   time.Duration
+	// CloseWriteTimeout bounds writing a close frame to a peer that may no longer be reading
+	CloseWriteTimeout time.Duration
+	// WriteWait bounds every message and ping write; a client not taking the data in time is disconnected
+	WriteWait time.Duration
+	// MaxBufferedMessages refuses new upgrades with 503 while the send buffers of all connections
+	// together hold more messages than this, 0 means no limit
+	MaxBufferedMessages int
+	// HistoryMaxBytes caps the edit history each document keeps for catch-up, next to its 1000 edit
+	// count cap; the oldest edits are evicted first. 0 means no byte limit.
+	HistoryMaxBytes int
+	// CloseOnTokenExpiry closes connections when their token expires, telling clients to reconnect with a fresh one
+	CloseOnTokenExpiry bool
+	// DocumentIDSource is where /ws/document finds the document ID: "query", "claim" or "first_message"
+	DocumentIDSource string
+	// InitialMessageTimeout is how long a client expected to open with a message may stay silent, 0 waits forever
+	InitialMessageTimeout time.Duration
+	// SenderExclusion sets per topic which of the sender's connections don't get its events back, as in
+	// "edit=connection,cursor=none"; policies are user, connection and none
+	SenderExclusion string
+	// TypingTimeout is how long a typing indicator lasts without being refreshed
+	TypingTimeout time.Duration
 }
 
 // JWTConfig holds JWT-related configuration
@@ -47,6 +169,14 @@ type JWTConfig struct {
 	SecretKey     string
 	TokenDuration time.Duration
 	Issuer        string
+	ClockSkew     time.Duration
+	// DisplayClaim names the claim holding a human-readable identity (e.g. name or email); sub remains the key
+	DisplayClaim string
+	// CacheTTL keeps successful token validations this long, capped at half the token's remaining lifetime; 0 disables the cache
+	CacheTTL time.Duration
+	// TokenSources lists where requests may carry their token, in priority order: "header"
+	// (Authorization: Bearer), "subprotocol" (Sec-WebSocket-Protocol) and "query" (?token=)
+	TokenSources []string
 }
 
 // Load loads configuration from environment variables with sensible defaults
@@ -54,24 +184,86 @@ func Load() *Config {
 	once.Do(func() {
 		singleConfig = &Config{
 			Server: ServerConfig{
-				Port:         getEnv("SERVER_PORT", "9001"),
-				Host:         getEnv("SERVER_HOST", "localhost"),
-				ReadTimeout:  getDuration("SERVER_READ_TIMEOUT", 5*time.Second),
-				WriteTimeout: getDuration("SERVER_WRITE_TIMEOUT", 2*time.Second),
+				Port:                   getEnv("SERVER_PORT", "9001"),
+				Host:                   getEnv("SERVER_HOST", "localhost"),
+				ReadTimeout:            getDuration("SERVER_READ_TIMEOUT", 5*time.Second),
+				WriteTimeout:           getDuration("SERVER_WRITE_TIMEOUT", 2*time.Second),
+				H2C:                    getBool("HTTP2_H2C", false),
+				MaxBodyBytes:           getInt("HTTP_MAX_BODY_BYTES", 1<<20),
+				ConnectionDrainTimeout: getDuration("SERVER_CONNECTION_DRAIN_TIMEOUT", 5*time.Second),
+				UnixSocket:             getEnv("SERVER_UNIX_SOCKET", ""),
 			},
 			WebSocket: WebSocketConfig{
-				CheckOrigin:       getBool("WS_CHECK_ORIGIN", false),
-				ReadBufferSize:    getInt("WS_READ_BUFFER_SIZE", 1024),
-				WriteBufferSize:   getInt("WS_WRITE_BUFFER_SIZE", 1024),
-				HandshakeTimeout:  getDuration("WS_HANDSHAKE_TIMEOUT", 10*time.Second),
-				EnableCompression: getBool("WS_ENABLE_COMPRESSION", false),
+				CheckOrigin:           getBool("WS_CHECK_ORIGIN", false),
+				ReadBufferSize:        getInt("WS_READ_BUFFER_SIZE", 1024),
+				WriteBufferSize:       getInt("WS_WRITE_BUFFER_SIZE", 1024),
+				HandshakeTimeout:      getDuration("WS_HANDSHAKE_TIMEOUT", 10*time.Second),
+				EnableCompression:     getBool("WS_ENABLE_COMPRESSION", false),
+				AllowAnonymousView:    getBool("WS_ALLOW_ANONYMOUS_VIEW", false),
+				PingInterval:          getDuration("WS_PING_INTERVAL", 20*time.Second),
+				PongTimeout:           getDuration("WS_PONG_TIMEOUT", 30*time.Second),
+				MaxMessageSize:        int64(getInt("WS_MAX_MESSAGE_SIZE", 1<<20)),
+				AppKeepalive:          getBool("WS_APP_KEEPALIVE", false),
+				AppKeepaliveInterval:  getDuration("WS_APP_KEEPALIVE_INTERVAL", 30*time.Second),
+				AppKeepaliveTimeout:   getDuration("WS_APP_KEEPALIVE_TIMEOUT", 30*time.Second),
+				DrainMode:             getEnv("WS_DRAIN_MODE", "reject"),
+				UnauthorizedStrategy:  getEnv("WS_UNAUTHORIZED_STRATEGY", "reject"),
+				SingleSessionPerUser:  getBool("SINGLE_SESSION_PER_USER", false),
+				PresenceTTL:           getDuration("WS_PRESENCE_TTL", time.Minute),
+				SlowConsumerGrace:     getDuration("WS_SLOW_CONSUMER_GRACE", 100*time.Millisecond),
+				OverflowPolicy:        getEnv("WS_OVERFLOW_POLICY", "close"),
+				StatsInterval:         getDuration("WS_STATS_INTERVAL", 5*time.Second),
+				BinaryPassthrough:     getBool("WS_BINARY_PASSTHROUGH", false),
+				TransientRateLimit:    getInt("WS_TRANSIENT_RATE_LIMIT", 30),
+				LowPriorityQueueLimit: getInt("WS_LOW_PRIORITY_QUEUE_LIMIT", 64),
+				MaxConcurrentUpgrades: getInt("WS_MAX_CONCURRENT_UPGRADES", 0),
+				UpgradeQueueTimeout:   getDuration("WS_UPGRADE_QUEUE_TIMEOUT", time.Second),
+				MaxBufferedMessages:   getInt("WS_MAX_BUFFERED_MESSAGES", 0),
+				HistoryMaxBytes:       getInt("WS_HISTORY_MAX_BYTES", 10<<20),
+				CloseWriteTimeout:     getDuration("WS_CLOSE_WRITE_TIMEOUT", time.Second),
+				WriteWait:             getDuration("WS_WRITE_WAIT", 10*time.Second),
+				CloseOnTokenExpiry:    getBool("WS_CLOSE_ON_TOKEN_EXPIRY", true),
+				DocumentIDSource:      getEnv("WS_DOCUMENT_ID_SOURCE", "query"),
+				InitialMessageTimeout: getDuration("WS_INITIAL_MESSAGE_TIMEOUT", 10*time.Second),
+				SenderExclusion:       getEnv("WS_SENDER_EXCLUSION", ""),
+				TypingTimeout:         getDuration("WS_TYPING_TIMEOUT", 3*time.Second),
 			},
 			JWT: JWTConfig{
-				SecretKey: getEnv("JWT_SECRET", "your-super-secret-jwt-key-change-this-in-production"),
-				Issuer:    getEnv("JWT_ISSUER", "ce-realtime-gateway"),
+				SecretKey:    getEnv("JWT_SECRET", "your-super-secret-jwt-key-change-this-in-production"),
+				Issuer:       getEnv("JWT_ISSUER", "ce-realtime-gateway"),
+				ClockSkew:    getDuration("JWT_CLOCK_SKEW", 30*time.Second),
+				CacheTTL:     getDuration("JWT_CACHE_TTL", 0),
+				DisplayClaim: getEnv("JWT_DISPLAY_CLAIM", ""),
+				TokenSources: getList("JWT_TOKEN_SOURCES", []string{"header", "subprotocol", "query"}),
+			},
+			Snapshot: SnapshotConfig{
+				Dir:      getEnv("SNAPSHOT_STORE_DIR", ""),
+				Compress: getBool("SNAPSHOT_STORE_COMPRESS", false),
+			},
+			Webhook: WebhookConfig{
+				URL:          getEnv("WEBHOOK_URL", ""),
+				QueueSize:    getInt("WEBHOOK_QUEUE_SIZE", 1000),
+				MaxRetries:   getInt("WEBHOOK_MAX_RETRIES", 3),
+				RetryBackoff: getDuration("WEBHOOK_RETRY_BACKOFF", 500*time.Millisecond),
+				Timeout:      getDuration("WEBHOOK_TIMEOUT", 5*time.Second),
+			},
+			Log: LogConfig{
+				Level:  getEnv("LOG_LEVEL", "info"),
+				Levels: getEnv("LOG_LEVELS", ""),
 			},
 			NATS: NATSConfig{
-				URL: getEnv("NATS_URL", "nats://localhost:4222"),
+				URL:                 getEnv("NATS_URL", "nats://localhost:4222"),
+				Timeout:             getDuration("NATS_TIMEOUT", 10*time.Second),
+				SubscriptionIdleTTL: getDuration("NATS_SUBSCRIPTION_IDLE_TTL", 0),
+				MaxSubscriptions:    getInt("NATS_MAX_SUBSCRIPTIONS", 10000),
+				FlushTimeout:        getDuration("NATS_FLUSH_TIMEOUT", 5*time.Second),
+				PublishTimeout:      getDuration("NATS_PUBLISH_TIMEOUT", 2*time.Second),
+				AllowFallback:       getBool("ALLOW_NATS_FALLBACK", false),
+				AdminSubject:        getEnv("NATS_ADMIN_SUBJECT", "gateway.admin"),
+				AdminSecret:         getEnv("NATS_ADMIN_SECRET", ""),
+				ReconcileInterval:   getDuration("NATS_RECONCILE_INTERVAL", time.Minute),
+				ReplayStream:        getEnv("NATS_REPLAY_STREAM", ""),
+				ReplayMaxAge:        getDuration("NATS_REPLAY_MAX_AGE", time.Minute),
 			},
 		}
 	})
@@ -113,6 +305,19 @@ func getDuration(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
+func getList(key string, defaultValue []string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	if len(list) == 0 {
+		return defaultValue
+	}
+	return list
+}
+
 // GetServerAddress returns the full server address
 func (c *Config) GetServerAddress() string {
 	return ":" + c.Server.Port
@@ -127,3 +332,45 @@ func (c *Config) GetWebSocketURL(endpoint string) string {
 func (c *Config) GetHTTPURL(endpoint string) string {
 	return "http://" + c.Server.Host + ":" + c.Server.Port + endpoint
 }
+
+// redactedValue replaces secrets in a redacted configuration
+const redactedValue = "[redacted]"
+
+// Redacted returns a copy of the configuration safe to show to operators: secrets are replaced
+// and URLs lose their credentials and query strings
+func (c *Config) Redacted() Config {
+	redacted := *c
+	if redacted.JWT.SecretKey != "" {
+		redacted.JWT.SecretKey = redactedValue
+	}
+	if redacted.NATS.AdminSecret != "" {
+		redacted.NATS.AdminSecret = redactedValue
+	}
+	redacted.NATS.URL = redactURLs(redacted.NATS.URL)
+	redacted.Webhook.URL = redactURLs(redacted.Webhook.URL)
+	return redacted
+}
+
+// redactURLs redacts every URL of a comma-separated list, as accepted by NATS_URL
+func redactURLs(list string) string {
+	if list == "" {
+		return list
+	}
+	urls := strings.Split(list, ",")
+	for i, raw := range urls {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil {
+			urls[i] = redactedValue
+			continue
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = "redacted"
+		}
+		// A user without password is a token in NATS URLs, Redacted would leave it in place
+		if _, hasPassword := u.User.Password(); u.User != nil && !hasPassword {
+			u.User = url.User("xxxxx")
+		}
+		urls[i] = u.Redacted()
+	}
+	return strings.Join(urls, ",")
+}
@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestRedactedHidesSecrets(t *testing.T) {
+	cfg := Config{
+		JWT:     JWTConfig{SecretKey: "jwt-secret"},
+		NATS:    NATSConfig{AdminSecret: "admin-secret", URL: "nats://user:pass@a:4222, nats://s3cr3t-token@b:4222,nats://c:4222"},
+		Webhook: WebhookConfig{URL: "https://hooks.example.com/in?key=abc"},
+	}
+
+	redacted := cfg.Redacted()
+
+	if redacted.JWT.SecretKey != redactedValue || redacted.NATS.AdminSecret != redactedValue {
+		t.Errorf("secrets = %q, %q; want them redacted", redacted.JWT.SecretKey, redacted.NATS.AdminSecret)
+	}
+	if want := "nats://user:xxxxx@a:4222,nats://xxxxx@b:4222,nats://c:4222"; redacted.NATS.URL != want {
+		t.Errorf("NATS URL = %q, want %q", redacted.NATS.URL, want)
+	}
+	if want := "https://hooks.example.com/in?redacted"; redacted.Webhook.URL != want {
+		t.Errorf("webhook URL = %q, want %q", redacted.Webhook.URL, want)
+	}
+	if cfg.JWT.SecretKey != "jwt-secret" {
+		t.Error("Redacted modified the configuration it was called on")
+	}
+}
+
+func TestRedactedKeepsUnsetSecretsEmpty(t *testing.T) {
+	redacted := (&Config{}).Redacted()
+
+	if redacted.JWT.SecretKey != "" || redacted.NATS.AdminSecret != "" || redacted.NATS.URL != "" {
+		t.Errorf("redacted = %+v, want unset values left empty", redacted)
+	}
+}
@@ -3,4 +3,23 @@ package config
 const (
 	MetaRemoteAddrKey = "RemoteAddr"
 	MetaDocumentIDKey = "DocumentID"
+	MetaReadOnlyKey   = "ReadOnly"
+	// MetaDowngradedKey marks a connection made read-only because it may not edit its current document
+	MetaDowngradedKey = "Downgraded"
+	// MetaPreferredColorKey holds the cursor color requested by the client, MetaCursorColorKey the one assigned
+	MetaPreferredColorKey = "PreferredColor"
+	MetaCursorColorKey    = "CursorColor"
+	// MetaCompressionKey records whether outbound messages are compressed, MetaSubprotocolKey the agreed subprotocol
+	MetaCompressionKey = "Compression"
+	MetaSubprotocolKey = "Subprotocol"
+	// MetaSinceRevisionKey holds the last document revision the client has seen, as sent in ?since
+	MetaSinceRevisionKey = "SinceRevision"
+	// MetaServiceKey marks publish-only service connections
+	MetaServiceKey = "Service"
+	// MetaSubscribedKey marks a connection counted in its document's NATS subscription
+	MetaSubscribedKey = "Subscribed"
+	// MetaDisplayNameKey holds the human-readable identity of the user, from JWT_DISPLAY_CLAIM
+	MetaDisplayNameKey = "DisplayName"
+	// MetaDocumentClaimKey holds the document the token was issued for, from its document_id claim
+	MetaDocumentClaimKey = "DocumentClaim"
 )
@@ -0,0 +1,56 @@
+package document
+
+import "github.com/emaforlin/ce-realtime-gateway/publisher"
+
+// ReplayFilter decides whether a stored event is replayed to a client catching up
+type ReplayFilter func(event publisher.DocumentEvent) bool
+
+// EditsOnly replays only content edits, leaving out presence, cursor and other transient events
+func EditsOnly(event publisher.DocumentEvent) bool {
+	switch event.Payload.Action {
+	case ActionInsert, ActionDelete, ActionReplace:
+		return true
+	default:
+		return false
+	}
+}
+
+// ExcludeUser leaves out the events sent by a user
+func ExcludeUser(userID string) ReplayFilter {
+	return func(event publisher.DocumentEvent) bool {
+		return event.UserID != userID
+	}
+}
+
+// ExcludeActions leaves out events with any of the given actions
+func ExcludeActions(actions ...string) ReplayFilter {
+	return func(event publisher.DocumentEvent) bool {
+		for _, action := range actions {
+			if event.Payload.Action == action {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Accepted reports whether every filter accepts the event
+func Accepted(event publisher.DocumentEvent, filters ...ReplayFilter) bool {
+	for _, filter := range filters {
+		if !filter(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterReplay returns the events accepted by every filter, preserving their order
+func FilterReplay(events []publisher.DocumentEvent, filters ...ReplayFilter) []publisher.DocumentEvent {
+	filtered := make([]publisher.DocumentEvent, 0, len(events))
+	for _, event := range events {
+		if Accepted(event, filters...) {
+			filtered = append(filtered, event)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,44 @@
+package document
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// replayed returns the data of the events FilterReplay keeps
+func replayed(events []publisher.DocumentEvent, filters ...ReplayFilter) []string {
+	var data []string
+	for _, event := range FilterReplay(events, filters...) {
+		data = append(data, event.Payload.Data)
+	}
+	return data
+}
+
+func TestFilterReplay(t *testing.T) {
+	events := []publisher.DocumentEvent{
+		{UserID: "alice", Payload: publisher.DocumentEventPayload{Action: ActionInsert, Data: "a1"}},
+		{UserID: "bob", Payload: publisher.DocumentEventPayload{Action: "cursor", Data: "b1"}},
+		{UserID: "bob", Payload: publisher.DocumentEventPayload{Action: ActionDelete, Data: "b2"}},
+		{UserID: "alice", Payload: publisher.DocumentEventPayload{Action: ActionReplace, Data: "a2"}},
+	}
+	tests := []struct {
+		name    string
+		filters []ReplayFilter
+		want    []string
+	}{
+		{"no filter", nil, []string{"a1", "b1", "b2", "a2"}},
+		{"edits only", []ReplayFilter{EditsOnly}, []string{"a1", "b2", "a2"}},
+		{"exclude user", []ReplayFilter{ExcludeUser("alice")}, []string{"b1", "b2"}},
+		{"exclude actions", []ReplayFilter{ExcludeActions(ActionDelete, ActionReplace)}, []string{"a1", "b1"}},
+		{"combined", []ReplayFilter{EditsOnly, ExcludeUser("bob")}, []string{"a1", "a2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replayed(events, tt.filters...); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
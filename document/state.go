@@ -0,0 +1,347 @@
+package document
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// Edit actions applied to the document content
+const (
+	ActionInsert  = "insert"
+	ActionDelete  = "delete"
+	ActionReplace = "replace"
+)
+
+// ChangesContent reports whether events with the action are applied to the document content
+func ChangesContent(action string) bool {
+	switch action {
+	case ActionInsert, ActionDelete, ActionReplace:
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	// ErrOutOfRange is returned when an edit addresses a position outside the document
+	ErrOutOfRange = errors.New("edit position out of range")
+	// ErrInvalidEdit is returned for edits that are malformed regardless of the document content
+	ErrInvalidEdit = errors.New("invalid edit")
+)
+
+// Validate checks the parts of an edit that don't depend on the document content
+func Validate(payload publisher.DocumentEventPayload) error {
+	switch payload.Action {
+	case ActionInsert, ActionDelete, ActionReplace:
+	default:
+		return nil
+	}
+
+	if payload.Position < 0 {
+		return fmt.Errorf("%w: negative position %d", ErrInvalidEdit, payload.Position)
+	}
+	if payload.Length < 0 {
+		return fmt.Errorf("%w: negative length %d", ErrInvalidEdit, payload.Length)
+	}
+	if payload.Action == ActionInsert && payload.Data == "" {
+		return fmt.Errorf("%w: insert without data", ErrInvalidEdit)
+	}
+	return nil
+}
+
+// Decompose expresses an edit as primitive inserts and deletes. A replace becomes a delete of
+// Length characters followed by an insert of Data at the same position; other edits are returned as is.
+func Decompose(payload publisher.DocumentEventPayload) []publisher.DocumentEventPayload {
+	if payload.Action != ActionReplace {
+		return []publisher.DocumentEventPayload{payload}
+	}
+
+	ops := make([]publisher.DocumentEventPayload, 0, 2)
+	if payload.Length > 0 {
+		ops = append(ops, publisher.DocumentEventPayload{
+			Action:   ActionDelete,
+			Position: payload.Position,
+			Length:   payload.Length,
+		})
+	}
+	if payload.Data != "" {
+		ops = append(ops, publisher.DocumentEventPayload{
+			Action:   ActionInsert,
+			Position: payload.Position,
+			Data:     payload.Data,
+		})
+	}
+	return ops
+}
+
+// deleteLength returns the number of characters a delete removes
+func deleteLength(payload publisher.DocumentEventPayload) int {
+	if payload.Length > 0 {
+		return payload.Length
+	}
+	return len([]rune(payload.Data))
+}
+
+// Snapshot is a point-in-time copy of a document's content
+type Snapshot struct {
+	DocumentID string `json:"document_id"`
+	Revision   int64  `json:"revision"`
+	Content    string `json:"content"`
+}
+
+// historyLimit is how many recent edits a document keeps for catch-up deltas
+const historyLimit = 1000
+
+// State holds the in-memory content of a single document
+type State struct {
+	documentID string
+	content    []rune
+	revision   int64
+	// history holds the edits that produced the last len(history) revisions, oldest first
+	history []publisher.DocumentEvent
+	// historyBytes is the retained size of history, kept within historyMaxBytes unless that is 0
+	historyBytes    int
+	historyMaxBytes int
+	mutex           sync.RWMutex
+	// syncMutex serializes Sync calls
+	syncMutex sync.Mutex
+}
+
+// NewState creates an empty document state whose history holds up to historyMaxBytes, 0 meaning no byte limit
+func NewState(documentID string, historyMaxBytes int) *State {
+	return &State{documentID: documentID, historyMaxBytes: historyMaxBytes}
+}
+
+// restoreState creates a document state from a stored snapshot
+func restoreState(snapshot Snapshot, historyMaxBytes int) *State {
+	return &State{
+		documentID:      snapshot.DocumentID,
+		content:         []rune(snapshot.Content),
+		revision:        snapshot.Revision,
+		historyMaxBytes: historyMaxBytes,
+	}
+}
+
+// Apply applies an edit event to the document and bumps its revision.
+// Events that don't change the content (presence, cursor, ...) are ignored.
+func (s *State) Apply(event publisher.DocumentEvent) error {
+	if !ChangesContent(event.Payload.Action) {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Validate the whole edit up front so a replace is applied entirely or not at all
+	payload := event.Payload
+	if err := Validate(payload); err != nil {
+		return err
+	}
+	removed := 0
+	switch payload.Action {
+	case ActionDelete:
+		removed = deleteLength(payload)
+	case ActionReplace:
+		removed = payload.Length
+	}
+	if end := payload.Position + removed; end > len(s.content) {
+		return fmt.Errorf("%w: %s %d..%d, length %d", ErrOutOfRange, payload.Action, payload.Position, end, len(s.content))
+	}
+
+	for _, op := range Decompose(payload) {
+		switch op.Action {
+		case ActionInsert:
+			s.content = append(s.content[:op.Position], append([]rune(op.Data), s.content[op.Position:]...)...)
+		case ActionDelete:
+			s.content = append(s.content[:op.Position], s.content[op.Position+deleteLength(op):]...)
+		}
+	}
+
+	s.revision++
+	s.history = append(s.history, event)
+	s.historyBytes += eventSize(event)
+	s.trimHistory()
+	return nil
+}
+
+// trimHistory evicts the oldest edits until the history is within both the count and the byte cap.
+// The caller must hold s.mutex.
+func (s *State) trimHistory() {
+	evict := 0
+	for evict < len(s.history) && (len(s.history)-evict > historyLimit || s.historyMaxBytes > 0 && s.historyBytes > s.historyMaxBytes) {
+		s.historyBytes -= eventSize(s.history[evict])
+		evict++
+	}
+	// Drop the references so the evicted payloads can be collected before the slice is reallocated
+	clear(s.history[:evict])
+	s.history = s.history[evict:]
+}
+
+// eventSize approximates the memory an edit holds on to, dominated by its strings
+func eventSize(event publisher.DocumentEvent) int {
+	return len(event.UserID) + len(event.DocumentID) + len(event.Color) + len(event.DisplayName) +
+		len(event.SenderConnectionID) + len(event.Payload.Action) + len(event.Payload.Data)
+}
+
+// Sync runs fn while no other Sync call on the state is running. Applying an edit together with
+// picking its recipients, and reading the state together with sending it to a joiner, each in one Sync call,
+// makes sure the joiner gets every edit exactly once. fn must not call Sync itself.
+func (s *State) Sync(fn func()) {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+	fn()
+}
+
+// Since returns the edits applied after the given revision, oldest first. It reports false when
+// the revision is no longer covered by the history (or is ahead of the document), in which case
+// the caller needs a full snapshot instead.
+func (s *State) Since(revision int64) ([]publisher.DocumentEvent, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	missed := s.revision - revision
+	if missed < 0 || missed > int64(len(s.history)) {
+		return nil, false
+	}
+
+	events := make([]publisher.DocumentEvent, missed)
+	copy(events, s.history[int64(len(s.history))-missed:])
+	return events, true
+}
+
+// HistoryEntry is a retained edit along with the revision it produced
+type HistoryEntry struct {
+	Revision int64 `json:"revision"`
+	publisher.DocumentEvent
+}
+
+// History returns up to limit retained edits after the given revision, oldest first, and
+// whether more follow. Edits older than the retained history are not available.
+func (s *State) History(since int64, limit int) ([]HistoryEntry, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// history[i] produced revision first+i
+	first := s.revision - int64(len(s.history)) + 1
+	start := max(since+1-first, 0)
+	if start >= int64(len(s.history)) {
+		return []HistoryEntry{}, false
+	}
+
+	end := min(start+int64(limit), int64(len(s.history)))
+	entries := make([]HistoryEntry, 0, end-start)
+	for i := start; i < end; i++ {
+		entries = append(entries, HistoryEntry{Revision: first + i, DocumentEvent: s.history[i]})
+	}
+	return entries, end < int64(len(s.history))
+}
+
+// Revision returns the current revision
+func (s *State) Revision() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.revision
+}
+
+// Snapshot returns the current content and revision
+func (s *State) Snapshot() Snapshot {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return Snapshot{
+		DocumentID: s.documentID,
+		Revision:   s.revision,
+		Content:    string(s.content),
+	}
+}
+
+// Registry tracks the state of every document with local connections
+type Registry struct {
+	states map[string]*entry
+	store  Store
+	// historyMaxBytes is the history byte cap of the states the registry creates
+	historyMaxBytes int
+	mutex           sync.RWMutex
+}
+
+type entry struct {
+	state *State
+	refs  int
+}
+
+// NewRegistry creates an empty document state registry. When store is not nil, states are
+// restored from it on first use and saved back once the last reference is released. Each
+// document keeps up to historyMaxBytes of edit history, 0 meaning no byte limit.
+func NewRegistry(store Store, historyMaxBytes int) *Registry {
+	return &Registry{
+		states:          make(map[string]*entry),
+		store:           store,
+		historyMaxBytes: historyMaxBytes,
+	}
+}
+
+// Acquire returns the state for a document, creating it on first use
+func (r *Registry) Acquire(documentID string) *State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e, exists := r.states[documentID]
+	if !exists {
+		e = &entry{state: r.load(documentID)}
+		r.states[documentID] = e
+	}
+	e.refs++
+	return e.state
+}
+
+// Release drops a reference to a document's state, discarding it once unused
+func (r *Registry) Release(documentID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e, exists := r.states[documentID]
+	if !exists {
+		return
+	}
+	e.refs--
+	if e.refs <= 0 {
+		delete(r.states, documentID)
+		if r.store != nil {
+			if err := r.store.Save(e.state.Snapshot()); err != nil {
+				log.Printf("Failed to save snapshot of document %s: %v", documentID, err)
+			}
+		}
+	}
+}
+
+// load restores a document's state from the store, falling back to an empty document
+func (r *Registry) load(documentID string) *State {
+	if r.store == nil {
+		return NewState(documentID, r.historyMaxBytes)
+	}
+
+	snapshot, found, err := r.store.Load(documentID)
+	if err != nil {
+		log.Printf("Failed to load snapshot of document %s: %v", documentID, err)
+	}
+	if err != nil || !found {
+		return NewState(documentID, r.historyMaxBytes)
+	}
+	return restoreState(snapshot, r.historyMaxBytes)
+}
+
+// Get returns the state for a document if it is being tracked
+func (r *Registry) Get(documentID string) (*State, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	e, exists := r.states[documentID]
+	if !exists {
+		return nil, false
+	}
+	return e.state, true
+}
@@ -0,0 +1,251 @@
+package document
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// edit returns an event carrying the given payload on doc1
+func edit(action string, position, length int, data string) publisher.DocumentEvent {
+	return publisher.DocumentEvent{
+		DocumentID: "doc1",
+		Payload:    publisher.DocumentEventPayload{Action: action, Position: position, Length: length, Data: data},
+	}
+}
+
+// stateWith returns a document state holding the given content
+func stateWith(t *testing.T, content string) *State {
+	t.Helper()
+
+	s := NewState("doc1", 0)
+	if content != "" {
+		if err := s.Apply(edit(ActionInsert, 0, 0, content)); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+	return s
+}
+
+func TestApplyReplace(t *testing.T) {
+	tests := []struct {
+		name     string
+		position int
+		length   int
+		data     string
+		want     string
+	}{
+		{"replace a word", 6, 5, "there", "hello there"},
+		{"longer text", 0, 5, "goodbye", "goodbye world"},
+		{"empty data deletes", 5, 6, "", "hello"},
+		{"zero length inserts", 5, 0, ",", "hello, world"},
+		{"up to the end", 6, 5, "🌍", "hello 🌍"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := stateWith(t, "hello world")
+
+			if err := s.Apply(edit(ActionReplace, tt.position, tt.length, tt.data)); err != nil {
+				t.Fatalf("Apply failed: %v", err)
+			}
+
+			snapshot := s.Snapshot()
+			if snapshot.Content != tt.want {
+				t.Errorf("content = %q, want %q", snapshot.Content, tt.want)
+			}
+			if snapshot.Revision != 2 {
+				t.Errorf("revision = %d, want 2 as a replace is a single edit", snapshot.Revision)
+			}
+		})
+	}
+}
+
+func TestApplyReplaceOutOfRangeChangesNothing(t *testing.T) {
+	s := stateWith(t, "hello")
+
+	err := s.Apply(edit(ActionReplace, 3, 5, "p!"))
+	if !errors.Is(err, ErrOutOfRange) {
+		t.Fatalf("Apply = %v, want ErrOutOfRange", err)
+	}
+
+	if snapshot := s.Snapshot(); snapshot.Content != "hello" || snapshot.Revision != 1 {
+		t.Errorf("state = %q at revision %d, want it untouched", snapshot.Content, snapshot.Revision)
+	}
+}
+
+// A replace has to land exactly where its delete followed by its insert would, whatever
+// concurrent inserts and deletes were applied before it
+func TestReplaceMatchesDecompositionAfterConcurrentEdits(t *testing.T) {
+	concurrent := [][]publisher.DocumentEvent{
+		{edit(ActionInsert, 0, 0, ">> ")},
+		{edit(ActionInsert, 11, 0, "!")},
+		{edit(ActionDelete, 0, 6, "")},
+		{edit(ActionDelete, 5, 0, " "), edit(ActionInsert, 5, 0, "_")},
+	}
+	replace := edit(ActionReplace, 2, 3, "LL")
+
+	for _, edits := range concurrent {
+		replaced := stateWith(t, "hello world")
+		decomposed := stateWith(t, "hello world")
+		for _, e := range edits {
+			if err := replaced.Apply(e); err != nil {
+				t.Fatalf("Apply failed: %v", err)
+			}
+			if err := decomposed.Apply(e); err != nil {
+				t.Fatalf("Apply failed: %v", err)
+			}
+		}
+
+		if err := replaced.Apply(replace); err != nil {
+			t.Fatalf("Apply replace failed: %v", err)
+		}
+		for _, op := range Decompose(replace.Payload) {
+			if err := decomposed.Apply(publisher.DocumentEvent{DocumentID: "doc1", Payload: op}); err != nil {
+				t.Fatalf("Apply %s failed: %v", op.Action, err)
+			}
+		}
+
+		if got, want := replaced.Snapshot().Content, decomposed.Snapshot().Content; got != want {
+			t.Errorf("after %v: replace gave %q, delete then insert gave %q", edits, got, want)
+		}
+	}
+}
+
+func TestSince(t *testing.T) {
+	s := NewState("doc1", 0)
+	for _, data := range []string{"a", "b", "c"} {
+		if err := s.Apply(edit(ActionInsert, 0, 0, data)); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+
+	events, ok := s.Since(1)
+	if !ok || len(events) != 2 || events[0].Payload.Data != "b" || events[1].Payload.Data != "c" {
+		t.Errorf("Since(1) = %+v, %v; want edits b and c", events, ok)
+	}
+	if events, ok := s.Since(3); !ok || len(events) != 0 {
+		t.Errorf("Since(3) = %+v, %v; want no edits", events, ok)
+	}
+	if _, ok := s.Since(4); ok {
+		t.Error("Since a revision ahead of the document succeeded")
+	}
+}
+
+func TestSinceBeyondHistory(t *testing.T) {
+	// Room for about two edits, so the first one is evicted
+	s := NewState("doc1", 2*eventSize(edit(ActionInsert, 0, 0, "a")))
+	for _, data := range []string{"a", "b", "c"} {
+		if err := s.Apply(edit(ActionInsert, 0, 0, data)); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+
+	if _, ok := s.Since(0); ok {
+		t.Error("Since a revision older than the history succeeded")
+	}
+	if events, ok := s.Since(1); !ok || len(events) != 2 {
+		t.Errorf("Since(1) = %+v, %v; want the two retained edits", events, ok)
+	}
+}
+
+func TestHistoryCountCap(t *testing.T) {
+	s := NewState("doc1", 0)
+	for i := 0; i < historyLimit+5; i++ {
+		if err := s.Apply(edit(ActionInsert, 0, 0, "a")); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+
+	if _, ok := s.Since(4); ok {
+		t.Error("Since a revision evicted by the count cap succeeded")
+	}
+	if events, ok := s.Since(5); !ok || len(events) != historyLimit {
+		t.Errorf("Since(5) returned %d edits, %v; want the %d retained", len(events), ok, historyLimit)
+	}
+}
+
+func TestHistoryByteCap(t *testing.T) {
+	small := edit(ActionInsert, 0, 0, "a")
+	large := edit(ActionInsert, 0, 0, string(make([]byte, 100)))
+	s := NewState("doc1", 3*eventSize(small)+eventSize(large))
+	for _, e := range []publisher.DocumentEvent{small, small, small, small, large} {
+		if err := s.Apply(e); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+
+	// The large edit pushed out the oldest small one, so the history is within the cap
+	if _, ok := s.Since(0); ok {
+		t.Error("Since a revision evicted by the byte cap succeeded")
+	}
+	if events, ok := s.Since(1); !ok || len(events) != 4 {
+		t.Errorf("Since(1) returned %d edits, %v; want the 4 retained", len(events), ok)
+	}
+	if want := 3*eventSize(small) + eventSize(large); s.historyBytes != want {
+		t.Errorf("history counts %d bytes, want %d", s.historyBytes, want)
+	}
+}
+
+func TestRegistryStatesHonorTheByteCap(t *testing.T) {
+	registry := NewRegistry(nil, eventSize(edit(ActionInsert, 0, 0, "a")))
+	state := registry.Acquire("doc1")
+	defer registry.Release("doc1")
+	for _, data := range []string{"a", "b"} {
+		if err := state.Apply(edit(ActionInsert, 0, 0, data)); err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+	}
+
+	if events, ok := state.Since(1); !ok || len(events) != 1 {
+		t.Errorf("Since(1) = %+v, %v; want the single edit that fits", events, ok)
+	}
+	if _, ok := state.Since(0); ok {
+		t.Error("the registry created a state without the byte cap")
+	}
+}
+
+func TestDecompose(t *testing.T) {
+	ops := Decompose(edit(ActionReplace, 4, 2, "xyz").Payload)
+	if len(ops) != 2 {
+		t.Fatalf("replace decomposed into %d edits, want 2", len(ops))
+	}
+	if ops[0].Action != ActionDelete || ops[0].Position != 4 || ops[0].Length != 2 {
+		t.Errorf("first edit = %+v, want a delete of 2 at 4", ops[0])
+	}
+	if ops[1].Action != ActionInsert || ops[1].Position != 4 || ops[1].Data != "xyz" {
+		t.Errorf("second edit = %+v, want an insert of xyz at 4", ops[1])
+	}
+
+	if ops := Decompose(edit(ActionReplace, 4, 0, "").Payload); len(ops) != 0 {
+		t.Errorf("an empty replace decomposed into %v, want nothing", ops)
+	}
+	if ops := Decompose(edit(ActionInsert, 1, 0, "a").Payload); len(ops) != 1 || ops[0].Action != ActionInsert {
+		t.Errorf("an insert decomposed into %v, want itself", ops)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload publisher.DocumentEventPayload
+		wantErr bool
+	}{
+		{"replace", edit(ActionReplace, 0, 1, "a").Payload, false},
+		{"negative position", edit(ActionReplace, -1, 1, "a").Payload, true},
+		{"negative length", edit(ActionReplace, 0, -1, "a").Payload, true},
+		{"insert without data", edit(ActionInsert, 0, 0, "").Payload, true},
+		{"cursor is not checked", edit("cursor", -1, -1, "").Payload, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.payload)
+			if tt.wantErr && !errors.Is(err, ErrInvalidEdit) {
+				t.Errorf("Validate = %v, want ErrInvalidEdit", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Validate = %v, want nil", err)
+			}
+		})
+	}
+}
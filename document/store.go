@@ -0,0 +1,106 @@
+package document
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// gzipMagic are the leading bytes of every gzip stream, used to detect compressed snapshots on load
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Store persists document snapshots
+type Store interface {
+	Save(snapshot Snapshot) error
+	// Load returns the stored snapshot of a document and whether one exists
+	Load(documentID string) (Snapshot, bool, error)
+}
+
+// FileStore keeps one snapshot file per document in a directory
+type FileStore struct {
+	dir      string
+	compress bool
+}
+
+// NewFileStore creates a file store in dir. When compress is set snapshots are written gzipped;
+// both compressed and plain snapshots are read back regardless of the setting.
+func NewFileStore(dir string, compress bool) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	return &FileStore{
+		dir:      dir,
+		compress: compress,
+	}, nil
+}
+
+// Save writes a snapshot, replacing any previous one for the document
+func (s *FileStore) Save(snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	if s.compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return fmt.Errorf("failed to compress snapshot: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to compress snapshot: %w", err)
+		}
+		data = buf.Bytes()
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated snapshot behind
+	path := s.path(snapshot.DocumentID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// Load reads the snapshot of a document, decompressing it if needed
+func (s *FileStore) Load(documentID string) (Snapshot, bool, error) {
+	data, err := os.ReadFile(s.path(documentID))
+	if errors.Is(err, os.ErrNotExist) {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	if bytes.HasPrefix(data, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return Snapshot{}, false, fmt.Errorf("failed to decompress snapshot: %w", err)
+		}
+		defer zr.Close()
+
+		if data, err = io.ReadAll(zr); err != nil {
+			return Snapshot{}, false, fmt.Errorf("failed to decompress snapshot: %w", err)
+		}
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return Snapshot{}, false, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	return snapshot, true, nil
+}
+
+// path returns the snapshot file of a document; the ID is escaped so it can't leave the directory
+func (s *FileStore) path(documentID string) string {
+	return filepath.Join(s.dir, url.PathEscape(documentID)+".json")
+}
@@ -0,0 +1,90 @@
+package document
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		store, err := NewFileStore(t.TempDir(), compress)
+		if err != nil {
+			t.Fatalf("NewFileStore failed: %v", err)
+		}
+		want := Snapshot{DocumentID: "notes/2026", Revision: 7, Content: "hello wörld"}
+
+		if err := store.Save(want); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		data, err := os.ReadFile(store.path(want.DocumentID))
+		if err != nil {
+			t.Fatalf("snapshot file not written: %v", err)
+		}
+		if got := bytes.HasPrefix(data, gzipMagic); got != compress {
+			t.Errorf("compress=%v: stored snapshot gzipped = %v", compress, got)
+		}
+
+		got, found, err := store.Load(want.DocumentID)
+		if err != nil || !found {
+			t.Fatalf("compress=%v: Load = %v, %v", compress, found, err)
+		}
+		if got != want {
+			t.Errorf("compress=%v: loaded %+v, want %+v", compress, got, want)
+		}
+	}
+}
+
+func TestFileStoreReadsEitherFormat(t *testing.T) {
+	dir := t.TempDir()
+	plain, _ := NewFileStore(dir, false)
+	compressed, _ := NewFileStore(dir, true)
+	if err := plain.Save(Snapshot{DocumentID: "doc1", Revision: 1, Content: "plain"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := compressed.Save(Snapshot{DocumentID: "doc2", Revision: 1, Content: "gzipped"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if got, _, err := compressed.Load("doc1"); err != nil || got.Content != "plain" {
+		t.Errorf("compressing store loaded %q, %v from a plain snapshot", got.Content, err)
+	}
+	if got, _, err := plain.Load("doc2"); err != nil || got.Content != "gzipped" {
+		t.Errorf("plain store loaded %q, %v from a compressed snapshot", got.Content, err)
+	}
+}
+
+func TestFileStoreLoadMissing(t *testing.T) {
+	store, _ := NewFileStore(t.TempDir(), false)
+
+	if _, found, err := store.Load("doc1"); found || err != nil {
+		t.Errorf("Load of a missing snapshot = %v, %v; want not found", found, err)
+	}
+}
+
+func TestFileStoreKeepsIDsInsideTheDirectory(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir, false)
+
+	if err := store.Save(Snapshot{DocumentID: "../escape"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape.json")); err == nil {
+		t.Error("snapshot written outside the store directory")
+	}
+}
+
+func TestRegistryRestoresReleasedDocument(t *testing.T) {
+	store, _ := NewFileStore(t.TempDir(), true)
+	registry := NewRegistry(store, 0)
+	if err := registry.Acquire("doc1").Apply(edit(ActionInsert, 0, 0, "kept")); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	registry.Release("doc1")
+
+	restored := NewRegistry(store, 0).Acquire("doc1").Snapshot()
+	if restored.Content != "kept" || restored.Revision != 1 {
+		t.Errorf("restored %q at revision %d, want \"kept\" at 1", restored.Content, restored.Revision)
+	}
+}
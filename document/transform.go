@@ -0,0 +1,127 @@
+package document
+
+import (
+	"slices"
+
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// Transform rewrites an edit made concurrently with an applied one, both against the same revision,
+// so that applying it after the applied edit has the effect its author intended. Replaces are
+// transformed as their delete and insert (see Decompose), so the result is a sequence of primitive
+// edits, possibly empty when the applied edit already removed everything the edit touched.
+// When both insert at the same position, opFirst decides whose text comes first; the two sides of
+// a pair of concurrent edits must pass opposite values to converge.
+func Transform(op, applied publisher.DocumentEventPayload, opFirst bool) []publisher.DocumentEventPayload {
+	ops, _ := transformOps(primitives(op), primitives(applied), opFirst)
+	return ops
+}
+
+// Inverse returns the primitive edits undoing an applied edit, in the order they must be applied.
+// removed is the text the edit deleted from the document: the deleted range of a delete or replace,
+// "" for an insert. A replace is undone as the delete of its inserted text followed by the insert of
+// the text it replaced.
+func Inverse(payload publisher.DocumentEventPayload, removed string) []publisher.DocumentEventPayload {
+	ops := Decompose(payload)
+	inverse := make([]publisher.DocumentEventPayload, 0, len(ops))
+	for i := len(ops) - 1; i >= 0; i-- {
+		switch op := ops[i]; op.Action {
+		case ActionInsert:
+			inverse = append(inverse, publisher.DocumentEventPayload{Action: ActionDelete, Position: op.Position, Length: len([]rune(op.Data))})
+		case ActionDelete:
+			inverse = append(inverse, publisher.DocumentEventPayload{Action: ActionInsert, Position: op.Position, Data: removed})
+		}
+	}
+	return inverse
+}
+
+// primitives decomposes an edit into inserts and deletes with explicit lengths, dropping the ones
+// that change nothing. Edits that don't change the content have no primitives.
+func primitives(payload publisher.DocumentEventPayload) []publisher.DocumentEventPayload {
+	if !ChangesContent(payload.Action) {
+		return nil
+	}
+
+	var ops []publisher.DocumentEventPayload
+	for _, op := range Decompose(payload) {
+		switch op.Action {
+		case ActionInsert:
+			if op.Data != "" {
+				ops = append(ops, publisher.DocumentEventPayload{Action: ActionInsert, Position: op.Position, Data: op.Data})
+			}
+		case ActionDelete:
+			if length := deleteLength(op); length > 0 {
+				ops = append(ops, publisher.DocumentEventPayload{Action: ActionDelete, Position: op.Position, Length: length})
+			}
+		}
+	}
+	return ops
+}
+
+// transformOps transforms two concurrent sequences of primitive edits against each other: a is
+// rewritten to apply after b and b to apply after a, the two orders giving the same content
+func transformOps(a, b []publisher.DocumentEventPayload, aFirst bool) ([]publisher.DocumentEventPayload, []publisher.DocumentEventPayload) {
+	switch {
+	case len(a) == 0 || len(b) == 0:
+		return a, b
+	case len(a) == 1 && len(b) == 1:
+		return transformPrimitive(a[0], b[0], aFirst), transformPrimitive(b[0], a[0], !aFirst)
+	case len(a) > 1:
+		// a[0] moves past b, then the rest of a moves past what b became after a[0]
+		a1, b1 := transformOps(a[:1], b, aFirst)
+		a2, b2 := transformOps(a[1:], b1, aFirst)
+		return slices.Concat(a1, a2), b2
+	default:
+		b1, a1 := transformOps(b[:1], a, !aFirst)
+		b2, a2 := transformOps(b[1:], a1, !aFirst)
+		return a2, slices.Concat(b1, b2)
+	}
+}
+
+// transformPrimitive rewrites the insert or delete op to apply after the concurrent applied one.
+// A delete spanning an applied insert is split in two so the inserted text survives.
+func transformPrimitive(op, applied publisher.DocumentEventPayload, opFirst bool) []publisher.DocumentEventPayload {
+	switch {
+	case op.Action == ActionInsert && applied.Action == ActionInsert:
+		if applied.Position < op.Position || applied.Position == op.Position && !opFirst {
+			op.Position += len([]rune(applied.Data))
+		}
+		return []publisher.DocumentEventPayload{op}
+
+	case op.Action == ActionInsert && applied.Action == ActionDelete:
+		switch end := applied.Position + applied.Length; {
+		case op.Position >= end:
+			op.Position -= applied.Length
+		case op.Position > applied.Position:
+			// The text around the insert is gone, it lands where the deleted range was
+			op.Position = applied.Position
+		}
+		return []publisher.DocumentEventPayload{op}
+
+	case op.Action == ActionDelete && applied.Action == ActionInsert:
+		inserted := len([]rune(applied.Data))
+		switch end := op.Position + op.Length; {
+		case applied.Position <= op.Position:
+			op.Position += inserted
+		case applied.Position < end:
+			before := publisher.DocumentEventPayload{Action: ActionDelete, Position: op.Position, Length: applied.Position - op.Position}
+			after := publisher.DocumentEventPayload{Action: ActionDelete, Position: op.Position + inserted, Length: end - applied.Position}
+			return []publisher.DocumentEventPayload{before, after}
+		}
+		return []publisher.DocumentEventPayload{op}
+
+	default:
+		// Both delete: what the applied delete already removed is left out
+		start, end := op.Position, op.Position+op.Length
+		appliedStart, appliedEnd := applied.Position, applied.Position+applied.Length
+		overlap := max(0, min(end, appliedEnd)-max(start, appliedStart))
+		if appliedStart < start {
+			op.Position = max(appliedStart, start-applied.Length)
+		}
+		op.Length -= overlap
+		if op.Length == 0 {
+			return nil
+		}
+		return []publisher.DocumentEventPayload{op}
+	}
+}
@@ -0,0 +1,111 @@
+package document
+
+import (
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// payload returns an edit payload with the given fields
+func payload(action string, position, length int, data string) publisher.DocumentEventPayload {
+	return publisher.DocumentEventPayload{Action: action, Position: position, Length: length, Data: data}
+}
+
+// applyAll applies the payloads to the state in order
+func applyAll(t *testing.T, s *State, payloads ...publisher.DocumentEventPayload) {
+	t.Helper()
+
+	for _, p := range payloads {
+		if err := s.Apply(edit(p.Action, p.Position, p.Length, p.Data)); err != nil {
+			t.Fatalf("Apply(%+v) failed: %v", p, err)
+		}
+	}
+}
+
+func TestTransformConcurrentEditsConverge(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b publisher.DocumentEventPayload
+		want string
+	}{
+		{"replace and insert before", payload(ActionReplace, 6, 5, "there"), payload(ActionInsert, 5, 0, ","), "hello, there"},
+		{"replace and insert inside", payload(ActionReplace, 6, 5, "there"), payload(ActionInsert, 8, 0, "X"), "hello thereX"},
+		{"replace and insert at the same position", payload(ActionReplace, 6, 5, "there"), payload(ActionInsert, 6, 0, "my "), "hello theremy "},
+		{"replace and delete before", payload(ActionReplace, 6, 5, "there"), payload(ActionDelete, 0, 6, ""), "there"},
+		{"replace and overlapping delete", payload(ActionReplace, 4, 4, "_"), payload(ActionDelete, 2, 4, ""), "he_rld"},
+		{"replace and delete of the replaced range", payload(ActionReplace, 6, 5, "there"), payload(ActionDelete, 6, 5, ""), "hello there"},
+		{"disjoint replaces", payload(ActionReplace, 0, 5, "howdy"), payload(ActionReplace, 6, 5, "there"), "howdy there"},
+		{"overlapping replaces", payload(ActionReplace, 0, 7, "X"), payload(ActionReplace, 4, 4, "Y"), "XYrld"},
+		{"same range replaced", payload(ActionReplace, 6, 5, "there"), payload(ActionReplace, 6, 5, "folks"), "hello therefolks"},
+		{"replace with empty data", payload(ActionReplace, 0, 6, ""), payload(ActionInsert, 11, 0, "!"), "world!"},
+		{"zero length replace", payload(ActionReplace, 5, 0, ","), payload(ActionDelete, 4, 2, ""), "hell,world"},
+		{"cursor moves are left alone", payload(ActionReplace, 6, 5, "there"), payload("cursor", 3, 0, ""), "hello there"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Both edits are made against the same revision, each replica applies its own first
+			first := stateWith(t, "hello world")
+			applyAll(t, first, tt.a)
+			applyAll(t, first, Transform(tt.b, tt.a, false)...)
+
+			second := stateWith(t, "hello world")
+			if ChangesContent(tt.b.Action) {
+				applyAll(t, second, tt.b)
+			}
+			applyAll(t, second, Transform(tt.a, tt.b, true)...)
+
+			got, other := first.Snapshot().Content, second.Snapshot().Content
+			if got != other {
+				t.Fatalf("replicas diverged: %q after a then b, %q after b then a", got, other)
+			}
+			if got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformInsertTieBreak(t *testing.T) {
+	a, b := payload(ActionInsert, 5, 0, "A"), payload(ActionInsert, 5, 0, "B")
+
+	got := Transform(a, b, true)
+	if len(got) != 1 || got[0].Position != 5 {
+		t.Errorf("Transform(a, b, true) = %+v, want a kept at 5", got)
+	}
+	got = Transform(a, b, false)
+	if len(got) != 1 || got[0].Position != 6 {
+		t.Errorf("Transform(a, b, false) = %+v, want a moved past b to 6", got)
+	}
+}
+
+func TestTransformDeleteOfDeletedRangeIsEmpty(t *testing.T) {
+	got := Transform(payload(ActionDelete, 2, 3, ""), payload(ActionReplace, 0, 8, "x"), false)
+	if len(got) != 0 {
+		t.Errorf("Transform = %+v, want nothing left to delete", got)
+	}
+}
+
+func TestInverseUndoesEdit(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    publisher.DocumentEventPayload
+		removed string
+	}{
+		{"insert", payload(ActionInsert, 5, 0, ","), ""},
+		{"delete", payload(ActionDelete, 5, 6, ""), " world"},
+		{"replace", payload(ActionReplace, 6, 5, "🌍 and moon"), "world"},
+		{"replace with empty data", payload(ActionReplace, 0, 6, ""), "hello "},
+		{"zero length replace", payload(ActionReplace, 5, 0, ","), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := stateWith(t, "hello world")
+			applyAll(t, s, tt.edit)
+			applyAll(t, s, Inverse(tt.edit, tt.removed)...)
+
+			if content := s.Snapshot().Content; content != "hello world" {
+				t.Errorf("content = %q, want the edit undone", content)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package eventbus
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// Topic identifies a class of document events carried by the bus
+type Topic int
+
+const (
+	// TopicEdit carries document edits (insert, delete, ...)
+	TopicEdit Topic = iota
+	// TopicPresence carries participant join/leave events
+	TopicPresence
+	// TopicCursor carries cursor and selection updates
+	TopicCursor
+)
+
+// String returns the topic name
+func (t Topic) String() string {
+	switch t {
+	case TopicEdit:
+		return "edit"
+	case TopicPresence:
+		return "presence"
+	case TopicCursor:
+		return "cursor"
+	default:
+		return "unknown"
+	}
+}
+
+// TopicFor maps a payload action to the topic it is published on
+func TopicFor(action string) Topic {
+	switch {
+	case strings.HasPrefix(action, "presence"), strings.HasPrefix(action, "typing"):
+		return TopicPresence
+	case strings.HasPrefix(action, "cursor"):
+		return TopicCursor
+	default:
+		return TopicEdit
+	}
+}
+
+var (
+	// ErrSubscriberFull is returned by Publish when a subscriber's buffer stayed full for the whole publish timeout
+	ErrSubscriberFull = errors.New("event bus subscriber is full")
+	// ErrClosed is returned by Publish once the bus is closed
+	ErrClosed = errors.New("event bus is closed")
+)
+
+// subscriber is a channel subscribed to one or more topics
+type subscriber struct {
+	ch chan publisher.DocumentEvent
+	// bestEffort subscribers miss events while their buffer is full instead of holding up publishers
+	bestEffort bool
+}
+
+// Bus fans out document events from the WebSocket layer to any number of in-process consumers
+type Bus struct {
+	subscribers map[Topic][]*subscriber
+	bufferSize  int
+	// publishTimeout is how long Publish waits for room in a full subscriber buffer
+	publishTimeout time.Duration
+	closed         bool
+	mutex          sync.RWMutex
+}
+
+// New creates a new event bus whose subscriber channels hold up to bufferSize events. Publishing
+// to a full subscriber waits up to publishTimeout before failing.
+func New(bufferSize int, publishTimeout time.Duration) *Bus {
+	return &Bus{
+		subscribers:    make(map[Topic][]*subscriber),
+		bufferSize:     bufferSize,
+		publishTimeout: publishTimeout,
+	}
+}
+
+// Subscribe returns a channel receiving every event published on any of the given topics.
+// No event is lost: publishers wait for the subscriber to make room, or fail.
+func (b *Bus) Subscribe(topics ...Topic) <-chan publisher.DocumentEvent {
+	return b.subscribe(false, topics)
+}
+
+// SubscribeBestEffort is Subscribe for consumers that can afford to miss events: those published
+// while the channel is full are dropped rather than holding up the publisher.
+func (b *Bus) SubscribeBestEffort(topics ...Topic) <-chan publisher.DocumentEvent {
+	return b.subscribe(true, topics)
+}
+
+// subscribe adds a subscriber to the given topics
+func (b *Bus) subscribe(bestEffort bool, topics []Topic) <-chan publisher.DocumentEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	sub := &subscriber{ch: make(chan publisher.DocumentEvent, b.bufferSize), bestEffort: bestEffort}
+	if b.closed {
+		close(sub.ch)
+		return sub.ch
+	}
+
+	for _, topic := range topics {
+		b.subscribers[topic] = append(b.subscribers[topic], sub)
+	}
+	return sub.ch
+}
+
+// EditCh returns a new subscription to edit events
+func (b *Bus) EditCh() <-chan publisher.DocumentEvent {
+	return b.Subscribe(TopicEdit)
+}
+
+// PresenceCh returns a new subscription to presence events
+func (b *Bus) PresenceCh() <-chan publisher.DocumentEvent {
+	return b.Subscribe(TopicPresence)
+}
+
+// CursorCh returns a new subscription to cursor events
+func (b *Bus) CursorCh() <-chan publisher.DocumentEvent {
+	return b.Subscribe(TopicCursor)
+}
+
+// Publish delivers an event to every subscriber of its topic. Best-effort subscribers whose buffer
+// is full miss it; for the others Publish waits up to the publish timeout, then gives up with
+// ErrSubscriberFull so the caller can reject the event instead of losing it silently.
+func (b *Bus) Publish(event publisher.DocumentEvent) error {
+	topic := TopicFor(event.Payload.Action)
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	var timeout <-chan time.Time
+	for _, sub := range b.subscribers[topic] {
+		select {
+		case sub.ch <- event:
+			continue
+		default:
+		}
+
+		if sub.bestEffort {
+			log.Printf("Event bus subscriber full, dropping %s event for document %s", topic, event.DocumentID)
+			continue
+		}
+		// A single timer bounds the whole publish, however many subscribers are full
+		if timeout == nil {
+			timer := time.NewTimer(b.publishTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case sub.ch <- event:
+		case <-timeout:
+			return fmt.Errorf("%s event for document %s: %w", topic, event.DocumentID, ErrSubscriberFull)
+		}
+	}
+	return nil
+}
+
+// Close closes every subscriber channel; further publishes fail with ErrClosed
+func (b *Bus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	// A channel may be subscribed to several topics, close it only once
+	seen := make(map[*subscriber]bool)
+	for _, subs := range b.subscribers {
+		for _, sub := range subs {
+			if !seen[sub] {
+				seen[sub] = true
+				close(sub.ch)
+			}
+		}
+	}
+	b.subscribers = make(map[Topic][]*subscriber)
+}
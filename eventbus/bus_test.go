@@ -0,0 +1,101 @@
+package eventbus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// event returns an event of the given action on doc1
+func event(action string) publisher.DocumentEvent {
+	return publisher.DocumentEvent{DocumentID: "doc1", Payload: publisher.DocumentEventPayload{Action: action}}
+}
+
+func TestPublishRoutesByTopic(t *testing.T) {
+	bus := New(1, time.Second)
+	edits := bus.Subscribe(TopicEdit)
+	cursors := bus.Subscribe(TopicCursor)
+
+	if err := bus.Publish(event("insert")); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	if got := <-edits; got.Payload.Action != "insert" {
+		t.Errorf("edit subscriber received %q, want insert", got.Payload.Action)
+	}
+	if len(cursors) != 0 {
+		t.Error("cursor subscriber received an edit")
+	}
+}
+
+func TestPublishWaitsForReliableSubscriber(t *testing.T) {
+	bus := New(1, time.Second)
+	events := bus.Subscribe(TopicEdit)
+	bus.Publish(event("insert"))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-events
+	}()
+
+	if err := bus.Publish(event("delete")); err != nil {
+		t.Fatalf("Publish failed although the subscriber made room: %v", err)
+	}
+	if got := <-events; got.Payload.Action != "delete" {
+		t.Errorf("received %q, want delete", got.Payload.Action)
+	}
+}
+
+func TestPublishFailsWhenReliableSubscriberStaysFull(t *testing.T) {
+	bus := New(1, 20*time.Millisecond)
+	bus.Subscribe(TopicEdit)
+	bus.Publish(event("insert"))
+
+	if err := bus.Publish(event("delete")); !errors.Is(err, ErrSubscriberFull) {
+		t.Errorf("Publish returned %v, want ErrSubscriberFull", err)
+	}
+}
+
+func TestPublishDropsForBestEffortSubscriber(t *testing.T) {
+	bus := New(1, time.Hour)
+	events := bus.SubscribeBestEffort(TopicEdit)
+	bus.Publish(event("insert"))
+
+	done := make(chan error, 1)
+	go func() { done <- bus.Publish(event("delete")) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Publish failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a best-effort subscriber")
+	}
+	if got := <-events; got.Payload.Action != "insert" {
+		t.Errorf("received %q, want insert", got.Payload.Action)
+	}
+	if len(events) != 0 {
+		t.Error("the event published while the buffer was full was delivered")
+	}
+}
+
+func TestClose(t *testing.T) {
+	bus := New(1, time.Second)
+	events := bus.Subscribe(TopicEdit, TopicPresence)
+
+	bus.Close()
+	bus.Close()
+
+	if _, ok := <-events; ok {
+		t.Error("subscriber channel still open after Close")
+	}
+	if err := bus.Publish(event("insert")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Publish after Close returned %v, want ErrClosed", err)
+	}
+	if _, ok := <-bus.Subscribe(TopicEdit); ok {
+		t.Error("subscribing to a closed bus returned an open channel")
+	}
+}
@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/nats"
+	"github.com/emaforlin/ce-realtime-gateway/websocket"
+)
+
+// ResubscribeResponse represents the result of a forced NATS resubscribe
+type ResubscribeResponse struct {
+	Status       string `json:"status"`
+	Resubscribed int    `json:"resubscribed"`
+	Error        string `json:"error,omitempty"`
+}
+
+// ResubscribeHandler forces the NATS manager to re-establish all document subscriptions; it requires the admin scope
+type ResubscribeHandler struct {
+	natsManager *nats.Manager
+}
+
+// NewResubscribeHandler creates a new resubscribe handler
+func NewResubscribeHandler(natsManager *nats.Manager) *ResubscribeHandler {
+	return &ResubscribeHandler{
+		natsManager: natsManager,
+	}
+}
+
+// ServeHTTP implements http.Handler for forced resubscription
+func (h *ResubscribeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.HasScope(r, middleware.ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	count, err := h.natsManager.Resubscribe()
+
+	response := ResubscribeResponse{
+		Status:       "ok",
+		Resubscribed: count,
+	}
+	status := http.StatusOK
+	if err != nil {
+		log.Printf("Forced resubscribe finished with errors: %v", err)
+		response.Status = "partial"
+		response.Error = err.Error()
+		status = http.StatusInternalServerError
+	}
+
+	writeJSON(w, status, response)
+}
+
+// natsPingTimeout bounds a NATS ping, RTT and round trip together
+const natsPingTimeout = 5 * time.Second
+
+// NATSPingResponse represents the latencies measured by a NATS ping, in milliseconds
+type NATSPingResponse struct {
+	Status      string  `json:"status"`
+	RTTMs       float64 `json:"rtt_ms"`
+	RoundTripMs float64 `json:"round_trip_ms"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// NATSPingHandler checks the gateway to NATS path and reports its latency; it requires the admin scope
+type NATSPingHandler struct {
+	natsManager *nats.Manager
+}
+
+// NewNATSPingHandler creates a new NATS ping handler
+func NewNATSPingHandler(natsManager *nats.Manager) *NATSPingHandler {
+	return &NATSPingHandler{
+		natsManager: natsManager,
+	}
+}
+
+// ServeHTTP implements http.Handler for NATS pings
+func (h *NATSPingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !middleware.HasScope(r, middleware.ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), natsPingTimeout)
+	defer cancel()
+
+	result, err := h.natsManager.Ping(ctx)
+
+	response := NATSPingResponse{
+		Status:      "ok",
+		RTTMs:       durationMs(result.RTT),
+		RoundTripMs: durationMs(result.RoundTrip),
+	}
+	status := http.StatusOK
+	if err != nil {
+		log.Printf("NATS ping failed: %v", err)
+		response.Status = "error"
+		response.Error = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, response)
+}
+
+// durationMs converts a duration to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// SnapshotHandler returns the in-memory state of a document; it requires the admin scope
+type SnapshotHandler struct {
+	states *document.Registry
+}
+
+// NewSnapshotHandler creates a new snapshot handler
+func NewSnapshotHandler(states *document.Registry) *SnapshotHandler {
+	return &SnapshotHandler{
+		states: states,
+	}
+}
+
+// ServeHTTP implements http.Handler for document snapshots
+func (h *SnapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.HasScope(r, middleware.ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	state, ok := h.states.Get(r.PathValue("id"))
+	if !ok {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, state.Snapshot())
+}
+
+// StatsResponse represents the gateway subscription statistics
+type StatsResponse struct {
+	Subscriptions    int            `json:"subscriptions"`
+	MaxSubscriptions int            `json:"max_subscriptions"`
+	Documents        map[string]int `json:"documents"`
+	// LastReconciliation lists the subscription discrepancies fixed by the latest reconciliation
+	LastReconciliation *nats.Reconciliation `json:"last_reconciliation,omitempty"`
+	// Activity is the edit activity of each subscribed document, hottest documents having the highest edit_rate
+	Activity map[string]nats.Activity `json:"activity"`
+	websocket.ConnectionStats
+}
+
+// StatsHandler handles subscription statistics requests
+type StatsHandler struct {
+	natsManager *nats.Manager
+	hub         *websocket.Hub
+}
+
+// NewStatsHandler creates a new stats handler
+func NewStatsHandler(natsManager *nats.Manager, hub *websocket.Hub) *StatsHandler {
+	return &StatsHandler{
+		natsManager: natsManager,
+		hub:         hub,
+	}
+}
+
+// ServeHTTP implements http.Handler for subscription statistics
+func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := h.natsManager.Snapshot()
+	response := StatsResponse{
+		Subscriptions:      stats.Subscriptions,
+		MaxSubscriptions:   stats.MaxSubscriptions,
+		Documents:          stats.Documents,
+		LastReconciliation: stats.LastReconciliation,
+		Activity:           stats.Activity,
+		ConnectionStats:    h.hub.ConnectionStats(),
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// DocumentDrainer pauses and resumes edits on a document
+type DocumentDrainer interface {
+	Drain(documentID string) bool
+	Undrain(documentID string) (int, bool)
+}
+
+// DrainResponse represents the result of a drain or undrain request
+type DrainResponse struct {
+	DocumentID string `json:"document_id"`
+	Draining   bool   `json:"draining"`
+	Changed    bool   `json:"changed"`
+	Released   int    `json:"released,omitempty"`
+}
+
+// DrainHandler drains or resumes edits on a document; it requires the admin scope
+type DrainHandler struct {
+	drainer DocumentDrainer
+	drain   bool
+}
+
+// NewDrainHandler creates a handler that pauses edits on a document
+func NewDrainHandler(drainer DocumentDrainer) *DrainHandler {
+	return &DrainHandler{
+		drainer: drainer,
+		drain:   true,
+	}
+}
+
+// NewUndrainHandler creates a handler that resumes edits on a drained document
+func NewUndrainHandler(drainer DocumentDrainer) *DrainHandler {
+	return &DrainHandler{
+		drainer: drainer,
+		drain:   false,
+	}
+}
+
+// ServeHTTP implements http.Handler for document draining
+func (h *DrainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !middleware.HasScope(r, middleware.ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	documentID := r.PathValue("id")
+	response := DrainResponse{
+		DocumentID: documentID,
+		Draining:   h.drain,
+	}
+	if h.drain {
+		response.Changed = h.drainer.Drain(documentID)
+	} else {
+		response.Released, response.Changed = h.drainer.Undrain(documentID)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// DocumentCloser disconnects every participant of a document
+type DocumentCloser interface {
+	CloseDocument(documentID string) int
+}
+
+// CloseDocumentResponse represents the result of closing a document
+type CloseDocumentResponse struct {
+	DocumentID string `json:"document_id"`
+	Closed     int    `json:"closed"`
+}
+
+// CloseDocumentHandler disconnects all participants of a document; it requires the admin scope
+type CloseDocumentHandler struct {
+	closer DocumentCloser
+}
+
+// NewCloseDocumentHandler creates a new close document handler
+func NewCloseDocumentHandler(closer DocumentCloser) *CloseDocumentHandler {
+	return &CloseDocumentHandler{
+		closer: closer,
+	}
+}
+
+// ServeHTTP implements http.Handler for closing documents
+func (h *CloseDocumentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !middleware.HasScope(r, middleware.ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	documentID := r.PathValue("id")
+	response := CloseDocumentResponse{
+		DocumentID: documentID,
+		Closed:     h.closer.CloseDocument(documentID),
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// AdminCommandRequest is the body of an admin command request
+type AdminCommandRequest struct {
+	Action     string `json:"action"`
+	DocumentID string `json:"document_id,omitempty"`
+	UserID     string `json:"user_id,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Token      string `json:"token,omitempty"`
+}
+
+// AdminCommandHandler publishes admin commands to every gateway instance; it requires the admin scope
+type AdminCommandHandler struct {
+	natsManager *nats.Manager
+}
+
+// NewAdminCommandHandler creates a new admin command handler
+func NewAdminCommandHandler(natsManager *nats.Manager) *AdminCommandHandler {
+	return &AdminCommandHandler{
+		natsManager: natsManager,
+	}
+}
+
+// ServeHTTP implements http.Handler for admin commands
+func (h *AdminCommandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !middleware.HasScope(r, middleware.ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var request AdminCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case request.Action == nats.AdminActionAnnounce && request.Message != "":
+	case request.Action == nats.AdminActionCloseDocument && request.DocumentID != "":
+	case request.Action == nats.AdminActionKick && request.UserID != "":
+	case request.Action == nats.AdminActionRevokeToken && request.Token != "":
+	default:
+		http.Error(w, "Invalid admin command", http.StatusBadRequest)
+		return
+	}
+
+	err := h.natsManager.PublishAdminCommand(nats.AdminCommand{
+		Action:     request.Action,
+		DocumentID: request.DocumentID,
+		UserID:     request.UserID,
+		Message:    request.Message,
+		Token:      request.Token,
+	})
+	if errors.Is(err, nats.ErrAdminDisabled) {
+		http.Error(w, "Admin commands are disabled", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to publish admin command: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SessionsResponse represents the active sessions of a user
+type SessionsResponse struct {
+	UserID   string              `json:"user_id"`
+	Sessions []websocket.Session `json:"sessions"`
+}
+
+// SessionsHandler lists the active connections of a user
+type SessionsHandler struct {
+	hub *websocket.Hub
+}
+
+// NewSessionsHandler creates a new sessions handler
+func NewSessionsHandler(hub *websocket.Hub) *SessionsHandler {
+	return &SessionsHandler{
+		hub: hub,
+	}
+}
+
+// ServeHTTP implements http.Handler for user sessions. Callers other than admins and the
+// user themselves get the sessions without network details.
+func (h *SessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.PathValue("id")
+	sessions := h.hub.UserSessions(userID)
+
+	callerID, _ := middleware.GetUserID(r)
+	if callerID != userID && !middleware.HasScope(r, middleware.ScopeAdmin) {
+		for i := range sessions {
+			sessions[i].RemoteAddr = ""
+		}
+	}
+
+	response := SessionsResponse{
+		UserID:   userID,
+		Sessions: sessions,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/nats"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/emaforlin/ce-realtime-gateway/websocket"
+	gorilla "github.com/gorilla/websocket"
+)
+
+// authenticatedRequest returns a request as AuthJWT passes it on for a token of alice with the given scopes
+func authenticatedRequest(method, target string, scopes ...string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	ctx := context.WithValue(r.Context(), middleware.UserIDKey, "alice")
+	ctx = context.WithValue(ctx, middleware.ScopesKey, scopes)
+	return r.WithContext(ctx)
+}
+
+// serve runs a request through a handler, filling in the path values of pattern
+func serve(handler http.Handler, pattern string, r *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.Handle(pattern, handler)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// newNATSManager returns a manager backed by an in-process NATS server
+func newNATSManager(t *testing.T) *nats.Manager {
+	t.Helper()
+
+	natsManager, err := nats.NewInProcessManager(config.Load().NATS)
+	if err != nil {
+		t.Fatalf("failed to start NATS: %v", err)
+	}
+	t.Cleanup(func() { natsManager.Close() })
+	return natsManager
+}
+
+func TestResubscribeHandlerRequiresAdmin(t *testing.T) {
+	handler := NewResubscribeHandler(newNATSManager(t))
+
+	w := serve(handler, "/admin/nats/resubscribe", authenticatedRequest(http.MethodPost, "/admin/nats/resubscribe"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status without the admin scope = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = serve(handler, "/admin/nats/resubscribe", authenticatedRequest(http.MethodPost, "/admin/nats/resubscribe", middleware.ScopeAdmin))
+	if w.Code != http.StatusOK {
+		t.Errorf("status with the admin scope = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestSnapshotHandlerRequiresAdmin(t *testing.T) {
+	states := document.NewRegistry(nil, 0)
+	states.Acquire("doc1")
+	handler := NewSnapshotHandler(states)
+
+	w := serve(handler, "/ws/document/{id}/snapshot", authenticatedRequest(http.MethodPost, "/ws/document/doc1/snapshot"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status without the admin scope = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = serve(handler, "/ws/document/{id}/snapshot", authenticatedRequest(http.MethodPost, "/ws/document/doc1/snapshot", middleware.ScopeAdmin))
+	if w.Code != http.StatusOK {
+		t.Errorf("status with the admin scope = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	w = serve(handler, "/ws/document/{id}/snapshot", authenticatedRequest(http.MethodPost, "/ws/document/doc2/snapshot", middleware.ScopeAdmin))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status of an unloaded document = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// fakeDrainer records the documents drained and undrained
+type fakeDrainer struct {
+	drained   []string
+	undrained []string
+}
+
+func (d *fakeDrainer) Drain(documentID string) bool {
+	d.drained = append(d.drained, documentID)
+	return true
+}
+
+func (d *fakeDrainer) Undrain(documentID string) (int, bool) {
+	d.undrained = append(d.undrained, documentID)
+	return 2, true
+}
+
+func TestDrainHandlerRequiresAdmin(t *testing.T) {
+	drainer := &fakeDrainer{}
+
+	for path, handler := range map[string]*DrainHandler{
+		"/documents/doc1/drain":   NewDrainHandler(drainer),
+		"/documents/doc1/undrain": NewUndrainHandler(drainer),
+	} {
+		w := serve(handler, "/documents/{id}/", authenticatedRequest(http.MethodPost, path))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s status without the admin scope = %d, want %d", path, w.Code, http.StatusForbidden)
+		}
+	}
+	if len(drainer.drained) != 0 || len(drainer.undrained) != 0 {
+		t.Fatalf("forbidden requests reached the drainer: drained %v, undrained %v", drainer.drained, drainer.undrained)
+	}
+
+	w := serve(NewDrainHandler(drainer), "/documents/{id}/drain", authenticatedRequest(http.MethodPost, "/documents/doc1/drain", middleware.ScopeAdmin))
+	if w.Code != http.StatusOK || len(drainer.drained) != 1 || drainer.drained[0] != "doc1" {
+		t.Errorf("drain with the admin scope: status %d, drained %v", w.Code, drainer.drained)
+	}
+	w = serve(NewUndrainHandler(drainer), "/documents/{id}/undrain", authenticatedRequest(http.MethodPost, "/documents/doc1/undrain", middleware.ScopeAdmin))
+	if w.Code != http.StatusOK || len(drainer.undrained) != 1 || drainer.undrained[0] != "doc1" {
+		t.Errorf("undrain with the admin scope: status %d, undrained %v", w.Code, drainer.undrained)
+	}
+}
+
+func TestNATSPingHandlerRequiresAdmin(t *testing.T) {
+	handler := NewNATSPingHandler(newNATSManager(t))
+
+	w := serve(handler, "/admin/nats/ping", authenticatedRequest(http.MethodGet, "/admin/nats/ping"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status without the admin scope = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = serve(handler, "/admin/nats/ping", authenticatedRequest(http.MethodGet, "/admin/nats/ping", middleware.ScopeAdmin))
+	if w.Code != http.StatusOK {
+		t.Errorf("status with the admin scope = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestSnapshotHandlerReturnsAppliedEdits(t *testing.T) {
+	states := document.NewRegistry(nil, 0)
+	state := states.Acquire("doc1")
+	for _, payload := range []publisher.DocumentEventPayload{
+		{Action: "insert", Position: 0, Data: "world"},
+		{Action: "insert", Position: 0, Data: "hello "},
+	} {
+		if err := state.Apply(publisher.DocumentEvent{DocumentID: "doc1", UserID: "alice", Payload: payload}); err != nil {
+			t.Fatalf("failed to apply edit: %v", err)
+		}
+	}
+
+	w := serve(NewSnapshotHandler(states), "/ws/document/{id}/snapshot", authenticatedRequest(http.MethodPost, "/ws/document/doc1/snapshot", middleware.ScopeAdmin))
+
+	var snapshot document.Snapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil {
+		t.Fatalf("invalid snapshot %q: %v", w.Body, err)
+	}
+	if snapshot.Content != "hello world" || snapshot.Revision != 2 || snapshot.DocumentID != "doc1" {
+		t.Errorf("snapshot = %+v, want doc1 at revision 2 reading \"hello world\"", snapshot)
+	}
+}
+
+// connectUser opens a WebSocket connection of a user to each of the documents, closed at the end of the test
+func connectUser(t *testing.T, hub *websocket.Hub, userID string, documentIDs ...string) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/{id}", func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, userID))
+		websocket.HandleWebSocket(gorilla.Upgrader{}, hub, &websocket.EchoHandler{})(w, r)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	for _, documentID := range documentIDs {
+		conn, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/"+documentID, nil)
+		if err != nil {
+			t.Fatalf("dial %s failed: %v", documentID, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hub.UserSessions(userID)) != len(documentIDs) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d sessions, want %d", userID, len(hub.UserSessions(userID)), len(documentIDs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// getSessions fetches the sessions of bob for a request of alice with the given scopes
+func getSessions(t *testing.T, handler http.Handler, scopes ...string) []websocket.Session {
+	t.Helper()
+
+	w := serve(handler, "GET /users/{id}/sessions", authenticatedRequest(http.MethodGet, "/users/bob/sessions", scopes...))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var response SessionsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body, err)
+	}
+	if response.UserID != "bob" {
+		t.Errorf("user_id = %q, want bob", response.UserID)
+	}
+	return response.Sessions
+}
+
+func TestSessionsHandlerListsEveryDocument(t *testing.T) {
+	hub := websocket.NewHub(idgen.NewSequential("conn"))
+	go hub.Run()
+	connectUser(t, hub, "bob", "doc1", "doc2")
+	connectUser(t, hub, "alice", "doc1")
+	handler := NewSessionsHandler(hub)
+
+	sessions := getSessions(t, handler, middleware.ScopeAdmin)
+	documents := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		documents = append(documents, session.DocumentID)
+		if session.ConnectionID == "" || session.ConnectedAt.IsZero() || session.RemoteAddr == "" {
+			t.Errorf("incomplete session for an admin: %+v", session)
+		}
+	}
+	slices.Sort(documents)
+	if !slices.Equal(documents, []string{"doc1", "doc2"}) {
+		t.Errorf("sessions are on %v, want doc1 and doc2", documents)
+	}
+
+	for _, session := range getSessions(t, handler) {
+		if session.RemoteAddr != "" {
+			t.Errorf("remote address %q shown to another user", session.RemoteAddr)
+		}
+	}
+}
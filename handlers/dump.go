@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/instance"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/nats"
+	"github.com/emaforlin/ce-realtime-gateway/websocket"
+)
+
+// DumpResponse is a diagnostic snapshot of the whole gateway, for support
+type DumpResponse struct {
+	InstanceID  string                     `json:"instance_id"`
+	Timestamp   time.Time                  `json:"timestamp"`
+	Config      config.Config              `json:"config"`
+	Connections []websocket.ConnectionDump `json:"connections"`
+	NATS        NATSDump                   `json:"nats"`
+	Runtime     RuntimeDump                `json:"runtime"`
+}
+
+// NATSDump describes the NATS connection and the document subscriptions
+type NATSDump struct {
+	Status           string                   `json:"status"`
+	Subscriptions    int                      `json:"subscriptions"`
+	MaxSubscriptions int                      `json:"max_subscriptions"`
+	Documents        map[string]int           `json:"documents"`
+	Activity         map[string]nats.Activity `json:"activity"`
+}
+
+// RuntimeDump holds the Go runtime statistics of the process
+type RuntimeDump struct {
+	GoVersion  string `json:"go_version"`
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heap_alloc_bytes"`
+	HeapInuse  uint64 `json:"heap_inuse_bytes"`
+	Sys        uint64 `json:"sys_bytes"`
+	NumGC      uint32 `json:"num_gc"`
+}
+
+// DumpHandler returns a diagnostic snapshot of the gateway; it requires the admin scope
+type DumpHandler struct {
+	natsManager *nats.Manager
+	hub         *websocket.Hub
+}
+
+// NewDumpHandler creates a new dump handler
+func NewDumpHandler(natsManager *nats.Manager, hub *websocket.Hub) *DumpHandler {
+	return &DumpHandler{
+		natsManager: natsManager,
+		hub:         hub,
+	}
+}
+
+// ServeHTTP implements http.Handler for diagnostic dumps. The configuration is redacted, and each
+// part is taken under the locks of its owner, so the parts may be a few moments apart.
+func (h *DumpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !middleware.HasScope(r, middleware.ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := h.natsManager.Snapshot()
+
+	response := DumpResponse{
+		InstanceID:  instance.ID(),
+		Timestamp:   time.Now(),
+		Config:      config.Load().Redacted(),
+		Connections: h.hub.DumpConnections(),
+		NATS: NATSDump{
+			Status:           h.natsManager.ConnectionStatus(),
+			Subscriptions:    stats.Subscriptions,
+			MaxSubscriptions: stats.MaxSubscriptions,
+			Documents:        stats.Documents,
+			Activity:         stats.Activity,
+		},
+		Runtime: RuntimeDump{
+			GoVersion:  runtime.Version(),
+			Goroutines: runtime.NumGoroutine(),
+			HeapAlloc:  mem.HeapAlloc,
+			HeapInuse:  mem.HeapInuse,
+			Sys:        mem.Sys,
+			NumGC:      mem.NumGC,
+		},
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/websocket"
+	natsPkg "github.com/nats-io/nats.go"
+)
+
+func TestDumpHandlerRequiresAdmin(t *testing.T) {
+	hub := websocket.NewHub(idgen.NewSequential("conn"))
+	handler := NewDumpHandler(newNATSManager(t), hub)
+
+	if w := serve(handler, "/admin/dump", authenticatedRequest(http.MethodGet, "/admin/dump")); w.Code != http.StatusForbidden {
+		t.Errorf("status without the admin scope = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := serve(handler, "/admin/dump", authenticatedRequest(http.MethodPost, "/admin/dump", middleware.ScopeAdmin)); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDumpIncludesConnectionsAndSubscriptions(t *testing.T) {
+	hub := websocket.NewHub(idgen.NewSequential("conn"))
+	go hub.Run()
+	connectUser(t, hub, "bob", "doc1", "doc2")
+	natsManager := newNATSManager(t)
+	if err := natsManager.Subscribe("doc1", func(*natsPkg.Msg) {}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	handler := NewDumpHandler(natsManager, hub)
+
+	w := serve(handler, "/admin/dump", authenticatedRequest(http.MethodGet, "/admin/dump", middleware.ScopeAdmin))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var dump DumpResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("invalid dump %q: %v", w.Body, err)
+	}
+
+	var documents []string
+	for _, conn := range dump.Connections {
+		if conn.ClientID != "bob" || conn.ConnectionID == "" || conn.State == "" {
+			t.Errorf("incomplete connection dump: %+v", conn)
+		}
+		documents = append(documents, conn.DocumentID)
+	}
+	slices.Sort(documents)
+	if !slices.Equal(documents, []string{"doc1", "doc2"}) {
+		t.Errorf("connections are on %v, want doc1 and doc2", documents)
+	}
+	if dump.NATS.Subscriptions != 1 || dump.NATS.Documents["doc1"] != 1 {
+		t.Errorf("NATS dump = %+v, want doc1 subscribed once", dump.NATS)
+	}
+	if dump.Runtime.Goroutines == 0 || dump.Runtime.GoVersion == "" {
+		t.Errorf("runtime dump = %+v, want it populated", dump.Runtime)
+	}
+	if secret := config.Load().JWT.SecretKey; secret != "" && strings.Contains(w.Body.String(), secret) {
+		t.Error("the dump reveals the JWT secret")
+	}
+}
@@ -1,11 +1,15 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
+	"github.com/emaforlin/ce-realtime-gateway/clock"
 	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/instance"
 )
 
 // HealthResponse represents the health check response
@@ -14,19 +18,24 @@ type HealthResponse struct {
 	Timestamp time.Time `json:"timestamp"`
 	Version   string    `json:"version"`
 	Uptime    string    `json:"uptime"`
+	NATS      string    `json:"nats,omitempty"`
 }
 
 // HealthHandler handles health check requests
 type HealthHandler struct {
-	startTime time.Time
-	version   string
+	startTime  time.Time
+	version    string
+	clock      clock.Clock
+	natsStatus func() string
 }
 
-// NewHealthHandler creates a new health handler
-func NewHealthHandler(version string) *HealthHandler {
+// NewHealthHandler creates a new health handler. natsStatus, when not nil, reports the NATS connection state.
+func NewHealthHandler(version string, clk clock.Clock, natsStatus func() string) *HealthHandler {
 	return &HealthHandler{
-		startTime: time.Now(),
-		version:   version,
+		startTime:  clk.Now(),
+		version:    version,
+		clock:      clk,
+		natsStatus: natsStatus,
 	}
 }
 
@@ -37,19 +46,39 @@ func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	uptime := time.Since(h.startTime)
+	now := h.clock.Now()
+	uptime := now.Sub(h.startTime)
 	response := HealthResponse{
 		Status:    "healthy",
-		Timestamp: time.Now(),
+		Timestamp: now,
 		Version:   h.version,
 		Uptime:    uptime.String(),
 	}
+	// Without NATS edits don't reach other instances; the gateway still serves, degraded, but load
+	// balancers should prefer instances that can fan out
+	status := http.StatusOK
+	if h.natsStatus != nil {
+		response.NATS = h.natsStatus()
+		if response.NATS != "connected" {
+			response.Status = "degraded"
+			status = http.StatusServiceUnavailable
+		}
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, status, response)
+}
 
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+// LivenessHandler answers orchestrator liveness probes with a bare 200 and no JSON work
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write([]byte("ok"))
 	}
 }
 
@@ -58,18 +87,22 @@ type InfoResponse struct {
 	Name        string            `json:"name"`
 	Version     string            `json:"version"`
 	Description string            `json:"description"`
+	InstanceID  string            `json:"instance_id"`
 	Endpoints   map[string]string `json:"endpoints"`
+	Routes      []string          `json:"routes,omitempty"`
 }
 
 // InfoHandler handles server information requests
 type InfoHandler struct {
 	config *config.Config
+	routes func() []string
 }
 
-// NewInfoHandler creates a new info handler
-func NewInfoHandler(cfg *config.Config) *InfoHandler {
+// NewInfoHandler creates a new info handler. routes, when not nil, lists the registered route patterns.
+func NewInfoHandler(cfg *config.Config, routes func() []string) *InfoHandler {
 	return &InfoHandler{
 		config: cfg,
+		routes: routes,
 	}
 }
 
@@ -84,19 +117,18 @@ func (h *InfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Name:        "Collaborative Editor WebSocket Gateway",
 		Version:     "1.0.0",
 		Description: "Real-time WebSocket gateway for collaborative editing",
+		InstanceID:  instance.ID(),
 		Endpoints: map[string]string{
 			"websocket_echo": h.config.GetWebSocketURL("/ws/echo"),
 			"health":         h.config.GetHTTPURL("/health"),
 			"info":           h.config.GetHTTPURL("/info"),
 		},
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if h.routes != nil {
+		response.Routes = h.routes()
 	}
+
+	writeJSON(w, http.StatusOK, response)
 }
 
 // NotFoundHandler handles 404 errors
@@ -107,9 +139,7 @@ func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
 		"path":    r.URL.Path,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusNotFound)
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusNotFound, response)
 }
 
 // MethodNotAllowedHandler handles 405 errors
@@ -121,7 +151,20 @@ func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
 		"path":    r.URL.Path,
 	}
 
+	writeJSON(w, http.StatusMethodNotAllowed, response)
+}
+
+// writeJSON writes v as a JSON response with the given status. The body is encoded before anything
+// is written, so an encoding failure can still be answered with a clean 500.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusMethodNotAllowed)
-	json.NewEncoder(w).Encode(response)
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
 }
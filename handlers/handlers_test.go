@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/clock"
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/instance"
+	"github.com/emaforlin/ce-realtime-gateway/nats"
+)
+
+// getHealth runs a health check, returning its status and decoded response
+func getHealth(t *testing.T, handler *HealthHandler) (int, HealthResponse) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var response HealthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid health response %q: %v", w.Body, err)
+	}
+	return w.Code, response
+}
+
+func TestHealthHandlerUptime(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	handler := NewHealthHandler("1.0.0", clk, nil)
+
+	clk.Advance(90 * time.Second)
+	_, response := getHealth(t, handler)
+
+	if response.Uptime != "1m30s" {
+		t.Errorf("uptime = %s, want 1m30s", response.Uptime)
+	}
+	if !response.Timestamp.Equal(start.Add(90 * time.Second)) {
+		t.Errorf("timestamp = %v, want %v", response.Timestamp, start.Add(90*time.Second))
+	}
+}
+
+func TestHealthHandlerReportsDetails(t *testing.T) {
+	code, response := getHealth(t, NewHealthHandler("1.0.0", clock.Real{}, nil))
+
+	if code != http.StatusOK {
+		t.Errorf("status = %d, want %d", code, http.StatusOK)
+	}
+	if response.Version != "1.0.0" || response.Uptime == "" {
+		t.Errorf("health response %+v lacks the version or uptime", response)
+	}
+}
+
+func TestHealthHandlerReportsNATSStatus(t *testing.T) {
+	status := "connected"
+	handler := NewHealthHandler("1.0.0", clock.Real{}, func() string { return status })
+
+	if code, response := getHealth(t, handler); code != http.StatusOK || response.Status != "healthy" || response.NATS != "connected" {
+		t.Errorf("health while connected = %d %+v, want healthy", code, response)
+	}
+
+	for _, status = range []string{nats.StatusReconnecting, nats.StatusRestarting, nats.StatusDisconnected} {
+		if code, response := getHealth(t, handler); code != http.StatusServiceUnavailable || response.Status != "degraded" || response.NATS != status {
+			t.Errorf("health while %s = %d %+v, want degraded", status, code, response)
+		}
+	}
+}
+
+func TestHealthHandlerDegradedOnceNATSDisconnects(t *testing.T) {
+	natsManager := newNATSManager(t)
+	handler := NewHealthHandler("1.0.0", clock.Real{}, natsManager.ConnectionStatus)
+	if code, response := getHealth(t, handler); code != http.StatusOK || response.NATS != nats.StatusConnected {
+		t.Fatalf("health while connected = %d %+v, want healthy", code, response)
+	}
+
+	natsManager.Close()
+
+	if code, response := getHealth(t, handler); code != http.StatusServiceUnavailable || response.NATS != nats.StatusDisconnected {
+		t.Errorf("health after NATS closed = %d %+v, want 503 and disconnected", code, response)
+	}
+}
+
+func TestLivenessHandler(t *testing.T) {
+	tests := []struct {
+		method string
+		code   int
+		body   string
+	}{
+		{http.MethodGet, http.StatusOK, "ok"},
+		{http.MethodHead, http.StatusOK, ""},
+		{http.MethodPost, http.StatusMethodNotAllowed, "Method not allowed\n"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		LivenessHandler(w, httptest.NewRequest(tt.method, "/healthz", nil))
+
+		if w.Code != tt.code || w.Body.String() != tt.body {
+			t.Errorf("%s /healthz = %d %q, want %d %q", tt.method, w.Code, w.Body, tt.code, tt.body)
+		}
+	}
+}
+
+func TestInfoHandlerReportsInstanceID(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewInfoHandler(config.Load(), nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/info", nil))
+
+	var response InfoResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid info response %q: %v", w.Body, err)
+	}
+	if response.InstanceID != instance.ID() {
+		t.Errorf("instance_id = %q, want %q", response.InstanceID, instance.ID())
+	}
+}
+
+// headerCounter is a response recorder counting the calls to WriteHeader
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	calls int
+}
+
+func (w *headerCounter) WriteHeader(status int) {
+	w.calls++
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func TestWriteJSONEncodingFailure(t *testing.T) {
+	w := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"unencodable": make(chan int)})
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if w.calls != 1 {
+		t.Errorf("WriteHeader called %d times, want once", w.calls)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType == "application/json" {
+		t.Error("failed response still claims to be JSON")
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	w := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "ok"})
+
+	if w.Code != http.StatusCreated || w.calls != 1 {
+		t.Errorf("status = %d after %d WriteHeader calls, want 201 once", w.Code, w.calls)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+	if w.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("body = %q", w.Body)
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+)
+
+// History page sizes
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// NextSinceHeader carries the since value of the next history page when the response was cut at the limit
+const NextSinceHeader = "X-Next-Since"
+
+// HistoryHandler exports the retained edit history of a loaded document; it requires the admin scope
+type HistoryHandler struct {
+	states *document.Registry
+}
+
+// NewHistoryHandler creates a new history handler
+func NewHistoryHandler(states *document.Registry) *HistoryHandler {
+	return &HistoryHandler{
+		states: states,
+	}
+}
+
+// ServeHTTP implements http.Handler for history exports. It returns the edits after the since
+// revision as a JSON array ordered by revision, at most limit of them.
+func (h *HistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !middleware.HasScope(r, middleware.ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	since, err := queryInt(r, "since", 0)
+	if err != nil || since < 0 {
+		http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultHistoryLimit)
+	if err != nil || limit <= 0 {
+		http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxHistoryLimit)
+
+	state, ok := h.states.Get(r.PathValue("id"))
+	if !ok {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	entries, more := state.History(int64(since), limit)
+	if more {
+		w.Header().Set(NextSinceHeader, strconv.FormatInt(entries[len(entries)-1].Revision, 10))
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// queryInt parses an integer query parameter, returning fallback when it is absent
+func queryInt(r *http.Request, name string, fallback int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
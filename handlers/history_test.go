@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// newHistoryHandler returns a history handler over doc1 with the given number of inserts applied
+func newHistoryHandler(t *testing.T, edits int) *HistoryHandler {
+	t.Helper()
+
+	states := document.NewRegistry(nil, 0)
+	state := states.Acquire("doc1")
+	for i := 0; i < edits; i++ {
+		err := state.Apply(publisher.DocumentEvent{
+			DocumentID: "doc1",
+			UserID:     "alice",
+			Payload:    publisher.DocumentEventPayload{Action: "insert", Position: 0, Data: "x"},
+		})
+		if err != nil {
+			t.Fatalf("failed to apply edit: %v", err)
+		}
+	}
+	return NewHistoryHandler(states)
+}
+
+func TestHistoryHandlerRequiresAdmin(t *testing.T) {
+	handler := newHistoryHandler(t, 1)
+
+	w := serve(handler, "/documents/{id}/history", authenticatedRequest(http.MethodGet, "/documents/doc1/history"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status without the admin scope = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestHistoryHandlerPages(t *testing.T) {
+	handler := newHistoryHandler(t, 5)
+
+	w := serve(handler, "/documents/{id}/history", authenticatedRequest(http.MethodGet, "/documents/doc1/history?since=1&limit=2", middleware.ScopeAdmin))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var entries []document.HistoryEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Revision != 2 || entries[1].Revision != 3 {
+		t.Errorf("got %+v, want revisions 2 and 3", entries)
+	}
+	if next := w.Header().Get(NextSinceHeader); next != "3" {
+		t.Errorf("%s = %q, want 3", NextSinceHeader, next)
+	}
+}
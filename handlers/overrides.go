@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/websocket"
+)
+
+// DocumentOverridesResponse represents the overrides of a document
+type DocumentOverridesResponse struct {
+	DocumentID string                      `json:"document_id"`
+	Overrides  websocket.DocumentOverrides `json:"overrides"`
+}
+
+// DocumentOverridesHandler reads, replaces and removes per-document limits; it requires the admin scope
+type DocumentOverridesHandler struct {
+	overrides *websocket.OverrideRegistry
+}
+
+// NewDocumentOverridesHandler creates a new document overrides handler
+func NewDocumentOverridesHandler(overrides *websocket.OverrideRegistry) *DocumentOverridesHandler {
+	return &DocumentOverridesHandler{
+		overrides: overrides,
+	}
+}
+
+// ServeHTTP implements http.Handler for document overrides
+func (h *DocumentOverridesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !middleware.HasScope(r, middleware.ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	documentID := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var overrides websocket.DocumentOverrides
+		if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if overrides.MaxConnections < 0 || overrides.TransientRateLimit < 0 || overrides.SendBufferSize < 0 {
+			http.Error(w, "Overrides must not be negative", http.StatusBadRequest)
+			return
+		}
+		h.overrides.Set(documentID, overrides)
+	case http.MethodDelete:
+		h.overrides.Delete(documentID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	overrides, _ := h.overrides.Get(documentID)
+	response := DocumentOverridesResponse{
+		DocumentID: documentID,
+		Overrides:  overrides,
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
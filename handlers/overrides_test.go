@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/websocket"
+)
+
+// overridesRequest returns an admin request on the overrides of doc1 with the given JSON body
+func overridesRequest(method, body string) *http.Request {
+	r := authenticatedRequest(method, "/documents/doc1/overrides", middleware.ScopeAdmin)
+	r.Body = io.NopCloser(strings.NewReader(body))
+	return r
+}
+
+func TestDocumentOverridesHandlerRequiresAdmin(t *testing.T) {
+	handler := NewDocumentOverridesHandler(websocket.NewOverrideRegistry())
+
+	w := serve(handler, "/documents/{id}/overrides", authenticatedRequest(http.MethodGet, "/documents/doc1/overrides"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status without the admin scope = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestDocumentOverridesHandler(t *testing.T) {
+	registry := websocket.NewOverrideRegistry()
+	handler := NewDocumentOverridesHandler(registry)
+
+	w := serve(handler, "/documents/{id}/overrides", overridesRequest(http.MethodPut, `{"max_connections":50,"send_buffer_size":1024}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var response DocumentOverridesResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	want := websocket.DocumentOverrides{MaxConnections: 50, SendBufferSize: 1024}
+	if response.DocumentID != "doc1" || response.Overrides != want {
+		t.Errorf("response = %+v, want doc1 with %+v", response, want)
+	}
+	if got, _ := registry.Get("doc1"); got != want {
+		t.Errorf("registry holds %+v, want %+v", got, want)
+	}
+
+	w = serve(handler, "/documents/{id}/overrides", overridesRequest(http.MethodDelete, ""))
+	if _, ok := registry.Get("doc1"); w.Code != http.StatusOK || ok {
+		t.Errorf("DELETE status = %d with overrides left: %v", w.Code, ok)
+	}
+}
+
+func TestDocumentOverridesHandlerRejectsInvalidOverrides(t *testing.T) {
+	registry := websocket.NewOverrideRegistry()
+	handler := NewDocumentOverridesHandler(registry)
+
+	for _, body := range []string{`{"transient_rate_limit":-1}`, `{"max_connections":`} {
+		w := serve(handler, "/documents/{id}/overrides", overridesRequest(http.MethodPut, body))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s: status = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if _, ok := registry.Get("doc1"); ok {
+		t.Error("invalid overrides were stored")
+	}
+}
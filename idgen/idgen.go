@@ -0,0 +1,40 @@
+package idgen
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync/atomic"
+)
+
+// Generator mints unique IDs (connections, anonymous clients, ...), allowing ID-dependent code to be driven deterministically
+type Generator interface {
+	NewID() string
+}
+
+// UUID is a Generator producing random version 4 UUIDs
+type UUID struct{}
+
+// NewID returns a new random UUID
+func (UUID) NewID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Sequential is a Generator producing predictable IDs: prefix-1, prefix-2, ...
+type Sequential struct {
+	prefix string
+	next   atomic.Uint64
+}
+
+// NewSequential creates a sequential generator with the given prefix
+func NewSequential(prefix string) *Sequential {
+	return &Sequential{prefix: prefix}
+}
+
+// NewID returns the next ID in the sequence
+func (s *Sequential) NewID() string {
+	return fmt.Sprintf("%s-%d", s.prefix, s.next.Add(1))
+}
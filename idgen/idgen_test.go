@@ -0,0 +1,32 @@
+package idgen
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestSequential(t *testing.T) {
+	ids := NewSequential("conn")
+
+	for _, want := range []string{"conn-1", "conn-2", "conn-3"} {
+		if got := ids.NewID(); got != want {
+			t.Errorf("NewID() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestUUID(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+
+	for i := 0; i < 100; i++ {
+		id := UUID{}.NewID()
+		if !format.MatchString(id) {
+			t.Fatalf("NewID() = %q, not a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("NewID() repeated %q", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,37 @@
+package instance
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+)
+
+// HeaderKey is the NATS header carrying the ID of the gateway instance that published a message
+const HeaderKey = "Gateway-Instance"
+
+var (
+	id   string
+	once sync.Once
+)
+
+// ID returns the identifier of this gateway instance, generated once per process
+// from the hostname and a random suffix
+func ID() string {
+	once.Do(func() {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = "gateway"
+		}
+		host, _, _ = strings.Cut(host, ".")
+
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			id = host
+			return
+		}
+		id = host + "-" + hex.EncodeToString(suffix)
+	})
+	return id
+}
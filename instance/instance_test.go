@@ -0,0 +1,26 @@
+package instance
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIDIsStableAndNamesTheHost(t *testing.T) {
+	id := ID()
+	if id == "" {
+		t.Fatal("instance ID is empty")
+	}
+	if again := ID(); again != id {
+		t.Errorf("instance ID changed from %q to %q within a run", id, again)
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "gateway"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	if !strings.HasPrefix(id, host+"-") {
+		t.Errorf("instance ID %q does not start with the host name %q", id, host)
+	}
+}
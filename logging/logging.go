@@ -0,0 +1,150 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Level is the severity of a log line
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Categories whose verbosity can be tuned independently
+const (
+	CategoryBroadcast    = "broadcast"
+	CategorySubscription = "subscription"
+	CategoryAuth         = "auth"
+	CategoryEdit         = "edit"
+	CategoryConnection   = "connection"
+)
+
+var (
+	defaultLevel = LevelInfo
+	levels       = map[string]Level{}
+	levelsMutex  sync.RWMutex
+)
+
+// ParseLevel parses a level name: debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// Configure sets the default level and per-category overrides given as "category=level,..."
+// (e.g. "broadcast=warn,auth=debug"). Invalid entries are reported and skipped.
+func Configure(defaultName, overrides string) error {
+	var errs []string
+
+	base, err := ParseLevel(defaultName)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	parsed := make(map[string]Level)
+	for _, entry := range strings.Split(overrides, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		category, name, found := strings.Cut(entry, "=")
+		if !found {
+			errs = append(errs, fmt.Sprintf("malformed log level override %q", entry))
+			continue
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		parsed[strings.TrimSpace(category)] = level
+	}
+
+	levelsMutex.Lock()
+	defaultLevel = base
+	levels = parsed
+	levelsMutex.Unlock()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid log configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Logger writes log lines of one category, dropping those below the category's level
+type Logger struct {
+	category string
+	// fields are the "key=value" pairs bound with With, prefixed to every line
+	fields []string
+}
+
+// For returns the logger of a category
+func For(category string) Logger {
+	return Logger{category: category}
+}
+
+// With returns a copy of the logger that prefixes every line with key=value, after the fields already bound
+func (l Logger) With(key string, value interface{}) Logger {
+	fields := make([]string, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	l.fields = append(fields, fmt.Sprintf("%s=%v", key, value))
+	return l
+}
+
+// Enabled reports whether lines of the given level are written for this category
+func (l Logger) Enabled(level Level) bool {
+	levelsMutex.RLock()
+	defer levelsMutex.RUnlock()
+
+	threshold, ok := levels[l.category]
+	if !ok {
+		threshold = defaultLevel
+	}
+	return level >= threshold
+}
+
+// Debugf logs at debug level
+func (l Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof logs at info level
+func (l Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs at warn level
+func (l Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs at error level
+func (l Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+func (l Logger) logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	if len(l.fields) > 0 {
+		format = "[" + strings.Join(l.fields, " ") + "] " + format
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+// captureLog redirects the standard logger for the rest of the test and resets the levels afterwards
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	output, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+		Configure("info", "")
+	})
+	return &buf
+}
+
+func TestCategoriesAreSuppressedIndependently(t *testing.T) {
+	buf := captureLog(t)
+	if err := Configure("info", "broadcast=warn,auth=debug"); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+
+	For(CategoryBroadcast).Infof("broadcast info")
+	For(CategoryBroadcast).Warnf("broadcast warn")
+	For(CategoryAuth).Debugf("auth debug")
+	For(CategoryEdit).Debugf("edit debug")
+	For(CategoryEdit).Infof("edit info")
+
+	got := buf.String()
+	for _, line := range []string{"broadcast warn", "auth debug", "edit info"} {
+		if !strings.Contains(got, line) {
+			t.Errorf("%q was suppressed", line)
+		}
+	}
+	for _, line := range []string{"broadcast info", "edit debug"} {
+		if strings.Contains(got, line) {
+			t.Errorf("%q was written", line)
+		}
+	}
+}
+
+func TestConfigureReportsInvalidEntries(t *testing.T) {
+	captureLog(t)
+
+	err := Configure("info", "broadcast=loud,auth,edit=warn")
+	if err == nil {
+		t.Fatal("Configure accepted invalid overrides")
+	}
+	if For(CategoryEdit).Enabled(LevelInfo) {
+		t.Error("the valid edit=warn override was not applied")
+	}
+	if !For(CategoryBroadcast).Enabled(LevelInfo) {
+		t.Error("the invalid broadcast override changed its level")
+	}
+}
+
+func TestWithPrefixesFields(t *testing.T) {
+	buf := captureLog(t)
+
+	For(CategoryConnection).With("user", "alice").With("conn", "c1").Infof("joined")
+
+	if got := strings.TrimSpace(buf.String()); got != "[user=alice conn=c1] joined" {
+		t.Errorf("logged %q", got)
+	}
+}
+
+func TestWithBindsFields(t *testing.T) {
+	buf := captureLog(t)
+	base := For(CategoryConnection).With("user", "alice")
+
+	base.With("doc", "doc1").Infof("joined")
+	base.Infof("left")
+
+	want := "[user=alice doc=doc1] joined\n[user=alice] left\n"
+	if buf.String() != want {
+		t.Errorf("logged %q, want %q", buf, want)
+	}
+}
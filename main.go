@@ -1,46 +1,113 @@
 package main
 
 import (
+	"context"
 	"log"
 
+	"github.com/emaforlin/ce-realtime-gateway/clock"
 	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/eventbus"
 	"github.com/emaforlin/ce-realtime-gateway/handlers"
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+	"github.com/emaforlin/ce-realtime-gateway/instance"
+	"github.com/emaforlin/ce-realtime-gateway/logging"
+	"github.com/emaforlin/ce-realtime-gateway/metrics"
 	"github.com/emaforlin/ce-realtime-gateway/middleware"
 	natsManager "github.com/emaforlin/ce-realtime-gateway/nats"
 	"github.com/emaforlin/ce-realtime-gateway/server"
+	"github.com/emaforlin/ce-realtime-gateway/shutdown"
+	"github.com/emaforlin/ce-realtime-gateway/webhook"
 	"github.com/emaforlin/ce-realtime-gateway/websocket"
 )
 
 const version = "1.0.0"
 
 func main() {
+	// Tag every log line with this instance's ID so replicas can be told apart
+	log.SetPrefix("[" + instance.ID() + "] ")
+
 	// Load configuration
 	cfg := config.Load()
+	if err := logging.Configure(cfg.Log.Level, cfg.Log.Levels); err != nil {
+		log.Printf("WARNING: %v", err)
+	}
+	clk := clock.Real{}
 
 	// Create server
 	srv := server.New(cfg)
 
 	// Create WebSocket hub and start it
-	hub := websocket.NewHub()
+	hub := websocket.NewHub(idgen.UUID{})
 	go hub.Run()
+	metrics.RegisterBufferedMessages(hub.BufferedMessages)
+	metrics.RegisterConnections(hub.ConnectionCount)
 
 	// Create WebSocket upgrader and handler
 	upgrader := websocket.NewUpgrader(cfg)
 	echoHandler := &websocket.EchoHandler{}
 
 	// Initialize unified NATS manager (handles both publishing and subscribing)
-	natsManager, err := natsManager.NewManager(cfg.NATS.URL)
+	natsManager, err := connectNATS(cfg.NATS)
 	if err != nil {
 		log.Fatalf("failed to initialize NATS manager: %v", err)
 	}
-	defer natsManager.Close()
+	metrics.RegisterSubscriptions(func() int { return len(natsManager.GetStats()) })
+
+	// Create the in-process event bus and forward every document event to NATS
+	bus := eventbus.New(256, cfg.NATS.PublishTimeout)
+	published := natsManager.PublishEvents(bus.Subscribe(eventbus.TopicEdit, eventbus.TopicPresence, eventbus.TopicCursor))
+
+	// Also deliver edits and presence changes to an external webhook, if configured. Delivery is
+	// best effort, a lagging webhook misses events rather than holding up edits.
+	var observer *webhook.Observer
+	if cfg.Webhook.URL != "" {
+		observer = webhook.NewObserver(cfg.Webhook)
+		go observer.Run(bus.SubscribeBestEffort(eventbus.TopicEdit, eventbus.TopicPresence))
+	}
+
+	// Track the in-memory state of documents with local connections, persisting snapshots if configured
+	var store document.Store
+	if cfg.Snapshot.Dir != "" {
+		fileStore, err := document.NewFileStore(cfg.Snapshot.Dir, cfg.Snapshot.Compress)
+		if err != nil {
+			log.Fatalf("failed to initialize snapshot store: %v", err)
+		}
+		store = fileStore
+	}
+	states := document.NewRegistry(store, cfg.WebSocket.HistoryMaxBytes)
 
 	// Create document handler with unified NATS manager
-	documentHandler := websocket.NewDocumentHandler(natsManager, hub)
+	documentHandler := websocket.NewDocumentHandler(natsManager, hub, bus, states, clk)
+	documentHandler.SetAuthorizer(websocket.AuthorizeDocumentClaim)
+	go documentHandler.SweepPresence()
+	go documentHandler.ReconcileSubscriptions(cfg.NATS.ReconcileInterval)
+
+	// Route documents by type prefix (e.g. "sheet:1234"); plain text is the default
+	documentRouter := websocket.NewRouter(documentHandler)
+
+	// Execute admin commands issued on any instance
+	if cfg.NATS.AdminSecret != "" {
+		if err := natsManager.SubscribeAdmin(documentHandler.HandleAdminCommand); err != nil {
+			log.Fatalf("failed to subscribe to admin commands: %v", err)
+		}
+	}
 
 	// Create HTTP handlers
-	healthHandler := handlers.NewHealthHandler(version)
-	infoHandler := handlers.NewInfoHandler(cfg)
+	healthHandler := handlers.NewHealthHandler(version, clk, natsManager.ConnectionStatus)
+	infoHandler := handlers.NewInfoHandler(cfg, srv.Routes)
+	resubscribeHandler := handlers.NewResubscribeHandler(natsManager)
+	natsPingHandler := handlers.NewNATSPingHandler(natsManager)
+	snapshotHandler := handlers.NewSnapshotHandler(states)
+	historyHandler := handlers.NewHistoryHandler(states)
+	statsHandler := handlers.NewStatsHandler(natsManager, hub)
+	drainHandler := handlers.NewDrainHandler(documentHandler)
+	undrainHandler := handlers.NewUndrainHandler(documentHandler)
+	closeDocumentHandler := handlers.NewCloseDocumentHandler(documentHandler)
+	adminCommandHandler := handlers.NewAdminCommandHandler(natsManager)
+	dumpHandler := handlers.NewDumpHandler(natsManager, hub)
+	sessionsHandler := handlers.NewSessionsHandler(hub)
+	overridesHandler := handlers.NewDocumentOverridesHandler(hub.Overrides())
 
 	// Register routes with middleware
 	srv.RegisterHandlerWithMiddleware("/health",
@@ -50,6 +117,12 @@ func main() {
 		middleware.CORS,
 	)
 
+	// Probe path for orchestrators; kept out of the request log since it is hit every few seconds
+	srv.RegisterHandlerWithMiddleware("/healthz",
+		handlers.LivenessHandler,
+		middleware.Recovery,
+	)
+
 	srv.RegisterHandlerWithMiddleware("/info",
 		infoHandler.ServeHTTP,
 		middleware.Logger,
@@ -57,6 +130,106 @@ func main() {
 		middleware.CORS,
 	)
 
+	srv.RegisterHandlerWithMiddleware("/stats",
+		statsHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.CORS,
+	)
+
+	srv.RegisterHandlerWithMiddleware("/metrics",
+		metrics.Handler().ServeHTTP,
+		middleware.Recovery,
+	)
+
+	// Cap request bodies on POST endpoints
+	maxBody := middleware.MaxBodyBytes(int64(cfg.Server.MaxBodyBytes))
+
+	// Register admin endpoints
+	srv.RegisterHandlerWithMiddleware("/admin/nats/resubscribe",
+		resubscribeHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+		maxBody,
+	)
+
+	srv.RegisterHandlerWithMiddleware("GET /admin/nats/ping",
+		natsPingHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+	)
+
+	srv.RegisterHandlerWithMiddleware("POST /admin/commands",
+		adminCommandHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+		maxBody,
+	)
+
+	srv.RegisterHandlerWithMiddleware("GET /admin/dump",
+		dumpHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+	)
+
+	srv.RegisterHandlerWithMiddleware("POST /ws/document/{id}/snapshot",
+		snapshotHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+		maxBody,
+	)
+
+	srv.RegisterHandlerWithMiddleware("POST /documents/{id}/drain",
+		drainHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+		maxBody,
+	)
+
+	srv.RegisterHandlerWithMiddleware("POST /documents/{id}/undrain",
+		undrainHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+		maxBody,
+	)
+
+	srv.RegisterHandlerWithMiddleware("POST /documents/{id}/close",
+		closeDocumentHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+		maxBody,
+	)
+
+	srv.RegisterHandlerWithMiddleware("GET /documents/{id}/history",
+		historyHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+	)
+
+	srv.RegisterHandlerWithMiddleware("/documents/{id}/overrides",
+		overridesHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+		maxBody,
+	)
+
+	srv.RegisterHandlerWithMiddleware("GET /users/{id}/sessions",
+		sessionsHandler.ServeHTTP,
+		middleware.Logger,
+		middleware.Recovery,
+		middleware.AuthJWT,
+	)
+
 	// Register WebSocket endpoint
 	srv.RegisterHandlerWithMiddleware("/ws/echo",
 		websocket.HandleWebSocket(upgrader, hub, echoHandler),
@@ -66,12 +239,76 @@ func main() {
 
 	// Register WebSocket endpoint for document collaboration
 	srv.RegisterHandlerWithMiddleware("/ws/document/{id}",
-		websocket.HandleWebSocket(upgrader, hub, documentHandler),
+		websocket.HandleWebSocket(upgrader, hub, documentRouter),
 		middleware.AuthJWT,
 		middleware.WebSocketLogger,
 		middleware.Recovery,
 	)
 
-	// Start server with graceful shutdown
-	log.Fatal(srv.Start())
+	// Register the document endpoint for clients that can't put the document ID in the path
+	if extractor, err := websocket.DocumentIDExtractorFor(cfg.WebSocket.DocumentIDSource); err != nil {
+		log.Printf("Not serving /ws/document: %v", err)
+	} else {
+		srv.RegisterHandlerWithMiddleware("/ws/document",
+			websocket.HandleWebSocketWithExtractor(upgrader, hub, documentRouter, extractor),
+			middleware.AuthJWT,
+			middleware.WebSocketLogger,
+			middleware.Recovery,
+		)
+	}
+
+	// Register the anonymous read-only endpoint for public document viewing
+	if cfg.WebSocket.AllowAnonymousView {
+		srv.RegisterHandlerWithMiddleware("/ws/document/{id}/view",
+			websocket.HandleAnonymousWebSocket(upgrader, hub, documentRouter),
+			middleware.WebSocketLogger,
+			middleware.Recovery,
+		)
+	}
+
+	// Tear down in order on SIGINT/SIGTERM: tell the WebSocket clients to reconnect elsewhere instead
+	// of leaving them to their heartbeat timeouts, stop the HTTP server, then let NATS deliver what
+	// is in flight
+	coordinator := shutdown.NewCoordinator()
+	coordinator.Add("websockets", cfg.Server.ConnectionDrainTimeout, hub.Shutdown)
+	coordinator.Add("http server", server.ShutdownTimeout, srv.Shutdown)
+	coordinator.Add("event bus", cfg.NATS.FlushTimeout, func(ctx context.Context) error {
+		bus.Close()
+		select {
+		case <-published:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if observer != nil {
+		coordinator.Add("webhook", cfg.Webhook.Timeout, func(ctx context.Context) error {
+			select {
+			case <-observer.Done():
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+	coordinator.Add("nats drain", cfg.NATS.FlushTimeout, natsManager.Drain)
+	coordinator.Add("nats close", cfg.NATS.FlushTimeout, func(context.Context) error {
+		return natsManager.Close()
+	})
+
+	if err := srv.Start(coordinator); err != nil {
+		log.Printf("Shutdown error: %v", err)
+	}
+}
+
+// connectNATS connects to the configured NATS server, falling back to an in-process broker if allowed
+func connectNATS(cfg config.NATSConfig) (*natsManager.Manager, error) {
+	manager, err := natsManager.NewManager(cfg)
+	if err == nil || !cfg.AllowFallback {
+		return manager, err
+	}
+
+	log.Printf("WARNING: NATS unavailable (%v), falling back to an in-process broker. "+
+		"Edits will NOT be shared with other gateway instances.", err)
+	return natsManager.NewInProcessManager(cfg)
 }
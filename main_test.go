@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/nats-io/nats.go"
+)
+
+// unreachableNATS is the configuration of a NATS server nobody listens for
+func unreachableNATS(allowFallback bool) config.NATSConfig {
+	return config.NATSConfig{URL: "nats://127.0.0.1:1", Timeout: time.Second, AllowFallback: allowFallback}
+}
+
+func TestConnectNATSFailsWithoutFallback(t *testing.T) {
+	if manager, err := connectNATS(unreachableNATS(false)); err == nil {
+		manager.Close()
+		t.Fatal("connected to an unreachable NATS server")
+	}
+}
+
+func TestConnectNATSFallbackFansOutLocally(t *testing.T) {
+	manager, err := connectNATS(unreachableNATS(true))
+	if err != nil {
+		t.Fatalf("connectNATS failed despite the fallback: %v", err)
+	}
+	t.Cleanup(func() { manager.Close() })
+
+	received := make(chan *nats.Msg, 1)
+	if err := manager.Subscribe("doc1", func(msg *nats.Msg) { received <- msg }); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	event := publisher.DocumentEvent{DocumentID: "doc1", UserID: "alice", Payload: publisher.DocumentEventPayload{Action: "insert", Data: "hello"}}
+	if err := manager.PublishDocumentEvent(event); err != nil {
+		t.Fatalf("PublishDocumentEvent failed: %v", err)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("edit not fanned out by the fallback broker")
+	}
+}
@@ -0,0 +1,226 @@
+package metrics
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gateway"
+
+var (
+	compressedPayloadBytes atomic.Uint64
+	compressedWireBytes    atomic.Uint64
+
+	noopDeliveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "noop_deliveries_total",
+		Help:      "NATS messages received for documents with no local connections.",
+	})
+
+	lowPriorityDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "low_priority_dropped_total",
+		Help:      "Cursor and presence messages dropped to keep room for edits.",
+	})
+
+	overflowDrops = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "overflow_dropped_total",
+		Help:      "Document messages dropped for connections whose send buffer overflowed, under the drop_message policy.",
+	})
+
+	unsubscribeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "unsubscribe_failures_total",
+		Help:      "Document subscriptions that NATS failed to unsubscribe and are retried later.",
+	})
+
+	webhookDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "dropped_total",
+		Help:      "Document events not delivered to the webhook, by reason (queue_full, delivery_failed).",
+	}, []string{"reason"})
+
+	messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "messages_total",
+		Help:      "WebSocket data messages by direction (received, sent).",
+	}, []string{"direction"})
+
+	broadcastFanout = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "broadcast_fanout",
+		Help:      "Connections a document broadcast was delivered to.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000},
+	})
+
+	natsPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "messages_published_total",
+		Help:      "Document messages published to NATS.",
+	})
+
+	natsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "messages_received_total",
+		Help:      "Document messages received from NATS, duplicates included.",
+	})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Rejected JWT authentications by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		noopDeliveries,
+		messages,
+		broadcastFanout,
+		natsPublished,
+		natsReceived,
+		authFailures,
+		lowPriorityDrops,
+		overflowDrops,
+		unsubscribeFailures,
+		webhookDrops,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "websocket",
+			Name:      "compression_payload_bytes_total",
+			Help:      "Uncompressed payload bytes of outbound frames on compressed connections.",
+		}, func() float64 { return float64(compressedPayloadBytes.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "websocket",
+			Name:      "compression_wire_bytes_total",
+			Help:      "Bytes written to the network for outbound frames on compressed connections.",
+		}, func() float64 { return float64(compressedWireBytes.Load()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "websocket",
+			Name:      "compression_ratio",
+			Help:      "Average ratio of wire bytes to payload bytes for outbound compressed frames.",
+		}, compressionRatio),
+	)
+}
+
+// Handler returns the HTTP handler serving the Prometheus metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterBufferedMessages exposes the number of outbound messages queued across connections, as reported by count
+func RegisterBufferedMessages(count func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "buffered_messages",
+		Help:      "Outbound messages queued in the send buffers of all connections.",
+	}, func() float64 { return float64(count()) }))
+}
+
+// RegisterConnections exposes the number of open WebSocket connections, as reported by count
+func RegisterConnections(count func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "connections",
+		Help:      "Open WebSocket connections.",
+	}, func() float64 { return float64(count()) }))
+}
+
+// RegisterSubscriptions exposes the number of document subscriptions, as reported by count
+func RegisterSubscriptions(count func() int) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "subscriptions",
+		Help:      "Active NATS document subscriptions.",
+	}, func() float64 { return float64(count()) }))
+}
+
+// Message directions on the messages counter
+const (
+	DirectionReceived = "received"
+	DirectionSent     = "sent"
+)
+
+// IncMessage records a WebSocket data message received from or sent to a client
+func IncMessage(direction string) {
+	messages.WithLabelValues(direction).Inc()
+}
+
+// ObserveFanout records how many connections a document broadcast reached
+func ObserveFanout(connections int) {
+	broadcastFanout.Observe(float64(connections))
+}
+
+// IncNATSPublished records a document message published to NATS
+func IncNATSPublished() {
+	natsPublished.Inc()
+}
+
+// IncNATSReceived records a document message received from NATS
+func IncNATSReceived() {
+	natsReceived.Inc()
+}
+
+// ObserveCompressedWrite records an outbound frame written on a compressed connection
+func ObserveCompressedWrite(payloadBytes, wireBytes int) {
+	compressedPayloadBytes.Add(uint64(payloadBytes))
+	compressedWireBytes.Add(uint64(wireBytes))
+}
+
+// IncUnsubscribeFailure records a document subscription that NATS failed to unsubscribe
+func IncUnsubscribeFailure() {
+	unsubscribeFailures.Inc()
+}
+
+// IncWebhookDrop records a document event the webhook did not deliver
+func IncWebhookDrop(reason string) {
+	webhookDrops.WithLabelValues(reason).Inc()
+}
+
+// IncNoopDelivery records a NATS message that had no local connection to deliver to
+func IncNoopDelivery() {
+	noopDeliveries.Inc()
+}
+
+// IncAuthFailure records a rejected authentication
+func IncAuthFailure(reason string) {
+	authFailures.WithLabelValues(reason).Inc()
+}
+
+// IncLowPriorityDrop records a cursor or presence message dropped for a busy connection
+func IncLowPriorityDrop() {
+	lowPriorityDrops.Inc()
+}
+
+// IncOverflowDrop records a document message dropped for a connection whose send buffer overflowed
+func IncOverflowDrop() {
+	overflowDrops.Inc()
+}
+
+// compressionRatio returns the average wire/payload ratio, or 0 before any compressed write
+func compressionRatio() float64 {
+	payload := compressedPayloadBytes.Load()
+	if payload == 0 {
+		return 0
+	}
+	return float64(compressedWireBytes.Load()) / float64(payload)
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the series exposed by the metrics endpoint, keyed by name and labels
+func scrape(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the scrape: %v", err)
+	}
+
+	series := make(map[string]float64)
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("unparsable sample %q: %v", line, err)
+		}
+		series[line[:i]] = value
+	}
+	return series
+}
+
+func TestHandlerExposesMetrics(t *testing.T) {
+	RegisterConnections(func() int { return 3 })
+	RegisterSubscriptions(func() int { return 2 })
+	IncMessage(DirectionReceived)
+	IncMessage(DirectionSent)
+	ObserveFanout(4)
+
+	series := scrape(t)
+
+	for name, want := range map[string]float64{
+		"gateway_websocket_connections":                       3,
+		"gateway_nats_subscriptions":                          2,
+		"gateway_websocket_broadcast_fanout_bucket{le=\"5\"}": 1,
+	} {
+		if got, ok := series[name]; !ok || got < want {
+			t.Errorf("%s = %v (exposed %v), want %v", name, got, ok, want)
+		}
+	}
+	for _, name := range []string{
+		`gateway_websocket_messages_total{direction="received"}`,
+		`gateway_websocket_messages_total{direction="sent"}`,
+		"gateway_nats_messages_published_total",
+		"gateway_nats_messages_received_total",
+		"gateway_websocket_broadcast_fanout_count",
+	} {
+		if _, ok := series[name]; !ok {
+			t.Errorf("%s not exposed", name)
+		}
+	}
+}
+
+func TestCountersIncrement(t *testing.T) {
+	tests := []struct {
+		series string
+		inc    func()
+	}{
+		{`gateway_websocket_messages_total{direction="received"}`, func() { IncMessage(DirectionReceived) }},
+		{`gateway_websocket_messages_total{direction="sent"}`, func() { IncMessage(DirectionSent) }},
+		{"gateway_nats_messages_published_total", IncNATSPublished},
+		{"gateway_nats_messages_received_total", IncNATSReceived},
+	}
+	for _, tt := range tests {
+		t.Run(tt.series, func(t *testing.T) {
+			before := scrape(t)[tt.series]
+			tt.inc()
+			if after := scrape(t)[tt.series]; after != before+1 {
+				t.Errorf("%s went from %v to %v, want an increment of 1", tt.series, before, after)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+)
+
+// maxCachedTokens bounds the authentication cache; new tokens aren't cached while it is full
+const maxCachedTokens = 10000
+
+// tokenCache remembers the claims of recently validated tokens, so clients reconnecting with the
+// same token skip signature verification. Only successful validations are cached.
+type tokenCache struct {
+	ttl     time.Duration
+	entries map[string]cachedToken
+	mutex   sync.Mutex
+}
+
+// cachedToken holds validated claims until expires
+type cachedToken struct {
+	claims  *Claims
+	expires time.Time
+}
+
+var (
+	authCache     *tokenCache
+	authCacheOnce sync.Once
+)
+
+// newTokenCache creates a cache keeping validations for at most ttl
+func newTokenCache(ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedToken),
+	}
+}
+
+// get returns the cached claims of a token, if they haven't expired
+func (c *tokenCache) get(token string, now time.Time) (*Claims, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[token]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(entry.expires) {
+		delete(c.entries, token)
+		return nil, false
+	}
+	return entry.claims, true
+}
+
+// put caches the claims of a validated token. The entry lives for the cache TTL but never more than
+// half the token's remaining lifetime, so an expiring token is always revalidated well before it expires.
+func (c *tokenCache) put(token string, claims *Claims, now time.Time) {
+	expires := now.Add(c.ttl)
+	if claims.ExpiresAt != nil {
+		if limit := now.Add(claims.ExpiresAt.Sub(now) / 2); limit.Before(expires) {
+			expires = limit
+		}
+	}
+	if !now.Before(expires) {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.entries) >= maxCachedTokens {
+		c.purgeExpired(now)
+		if len(c.entries) >= maxCachedTokens {
+			return
+		}
+	}
+	c.entries[token] = cachedToken{claims: claims, expires: expires}
+}
+
+// purgeExpired drops expired entries. The caller must hold c.mutex.
+func (c *tokenCache) purgeExpired(now time.Time) {
+	for token, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, token)
+		}
+	}
+}
+
+// invalidate drops the entries matching a predicate and returns how many were dropped
+func (c *tokenCache) invalidate(match func(token string, claims *Claims) bool) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	dropped := 0
+	for token, entry := range c.entries {
+		if match(token, entry.claims) {
+			delete(c.entries, token)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// tokenCacheFor returns the shared authentication cache, or nil when caching is disabled
+func tokenCacheFor(ttl time.Duration) *tokenCache {
+	authCacheOnce.Do(func() {
+		if ttl > 0 {
+			authCache = newTokenCache(ttl)
+		}
+	})
+	return authCache
+}
+
+// InvalidateToken drops a token from the authentication cache, so its next use is validated again.
+// Use RevokeToken to also reject it.
+func InvalidateToken(token string) {
+	cache := tokenCacheFor(config.Load().JWT.CacheTTL)
+	if cache == nil {
+		return
+	}
+	cache.invalidate(func(cached string, _ *Claims) bool { return cached == token })
+}
+
+// InvalidateSubject drops every cached token of a subject, for when all of a user's tokens are revoked.
+// It returns the number of tokens dropped.
+func InvalidateSubject(subject string) int {
+	cache := tokenCacheFor(config.Load().JWT.CacheTTL)
+	if cache == nil {
+		return 0
+	}
+	return cache.invalidate(func(_ string, claims *Claims) bool { return claims.Subject == subject })
+}
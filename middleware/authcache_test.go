@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// enableAuthCache makes AuthJWT use a fresh cache for the rest of the test
+func enableAuthCache(t *testing.T, ttl time.Duration) *tokenCache {
+	authCacheOnce.Do(func() {})
+	authCache = newTokenCache(ttl)
+	t.Cleanup(func() { authCache = nil })
+	return authCache
+}
+
+func TestTokenCacheHit(t *testing.T) {
+	cache := newTokenCache(time.Minute)
+	now := time.Now()
+	claims := userClaims(now.Add(time.Hour))
+
+	if _, ok := cache.get("token", now); ok {
+		t.Fatal("an empty cache returned claims")
+	}
+	cache.put("token", &claims, now)
+	if got, ok := cache.get("token", now.Add(30*time.Second)); !ok || got != &claims {
+		t.Errorf("get = %v, %v; want the cached claims", got, ok)
+	}
+}
+
+func TestTokenCacheEntriesExpire(t *testing.T) {
+	cache := newTokenCache(time.Minute)
+	now := time.Now()
+	claims := userClaims(now.Add(time.Hour))
+	cache.put("token", &claims, now)
+
+	if _, ok := cache.get("token", now.Add(time.Minute)); ok {
+		t.Error("an entry older than the TTL was returned")
+	}
+	if len(cache.entries) != 0 {
+		t.Error("the expired entry was kept")
+	}
+}
+
+func TestTokenCacheBoundedByTokenExpiry(t *testing.T) {
+	cache := newTokenCache(time.Hour)
+	now := time.Now()
+	expiring := userClaims(now.Add(10 * time.Minute))
+	cache.put("token", &expiring, now)
+
+	if _, ok := cache.get("token", now.Add(4*time.Minute)); !ok {
+		t.Error("entry dropped before half the token lifetime")
+	}
+	if _, ok := cache.get("token", now.Add(5*time.Minute)); ok {
+		t.Error("entry kept past half the token lifetime")
+	}
+
+	expired := userClaims(now.Add(-time.Second))
+	cache.put("expired", &expired, now)
+	if _, ok := cache.get("expired", now); ok {
+		t.Error("an expired token was cached")
+	}
+}
+
+func TestTokenCacheInvalidate(t *testing.T) {
+	cache := newTokenCache(time.Minute)
+	now := time.Now()
+	alice, bob := userClaims(now.Add(time.Hour)), userClaims(now.Add(time.Hour))
+	bob.Subject = "bob"
+	cache.put("alice-1", &alice, now)
+	cache.put("alice-2", &alice, now)
+	cache.put("bob-1", &bob, now)
+
+	if dropped := cache.invalidate(func(_ string, claims *Claims) bool { return claims.Subject == "alice" }); dropped != 2 {
+		t.Errorf("dropped %d entries, want alice's 2", dropped)
+	}
+	if _, ok := cache.get("bob-1", now); !ok {
+		t.Error("bob's token was dropped")
+	}
+}
+
+func TestAuthJWTUsesTheCache(t *testing.T) {
+	cache := enableAuthCache(t, time.Minute)
+	token := signedToken(t, userClaims(time.Now().Add(time.Hour)), "")
+
+	if status := authenticate(token); status != http.StatusOK {
+		t.Fatalf("status = %d, want %d", status, http.StatusOK)
+	}
+	if _, ok := cache.get(token, time.Now()); !ok {
+		t.Error("the validated token was not cached")
+	}
+
+	// A cached entry is trusted without validating the token again
+	claims := Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}}
+	cache.put("not-a-jwt", &claims, time.Now())
+	if status := authenticate("not-a-jwt"); status != http.StatusOK {
+		t.Errorf("cached token: status = %d, want %d", status, http.StatusOK)
+	}
+
+	InvalidateToken("not-a-jwt")
+	if status := authenticate("not-a-jwt"); status != http.StatusUnauthorized {
+		t.Errorf("revoked token: status = %d, want %d", status, http.StatusUnauthorized)
+	}
+	if dropped := InvalidateSubject("alice"); dropped != 1 {
+		t.Errorf("InvalidateSubject dropped %d tokens, want 1", dropped)
+	}
+}
+
+func TestAuthJWTDoesNotCacheFailures(t *testing.T) {
+	cache := enableAuthCache(t, time.Minute)
+	token := signedToken(t, userClaims(time.Now().Add(time.Hour)), "another-secret")
+
+	authenticate(token)
+	if _, ok := cache.get(token, time.Now()); ok {
+		t.Error("a rejected token was cached")
+	}
+}
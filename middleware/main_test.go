@@ -0,0 +1,13 @@
+package middleware
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain names the display claim. The configuration is loaded once per process, so it is set
+// before any test runs.
+func TestMain(m *testing.M) {
+	os.Setenv("JWT_DISPLAY_CLAIM", "name")
+	os.Exit(m.Run())
+}
@@ -3,13 +3,18 @@ package middleware
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/emaforlin/ce-realtime-gateway/clock"
 	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/logging"
+	"github.com/emaforlin/ce-realtime-gateway/metrics"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -19,8 +24,32 @@ type contextKey string
 const (
 	UserIDKey contextKey = "userID"
 	IssuerKey contextKey = "issuer"
+	ScopesKey contextKey = "scopes"
+	// TokenExpiryKey holds the expiry of the request's token, when it has one
+	TokenExpiryKey contextKey = "tokenExpiry"
+	// DocumentClaimKey holds the document the request's token is issued for, when it names one
+	DocumentClaimKey contextKey = "documentClaim"
+	// DisplayNameKey holds the human-readable identity taken from the configured display claim
+	DisplayNameKey contextKey = "displayName"
 )
 
+// ScopeAdmin grants access to administrative details and operations
+const ScopeAdmin = "admin"
+
+// ScopeService marks backend services that publish events over WebSocket but never receive broadcasts
+const ScopeService = "service"
+
+// Claims are the JWT claims accepted by the gateway
+type Claims struct {
+	jwt.RegisteredClaims
+	// Scope is a space-separated list of granted scopes
+	Scope string `json:"scope,omitempty"`
+	// DocumentID names the document the token is issued for, used by the claim document ID source
+	DocumentID string `json:"document_id,omitempty"`
+	// DisplayName is the value of the configured display claim, extracted after validation
+	DisplayName string `json:"-"`
+}
+
 // GetUserID extracts the user ID from the request context
 func GetUserID(r *http.Request) (string, bool) {
 	userID, ok := r.Context().Value(UserIDKey).(string)
@@ -33,54 +62,164 @@ func GetIssuer(r *http.Request) (string, bool) {
 	return issuer, ok
 }
 
+// GetTokenExpiry returns when the authenticated token of the request expires
+func GetTokenExpiry(r *http.Request) (time.Time, bool) {
+	expiresAt, ok := r.Context().Value(TokenExpiryKey).(time.Time)
+	return expiresAt, ok
+}
+
+// GetDocumentClaim returns the document named by the request's token
+func GetDocumentClaim(r *http.Request) (string, bool) {
+	documentID, ok := r.Context().Value(DocumentClaimKey).(string)
+	return documentID, ok
+}
+
+// GetDisplayName returns the human-readable identity of the request's user, when the token carries one
+func GetDisplayName(r *http.Request) (string, bool) {
+	displayName, ok := r.Context().Value(DisplayNameKey).(string)
+	return displayName, ok
+}
+
+// displayClaim returns the string value of a claim of an already validated token, "" if absent
+func displayClaim(tokenStr, claim string) string {
+	var values jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenStr, &values); err != nil {
+		return ""
+	}
+	value, _ := values[claim].(string)
+	return value
+}
+
+// HasScope reports whether the authenticated token of the request was granted the given scope
+func HasScope(r *http.Request, scope string) bool {
+	scopes, _ := r.Context().Value(ScopesKey).([]string)
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authLog logs rejected authentications
+var authLog = logging.For(logging.CategoryAuth)
+
+// Reasons an authentication is rejected, as reported on the auth failure metric
+const (
+	authFailureMissingToken     = "missing_token"
+	authFailureInvalidSignature = "invalid_signature"
+	authFailureExpired          = "expired"
+	authFailureBadIssuer        = "bad_issuer"
+	authFailureBadClaims        = "bad_claims"
+	authFailureRevoked          = "revoked"
+)
+
+// authFailureReason classifies a token validation error
+func authFailureReason(err error) string {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired), errors.Is(err, jwt.ErrTokenNotValidYet):
+		return authFailureExpired
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return authFailureInvalidSignature
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return authFailureBadIssuer
+	default:
+		return authFailureBadClaims
+	}
+}
+
 // AuthJWT is a middleware to authenticate request via validating JWT tokens
 func AuthJWT(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenStr := r.URL.Query().Get("token")
+		jwtConfig := config.Load().JWT
+		tokenStr := tokenFromRequest(r, jwtConfig.TokenSources)
 
 		// Check if token is provided
 		if tokenStr == "" {
-			http.Error(w, "Missing token parameter", http.StatusUnauthorized)
+			metrics.IncAuthFailure(authFailureMissingToken)
+			http.Error(w, "Missing token", http.StatusUnauthorized)
 			return
 		}
 
-		// Parse and validate token
-		token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-			}
-			return []byte(config.Load().JWT.SecretKey), nil
-		})
-
-		if err != nil {
-			log.Printf("JWT validation error: %v", err)
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		if revokedTokens.revoked(tokenStr, time.Now()) {
+			authLog.Warnf("Rejected revoked token")
+			metrics.IncAuthFailure(authFailureRevoked)
+			http.Error(w, "Revoked token", http.StatusUnauthorized)
 			return
 		}
 
-		// Check if token is valid and extract claims
-		if claims, ok := token.Claims.(*jwt.RegisteredClaims); ok && token.Valid {
-			sub, err := claims.GetSubject()
+		cache := tokenCacheFor(jwtConfig.CacheTTL)
+
+		claims, cached := (*Claims)(nil), false
+		if cache != nil {
+			claims, cached = cache.get(tokenStr, time.Now())
+		}
+
+		if !cached {
+			// Parse and validate token, tolerating small clock differences on exp/nbf; an empty
+			// configured issuer accepts any
+			token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(t *jwt.Token) (interface{}, error) {
+				if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+				}
+				return []byte(jwtConfig.SecretKey), nil
+			}, jwt.WithLeeway(jwtConfig.ClockSkew), jwt.WithIssuer(jwtConfig.Issuer))
+
 			if err != nil {
-				log.Printf("Failed to get subject from token: %v", err)
+				authLog.Warnf("JWT validation error: %v", err)
+				metrics.IncAuthFailure(authFailureReason(err))
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			// Check if token is valid and extract claims
+			var ok bool
+			claims, ok = token.Claims.(*Claims)
+			if !ok || !token.Valid {
+				authLog.Warnf("Invalid token or claims")
+				metrics.IncAuthFailure(authFailureBadClaims)
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			if _, err := claims.GetSubject(); err != nil {
+				authLog.Warnf("Failed to get subject from token: %v", err)
+				metrics.IncAuthFailure(authFailureBadClaims)
 				http.Error(w, "Invalid token claims", http.StatusUnauthorized)
 				return
 			}
 
-			// Store user info in request context for downstream handlers
-			ctx := r.Context()
-			ctx = context.WithValue(ctx, UserIDKey, sub)
-			if claims.Issuer != "" {
-				ctx = context.WithValue(ctx, IssuerKey, claims.Issuer)
+			// sub stays the key; the display claim only names the user for people
+			if jwtConfig.DisplayClaim != "" {
+				claims.DisplayName = displayClaim(tokenStr, jwtConfig.DisplayClaim)
 			}
-			r = r.WithContext(ctx)
 
-			next.ServeHTTP(w, r)
-		} else {
-			log.Printf("Invalid token or claims")
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
+			if cache != nil {
+				cache.put(tokenStr, claims, time.Now())
+			}
+		}
+
+		// Store user info in request context for downstream handlers
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, UserIDKey, claims.Subject)
+		if claims.Issuer != "" {
+			ctx = context.WithValue(ctx, IssuerKey, claims.Issuer)
+		}
+		if claims.Scope != "" {
+			ctx = context.WithValue(ctx, ScopesKey, strings.Fields(claims.Scope))
+		}
+		if claims.ExpiresAt != nil {
+			ctx = context.WithValue(ctx, TokenExpiryKey, claims.ExpiresAt.Time)
+		}
+		if claims.DocumentID != "" {
+			ctx = context.WithValue(ctx, DocumentClaimKey, claims.DocumentID)
 		}
+		if claims.DisplayName != "" {
+			ctx = context.WithValue(ctx, DisplayNameKey, claims.DisplayName)
+		}
+		r = r.WithContext(ctx)
+
+		next.ServeHTTP(w, r)
 	}
 }
 
@@ -159,7 +298,7 @@ func Recovery(next http.HandlerFunc) http.HandlerFunc {
 }
 
 // RateLimiter creates a simple rate limiting middleware
-func RateLimiter(requests int, window time.Duration) func(http.HandlerFunc) http.HandlerFunc {
+func RateLimiter(requests int, window time.Duration, clk clock.Clock) func(http.HandlerFunc) http.HandlerFunc {
 	type client struct {
 		count    int
 		lastSeen time.Time
@@ -170,7 +309,7 @@ func RateLimiter(requests int, window time.Duration) func(http.HandlerFunc) http
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			ip := r.RemoteAddr
-			now := time.Now()
+			now := clk.Now()
 
 			if c, exists := clients[ip]; exists {
 				if now.Sub(c.lastSeen) > window {
@@ -196,6 +335,22 @@ func RateLimiter(requests int, window time.Duration) func(http.HandlerFunc) http
 	}
 }
 
+// MaxBodyBytes rejects requests whose body exceeds limit bytes with 413 Request Entity Too Large.
+// Bodies without a declared length are capped with http.MaxBytesReader, so reads past the limit fail.
+func MaxBodyBytes(limit int64) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
 // Chain combines multiple middlewares
 func Chain(middlewares ...func(http.HandlerFunc) http.HandlerFunc) func(http.HandlerFunc) http.HandlerFunc {
 	return func(final http.HandlerFunc) http.HandlerFunc {
@@ -210,17 +365,42 @@ func Chain(middlewares ...func(http.HandlerFunc) http.HandlerFunc) func(http.Han
 type responseWrapper struct {
 	http.ResponseWriter
 	statusCode int
+	// wroteHeader and hijacked guard against writes the underlying writer would reject
+	wroteHeader bool
+	hijacked    bool
 }
 
+// WriteHeader records the status code, ignoring calls after the header was sent or the connection hijacked
 func (w *responseWrapper) WriteHeader(statusCode int) {
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+	w.wroteHeader = true
 	w.statusCode = statusCode
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
+// Write writes the body, failing cleanly once the connection has been hijacked
+func (w *responseWrapper) Write(b []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
 // Hijack implements http.Hijacker interface for WebSocket support
 func (w *responseWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
-		return hijacker.Hijack()
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.Hijacker interface not supported")
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err == nil {
+		// The upgrade response is written on the raw connection, log it as such
+		w.hijacked = true
+		w.statusCode = http.StatusSwitchingProtocols
 	}
-	return nil, nil, fmt.Errorf("http.Hijacker interface not supported")
+	return conn, brw, err
 }
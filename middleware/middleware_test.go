@@ -0,0 +1,280 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/clock"
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signedToken signs claims with the configured secret, or with secret when it is set
+func signedToken(t *testing.T, claims Claims, secret string) string {
+	t.Helper()
+
+	if secret == "" {
+		secret = config.Load().JWT.SecretKey
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+// userClaims returns the claims of a token for alice from the configured issuer expiring at expiresAt
+func userClaims(expiresAt time.Time) Claims {
+	return Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "alice",
+		Issuer:    config.Load().JWT.Issuer,
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}}
+}
+
+// foreignClaims returns the claims of a valid token for alice from another issuer
+func foreignClaims() Claims {
+	claims := userClaims(time.Now().Add(time.Hour))
+	claims.Issuer = "someone-else"
+	return claims
+}
+
+func TestAuthFailureReason(t *testing.T) {
+	keyFunc := func(*jwt.Token) (interface{}, error) { return []byte(config.Load().JWT.SecretKey), nil }
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"expired", signedToken(t, userClaims(time.Now().Add(-time.Hour)), ""), authFailureExpired},
+		{"wrong secret", signedToken(t, userClaims(time.Now().Add(time.Hour)), "another-secret"), authFailureInvalidSignature},
+		{"wrong issuer", signedToken(t, foreignClaims(), ""), authFailureBadIssuer},
+		{"malformed", "not-a-token", authFailureBadClaims},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := jwt.ParseWithClaims(tt.token, &Claims{}, keyFunc, jwt.WithIssuer(config.Load().JWT.Issuer))
+			if err == nil {
+				t.Fatal("token was accepted")
+			}
+			if got := authFailureReason(err); got != tt.want {
+				t.Errorf("reason = %q, want %q (error: %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestAuthJWTRejectsInvalidTokens(t *testing.T) {
+	for name, token := range map[string]string{
+		"expired":      signedToken(t, userClaims(time.Now().Add(-time.Hour)), ""),
+		"wrong secret": signedToken(t, userClaims(time.Now().Add(time.Hour)), "another-secret"),
+		"wrong issuer": signedToken(t, foreignClaims(), ""),
+		"no issuer":    signedToken(t, Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "alice"}}, ""),
+	} {
+		if status := authenticate(token); status != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d", name, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+// authenticate runs a request bearing token through AuthJWT, returning the response status
+func authenticate(token string) int {
+	handler := AuthJWT(func(w http.ResponseWriter, r *http.Request) {})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestAuthJWTToleratesClockSkew(t *testing.T) {
+	skew := config.Load().JWT.ClockSkew
+
+	if status := authenticate(signedToken(t, userClaims(time.Now().Add(-skew/2)), "")); status != http.StatusOK {
+		t.Errorf("token expired within the clock skew: status = %d, want %d", status, http.StatusOK)
+	}
+	if status := authenticate(signedToken(t, userClaims(time.Now().Add(-2*skew)), "")); status != http.StatusUnauthorized {
+		t.Errorf("token expired beyond the clock skew: status = %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	notYetValid := userClaims(time.Now().Add(time.Hour))
+	notYetValid.NotBefore = jwt.NewNumericDate(time.Now().Add(skew / 2))
+	if status := authenticate(signedToken(t, notYetValid, "")); status != http.StatusOK {
+		t.Errorf("token valid within the clock skew: status = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestRateLimiterWindow(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	handler := RateLimiter(2, time.Minute, clk)(func(w http.ResponseWriter, r *http.Request) {})
+	request := func() int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := request(); status != http.StatusOK {
+			t.Fatalf("request %d within the limit: status = %d", i+1, status)
+		}
+	}
+	if status := request(); status != http.StatusTooManyRequests {
+		t.Errorf("request over the limit: status = %d, want %d", status, http.StatusTooManyRequests)
+	}
+
+	clk.Advance(time.Minute + time.Second)
+	if status := request(); status != http.StatusOK {
+		t.Errorf("request in a new window: status = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	handler := MaxBodyBytes(8)(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if !errors.As(err, &tooLarge) {
+				t.Errorf("reading the body failed with %v, want a MaxBytesError", err)
+			}
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	tests := []struct {
+		name string
+		body io.Reader
+		want int
+	}{
+		{"under the limit", strings.NewReader("{}"), http.StatusOK},
+		{"at the limit", strings.NewReader("12345678"), http.StatusOK},
+		{"declared over the limit", strings.NewReader("123456789"), http.StatusRequestEntityTooLarge},
+		{"streamed over the limit", io.MultiReader(strings.NewReader("12345"), strings.NewReader("6789")), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodPost, "/admin/broadcast", tt.body))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerAfterHijack(t *testing.T) {
+	var writeErr error
+	handler := Logger(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		brw.Flush()
+
+		// An error path still writing a response must not reach the hijacked writer
+		w.WriteHeader(http.StatusInternalServerError)
+		_, writeErr = w.Write([]byte("too late"))
+	})
+	var serverLog bytes.Buffer
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.ErrorLog = log.New(&serverLog, "", 0)
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("failed to send the request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	server.Close()
+
+	if !errors.Is(writeErr, http.ErrHijacked) {
+		t.Errorf("Write after hijack = %v, want ErrHijacked", writeErr)
+	}
+	if serverLog.Len() > 0 {
+		t.Errorf("server logged warnings: %s", serverLog.String())
+	}
+}
+
+func TestLoggerIgnoresSuperfluousWriteHeader(t *testing.T) {
+	var serverLog bytes.Buffer
+	server := httptest.NewUnstartedServer(Logger(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	server.Config.ErrorLog = log.New(&serverLog, "", 0)
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("status = %d, want the first one, %d", resp.StatusCode, http.StatusAccepted)
+	}
+	server.Close()
+
+	if serverLog.Len() > 0 {
+		t.Errorf("server logged warnings: %s", serverLog.String())
+	}
+}
+
+func TestAuthJWTExtractsDisplayClaim(t *testing.T) {
+	var userID, displayName string
+	var named bool
+	handler := AuthJWT(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ = GetUserID(r)
+		displayName, named = GetDisplayName(r)
+	})
+	request := func(claims jwt.MapClaims) {
+		t.Helper()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.Load().JWT.SecretKey))
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	expiresAt := time.Now().Add(time.Hour).Unix()
+
+	request(jwt.MapClaims{"sub": "u-42", "iss": config.Load().JWT.Issuer, "name": "Alice Liddell", "exp": expiresAt})
+	if userID != "u-42" || displayName != "Alice Liddell" {
+		t.Errorf("user %q named %q, want u-42 named Alice Liddell", userID, displayName)
+	}
+
+	request(jwt.MapClaims{"sub": "u-43", "iss": config.Load().JWT.Issuer, "email": "bob@example.com", "exp": expiresAt})
+	if userID != "u-43" || named {
+		t.Errorf("user %q named %q, want u-43 without a display name", userID, displayName)
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// revocationList holds revoked tokens until they would have expired anyway
+type revocationList struct {
+	tokens map[string]time.Time
+	mutex  sync.Mutex
+}
+
+// revokedTokens is the revocation list shared by every request
+var revokedTokens = &revocationList{tokens: make(map[string]time.Time)}
+
+// revoke records a token as revoked until expires, dropping the entries that have expired
+func (l *revocationList) revoke(token string, expires, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for revoked, until := range l.tokens {
+		if !now.Before(until) {
+			delete(l.tokens, revoked)
+		}
+	}
+	l.tokens[token] = expires
+}
+
+// revoked reports whether a token was revoked
+func (l *revocationList) revoked(token string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	until, ok := l.tokens[token]
+	return ok && now.Before(until)
+}
+
+// RevokeToken rejects a token on every later request, cached or not. The token is kept on the
+// revocation list until it expires, tolerating the clock skew; a token without a readable expiry
+// is kept for the configured token duration.
+func RevokeToken(token string) {
+	jwtConfig := config.Load().JWT
+	now := time.Now()
+
+	expires := now.Add(jwtConfig.TokenDuration)
+	var claims Claims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err == nil && claims.ExpiresAt != nil {
+		expires = claims.ExpiresAt.Add(jwtConfig.ClockSkew)
+	}
+
+	revokedTokens.revoke(token, expires, now)
+	InvalidateToken(token)
+}
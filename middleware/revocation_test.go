@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRevokedTokenRejectedOnNextUse(t *testing.T) {
+	cache := enableAuthCache(t, time.Minute)
+	// The token ID tells it apart from the identical tokens other tests sign in the same second
+	claims := userClaims(time.Now().Add(time.Hour))
+	claims.ID = "revoked"
+	revoked := signedToken(t, claims, "")
+	other := signedToken(t, userClaims(time.Now().Add(2*time.Hour)), "")
+
+	for _, token := range []string{revoked, other} {
+		if status := authenticate(token); status != http.StatusOK {
+			t.Fatalf("status = %d, want %d", status, http.StatusOK)
+		}
+	}
+
+	RevokeToken(revoked)
+	if _, ok := cache.get(revoked, time.Now()); ok {
+		t.Error("the revoked token is still cached")
+	}
+	if status := authenticate(revoked); status != http.StatusUnauthorized {
+		t.Errorf("revoked token: status = %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := authenticate(other); status != http.StatusOK {
+		t.Errorf("other token: status = %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestRevocationLastsUntilExpiry(t *testing.T) {
+	list := &revocationList{tokens: make(map[string]time.Time)}
+	now := time.Now()
+
+	list.revoke("expiring", now.Add(time.Minute), now)
+	if !list.revoked("expiring", now) {
+		t.Fatal("the token was not revoked")
+	}
+	if list.revoked("expiring", now.Add(time.Minute)) {
+		t.Error("the token is still revoked once it expired")
+	}
+
+	list.revoke("other", now.Add(time.Hour), now.Add(time.Minute))
+	if _, kept := list.tokens["expiring"]; kept {
+		t.Error("the expired revocation was kept")
+	}
+}
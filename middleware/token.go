@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Places a request may carry its JWT, as listed in JWT_TOKEN_SOURCES
+const (
+	// TokenSourceHeader reads "Authorization: Bearer <token>"
+	TokenSourceHeader = "header"
+	// TokenSourceSubprotocol reads the WebSocket subprotocols "access_token, <token>", for browser
+	// clients that can't set headers
+	TokenSourceSubprotocol = "subprotocol"
+	// TokenSourceQuery reads ?token=, which ends up in access logs and proxies
+	TokenSourceQuery = "query"
+)
+
+// TokenSubprotocol is the subprotocol announcing that the next one offered is the token. The
+// upgrader must select it, as browsers fail a handshake that selects none of their subprotocols.
+const TokenSubprotocol = "access_token"
+
+// tokenFromRequest returns the token found in the first of the sources that has one, "" if none does
+func tokenFromRequest(r *http.Request, sources []string) string {
+	for _, source := range sources {
+		var token string
+		switch source {
+		case TokenSourceHeader:
+			scheme, credentials, found := strings.Cut(r.Header.Get("Authorization"), " ")
+			if found && strings.EqualFold(scheme, "Bearer") {
+				token = strings.TrimSpace(credentials)
+			}
+		case TokenSourceSubprotocol:
+			token = subprotocolToken(r)
+		case TokenSourceQuery:
+			token = r.URL.Query().Get("token")
+		}
+		if token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// subprotocolToken returns the subprotocol following TokenSubprotocol in the offered ones
+func subprotocolToken(r *http.Request) string {
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == TokenSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+// AcceptsTokenSubprotocol reports whether the sources include the WebSocket subprotocol
+func AcceptsTokenSubprotocol(sources []string) bool {
+	for _, source := range sources {
+		if source == TokenSourceSubprotocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// allSources lists every token source, in the default priority order
+var allSources = []string{TokenSourceHeader, TokenSourceSubprotocol, TokenSourceQuery}
+
+// tokenRequest returns a request carrying token in the given source, or none when source is empty
+func tokenRequest(source, token string) *http.Request {
+	target := "/ws/document/doc1"
+	if source == TokenSourceQuery {
+		target += "?token=" + token
+	}
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	switch source {
+	case TokenSourceHeader:
+		r.Header.Set("Authorization", "Bearer "+token)
+	case TokenSourceSubprotocol:
+		r.Header.Set("Sec-WebSocket-Protocol", "collab.v1, "+TokenSubprotocol+", "+token)
+	}
+	return r
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	withHeader := func(name, value string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/ws/document/doc1?token=from-query", nil)
+		r.Header.Set(name, value)
+		return r
+	}
+	tests := []struct {
+		name    string
+		r       *http.Request
+		sources []string
+		want    string
+	}{
+		{"header", tokenRequest(TokenSourceHeader, "t1"), allSources, "t1"},
+		{"subprotocol", tokenRequest(TokenSourceSubprotocol, "t2"), allSources, "t2"},
+		{"query", tokenRequest(TokenSourceQuery, "t3"), allSources, "t3"},
+		{"none", tokenRequest("", ""), allSources, ""},
+		{"lowercase bearer", withHeader("Authorization", "bearer t4"), allSources, "t4"},
+		{"other scheme skipped", withHeader("Authorization", "Basic dXNlcg=="), allSources, "from-query"},
+		{"subprotocol without token", withHeader("Sec-WebSocket-Protocol", TokenSubprotocol), allSources, "from-query"},
+		{"header before query", withHeader("Authorization", "Bearer t5"), allSources, "t5"},
+		{"priority follows the sources", withHeader("Authorization", "Bearer t5"), []string{TokenSourceQuery, TokenSourceHeader}, "from-query"},
+		{"unlisted source ignored", tokenRequest(TokenSourceQuery, "t6"), []string{TokenSourceHeader}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenFromRequest(tt.r, tt.sources); got != tt.want {
+				t.Errorf("tokenFromRequest = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthJWTReadsEveryTokenSource(t *testing.T) {
+	token := signedToken(t, userClaims(time.Now().Add(time.Hour)), "")
+	for _, source := range allSources {
+		t.Run(source, func(t *testing.T) {
+			var userID string
+			handler := AuthJWT(func(w http.ResponseWriter, r *http.Request) { userID, _ = GetUserID(r) })
+
+			w := httptest.NewRecorder()
+			handler(w, tokenRequest(source, token))
+
+			if w.Code != http.StatusOK || userID != "alice" {
+				t.Errorf("status %d for user %q, want alice authenticated", w.Code, userID)
+			}
+		})
+	}
+}
+
+func TestAuthJWTWithoutToken(t *testing.T) {
+	handler := AuthJWT(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called without a token")
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, tokenRequest("", ""))
+
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Missing token") {
+		t.Errorf("response = %d %q, want 401 Missing token", w.Code, w.Body)
+	}
+}
+
+func TestAcceptsTokenSubprotocol(t *testing.T) {
+	if !AcceptsTokenSubprotocol(allSources) {
+		t.Error("the subprotocol source was not recognized")
+	}
+	if AcceptsTokenSubprotocol([]string{TokenSourceHeader, TokenSourceQuery}) {
+		t.Error("sources without the subprotocol reported accepting it")
+	}
+}
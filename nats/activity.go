@@ -0,0 +1,84 @@
+package nats
+
+import (
+	"math"
+	"time"
+)
+
+// activityHalfLife is how long it takes the edit rate of a document to halve once edits stop
+const activityHalfLife = time.Minute
+
+// Activity describes how busy a subscribed document is
+type Activity struct {
+	// LastEdit is when the latest edit was received, nil if there was none since subscribing
+	LastEdit *time.Time `json:"last_edit,omitempty"`
+	// EditRate is the recent number of edits per minute, decaying towards 0 when the document goes quiet
+	EditRate float64 `json:"edit_rate"`
+}
+
+// activity tracks the edits of a subscription as an exponentially decaying count
+type activity struct {
+	lastEdit  time.Time
+	score     float64
+	updatedAt time.Time
+}
+
+// record counts an edit received at now
+func (a *activity) record(now time.Time) {
+	a.score = a.decayed(now) + 1
+	a.updatedAt = now
+	a.lastEdit = now
+}
+
+// decayed returns the edit count as of now, older edits weighing less
+func (a *activity) decayed(now time.Time) float64 {
+	if a.score == 0 {
+		return 0
+	}
+	elapsed := now.Sub(a.updatedAt)
+	if elapsed <= 0 {
+		return a.score
+	}
+	return a.score * math.Exp2(-float64(elapsed)/float64(activityHalfLife))
+}
+
+// rate converts the decayed count into edits per minute: a steady rate r keeps the count at r*halfLife/ln 2
+func (a *activity) rate(now time.Time) float64 {
+	return a.decayed(now) * math.Ln2 / activityHalfLife.Minutes()
+}
+
+// snapshot returns the activity as of now
+func (a *activity) snapshot(now time.Time) Activity {
+	result := Activity{EditRate: a.rate(now)}
+	if !a.lastEdit.IsZero() {
+		lastEdit := a.lastEdit
+		result.LastEdit = &lastEdit
+	}
+	return result
+}
+
+// RecordEdit counts an edit on a subscribed document towards its activity; unsubscribed documents are ignored
+func (m *Manager) RecordEdit(documentID string) {
+	m.mutex.RLock()
+	docSub, exists := m.subscriptions[documentID]
+	m.mutex.RUnlock()
+	if !exists {
+		return
+	}
+
+	docSub.mutex.Lock()
+	docSub.activity.record(time.Now())
+	docSub.mutex.Unlock()
+}
+
+// documentActivity returns the activity of every subscribed document. The caller must hold m.mutex.
+func (m *Manager) documentActivity() map[string]Activity {
+	now := time.Now()
+	result := make(map[string]Activity, len(m.subscriptions))
+	for documentID, docSub := range m.subscriptions {
+		docSub.mutex.RLock()
+		result[documentID] = docSub.activity.snapshot(now)
+		docSub.mutex.RUnlock()
+	}
+	return result
+}
@@ -0,0 +1,106 @@
+package nats
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+)
+
+func TestActivityDecaysWhenIdle(t *testing.T) {
+	var a activity
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		a.record(start)
+	}
+
+	busy := a.rate(start)
+	if busy <= 0 {
+		t.Fatalf("rate after 10 edits = %v, want it positive", busy)
+	}
+	if got := a.rate(start.Add(activityHalfLife)); math.Abs(got-busy/2) > 1e-9 {
+		t.Errorf("rate after one half-life = %v, want %v", got, busy/2)
+	}
+	if got := a.rate(start.Add(20 * activityHalfLife)); got > busy/1e5 {
+		t.Errorf("rate after a long idle spell = %v, want it close to 0", got)
+	}
+
+	snapshot := a.snapshot(start.Add(time.Hour))
+	if snapshot.LastEdit == nil || !snapshot.LastEdit.Equal(start) {
+		t.Errorf("last edit = %v, want %v whatever the decay", snapshot.LastEdit, start)
+	}
+}
+
+func TestActivityRateMatchesSteadyEditing(t *testing.T) {
+	var a activity
+	now := time.Now()
+	// One edit a second for long enough that the count settles
+	for i := 0; i < 1200; i++ {
+		now = now.Add(time.Second)
+		a.record(now)
+	}
+
+	if got := a.rate(now); math.Abs(got-60) > 1 {
+		t.Errorf("rate = %v edits per minute, want about 60", got)
+	}
+}
+
+func TestActivityWithoutEdits(t *testing.T) {
+	var a activity
+
+	if snapshot := a.snapshot(time.Now()); snapshot.LastEdit != nil || snapshot.EditRate != 0 {
+		t.Errorf("activity of an unedited document = %+v, want none", snapshot)
+	}
+}
+
+func TestRecordEditShowsInSnapshot(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	for _, documentID := range []string{"doc1", "doc2"} {
+		if err := m.Subscribe(documentID, ignore); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+
+	m.RecordEdit("doc1")
+	m.RecordEdit("doc1")
+	m.RecordEdit("unsubscribed")
+
+	activity := m.Snapshot().Activity
+	if hot := activity["doc1"]; hot.LastEdit == nil || hot.EditRate <= 0 {
+		t.Errorf("doc1 activity = %+v, want its edits counted", hot)
+	}
+	if cold := activity["doc2"]; cold.LastEdit != nil || cold.EditRate != 0 {
+		t.Errorf("doc2 activity = %+v, want none", cold)
+	}
+	if _, ok := activity["unsubscribed"]; ok {
+		t.Error("an edit on an unsubscribed document was tracked")
+	}
+}
+
+func TestEvictionShedsTheColdestIdleDocument(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{MaxSubscriptions: 2, SubscriptionIdleTTL: time.Hour})
+	for _, documentID := range []string{"hot", "cold"} {
+		if err := m.Subscribe(documentID, ignore); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		m.RecordEdit("hot")
+	}
+	// The hot document has been idle the longest, which alone would make it the one evicted
+	m.Unsubscribe("hot")
+	m.Unsubscribe("cold")
+
+	if err := m.Subscribe("new", ignore); err != nil {
+		t.Fatalf("Subscribe failed with idle subscriptions to evict: %v", err)
+	}
+
+	documents := m.Snapshot().Documents
+	if _, ok := documents["cold"]; ok {
+		t.Error("the cold document kept its subscription")
+	}
+	if _, ok := documents["hot"]; !ok {
+		t.Error("the hot document was evicted before the cold one")
+	}
+}
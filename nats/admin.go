@@ -0,0 +1,102 @@
+package nats
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/emaforlin/ce-realtime-gateway/instance"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/nats-io/nats.go"
+)
+
+// Admin command actions executed by every gateway instance
+const (
+	AdminActionAnnounce      = "announce"
+	AdminActionCloseDocument = "close_document"
+	AdminActionKick          = "kick"
+	AdminActionRevokeToken   = "revoke_token"
+)
+
+// ErrAdminDisabled is returned when admin commands are used without a shared secret configured
+var ErrAdminDisabled = errors.New("admin commands are disabled")
+
+// AdminCommand is an admin action broadcast to all gateway instances
+type AdminCommand struct {
+	Action     string `json:"action"`
+	DocumentID string `json:"document_id,omitempty"`
+	UserID     string `json:"user_id,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Token      string `json:"token,omitempty"`
+	// Origin is the instance that issued the command, Secret the shared secret authenticating it
+	Origin string `json:"origin"`
+	Secret string `json:"secret"`
+}
+
+// PublishAdminCommand sends a command to every instance, including this one
+func (m *Manager) PublishAdminCommand(cmd AdminCommand) error {
+	if m.adminSecret == "" {
+		return ErrAdminDisabled
+	}
+
+	cmd.Origin = instance.ID()
+	cmd.Secret = m.adminSecret
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to marshal admin command: %w", err)
+	}
+
+	subject, err := publisher.BuildSubject(m.adminSubject, cmd.Action, "")
+	if err != nil {
+		return err
+	}
+	if err := m.connection().Publish(subject, data); err != nil {
+		return fmt.Errorf("failed to publish admin command to %s: %w", subject, err)
+	}
+	return nil
+}
+
+// SubscribeAdmin runs handler for every authenticated admin command. Commands without the shared
+// secret are dropped.
+func (m *Manager) SubscribeAdmin(handler func(AdminCommand)) error {
+	if m.adminSecret == "" {
+		return ErrAdminDisabled
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.adminHandler = recoverHandler(m.adminSubject, func(msg *nats.Msg) {
+		var cmd AdminCommand
+		if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+			log.Printf("Dropping malformed admin command on %s: %v", msg.Subject, err)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(cmd.Secret), []byte(m.adminSecret)) != 1 {
+			log.Printf("Dropping unauthenticated admin command %q on %s", cmd.Action, msg.Subject)
+			return
+		}
+		log.Printf("Executing admin command %q from instance %s", cmd.Action, cmd.Origin)
+		handler(cmd)
+	})
+	return m.subscribeAdmin()
+}
+
+// subscribeAdmin (re)subscribes the admin handler on the current connection. The caller must hold m.mutex.
+func (m *Manager) subscribeAdmin() error {
+	if m.adminHandler == nil {
+		return nil
+	}
+	if m.adminSub != nil && m.adminSub.IsValid() {
+		m.adminSub.Unsubscribe()
+	}
+
+	sub, err := m.conn.Subscribe(m.adminSubject+".>", m.adminHandler)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to admin commands: %w", err)
+	}
+	m.adminSub = sub
+	return nil
+}
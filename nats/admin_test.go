@@ -0,0 +1,93 @@
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// newAdminManager returns a manager on the server at url sharing the admin secret
+func newAdminManager(t *testing.T, url, secret string) *Manager {
+	t.Helper()
+
+	m, err := NewManager(config.NATSConfig{URL: url, Timeout: 5 * time.Second, AdminSubject: "gateway.admin", AdminSecret: secret})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// receiveAdmin subscribes to admin commands, returning the ones executed
+func receiveAdmin(t *testing.T, m *Manager) <-chan AdminCommand {
+	t.Helper()
+
+	commands := make(chan AdminCommand, 16)
+	if err := m.SubscribeAdmin(func(cmd AdminCommand) { commands <- cmd }); err != nil {
+		t.Fatalf("SubscribeAdmin failed: %v", err)
+	}
+	if err := m.GetConnection().Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	return commands
+}
+
+func TestAdminCommandsReachEveryInstance(t *testing.T) {
+	ns := startServer(t, &server.Options{Port: -1})
+	issuer := newAdminManager(t, ns.ClientURL(), "s3cret")
+	other := newAdminManager(t, ns.ClientURL(), "s3cret")
+	received := []<-chan AdminCommand{receiveAdmin(t, issuer), receiveAdmin(t, other)}
+
+	cmd := AdminCommand{Action: AdminActionAnnounce, DocumentID: "doc1", Message: "maintenance at noon"}
+	if err := issuer.PublishAdminCommand(cmd); err != nil {
+		t.Fatalf("PublishAdminCommand failed: %v", err)
+	}
+
+	for i, commands := range received {
+		select {
+		case got := <-commands:
+			if got.Action != cmd.Action || got.DocumentID != cmd.DocumentID || got.Message != cmd.Message {
+				t.Errorf("instance %d executed %+v, want %+v", i, got, cmd)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("instance %d did not execute the command", i)
+		}
+	}
+}
+
+func TestAdminCommandsWithoutTheSecretDropped(t *testing.T) {
+	ns := startServer(t, &server.Options{Port: -1})
+	m := newAdminManager(t, ns.ClientURL(), "s3cret")
+	commands := receiveAdmin(t, m)
+
+	for _, secret := range []string{"", "guess"} {
+		data, _ := json.Marshal(AdminCommand{Action: AdminActionKick, UserID: "bob", Secret: secret})
+		if err := m.GetConnection().Publish("gateway.admin.kick", data); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	if err := m.GetConnection().Publish("gateway.admin.kick", []byte("not json")); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	select {
+	case cmd := <-commands:
+		t.Fatalf("executed unauthenticated command %+v", cmd)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestAdminDisabledWithoutSecret(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{AdminSubject: "gateway.admin"})
+
+	if err := m.PublishAdminCommand(AdminCommand{Action: AdminActionAnnounce}); !errors.Is(err, ErrAdminDisabled) {
+		t.Errorf("PublishAdminCommand = %v, want ErrAdminDisabled", err)
+	}
+	if err := m.SubscribeAdmin(func(AdminCommand) {}); !errors.Is(err, ErrAdminDisabled) {
+		t.Errorf("SubscribeAdmin = %v, want ErrAdminDisabled", err)
+	}
+}
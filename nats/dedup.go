@@ -0,0 +1,53 @@
+package nats
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// MessageIDHeaderKey carries a unique ID on every document message, used to drop duplicates
+const MessageIDHeaderKey = "Gateway-Msg-Id"
+
+// dedupWindow is the number of recent message IDs remembered per document
+const dedupWindow = 1024
+
+// recentIDs remembers the last dedupWindow message IDs seen
+type recentIDs struct {
+	mutex sync.Mutex
+	seen  map[string]struct{}
+	order []string
+	next  int
+}
+
+// add records an ID, reporting false if it was already seen
+func (r *recentIDs) add(id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, dup := r.seen[id]; dup {
+		return false
+	}
+	if len(r.order) < dedupWindow {
+		r.order = append(r.order, id)
+	} else {
+		delete(r.seen, r.order[r.next])
+		r.order[r.next] = id
+		r.next = (r.next + 1) % dedupWindow
+	}
+	r.seen[id] = struct{}{}
+	return true
+}
+
+// dedupHandler wraps a document handler so a message delivered by two subscriptions at once,
+// as happens while Resubscribe overlaps the old and new one, is only handled once.
+// Messages without an ID are always handled.
+func dedupHandler(handler nats.MsgHandler) nats.MsgHandler {
+	recent := &recentIDs{seen: make(map[string]struct{}, dedupWindow)}
+	return func(msg *nats.Msg) {
+		if id := msg.Header.Get(MessageIDHeaderKey); id != "" && !recent.add(id) {
+			return
+		}
+		handler(msg)
+	}
+}
@@ -0,0 +1,43 @@
+package nats
+
+import (
+	"fmt"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/instance"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// NewInProcessManager creates a manager backed by an embedded NATS server that doesn't listen on
+// the network. Messages only fan out to connections of this gateway instance, which keeps a single
+// instance usable for local testing or degraded operation when no NATS server is reachable.
+// JetStream is enabled when a replay stream is configured.
+func NewInProcessManager(cfg config.NATSConfig) (*Manager, error) {
+	ns, err := server.NewServer(&server.Options{
+		ServerName: "gateway-fallback-" + instance.ID(),
+		DontListen: true,
+		NoLog:      true,
+		NoSigs:     true,
+		JetStream:  cfg.ReplayStream != "",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create in-process NATS server: %w", err)
+	}
+
+	ns.Start()
+	if !ns.ReadyForConnections(cfg.Timeout) {
+		ns.Shutdown()
+		return nil, fmt.Errorf("in-process NATS server not ready after %v", cfg.Timeout)
+	}
+
+	cfg.URL = ns.ClientURL()
+	m, err := newManager(cfg, nats.InProcessServer(ns))
+	if err != nil {
+		ns.Shutdown()
+		return nil, err
+	}
+	m.embedded = ns
+
+	return m, nil
+}
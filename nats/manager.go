@@ -1,43 +1,135 @@
 package nats
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/instance"
+	"github.com/emaforlin/ce-realtime-gateway/logging"
+	"github.com/emaforlin/ce-realtime-gateway/metrics"
 	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
 )
 
+// subscriptionLog logs the subscription lifecycle of documents
+var subscriptionLog = logging.For(logging.CategorySubscription)
+
+// Headers marking opaque (binary or encrypted) messages and their sender, and the connection an event came from
+const (
+	SenderHeaderKey           = "Gateway-Sender"
+	SenderConnectionHeaderKey = "Gateway-Sender-Connection"
+	EncodingHeaderKey         = "Gateway-Encoding"
+	EncodingBinary            = "binary"
+	// EncodingEncrypted marks end-to-end encrypted text payloads, relayed without being parsed
+	EncodingEncrypted = "encrypted"
+)
+
+// ErrSubscriptionLimit is returned when subscribing to a new document would exceed the configured maximum
+var ErrSubscriptionLimit = errors.New("maximum number of document subscriptions reached")
+
 // Manager handles both publishing and subscription with a single NATS connection
 type Manager struct {
 	conn          *nats.Conn
 	subscriptions map[string]*DocumentSubscription
 	mutex         sync.RWMutex
+	idleTTL       time.Duration
+	maxSubs       int
+	flushTimeout  time.Duration
+	// embedded is the in-process fallback server, if the manager runs on one
+	embedded  *server.Server
+	done      chan struct{}
+	closeOnce sync.Once
+	// connect dials a new connection with the manager's options, restarting marks a watchdog restart in progress
+	connect    func() (*nats.Conn, error)
+	restarting atomic.Bool
+	// status is the connection state as last reported by the client's callbacks
+	status atomic.Value
+	// messageSeq numbers published document messages for their message ID
+	messageSeq atomic.Uint64
+	// admin commands shared by all instances
+	adminSubject string
+	adminSecret  string
+	adminHandler nats.MsgHandler
+	adminSub     *nats.Subscription
+	// orphanSuspects holds the documents that looked orphaned on the last reconciliation
+	orphanSuspects     map[string]struct{}
+	lastReconciliation *Reconciliation
+	// replayStream is the JetStream stream documents are subscribed through, empty without replay
+	replayStream string
+	replayMaxAge time.Duration
+	// replayFilters pick the replayed events passed on to document handlers
+	replayFilters []document.ReplayFilter
 }
 
 // NewManager creates a new NATS manager with a single connection
-func NewManager(natsURL string) (*Manager, error) {
+func NewManager(cfg config.NATSConfig) (*Manager, error) {
+	return newManager(cfg)
+}
+
+// newManager connects to NATS with the default options plus any extra ones
+func newManager(cfg config.NATSConfig, extraOpts ...nats.Option) (*Manager, error) {
 	opts := []nats.Option{
-		nats.Name("CollaborativeEditor-Gateway"),
-		nats.Timeout(10 * time.Second),
+		nats.Name("CollaborativeEditor-Gateway-" + instance.ID()),
+		nats.Timeout(cfg.Timeout),
 		nats.ReconnectWait(2 * time.Second),
 		nats.MaxReconnects(5),
 	}
+	opts = append(opts, extraOpts...)
+
+	m := &Manager{
+		subscriptions: make(map[string]*DocumentSubscription),
+		idleTTL:       cfg.SubscriptionIdleTTL,
+		maxSubs:       cfg.MaxSubscriptions,
+		flushTimeout:  cfg.FlushTimeout,
+		done:          make(chan struct{}),
+		adminSubject:  cfg.AdminSubject,
+		adminSecret:   cfg.AdminSecret,
+		replayStream:  cfg.ReplayStream,
+		replayMaxAge:  cfg.ReplayMaxAge,
+		replayFilters: []document.ReplayFilter{document.EditsOnly},
+	}
+	// Track the connection state; once the client gives up reconnecting, the watchdog takes over
+	opts = append(opts,
+		nats.DisconnectErrHandler(m.connectionLost),
+		nats.ReconnectHandler(m.connectionRestored),
+		nats.ClosedHandler(m.connectionClosed),
+	)
+	m.connect = func() (*nats.Conn, error) {
+		return nats.Connect(cfg.URL, opts...)
+	}
 
-	conn, err := nats.Connect(natsURL, opts...)
+	conn, err := m.connect()
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
 	}
+	m.conn = conn
+	m.status.Store(StatusConnected)
 
-	log.Printf("Connected to NATS at %s", natsURL)
+	log.Printf("Connected to NATS at %s", cfg.URL)
 
-	return &Manager{
-		conn:          conn,
-		subscriptions: make(map[string]*DocumentSubscription),
-	}, nil
+	if m.replayStream != "" {
+		if err := m.ensureReplayStream(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// Idle subscriptions are only retained when a TTL is configured, so only then is a sweeper needed
+	if m.idleTTL > 0 {
+		go m.sweepIdleSubscriptions(max(m.idleTTL/2, time.Second))
+	}
+
+	return m, nil
 }
 
 // PublishDocumentEvent publishes a document event (Publisher functionality)
@@ -48,16 +140,81 @@ func (m *Manager) PublishDocumentEvent(event publisher.DocumentEvent) error {
 	}
 
 	// Use the same subject pattern for consistency
-	subject := fmt.Sprintf("document.%s.edit", event.DocumentID)
+	subject, err := documentSubject(event.DocumentID)
+	if err != nil {
+		return err
+	}
 
-	if err := m.conn.Publish(subject, data); err != nil {
+	msg := &nats.Msg{
+		Subject: subject,
+		Data:    data,
+		Header:  nats.Header{},
+	}
+	msg.Header.Set(instance.HeaderKey, instance.ID())
+	msg.Header.Set(MessageIDHeaderKey, m.nextMessageID())
+	if event.SenderConnectionID != "" {
+		msg.Header.Set(SenderConnectionHeaderKey, event.SenderConnectionID)
+	}
+
+	if err := m.connection().PublishMsg(msg); err != nil {
 		return fmt.Errorf("failed to publish to NATS: %w", err)
 	}
+	metrics.IncNATSPublished()
 
-	log.Printf("Published event to NATS: %s -> %s", subject, event.Payload.Action)
+	logging.For(logging.CategoryEdit).Debugf("Published event to NATS: %s -> %s", subject, event.Payload.Action)
 	return nil
 }
 
+// PublishBinary publishes an opaque binary update for a document as is, tagging it with the
+// sender so receivers can exclude it without parsing the payload
+func (m *Manager) PublishBinary(documentID, senderID string, data []byte) error {
+	return m.PublishOpaque(documentID, senderID, EncodingBinary, data)
+}
+
+// PublishOpaque publishes a payload the gateway doesn't read, with the encoding telling receivers how to relay it
+func (m *Manager) PublishOpaque(documentID, senderID, encoding string, data []byte) error {
+	subject, err := documentSubject(documentID)
+	if err != nil {
+		return err
+	}
+
+	msg := &nats.Msg{
+		Subject: subject,
+		Data:    data,
+		Header:  nats.Header{},
+	}
+	msg.Header.Set(instance.HeaderKey, instance.ID())
+	msg.Header.Set(SenderHeaderKey, senderID)
+	msg.Header.Set(EncodingHeaderKey, encoding)
+	msg.Header.Set(MessageIDHeaderKey, m.nextMessageID())
+
+	if err := m.connection().PublishMsg(msg); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+	metrics.IncNATSPublished()
+	return nil
+}
+
+// nextMessageID returns an ID unique across instances for the next published document message
+func (m *Manager) nextMessageID() string {
+	return instance.ID() + "-" + strconv.FormatUint(m.messageSeq.Add(1), 10)
+}
+
+// PublishEvents publishes every event received from events in the background until the channel
+// is closed. The returned channel is closed once the last event has been published.
+func (m *Manager) PublishEvents(events <-chan publisher.DocumentEvent) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			if err := m.PublishDocumentEvent(event); err != nil {
+				log.Printf("Failed to publish document event: %v", err)
+			}
+		}
+	}()
+	return done
+}
+
 // Subscribe creates or increments subscription for a document
 func (m *Manager) Subscribe(documentID string, handler func(msg *nats.Msg)) error {
 	m.mutex.Lock()
@@ -65,33 +222,48 @@ func (m *Manager) Subscribe(documentID string, handler func(msg *nats.Msg)) erro
 
 	docSub, exists := m.subscriptions[documentID]
 	if !exists {
-		// Create new subscription
-		subject := fmt.Sprintf("document.%s.edit", documentID)
-		sub, err := m.conn.Subscribe(subject, handler)
-		if err != nil {
-			return fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+		// Make room by dropping an idle subscription before refusing a new document
+		if m.maxSubs > 0 && len(m.subscriptions) >= m.maxSubs && !m.evictIdleSubscription() {
+			return fmt.Errorf("%w (%d)", ErrSubscriptionLimit, m.maxSubs)
 		}
 
+		// Create new subscription
 		docSub = &DocumentSubscription{
 			documentID:      documentID,
-			subscription:    sub,
 			connectionCount: 0,
+			natsHandler:     documentMsgHandler(documentID, handler),
 		}
+		sub, err := m.subscribeDocument(docSub)
+		if err != nil {
+			return err
+		}
+		docSub.subscription = sub
 		m.subscriptions[documentID] = docSub
-		log.Printf("Created NATS subscription for document: %s", documentID)
+		subscriptionLog.Infof("Created NATS subscription for document: %s", documentID)
+	} else if docSub.subscription == nil || !docSub.subscription.IsValid() {
+		// The entry outlived its NATS subscription, e.g. after a failed unsubscribe; subscribe it again
+		sub, err := m.subscribeDocument(docSub)
+		if err != nil {
+			return err
+		}
+		docSub.subscription = sub
+		subscriptionLog.Infof("Recreated NATS subscription for document: %s", documentID)
 	}
 
-	// Increment connection count
+	// Increment connection count, reviving the subscription if it was idle
 	docSub.mutex.Lock()
 	docSub.connectionCount++
+	docSub.idleSince = time.Time{}
 	count := docSub.connectionCount
 	docSub.mutex.Unlock()
 
-	log.Printf("User subscribed to document %s (active connections: %d)", documentID, count)
+	subscriptionLog.Debugf("User subscribed to document %s (active connections: %d)", documentID, count)
 	return nil
 }
 
-// Unsubscribe decrements subscription count and removes if no more connections
+// Unsubscribe decrements subscription count and removes if no more connections.
+// The count is decremented even when NATS fails to unsubscribe; the subscription is then kept
+// idle and its removal retried by the idle sweeper or the next reconciliation.
 func (m *Manager) Unsubscribe(documentID string) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -102,62 +274,288 @@ func (m *Manager) Unsubscribe(documentID string) error {
 	}
 
 	docSub.mutex.Lock()
+	if docSub.connectionCount <= 0 {
+		docSub.mutex.Unlock()
+		return nil // Already idle
+	}
 	docSub.connectionCount--
 	count := docSub.connectionCount
+	if count <= 0 {
+		docSub.idleSince = time.Now()
+	}
 	docSub.mutex.Unlock()
 
-	log.Printf("User unsubscribed from document %s (remaining connections: %d)", documentID, count)
+	subscriptionLog.Debugf("User unsubscribed from document %s (remaining connections: %d)", documentID, count)
 
-	// If no more connections, remove subscription
+	// If no more connections, remove subscription unless it is kept idle for a while
 	if count <= 0 {
-		if err := docSub.subscription.Unsubscribe(); err != nil {
-			log.Printf("Error unsubscribing from document %s: %v", documentID, err)
+		if m.idleTTL > 0 {
+			subscriptionLog.Debugf("Keeping idle NATS subscription for document %s for up to %v", documentID, m.idleTTL)
+			return nil
 		}
-		delete(m.subscriptions, documentID)
-		log.Printf("Removed NATS subscription for document: %s", documentID)
+		return m.removeSubscription(documentID, docSub)
 	}
 
 	return nil
 }
 
+// removeSubscription unsubscribes from NATS and forgets the document. If NATS refuses while the
+// subscription is still live, the document is kept so the removal can be retried.
+// The caller must hold m.mutex.
+func (m *Manager) removeSubscription(documentID string, docSub *DocumentSubscription) error {
+	if err := docSub.subscription.Unsubscribe(); err != nil && docSub.subscription.IsValid() {
+		metrics.IncUnsubscribeFailure()
+		subscriptionLog.Warnf("Error unsubscribing from document %s, will retry: %v", documentID, err)
+		return fmt.Errorf("failed to unsubscribe from document %s: %w", documentID, err)
+	}
+	delete(m.subscriptions, documentID)
+	subscriptionLog.Infof("Removed NATS subscription for document: %s", documentID)
+	return nil
+}
+
+// evictIdleSubscription removes the idle subscription of the least edited document, the longest idle
+// one among equally cold documents, reporting whether one was found.
+// The caller must hold m.mutex.
+func (m *Manager) evictIdleSubscription() bool {
+	now := time.Now()
+	var oldestID string
+	var oldest time.Time
+	var coldest float64
+	for documentID, docSub := range m.subscriptions {
+		docSub.mutex.RLock()
+		idle := docSub.connectionCount <= 0 && !docSub.idleSince.IsZero()
+		idleSince := docSub.idleSince
+		rate := docSub.activity.rate(now)
+		docSub.mutex.RUnlock()
+
+		if !idle {
+			continue
+		}
+		if oldestID == "" || rate < coldest || (rate == coldest && idleSince.Before(oldest)) {
+			oldestID, oldest, coldest = documentID, idleSince, rate
+		}
+	}
+
+	if oldestID == "" {
+		return false
+	}
+	return m.removeSubscription(oldestID, m.subscriptions[oldestID]) == nil
+}
+
+// sweepIdleSubscriptions periodically removes subscriptions that have been idle longer than the TTL
+func (m *Manager) sweepIdleSubscriptions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.removeIdleSubscriptions(now)
+		}
+	}
+}
+
+// removeIdleSubscriptions removes every subscription with no connections since before now minus the TTL
+func (m *Manager) removeIdleSubscriptions(now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for documentID, docSub := range m.subscriptions {
+		docSub.mutex.RLock()
+		expired := docSub.connectionCount <= 0 && !docSub.idleSince.IsZero() && now.Sub(docSub.idleSince) > m.idleTTL
+		docSub.mutex.RUnlock()
+
+		if expired {
+			_ = m.removeSubscription(documentID, docSub)
+		}
+	}
+}
+
+// Resubscribe re-establishes the NATS subscription of every document that still has active connections.
+// It is safe to call after a reconnect or whenever subscriptions may have been lost, and returns the
+// number of documents that were resubscribed.
+//
+// A still valid subscription is only drained once its replacement is in place, so messages keep
+// flowing during the switch; messages received by both are handled once thanks to their message ID.
+// With a replay stream configured, the new subscription also replays the edits published since the
+// last one the document received, so edits published while the connection was down are not lost.
+func (m *Manager) Resubscribe() (int, error) {
+	return m.resubscribe(false)
+}
+
+// resubscribe does the work of Resubscribe; with onlyInvalid, subscriptions that are still valid
+// are left alone
+func (m *Manager) resubscribe(onlyInvalid bool) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var errs []error
+	resubscribed := 0
+	for documentID, docSub := range m.subscriptions {
+		docSub.mutex.Lock()
+		if docSub.connectionCount <= 0 || (onlyInvalid && docSub.subscription != nil && docSub.subscription.IsValid()) {
+			docSub.mutex.Unlock()
+			continue
+		}
+
+		sub, err := m.subscribeDocument(docSub)
+		if err != nil {
+			docSub.mutex.Unlock()
+			errs = append(errs, fmt.Errorf("failed to resubscribe: %w", err))
+			continue
+		}
+		previous := docSub.subscription
+		docSub.subscription = sub
+		docSub.mutex.Unlock()
+
+		// Let the previous subscription deliver what it already received before it goes away
+		if previous != nil && previous.IsValid() {
+			if err := previous.Drain(); err != nil {
+				log.Printf("Error draining stale subscription for document %s: %v", documentID, err)
+			}
+		}
+
+		resubscribed++
+		subscriptionLog.Infof("Resubscribed NATS subscription for document: %s", documentID)
+	}
+
+	return resubscribed, errors.Join(errs...)
+}
+
 // GetConnection returns the underlying NATS connection (if needed for advanced operations)
 func (m *Manager) GetConnection() *nats.Conn {
-	return m.conn
+	return m.connection()
+}
+
+// Drain stops the document subscriptions from taking new messages, waits for their handlers to
+// finish the messages already received and flushes pending publishes, giving up when ctx expires.
+// The connection stays open for Close.
+func (m *Manager) Drain(ctx context.Context) error {
+	m.mutex.RLock()
+	subs := make([]*nats.Subscription, 0, len(m.subscriptions))
+	for documentID, docSub := range m.subscriptions {
+		if err := docSub.subscription.Drain(); err != nil {
+			log.Printf("Error draining subscription for document %s: %v", documentID, err)
+			continue
+		}
+		subs = append(subs, docSub.subscription)
+	}
+	m.mutex.RUnlock()
+
+	// A drained subscription turns invalid once its pending messages are handled
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for _, sub := range subs {
+		for sub.IsValid() {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("subscriptions still draining: %w", ctx.Err())
+			case <-ticker.C:
+			}
+		}
+	}
+
+	if conn := m.connection(); conn != nil && conn.IsConnected() {
+		return conn.FlushWithContext(ctx)
+	}
+	return nil
 }
 
 // Close closes all subscriptions and the NATS connection
 func (m *Manager) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	// Close all active subscriptions
+	// Close all active subscriptions; drained ones are already gone
 	for documentID, docSub := range m.subscriptions {
+		if !docSub.subscription.IsValid() {
+			continue
+		}
 		if err := docSub.subscription.Unsubscribe(); err != nil {
 			log.Printf("Error closing subscription for document %s: %v", documentID, err)
 		}
 	}
 	m.subscriptions = make(map[string]*DocumentSubscription)
 
-	// Close NATS connection
+	// Close NATS connection, first making sure buffered publishes reach the server
 	if m.conn != nil {
+		if m.flushTimeout > 0 && m.conn.IsConnected() {
+			if err := m.conn.FlushTimeout(m.flushTimeout); err != nil {
+				log.Printf("Error flushing NATS connection: %v", err)
+			}
+		}
 		m.conn.Close()
 		log.Println("NATS connection closed")
 	}
 
+	if m.embedded != nil {
+		m.embedded.Shutdown()
+		m.embedded.WaitForShutdown()
+	}
+
 	return nil
 }
 
 // IsConnected checks if the NATS connection is still active
 func (m *Manager) IsConnected() bool {
-	return m.conn != nil && m.conn.IsConnected()
+	conn := m.connection()
+	return conn != nil && conn.IsConnected()
 }
 
-// GetStats returns statistics about active subscriptions
+// SubscriptionCount returns the number of document subscriptions currently held, including idle ones
+func (m *Manager) SubscriptionCount() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.subscriptions)
+}
+
+// MaxSubscriptions returns the configured subscription limit, 0 meaning unlimited
+func (m *Manager) MaxSubscriptions() int {
+	return m.maxSubs
+}
+
+// GetStats returns the connection count of every subscribed document. Connection counts only
+// change while m.mutex is held for writing, so the map is a consistent point-in-time snapshot.
 func (m *Manager) GetStats() map[string]int {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	stats := make(map[string]int)
+	return m.documentStats()
+}
+
+// Stats is a consistent snapshot of the subscription state
+type Stats struct {
+	Subscriptions    int
+	MaxSubscriptions int
+	Documents        map[string]int
+	// LastReconciliation is the outcome of the latest reconciliation run, nil before the first one
+	LastReconciliation *Reconciliation
+	// Activity describes how busy each subscribed document is
+	Activity map[string]Activity
+}
+
+// Snapshot returns the subscription count, limit and per-document connection counts taken
+// together, so they always agree with each other
+func (m *Manager) Snapshot() Stats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return Stats{
+		Subscriptions:      len(m.subscriptions),
+		MaxSubscriptions:   m.maxSubs,
+		Documents:          m.documentStats(),
+		LastReconciliation: m.lastReconciliation,
+		Activity:           m.documentActivity(),
+	}
+}
+
+// documentStats returns the connection count of every subscribed document. The caller must hold m.mutex.
+func (m *Manager) documentStats() map[string]int {
+	stats := make(map[string]int, len(m.subscriptions))
 	for docID, docSub := range m.subscriptions {
 		docSub.mutex.RLock()
 		stats[docID] = docSub.connectionCount
@@ -165,3 +563,74 @@ func (m *Manager) GetStats() map[string]int {
 	}
 	return stats
 }
+
+// documentSubject returns the NATS subject carrying edits for a document
+func documentSubject(documentID string) (string, error) {
+	return publisher.DocumentSubject(documentID, "")
+}
+
+// subscribeDocument subscribes the handler of a document to its subject. With a replay stream, the
+// subscription is an ordered JetStream consumer picking up after the last edit the document received,
+// the replayed events going through the replay filters.
+// The caller must hold m.mutex.
+func (m *Manager) subscribeDocument(docSub *DocumentSubscription) (*nats.Subscription, error) {
+	subject, err := documentSubject(docSub.documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	var sub *nats.Subscription
+	if m.replayStream == "" {
+		sub, err = m.conn.Subscribe(subject, docSub.natsHandler)
+	} else {
+		var js nats.JetStreamContext
+		if js, err = m.conn.JetStream(); err == nil {
+			sub, err = m.subscribeReplay(js, subject, docSub)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+	}
+	return sub, nil
+}
+
+// subscribeReplay subscribes a document through the replay stream. Everything up to the stream's
+// last message when subscribing is replayed; what comes after is received live.
+func (m *Manager) subscribeReplay(js nats.JetStreamContext, subject string, docSub *DocumentSubscription) (*nats.Subscription, error) {
+	start, replaying := docSub.replayFrom()
+
+	var replayEnd uint64
+	if replaying {
+		info, err := js.StreamInfo(m.replayStream)
+		if err != nil {
+			return nil, err
+		}
+		replayEnd = info.State.LastSeq
+	}
+
+	handler := docSub.trackSequence(filterReplay(docSub.natsHandler, replayEnd, m.replayFilters))
+	return js.Subscribe(subject, handler, nats.BindStream(m.replayStream), nats.OrderedConsumer(), start)
+}
+
+// documentMsgHandler wraps the callback of a document subscription: received messages are counted,
+// redeliveries dropped and panics recovered
+func documentMsgHandler(documentID string, handler nats.MsgHandler) nats.MsgHandler {
+	deduped := dedupHandler(handler)
+	return recoverHandler(documentID, func(msg *nats.Msg) {
+		metrics.IncNATSReceived()
+		deduped(msg)
+	})
+}
+
+// recoverHandler wraps a subscription callback so a panic is logged instead of crashing the process
+func recoverHandler(documentID string, handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("Panic recovered in NATS handler for document %s: %v", documentID, err)
+			}
+		}()
+
+		handler(msg)
+	}
+}
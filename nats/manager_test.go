@@ -0,0 +1,412 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/instance"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// startServer starts a NATS server listening on the network, shut down at the end of the test
+func startServer(t *testing.T, opts *server.Options) *server.Server {
+	t.Helper()
+
+	opts.NoLog, opts.NoSigs = true, true
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	ns.Start()
+	t.Cleanup(ns.Shutdown)
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	return ns
+}
+
+// newInProcessManager returns a manager configured with cfg on an in-process server
+func newInProcessManager(t *testing.T, cfg config.NATSConfig) *Manager {
+	t.Helper()
+
+	cfg.Timeout = 5 * time.Second
+	m, err := NewInProcessManager(cfg)
+	if err != nil {
+		t.Fatalf("NewInProcessManager failed: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// ignore is a document handler dropping every message
+func ignore(*nats.Msg) {}
+
+func TestUnsubscribeRemovesRightAwayWithoutIdleTTL(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	if err := m.Subscribe("doc1", ignore); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	if err := m.Unsubscribe("doc1"); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+
+	if count := m.SubscriptionCount(); count != 0 {
+		t.Errorf("%d subscriptions left after the last connection left, want 0", count)
+	}
+}
+
+func TestIdleSubscriptionRemovedAfterTTL(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{SubscriptionIdleTTL: time.Minute})
+	if err := m.Subscribe("doc1", ignore); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	m.Unsubscribe("doc1")
+
+	m.removeIdleSubscriptions(time.Now())
+	if count := m.SubscriptionCount(); count != 1 {
+		t.Fatalf("idle subscription removed before its TTL (%d left)", count)
+	}
+
+	m.removeIdleSubscriptions(time.Now().Add(2 * time.Minute))
+	if count := m.SubscriptionCount(); count != 0 {
+		t.Errorf("idle subscription kept past its TTL (%d left)", count)
+	}
+}
+
+func TestRejoinRevivesIdleSubscription(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{SubscriptionIdleTTL: time.Minute})
+	if err := m.Subscribe("doc1", ignore); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	m.Unsubscribe("doc1")
+	if err := m.Subscribe("doc1", ignore); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	m.removeIdleSubscriptions(time.Now().Add(2 * time.Minute))
+
+	if stats := m.GetStats(); stats["doc1"] != 1 {
+		t.Errorf("doc1 subscription stats = %v, want 1 connection", stats)
+	}
+}
+
+func TestResubscribeRestoresLostSubscription(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	edits := subscribeEdits(t, m, "doc1")
+	loseSubscription(t, m, "doc1")
+
+	count, err := m.Resubscribe()
+	if err != nil || count != 1 {
+		t.Fatalf("Resubscribe = %d, %v; want 1 document", count, err)
+	}
+	publishEdit(t, m, "doc1", "hello")
+
+	expectEdits(t, edits, "hello")
+}
+
+func TestResubscribeSkipsIdleSubscriptions(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{SubscriptionIdleTTL: time.Minute})
+	if err := m.Subscribe("doc1", ignore); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	m.Unsubscribe("doc1")
+
+	if count, err := m.Resubscribe(); err != nil || count != 0 {
+		t.Errorf("Resubscribe = %d, %v; want no document", count, err)
+	}
+}
+
+func TestReconnectRestoresLostSubscription(t *testing.T) {
+	ns := startServer(t, &server.Options{Port: -1})
+	port := ns.Addr().(*net.TCPAddr).Port
+	m, err := NewManager(config.NATSConfig{URL: ns.ClientURL(), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	edits := subscribeEdits(t, m, "doc1")
+
+	// The subscription is lost while the server goes away, the client reconnects once it is back
+	loseSubscription(t, m, "doc1")
+	ns.Shutdown()
+	waitForStatus(t, m, StatusReconnecting)
+	startServer(t, &server.Options{Port: port})
+	waitForStatus(t, m, StatusConnected)
+
+	publishEdit(t, m, "doc1", "hello")
+	expectEdits(t, edits, "hello")
+}
+
+func TestReconnectResubscribesOnlyInvalidSubscriptions(t *testing.T) {
+	ns := startServer(t, &server.Options{Port: -1})
+	port := ns.Addr().(*net.TCPAddr).Port
+	m, err := NewManager(config.NATSConfig{URL: ns.ClientURL(), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	lost := subscribeEdits(t, m, "doc1")
+	kept := subscribeEdits(t, m, "doc2")
+	m.mutex.RLock()
+	keptSubscription := m.subscriptions["doc2"].subscription
+	m.mutex.RUnlock()
+
+	loseSubscription(t, m, "doc1")
+	ns.Shutdown()
+	waitForStatus(t, m, StatusReconnecting)
+	startServer(t, &server.Options{Port: port})
+	waitForStatus(t, m, StatusConnected)
+
+	// The client replays the valid subscription itself; subscribing it again would deliver twice
+	publishEdit(t, m, "doc1", "hello")
+	publishEdit(t, m, "doc2", "world")
+	expectEdits(t, lost, "hello")
+	expectEdits(t, kept, "world")
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.subscriptions["doc2"].subscription != keptSubscription {
+		t.Error("the valid subscription was replaced on reconnect")
+	}
+	if count := m.subscriptions["doc1"].connectionCount; count != 1 {
+		t.Errorf("resubscribed document counts %d connections, want 1", count)
+	}
+}
+
+// waitForStatus waits until the manager reports the given connection status
+func waitForStatus(t *testing.T, m *Manager, status string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for m.ConnectionStatus() != status {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection status is %s, want %s", m.ConnectionStatus(), status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{MaxSubscriptions: 2})
+	for _, documentID := range []string{"doc1", "doc2", "doc1"} {
+		if err := m.Subscribe(documentID, ignore); err != nil {
+			t.Fatalf("Subscribe(%s) failed below the limit: %v", documentID, err)
+		}
+	}
+
+	if err := m.Subscribe("doc3", ignore); !errors.Is(err, ErrSubscriptionLimit) {
+		t.Errorf("Subscribe beyond the limit returned %v, want ErrSubscriptionLimit", err)
+	}
+	if stats := m.Snapshot(); stats.Subscriptions != 2 || stats.MaxSubscriptions != 2 {
+		t.Errorf("stats report %d of %d subscriptions, want 2 of 2", stats.Subscriptions, stats.MaxSubscriptions)
+	}
+
+	m.Unsubscribe("doc2")
+	if err := m.Subscribe("doc3", ignore); err != nil {
+		t.Errorf("Subscribe failed once a document was released: %v", err)
+	}
+}
+
+func TestPanickingHandlerKeepsDelivering(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	panics := make(chan struct{}, 4)
+	err := m.Subscribe("doc1", func(*nats.Msg) {
+		panics <- struct{}{}
+		panic("broadcast failed")
+	})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	edits := subscribeEdits(t, m, "doc2")
+
+	publishEdit(t, m, "doc1", "boom")
+	publishEdit(t, m, "doc2", "hello")
+	publishEdit(t, m, "doc1", "boom again")
+
+	expectEdits(t, edits, "hello")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-panics:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("doc1 handler ran %d times, want 2: the subscription died with the first panic", i)
+		}
+	}
+}
+
+func TestPublishedMessagesNameTheInstance(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	received := make(chan *nats.Msg, 1)
+	if err := m.Subscribe("doc1", func(msg *nats.Msg) { received <- msg }); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	publishEdit(t, m, "doc1", "hello")
+
+	select {
+	case msg := <-received:
+		if got := msg.Header.Get(instance.HeaderKey); got != instance.ID() {
+			t.Errorf("%s header = %q, want %q", instance.HeaderKey, got, instance.ID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("published message not received")
+	}
+}
+
+func TestCloseFlushesBufferedPublishes(t *testing.T) {
+	ns := startServer(t, &server.Options{Port: -1})
+	subscriber, err := NewManager(config.NATSConfig{URL: ns.ClientURL(), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	t.Cleanup(func() { subscriber.Close() })
+	edits := subscribeEdits(t, subscriber, "doc1")
+	if err := subscriber.GetConnection().Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	m, err := NewManager(config.NATSConfig{URL: ns.ClientURL(), Timeout: 5 * time.Second, FlushTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	event := publisher.DocumentEvent{DocumentID: "doc1", UserID: "alice", Payload: publisher.DocumentEventPayload{Action: "insert", Data: "last words"}}
+	if err := m.PublishDocumentEvent(event); err != nil {
+		t.Fatalf("PublishDocumentEvent failed: %v", err)
+	}
+	m.Close()
+
+	expectEdits(t, edits, "last words")
+}
+
+func TestSnapshotConsistentWhileSubscribing(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	stop := make(chan struct{})
+	var subscribers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		subscribers.Add(1)
+		go func(documentID string) {
+			defer subscribers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				m.Subscribe(documentID, ignore)
+				m.Subscribe("shared", ignore)
+				m.Unsubscribe("shared")
+				m.Unsubscribe(documentID)
+			}
+		}(fmt.Sprintf("doc%d", i%2))
+	}
+
+	for i := 0; i < 200; i++ {
+		stats := m.Snapshot()
+		if stats.Subscriptions != len(stats.Documents) {
+			t.Fatalf("snapshot counts %d subscriptions but lists %d documents", stats.Subscriptions, len(stats.Documents))
+		}
+		for documentID, count := range stats.Documents {
+			if count < 1 || count > 4 {
+				t.Fatalf("snapshot counts %d connections on %s, want 1 to 4", count, documentID)
+			}
+		}
+		m.GetStats()
+	}
+	close(stop)
+	subscribers.Wait()
+
+	if stats := m.Snapshot(); stats.Subscriptions != 0 || len(stats.Documents) != 0 {
+		t.Errorf("snapshot after everyone left = %+v, want it empty", stats)
+	}
+}
+
+func TestWatchdogReplacesClosedConnection(t *testing.T) {
+	ns := startServer(t, &server.Options{Port: -1})
+	port := ns.Addr().(*net.TCPAddr).Port
+	m, err := NewManager(config.NATSConfig{URL: ns.ClientURL(), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	edits := subscribeEdits(t, m, "doc1")
+
+	// The client gives up for good while the server is away, as after exhausting its reconnects
+	ns.Shutdown()
+	m.GetConnection().Close()
+	waitForStatus(t, m, StatusRestarting)
+	startServer(t, &server.Options{Port: port})
+	waitForStatus(t, m, StatusConnected)
+
+	publishEdit(t, m, "doc1", "hello")
+	expectEdits(t, edits, "hello")
+}
+
+func TestWatchdogStopsWithTheManager(t *testing.T) {
+	ns := startServer(t, &server.Options{Port: -1})
+	m, err := NewManager(config.NATSConfig{URL: ns.ClientURL(), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+
+	m.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if status := m.ConnectionStatus(); status != StatusDisconnected {
+		t.Errorf("status after Close = %s, want %s without a restart", status, StatusDisconnected)
+	}
+}
+
+func TestUnsubscribeFailureKeepsCountConsistent(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	release := make(chan struct{})
+	handling := make(chan struct{}, 1)
+	for i := 0; i < 2; i++ {
+		err := m.Subscribe("doc1", func(*nats.Msg) {
+			handling <- struct{}{}
+			<-release
+		})
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+
+	// NATS refuses to unsubscribe while the connection drains, which a blocked handler holds up
+	publishEdit(t, m, "doc1", "pending")
+	<-handling
+	if err := m.GetConnection().Drain(); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	if err := m.Unsubscribe("doc1"); err != nil {
+		t.Errorf("Unsubscribe of a shared document = %v, want nil", err)
+	}
+	if err := m.Unsubscribe("doc1"); !errors.Is(err, nats.ErrConnectionDraining) {
+		t.Errorf("Unsubscribe while draining = %v, want ErrConnectionDraining", err)
+	}
+	if got, ok := m.GetStats()["doc1"]; !ok || got != 0 {
+		t.Errorf("doc1 counts %d connections (kept: %v), want 0 and the subscription kept for a retry", got, ok)
+	}
+	if err := m.Unsubscribe("doc1"); err != nil {
+		t.Errorf("a repeated Unsubscribe = %v, want nil", err)
+	}
+	if got := m.GetStats()["doc1"]; got != 0 {
+		t.Errorf("a repeated Unsubscribe took the count to %d", got)
+	}
+
+	// Once the drain is over, reconciliation retries the removal
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for m.SubscriptionCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("reconciliation never removed the subscription that failed to unsubscribe")
+		}
+		m.Reconcile(nil, nil, func(string) nats.MsgHandler { return ignore })
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,52 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// PingResult holds the latencies measured by Ping
+type PingResult struct {
+	// RTT is the round trip of a PING to the server, RoundTrip that of a message published to
+	// a throwaway subject and received back through a subscription
+	RTT       time.Duration
+	RoundTrip time.Duration
+}
+
+// Ping measures the latency to the NATS server and of a publish/subscribe round trip, giving up when ctx is done
+func (m *Manager) Ping(ctx context.Context) (PingResult, error) {
+	conn := m.connection()
+	if conn == nil || !conn.IsConnected() {
+		return PingResult{}, errors.New("not connected to NATS")
+	}
+
+	var result PingResult
+
+	start := time.Now()
+	if err := conn.FlushWithContext(ctx); err != nil {
+		return result, fmt.Errorf("measuring RTT: %w", err)
+	}
+	result.RTT = time.Since(start)
+
+	subject := nats.NewInbox()
+	sub, err := conn.SubscribeSync(subject)
+	if err != nil {
+		return result, fmt.Errorf("subscribing to %s: %w", subject, err)
+	}
+	defer sub.Unsubscribe()
+
+	start = time.Now()
+	if err := conn.Publish(subject, []byte("ping")); err != nil {
+		return result, fmt.Errorf("publishing to %s: %w", subject, err)
+	}
+	if _, err := sub.NextMsgWithContext(ctx); err != nil {
+		return result, fmt.Errorf("waiting for the round trip on %s: %w", subject, err)
+	}
+	result.RoundTrip = time.Since(start)
+
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package nats
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Reconciliation reports the discrepancies fixed by one reconciliation run
+type Reconciliation struct {
+	At time.Time `json:"at"`
+	// Orphaned lists the documents whose subscription was removed because no connection used it
+	Orphaned []string `json:"orphaned"`
+	// Missing lists the documents with joined connections whose subscription had to be recreated
+	Missing []string `json:"missing"`
+	// Restored lists the documents whose subscription had died (e.g. unsubscribed behind the
+	// manager's back) and was established again; Lost those where that failed
+	Restored []string `json:"restored"`
+	Lost     []string `json:"lost"`
+}
+
+// Reconcile compares the subscriptions with the connections actually open on this instance.
+// present counts the connections of each document in any state, joined only those that completed
+// their join and must therefore be subscribed.
+//
+// A subscription still counting connections for a document without any is removed, but only once
+// it is seen on two consecutive runs, so a join or leave in flight isn't mistaken for a leak.
+// A document with joined connections and no subscription is subscribed again with handlerFor.
+// Without an idle TTL, idle subscriptions left behind by a failed unsubscribe are removed again.
+// A dead subscription of a document with open connections is subscribed again; the documents where
+// that fails are reported as lost, as their connections no longer receive updates.
+func (m *Manager) Reconcile(present, joined map[string]int, handlerFor func(documentID string) nats.MsgHandler) Reconciliation {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := Reconciliation{At: time.Now(), Orphaned: []string{}, Missing: []string{}, Restored: []string{}, Lost: []string{}}
+
+	suspects := make(map[string]struct{})
+	for documentID, docSub := range m.subscriptions {
+		docSub.mutex.RLock()
+		count := docSub.connectionCount
+		docSub.mutex.RUnlock()
+
+		// While the connection is being replaced every subscription is invalid, the restart restores them
+		if count > 0 && present[documentID] > 0 && !docSub.subscription.IsValid() && !m.restarting.Load() {
+			sub, err := m.subscribeDocument(docSub)
+			if err != nil {
+				subscriptionLog.Errorf("NATS subscription for document %s died and could not be restored: %v", documentID, err)
+				result.Lost = append(result.Lost, documentID)
+			} else {
+				docSub.subscription = sub
+				subscriptionLog.Warnf("Restored dead NATS subscription for document %s", documentID)
+				result.Restored = append(result.Restored, documentID)
+			}
+		}
+
+		if count <= 0 && m.idleTTL <= 0 && present[documentID] == 0 {
+			_ = m.removeSubscription(documentID, docSub)
+			continue
+		}
+		if count <= 0 || present[documentID] > 0 {
+			continue
+		}
+		if _, suspected := m.orphanSuspects[documentID]; !suspected {
+			suspects[documentID] = struct{}{}
+			continue
+		}
+
+		subscriptionLog.Warnf("Removing orphaned NATS subscription for document %s (%d connections counted, none open)", documentID, count)
+		if err := m.removeSubscription(documentID, docSub); err != nil {
+			continue
+		}
+		result.Orphaned = append(result.Orphaned, documentID)
+	}
+	m.orphanSuspects = suspects
+
+	for documentID, count := range joined {
+		if _, exists := m.subscriptions[documentID]; exists {
+			continue
+		}
+
+		docSub := &DocumentSubscription{
+			documentID:      documentID,
+			connectionCount: count,
+			natsHandler:     documentMsgHandler(documentID, handlerFor(documentID)),
+		}
+		sub, err := m.subscribeDocument(docSub)
+		if err != nil {
+			subscriptionLog.Errorf("Failed to restore NATS subscription for document %s: %v", documentID, err)
+			continue
+		}
+		docSub.subscription = sub
+		m.subscriptions[documentID] = docSub
+		subscriptionLog.Warnf("Restored missing NATS subscription for document %s (%d connections)", documentID, count)
+		result.Missing = append(result.Missing, documentID)
+	}
+
+	sort.Strings(result.Orphaned)
+	sort.Strings(result.Missing)
+	sort.Strings(result.Restored)
+	sort.Strings(result.Lost)
+	m.lastReconciliation = &result
+	return result
+}
@@ -0,0 +1,130 @@
+package nats
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/nats-io/nats.go"
+)
+
+// noHandler fails the test if reconciliation tries to subscribe a document
+func noHandler(t *testing.T) func(string) nats.MsgHandler {
+	return func(documentID string) nats.MsgHandler {
+		t.Errorf("reconciliation subscribed %s", documentID)
+		return ignore
+	}
+}
+
+func TestReconcileRemovesLeakedSubscription(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	// A subscription whose connection left without unsubscribing
+	if err := m.Subscribe("doc1", ignore); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	if result := m.Reconcile(nil, nil, noHandler(t)); len(result.Orphaned) != 0 {
+		t.Errorf("first run removed %v, want the leak only suspected", result.Orphaned)
+	}
+	result := m.Reconcile(nil, nil, noHandler(t))
+	if !slices.Equal(result.Orphaned, []string{"doc1"}) {
+		t.Errorf("second run removed %v, want doc1", result.Orphaned)
+	}
+
+	stats := m.Snapshot()
+	if stats.Subscriptions != 0 {
+		t.Errorf("%d subscriptions left, want none", stats.Subscriptions)
+	}
+	if stats.LastReconciliation == nil || !slices.Equal(stats.LastReconciliation.Orphaned, []string{"doc1"}) {
+		t.Errorf("stats report reconciliation %+v, want doc1 orphaned", stats.LastReconciliation)
+	}
+}
+
+func TestReconcileKeepsSubscriptionsInUse(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	if err := m.Subscribe("doc1", ignore); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	open := map[string]int{"doc1": 1}
+
+	for i := 0; i < 2; i++ {
+		result := m.Reconcile(open, open, noHandler(t))
+		if len(result.Orphaned)+len(result.Missing)+len(result.Restored)+len(result.Lost) != 0 {
+			t.Errorf("run %d reported %+v, want no discrepancy", i+1, result)
+		}
+	}
+	// A connection still joining counts as present
+	if result := m.Reconcile(open, nil, noHandler(t)); len(result.Orphaned) != 0 {
+		t.Errorf("removed %v while a connection was joining", result.Orphaned)
+	}
+	if m.SubscriptionCount() != 1 {
+		t.Errorf("%d subscriptions, want doc1 kept", m.SubscriptionCount())
+	}
+}
+
+func TestReconcileRestoresMissingSubscription(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	edits := make(chan string, 16)
+	open := map[string]int{"doc1": 2}
+
+	result := m.Reconcile(open, open, func(string) nats.MsgHandler {
+		return func(msg *nats.Msg) { edits <- msg.Subject }
+	})
+	if !slices.Equal(result.Missing, []string{"doc1"}) {
+		t.Fatalf("restored %v, want doc1", result.Missing)
+	}
+	if got := m.GetStats()["doc1"]; got != 2 {
+		t.Errorf("doc1 counts %d connections, want 2", got)
+	}
+
+	publishEdit(t, m, "doc1", "after")
+	select {
+	case <-edits:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the restored subscription received nothing")
+	}
+}
+
+func TestReconcileRestoresDeadSubscription(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	edits := subscribeEdits(t, m, "doc1")
+	loseSubscription(t, m, "doc1")
+	open := map[string]int{"doc1": 1}
+
+	if result := m.Reconcile(open, open, noHandler(t)); !slices.Equal(result.Restored, []string{"doc1"}) {
+		t.Fatalf("restored %v, want doc1", result.Restored)
+	}
+
+	publishEdit(t, m, "doc1", "after")
+	expectEdits(t, edits, "after")
+}
+
+func TestReconcileReportsLostSubscription(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	release := make(chan struct{})
+	defer close(release)
+	handling := make(chan struct{}, 1)
+	err := m.Subscribe("blocker", func(*nats.Msg) {
+		handling <- struct{}{}
+		<-release
+	})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	subscribeEdits(t, m, "doc1")
+
+	// NATS refuses new subscriptions while the connection drains, which a blocked handler holds up
+	publishEdit(t, m, "blocker", "pending")
+	<-handling
+	loseSubscription(t, m, "doc1")
+	if err := m.GetConnection().Drain(); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	open := map[string]int{"doc1": 1}
+	result := m.Reconcile(open, open, noHandler(t))
+	if !slices.Equal(result.Lost, []string{"doc1"}) || len(result.Restored) != 0 {
+		t.Errorf("lost %v and restored %v, want doc1 lost", result.Lost, result.Restored)
+	}
+}
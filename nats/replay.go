@@ -0,0 +1,96 @@
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/nats-io/nats.go"
+)
+
+// replayStreamSubjects are the subjects of the edits kept in the replay stream
+var replayStreamSubjects = []string{publisher.SubjectPrefixDocument + ".*.edit"}
+
+// ensureReplayStream creates the replay stream unless it exists already. It is kept in memory:
+// it only has to bridge the short windows during which a document isn't subscribed.
+// The caller must hold m.mutex or own the manager exclusively.
+func (m *Manager) ensureReplayStream() error {
+	js, err := m.conn.JetStream()
+	if err != nil {
+		return fmt.Errorf("JetStream unavailable: %w", err)
+	}
+
+	_, err = js.StreamInfo(m.replayStream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     m.replayStream,
+			Subjects: replayStreamSubjects,
+			Storage:  nats.MemoryStorage,
+			MaxAge:   m.replayMaxAge,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up replay stream %s: %w", m.replayStream, err)
+	}
+	return nil
+}
+
+// SetReplayFilters replaces the filters applied to the events replayed from the stream when a
+// document is resubscribed; the default keeps edits only. Events received live are not filtered.
+// It must be called before documents are subscribed.
+func (m *Manager) SetReplayFilters(filters ...document.ReplayFilter) {
+	m.replayFilters = filters
+}
+
+// replayFrom returns where a new consumer of the document starts reading the replay stream: after
+// the last edit the document received, from when it was first subscribed if it received none, or
+// with the next edit for a new document. replaying tells whether the consumer starts in the past.
+func (docSub *DocumentSubscription) replayFrom() (start nats.SubOpt, replaying bool) {
+	docSub.sequenceMutex.Lock()
+	defer docSub.sequenceMutex.Unlock()
+
+	switch {
+	case docSub.lastSequence > 0:
+		return nats.StartSequence(docSub.lastSequence + 1), true
+	case !docSub.subscribedAt.IsZero():
+		return nats.StartTime(docSub.subscribedAt), true
+	default:
+		docSub.subscribedAt = time.Now()
+		return nats.DeliverNew(), false
+	}
+}
+
+// filterReplay wraps the handler of a document so the events replayed from the stream, the ones up
+// to replayEnd, only reach it when every filter accepts them. Opaque messages and ones that can't
+// be decoded are passed on as is.
+func filterReplay(handler nats.MsgHandler, replayEnd uint64, filters []document.ReplayFilter) nats.MsgHandler {
+	if replayEnd == 0 || len(filters) == 0 {
+		return handler
+	}
+	return func(msg *nats.Msg) {
+		if meta, err := msg.Metadata(); err == nil && meta.Sequence.Stream <= replayEnd && msg.Header.Get(EncodingHeaderKey) == "" {
+			var event publisher.DocumentEvent
+			if err := json.Unmarshal(msg.Data, &event); err == nil && !document.Accepted(event, filters...) {
+				return
+			}
+		}
+		handler(msg)
+	}
+}
+
+// trackSequence wraps the handler of a document so the replay stream sequence of every received
+// edit is recorded. While an old and a new subscription overlap, either may deliver first, so
+// only the highest sequence is kept.
+func (docSub *DocumentSubscription) trackSequence(handler nats.MsgHandler) nats.MsgHandler {
+	return func(msg *nats.Msg) {
+		if meta, err := msg.Metadata(); err == nil {
+			docSub.sequenceMutex.Lock()
+			docSub.lastSequence = max(docSub.lastSequence, meta.Sequence.Stream)
+			docSub.sequenceMutex.Unlock()
+		}
+		handler(msg)
+	}
+}
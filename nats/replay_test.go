@@ -0,0 +1,182 @@
+package nats
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// newReplayManager returns a manager replaying edits from a stream on a JetStream server of its own
+func newReplayManager(t *testing.T) *Manager {
+	t.Helper()
+
+	ns := startServer(t, &server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	m, err := NewManager(config.NATSConfig{URL: ns.ClientURL(), Timeout: 5 * time.Second, ReplayStream: "DOCUMENTS", ReplayMaxAge: time.Minute})
+	if err != nil {
+		t.Fatalf("NewManager failed: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// subscribeEdits subscribes to a document, returning the data of the edits it receives
+func subscribeEdits(t *testing.T, m *Manager, documentID string) <-chan string {
+	t.Helper()
+
+	edits := make(chan string, 16)
+	err := m.Subscribe(documentID, func(msg *nats.Msg) {
+		var event publisher.DocumentEvent
+		if err := json.Unmarshal(msg.Data, &event); err == nil {
+			edits <- event.Payload.Data
+		}
+	})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	return edits
+}
+
+// publishEdit publishes an insert of data by alice on a document and waits for the server to take it
+func publishEdit(t *testing.T, m *Manager, documentID, data string) {
+	t.Helper()
+
+	publishEvent(t, m, documentID, "alice", "insert", data)
+}
+
+// publishEvent publishes an event on a document and waits for the server to take it
+func publishEvent(t *testing.T, m *Manager, documentID, userID, action, data string) {
+	t.Helper()
+
+	event := publisher.DocumentEvent{DocumentID: documentID, UserID: userID, Payload: publisher.DocumentEventPayload{Action: action, Data: data}}
+	if err := m.PublishDocumentEvent(event); err != nil {
+		t.Fatalf("PublishDocumentEvent failed: %v", err)
+	}
+	if err := m.GetConnection().Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+}
+
+// loseSubscription unsubscribes the NATS subscription of a document behind the manager's back
+func loseSubscription(t *testing.T, m *Manager, documentID string) {
+	t.Helper()
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if err := m.subscriptions[documentID].subscription.Unsubscribe(); err != nil {
+		t.Fatalf("Unsubscribe failed: %v", err)
+	}
+}
+
+// expectEdits fails the test unless exactly the given edits arrive, in order
+func expectEdits(t *testing.T, edits <-chan string, want ...string) {
+	t.Helper()
+
+	for _, data := range want {
+		select {
+		case got := <-edits:
+			if got != data {
+				t.Fatalf("received edit %q, want %q", got, data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("edit %q not received", data)
+		}
+	}
+	select {
+	case got := <-edits:
+		t.Fatalf("unexpectedly received edit %q", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestResubscribeReplaysMissedEdits(t *testing.T) {
+	m := newReplayManager(t)
+	edits := subscribeEdits(t, m, "doc1")
+	publishEdit(t, m, "doc1", "first")
+	expectEdits(t, edits, "first")
+
+	loseSubscription(t, m, "doc1")
+	publishEdit(t, m, "doc1", "missed")
+	if count, err := m.Resubscribe(); err != nil || count != 1 {
+		t.Fatalf("Resubscribe = %d, %v; want 1 document", count, err)
+	}
+
+	expectEdits(t, edits, "missed")
+}
+
+func TestResubscribeReplaysEditsMissedBeforeTheFirst(t *testing.T) {
+	m := newReplayManager(t)
+	edits := subscribeEdits(t, m, "doc1")
+
+	loseSubscription(t, m, "doc1")
+	publishEdit(t, m, "doc1", "missed")
+	if _, err := m.Resubscribe(); err != nil {
+		t.Fatalf("Resubscribe failed: %v", err)
+	}
+
+	expectEdits(t, edits, "missed")
+}
+
+func TestResubscribeOverlapDeliversOnce(t *testing.T) {
+	m := newReplayManager(t)
+	edits := subscribeEdits(t, m, "doc1")
+	publishEdit(t, m, "doc1", "first")
+	expectEdits(t, edits, "first")
+
+	if _, err := m.Resubscribe(); err != nil {
+		t.Fatalf("Resubscribe failed: %v", err)
+	}
+	publishEdit(t, m, "doc1", "second")
+
+	expectEdits(t, edits, "second")
+}
+
+func TestSubscribeSkipsEarlierEdits(t *testing.T) {
+	m := newReplayManager(t)
+	publishEdit(t, m, "doc1", "before")
+
+	edits := subscribeEdits(t, m, "doc1")
+	publishEdit(t, m, "doc1", "after")
+
+	expectEdits(t, edits, "after")
+}
+
+func TestReplayLeavesOutNonEdits(t *testing.T) {
+	m := newReplayManager(t)
+	edits := subscribeEdits(t, m, "doc1")
+	publishEdit(t, m, "doc1", "first")
+	expectEdits(t, edits, "first")
+
+	loseSubscription(t, m, "doc1")
+	publishEvent(t, m, "doc1", "alice", "cursor", "missed cursor")
+	publishEdit(t, m, "doc1", "missed")
+	if _, err := m.Resubscribe(); err != nil {
+		t.Fatalf("Resubscribe failed: %v", err)
+	}
+	expectEdits(t, edits, "missed")
+
+	// Only the replay is filtered
+	publishEvent(t, m, "doc1", "alice", "cursor", "live cursor")
+	expectEdits(t, edits, "live cursor")
+}
+
+func TestReplayFiltersAreReplaceable(t *testing.T) {
+	m := newReplayManager(t)
+	m.SetReplayFilters(document.ExcludeUser("bob"))
+	edits := subscribeEdits(t, m, "doc1")
+
+	loseSubscription(t, m, "doc1")
+	publishEvent(t, m, "doc1", "bob", "insert", "bob's")
+	publishEvent(t, m, "doc1", "alice", "cursor", "alice's cursor")
+	publishEdit(t, m, "doc1", "alice's")
+	if _, err := m.Resubscribe(); err != nil {
+		t.Fatalf("Resubscribe failed: %v", err)
+	}
+
+	expectEdits(t, edits, "alice's cursor", "alice's")
+}
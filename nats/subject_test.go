@@ -0,0 +1,39 @@
+package nats
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+func TestManagerRejectsInvalidSubjects(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+
+	if err := m.Subscribe("doc.>", ignore); !errors.Is(err, publisher.ErrInvalidSubject) {
+		t.Errorf("Subscribe = %v, want ErrInvalidSubject", err)
+	}
+	if count := m.SubscriptionCount(); count != 0 {
+		t.Errorf("%d subscriptions after a rejected Subscribe, want 0", count)
+	}
+	event := publisher.DocumentEvent{DocumentID: "*", Payload: publisher.DocumentEventPayload{Action: "insert", Data: "x"}}
+	if err := m.PublishDocumentEvent(event); !errors.Is(err, publisher.ErrInvalidSubject) {
+		t.Errorf("PublishDocumentEvent = %v, want ErrInvalidSubject", err)
+	}
+	if err := m.PublishOpaque("a.b", "alice", EncodingBinary, []byte{1}); !errors.Is(err, publisher.ErrInvalidSubject) {
+		t.Errorf("PublishOpaque = %v, want ErrInvalidSubject", err)
+	}
+}
+
+func TestSubscriptionManagerRejectsInvalidSubjects(t *testing.T) {
+	m := newInProcessManager(t, config.NATSConfig{})
+	sm := NewSubscriptionManager(m.GetConnection())
+
+	if err := sm.Subscribe("doc *", func(string, []byte) {}); !errors.Is(err, publisher.ErrInvalidSubject) {
+		t.Errorf("Subscribe = %v, want ErrInvalidSubject", err)
+	}
+	if count := sm.GetActiveSubscriptions(); count != 0 {
+		t.Errorf("%d subscriptions after a rejected Subscribe, want 0", count)
+	}
+}
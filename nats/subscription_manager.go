@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
 	"github.com/nats-io/nats.go"
 )
 
@@ -22,6 +24,15 @@ type DocumentSubscription struct {
 	connectionCount int
 	mutex           sync.RWMutex
 	messageHandler  func(documentID string, data []byte)
+	natsHandler     nats.MsgHandler
+	idleSince       time.Time
+	// activity tracks how often the document is edited, so cold documents are shed first
+	activity activity
+	// lastSequence is the replay stream sequence of the last edit received, subscribedAt when the
+	// document was first subscribed; both are only used with replay enabled
+	sequenceMutex sync.Mutex
+	lastSequence  uint64
+	subscribedAt  time.Time
 }
 
 // NewSubscriptionManager creates a new subscription manager
@@ -40,7 +51,10 @@ func (sm *SubscriptionManager) Subscribe(documentID string, messageHandler func(
 	docSub, exists := sm.subscriptions[documentID]
 	if !exists {
 		// Create new subscription
-		subject := fmt.Sprintf("document.%s.edit", documentID)
+		subject, err := publisher.DocumentSubject(documentID, "")
+		if err != nil {
+			return err
+		}
 
 		// Handler that processes NATS messages
 		natsHandler := func(msg *nats.Msg) {
@@ -0,0 +1,134 @@
+package nats
+
+import (
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Backoff bounds between attempts to replace a permanently closed connection
+const (
+	restartBackoffMin = time.Second
+	restartBackoffMax = 30 * time.Second
+)
+
+// Connection states reported by ConnectionStatus
+const (
+	StatusConnected    = "connected"
+	StatusReconnecting = "reconnecting"
+	StatusRestarting   = "restarting"
+	StatusDisconnected = "disconnected"
+)
+
+// connection returns the current NATS connection, which the watchdog may replace
+func (m *Manager) connection() *nats.Conn {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.conn
+}
+
+// connectionLost runs when the connection drops, before the client tries to reconnect; it also
+// runs when the connection is closed
+func (m *Manager) connectionLost(conn *nats.Conn, err error) {
+	if conn.IsReconnecting() {
+		m.status.Store(StatusReconnecting)
+		log.Printf("NATS connection lost, reconnecting: %v", err)
+		return
+	}
+	m.status.Store(StatusDisconnected)
+}
+
+// connectionRestored runs when the client reconnected on its own. The client replays its valid
+// subscriptions itself, so only the documents whose subscription was invalidated meanwhile are
+// subscribed again; resubscribing the others would deliver every message twice.
+func (m *Manager) connectionRestored(conn *nats.Conn) {
+	m.status.Store(StatusConnected)
+	log.Printf("NATS connection restored to %s", conn.ConnectedUrl())
+
+	count, err := m.resubscribe(true)
+	if err != nil {
+		log.Printf("NATS connection restored, but resubscribing failed: %v", err)
+	}
+	if count > 0 {
+		log.Printf("NATS connection restored, resubscribed %d documents", count)
+	}
+}
+
+// connectionClosed runs when the client closes the connection for good, normally after
+// exhausting its reconnect attempts. Unless the manager itself is closing, the watchdog
+// starts replacing the connection.
+func (m *Manager) connectionClosed(*nats.Conn) {
+	m.status.Store(StatusDisconnected)
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+
+	if m.restarting.CompareAndSwap(false, true) {
+		log.Printf("NATS connection closed permanently, restarting it")
+		go m.restart()
+	}
+}
+
+// restart dials a new connection with exponential backoff, then swaps it in and restores
+// the subscriptions of documents with active connections
+func (m *Manager) restart() {
+	defer m.restarting.Store(false)
+
+	backoff := restartBackoffMin
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		conn, err := m.connect()
+		if err != nil {
+			log.Printf("Failed to restart NATS connection (retrying in %v): %v", backoff, err)
+			backoff = min(backoff*2, restartBackoffMax)
+			continue
+		}
+
+		m.mutex.Lock()
+		select {
+		case <-m.done:
+			m.mutex.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		m.conn = conn
+		m.status.Store(StatusConnected)
+		if err := m.subscribeAdmin(); err != nil {
+			log.Printf("NATS connection restarted, but %v", err)
+		}
+		// A server that restarted lost the in-memory replay stream along with the edits in it
+		if m.replayStream != "" {
+			if err := m.ensureReplayStream(); err != nil {
+				log.Printf("NATS connection restarted, but %v", err)
+			}
+		}
+		m.mutex.Unlock()
+
+		count, err := m.Resubscribe()
+		if err != nil {
+			log.Printf("NATS connection restarted, but resubscribing failed: %v", err)
+		}
+		log.Printf("NATS connection restarted, restored %d subscriptions", count)
+		return
+	}
+}
+
+// ConnectionStatus reports the state of the NATS connection, as tracked by the connection callbacks
+func (m *Manager) ConnectionStatus() string {
+	if m.restarting.Load() {
+		return StatusRestarting
+	}
+	if status, ok := m.status.Load().(string); ok {
+		return status
+	}
+	return StatusDisconnected
+}
@@ -0,0 +1,100 @@
+package presence
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry is a participant seen in a document
+type Entry struct {
+	DocumentID string
+	UserID     string
+	LastSeen   time.Time
+}
+
+// Store tracks document participants across gateway instances. Entries must be refreshed
+// within the TTL or they expire, so participants of a crashed instance eventually disappear.
+type Store struct {
+	ttl       time.Duration
+	documents map[string]map[string]time.Time // documentID -> userID -> last seen
+	mutex     sync.Mutex
+}
+
+// NewStore creates a presence store whose entries expire after ttl without a refresh
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		ttl:       ttl,
+		documents: make(map[string]map[string]time.Time),
+	}
+}
+
+// TTL returns how long an entry lives without being refreshed
+func (s *Store) TTL() time.Duration {
+	return s.ttl
+}
+
+// Touch records that a user is present in a document, reporting whether the entry is new
+func (s *Store) Touch(documentID, userID string, now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	users, exists := s.documents[documentID]
+	if !exists {
+		users = make(map[string]time.Time)
+		s.documents[documentID] = users
+	}
+	_, known := users[userID]
+	users[userID] = now
+	return !known
+}
+
+// Remove forgets a user in a document, reporting whether it was present
+func (s *Store) Remove(documentID, userID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	users, exists := s.documents[documentID]
+	if !exists {
+		return false
+	}
+	if _, known := users[userID]; !known {
+		return false
+	}
+	delete(users, userID)
+	if len(users) == 0 {
+		delete(s.documents, documentID)
+	}
+	return true
+}
+
+// Expire removes and returns every entry not refreshed within the TTL as of now
+func (s *Store) Expire(now time.Time) []Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var expired []Entry
+	for documentID, users := range s.documents {
+		for userID, lastSeen := range users {
+			if now.Sub(lastSeen) > s.ttl {
+				expired = append(expired, Entry{DocumentID: documentID, UserID: userID, LastSeen: lastSeen})
+				delete(users, userID)
+			}
+		}
+		if len(users) == 0 {
+			delete(s.documents, documentID)
+		}
+	}
+	return expired
+}
+
+// Members returns the users currently present in a document
+func (s *Store) Members(documentID string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	members := make([]string, 0, len(s.documents[documentID]))
+	for userID := range s.documents[documentID] {
+		members = append(members, userID)
+	}
+	return members
+}
@@ -0,0 +1,56 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTouchReportsNewEntries(t *testing.T) {
+	store := NewStore(time.Minute)
+	now := time.Now()
+
+	if !store.Touch("doc1", "alice", now) {
+		t.Error("first Touch did not report a new entry")
+	}
+	if store.Touch("doc1", "alice", now) {
+		t.Error("refreshing Touch reported a new entry")
+	}
+	if !store.Touch("doc2", "alice", now) {
+		t.Error("Touch in another document did not report a new entry")
+	}
+}
+
+func TestExpireUnrefreshedEntries(t *testing.T) {
+	store := NewStore(time.Minute)
+	start := time.Now()
+	store.Touch("doc1", "alice", start)
+	store.Touch("doc1", "bob", start)
+
+	store.Touch("doc1", "bob", start.Add(45*time.Second))
+	expired := store.Expire(start.Add(90 * time.Second))
+
+	if len(expired) != 1 || expired[0].UserID != "alice" || expired[0].DocumentID != "doc1" || !expired[0].LastSeen.Equal(start) {
+		t.Fatalf("expired %+v, want only alice", expired)
+	}
+	if members := store.Members("doc1"); len(members) != 1 || members[0] != "bob" {
+		t.Errorf("members = %v, want bob", members)
+	}
+	if expired := store.Expire(start.Add(90 * time.Second)); len(expired) != 0 {
+		t.Errorf("entries expired twice: %+v", expired)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	store := NewStore(time.Minute)
+	store.Touch("doc1", "alice", time.Now())
+
+	if !store.Remove("doc1", "alice") {
+		t.Error("Remove did not report a present user")
+	}
+	if store.Remove("doc1", "alice") {
+		t.Error("Remove reported a user already gone")
+	}
+	if members := store.Members("doc1"); len(members) != 0 {
+		t.Errorf("members = %v, want none", members)
+	}
+}
@@ -1,14 +1,34 @@
 package publisher
 
+// Presence actions published on behalf of the server
+const (
+	ActionPresenceJoin      = "presence_join"
+	ActionPresenceLeave     = "presence_leave"
+	ActionPresenceHeartbeat = "presence_heartbeat"
+	// ActionTyping is published while a user types, ActionTypingStopped once their indicator expires
+	ActionTyping        = "typing"
+	ActionTypingStopped = "typing_stopped"
+)
+
 type DocumentEvent struct {
-	UserID     string               `json:"user_id"`
-	DocumentID string               `json:"document_id"`
-	Payload    DocumentEventPayload `json:"payload"`
-	Timestamp  int64                `json:"timestamp"`
+	SchemaVersion int                  `json:"schema_version"`
+	UserID        string               `json:"user_id"`
+	DocumentID    string               `json:"document_id"`
+	Payload       DocumentEventPayload `json:"payload"`
+	Timestamp     int64                `json:"timestamp"`
+	Color         string               `json:"color,omitempty"`
+	// DisplayName is the human-readable identity of the user, UserID remains the key
+	DisplayName string `json:"display_name,omitempty"`
+	// Service is set on events published by backend services, which are not document participants
+	Service bool `json:"service,omitempty"`
+	// SenderConnectionID is the connection the event came from; it travels in a NATS header, not in the payload
+	SenderConnectionID string `json:"-"`
 }
 
 type DocumentEventPayload struct {
 	Action   string `json:"action"`
 	Position int    `json:"position"`
 	Data     string `json:"data"`
+	// Length is the number of characters removed by a delete or replace; deletes default to len(Data)
+	Length int `json:"length,omitempty"`
 }
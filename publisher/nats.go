@@ -26,7 +26,10 @@ func (n *NATSPublisher) PublishDocumentEvent(event DocumentEvent) error {
 		return fmt.Errorf("failed to marshal event: %w", err)
 	}
 
-	subject := fmt.Sprintf("document.%s.edit.%s", event.DocumentID, event.Payload.Action)
+	subject, err := DocumentSubject(event.DocumentID, event.Payload.Action)
+	if err != nil {
+		return err
+	}
 
 	if err := n.conn.Publish(subject, data); err != nil {
 		return fmt.Errorf("failed to publish to NATS: %w", err)
@@ -0,0 +1,31 @@
+package publisher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CurrentSchemaVersion is the DocumentEvent schema version the gateway publishes
+const CurrentSchemaVersion = 1
+
+// ErrUnsupportedSchemaVersion is returned for payloads with a schema version the gateway can't handle
+var ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+
+// payloadUpgraders converts a payload of the keyed schema version to CurrentSchemaVersion
+var payloadUpgraders = map[int]func(DocumentEventPayload) DocumentEventPayload{
+	1: func(p DocumentEventPayload) DocumentEventPayload { return p },
+}
+
+// UpgradePayload converts a payload sent with the given schema version to the current schema.
+// A missing (zero) version is treated as version 1.
+func UpgradePayload(version int, payload DocumentEventPayload) (DocumentEventPayload, error) {
+	if version == 0 {
+		version = 1
+	}
+
+	upgrade, ok := payloadUpgraders[version]
+	if !ok {
+		return DocumentEventPayload{}, fmt.Errorf("%w: %d (supported up to %d)", ErrUnsupportedSchemaVersion, version, CurrentSchemaVersion)
+	}
+	return upgrade(payload), nil
+}
@@ -0,0 +1,31 @@
+package publisher
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUpgradePayload(t *testing.T) {
+	payload := DocumentEventPayload{Action: "insert", Position: 3, Data: "hi"}
+	tests := []struct {
+		name    string
+		version int
+		wantErr error
+	}{
+		{"missing version", 0, nil},
+		{"current version", CurrentSchemaVersion, nil},
+		{"future version", CurrentSchemaVersion + 1, ErrUnsupportedSchemaVersion},
+		{"negative version", -1, ErrUnsupportedSchemaVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := UpgradePayload(tt.version, payload)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != payload {
+				t.Errorf("payload = %+v, want %+v", got, payload)
+			}
+		})
+	}
+}
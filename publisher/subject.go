@@ -0,0 +1,64 @@
+package publisher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidSubject is returned when a NATS subject would contain an invalid token
+var ErrInvalidSubject = errors.New("invalid NATS subject")
+
+// SubjectPrefixDocument is the first token of every document subject
+const SubjectPrefixDocument = "document"
+
+// BuildSubject joins prefix, docID and suffix into a NATS subject. It is the only place subjects
+// are put together, so an ID containing a '.', '*' or '>' can never widen a subscription or
+// publish to another document. prefix and suffix may span several tokens, docID must be exactly
+// one; an empty suffix is left out.
+func BuildSubject(prefix, docID, suffix string) (string, error) {
+	if err := validateTokens(prefix); err != nil {
+		return "", fmt.Errorf("%w: prefix %q: %v", ErrInvalidSubject, prefix, err)
+	}
+	if err := validateToken(docID); err != nil {
+		return "", fmt.Errorf("%w: document ID %q: %v", ErrInvalidSubject, docID, err)
+	}
+	if suffix == "" {
+		return prefix + "." + docID, nil
+	}
+	if err := validateTokens(suffix); err != nil {
+		return "", fmt.Errorf("%w: suffix %q: %v", ErrInvalidSubject, suffix, err)
+	}
+	return prefix + "." + docID + "." + suffix, nil
+}
+
+// DocumentSubject returns the subject carrying the edits of a document, optionally narrowed to an action
+func DocumentSubject(docID, action string) (string, error) {
+	suffix := "edit"
+	if action != "" {
+		suffix += "." + action
+	}
+	return BuildSubject(SubjectPrefixDocument, docID, suffix)
+}
+
+// validateTokens validates every dot-separated token of a subject part
+func validateTokens(part string) error {
+	for _, token := range strings.Split(part, ".") {
+		if err := validateToken(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateToken checks a single token against the NATS subject rules: non-empty, no separators,
+// wildcards or whitespace
+func validateToken(token string) error {
+	if token == "" {
+		return errors.New("empty token")
+	}
+	if i := strings.IndexAny(token, ".*> \t\r\n"); i >= 0 {
+		return fmt.Errorf("forbidden character %q", token[i])
+	}
+	return nil
+}
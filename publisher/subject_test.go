@@ -0,0 +1,62 @@
+package publisher
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBuildSubject(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefix  string
+		docID   string
+		suffix  string
+		want    string
+		wantErr bool
+	}{
+		{"document edits", "document", "doc1", "edit", "document.doc1.edit", false},
+		{"multi-token parts", "gateway.admin", "doc-1_x", "edit.insert", "gateway.admin.doc-1_x.edit.insert", false},
+		{"no suffix", "admin", "close", "", "admin.close", false},
+		{"dot in ID", "document", "a.b", "edit", "", true},
+		{"single wildcard ID", "document", "*", "edit", "", true},
+		{"full wildcard ID", "document", ">", "edit", "", true},
+		{"wildcard inside ID", "document", "doc*", "edit", "", true},
+		{"whitespace in ID", "document", "doc 1", "edit", "", true},
+		{"empty ID", "document", "", "edit", "", true},
+		{"empty prefix token", "document.", "doc1", "edit", "", true},
+		{"wildcard suffix", "document", "doc1", "edit.>", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BuildSubject(tt.prefix, tt.docID, tt.suffix)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidSubject) {
+					t.Errorf("BuildSubject = %q, %v; want ErrInvalidSubject", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("BuildSubject = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDocumentSubject(t *testing.T) {
+	if got, err := DocumentSubject("doc1", ""); err != nil || got != "document.doc1.edit" {
+		t.Errorf("DocumentSubject without action = %q, %v", got, err)
+	}
+	if got, err := DocumentSubject("doc1", "insert"); err != nil || got != "document.doc1.edit.insert" {
+		t.Errorf("DocumentSubject with action = %q, %v", got, err)
+	}
+}
+
+func TestNATSPublisherRejectsInvalidSubjects(t *testing.T) {
+	// The subject is checked before the connection is used, so none is needed
+	p, _ := NewNATSPublisher(nil)
+
+	err := p.PublishDocumentEvent(DocumentEvent{DocumentID: "doc.*", Payload: DocumentEventPayload{Action: "insert", Data: "x"}})
+	if !errors.Is(err, ErrInvalidSubject) {
+		t.Errorf("PublishDocumentEvent = %v, want ErrInvalidSubject", err)
+	}
+}
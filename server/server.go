@@ -2,14 +2,21 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
+	"sort"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/shutdown"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Server represents the HTTP server with graceful shutdown
@@ -17,18 +24,27 @@ type Server struct {
 	config     *config.Config
 	httpServer *http.Server
 	mux        *http.ServeMux
+	// routes lists the patterns registered successfully
+	routes      []string
+	routesMutex sync.Mutex
 }
 
 // New creates a new server instance
 func New(cfg *config.Config) *Server {
 	mux := http.NewServeMux()
 
+	// h2c only takes over requests that ask for HTTP/2; WebSocket upgrades stay on HTTP/1.1 and can still hijack
+	var handler http.Handler = mux
+	if cfg.Server.H2C {
+		handler = h2c.NewHandler(mux, &http2.Server{})
+	}
+
 	return &Server{
 		config: cfg,
 		mux:    mux,
 		httpServer: &http.Server{
 			Addr:         cfg.GetServerAddress(),
-			Handler:      mux,
+			Handler:      handler,
 			ReadTimeout:  cfg.Server.ReadTimeout,
 			WriteTimeout: cfg.Server.WriteTimeout,
 		},
@@ -37,7 +53,7 @@ func New(cfg *config.Config) *Server {
 
 // RegisterHandler registers a handler for the given pattern
 func (s *Server) RegisterHandler(pattern string, handler http.HandlerFunc) {
-	s.mux.HandleFunc(pattern, handler)
+	s.handle(pattern, handler)
 }
 
 // RegisterHandlerWithMiddleware registers a handler with middleware
@@ -47,34 +63,113 @@ func (s *Server) RegisterHandlerWithMiddleware(pattern string, handler http.Hand
 	for i := len(middlewares) - 1; i >= 0; i-- {
 		finalHandler = middlewares[i](finalHandler)
 	}
-	s.mux.HandleFunc(pattern, finalHandler)
+	s.handle(pattern, finalHandler)
 }
 
-// Start starts the server with graceful shutdown
-func (s *Server) Start() error {
-	// Start server in goroutine
-	go func() {
-		log.Printf("Starting server on %s", s.config.GetServerAddress())
-		log.Printf("WebSocket endpoint: %s/ws/echo", s.config.GetWebSocketURL(""))
-		log.Printf("Health check: %s/health", s.config.GetHTTPURL(""))
+// handle registers a handler on the mux. The mux panics on malformed or conflicting patterns;
+// that is logged and the route skipped instead, so one bad route doesn't take the process down.
+func (s *Server) handle(pattern string, handler http.HandlerFunc) {
+	if err := s.tryHandle(pattern, handler); err != nil {
+		log.Printf("Failed to register route %q: %v", pattern, err)
+		return
+	}
+
+	s.routesMutex.Lock()
+	s.routes = append(s.routes, pattern)
+	s.routesMutex.Unlock()
+}
+
+// tryHandle registers a handler on the mux, turning a registration panic into an error
+func (s *Server) tryHandle(pattern string, handler http.HandlerFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	s.mux.HandleFunc(pattern, handler)
+	return nil
+}
+
+// Routes returns the registered route patterns in sorted order
+func (s *Server) Routes() []string {
+	s.routesMutex.Lock()
+	defer s.routesMutex.Unlock()
+
+	routes := make([]string, len(s.routes))
+	copy(routes, s.routes)
+	sort.Strings(routes)
+	return routes
+}
+
+// ShutdownTimeout is how long outstanding requests get to complete on shutdown
+const ShutdownTimeout = 30 * time.Second
+
+// Start starts the server and blocks until SIGINT or SIGTERM, then runs the coordinator's shutdown
+// sequence, which should include the server's own Shutdown
+func (s *Server) Start(coordinator *shutdown.Coordinator) error {
+	s.Serve()
+	return coordinator.WaitForSignal(syscall.SIGINT, syscall.SIGTERM)
+}
 
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+// Serve starts accepting connections in the background
+func (s *Server) Serve() {
+	go func() {
+		listener, err := s.listen()
+		if err != nil {
 			log.Fatalf("Server failed to start: %v", err)
 		}
+
+		if socket := s.config.Server.UnixSocket; socket != "" {
+			log.Printf("Starting server on unix socket %s", socket)
+		} else {
+			log.Printf("Starting server on %s", s.config.GetServerAddress())
+			log.Printf("WebSocket endpoint: %s/ws/echo", s.config.GetWebSocketURL(""))
+			log.Printf("Health check: %s/health", s.config.GetHTTPURL(""))
+		}
+
+		if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
 	}()
+}
 
-	// Wait for interrupt signal for graceful shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+// listen opens the Unix domain socket when one is configured, the TCP port otherwise. A socket
+// file left behind by a previous run is replaced; any other file at that path is an error.
+func (s *Server) listen() (net.Listener, error) {
+	socket := s.config.Server.UnixSocket
+	if socket == "" {
+		return net.Listen("tcp", s.httpServer.Addr)
+	}
 
-	log.Println("Shutting down server...")
+	if info, err := os.Lstat(socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", socket, err)
+		}
+	}
+	return net.Listen("unix", socket)
+}
 
-	// Give outstanding requests a deadline to complete
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// removeSocket deletes the Unix domain socket file, if the server listens on one
+func (s *Server) removeSocket() {
+	socket := s.config.Server.UnixSocket
+	if socket == "" {
+		return
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove socket %s: %v", socket, err)
+	}
+}
+
+// Shutdown stops accepting connections and waits for outstanding requests until ctx expires.
+// Hijacked WebSocket connections are not waited for, the hub closes them beforehand.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Println("Shutting down server...")
 
 	// Attempt graceful shutdown
+	defer s.removeSocket()
 	if err := s.httpServer.Shutdown(ctx); err != nil {
 		log.Printf("Server forced to shutdown: %v", err)
 		return err
@@ -86,6 +181,7 @@ func (s *Server) Start() error {
 
 // Stop stops the server immediately
 func (s *Server) Stop() error {
+	defer s.removeSocket()
 	return s.httpServer.Close()
 }
 
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/shutdown"
+	"golang.org/x/net/http2"
+)
+
+// testConfig returns a configuration listening on a free local port
+func testConfig() *config.Config {
+	return &config.Config{
+		Server: config.ServerConfig{Host: "127.0.0.1", Port: "0"},
+	}
+}
+
+func TestStartRunsCoordinatorOnSignal(t *testing.T) {
+	srv := New(testConfig())
+	srv.RegisterHandler("/ping", func(w http.ResponseWriter, r *http.Request) {})
+
+	stopped := make(chan struct{})
+	coordinator := shutdown.NewCoordinator()
+	coordinator.Add("http server", time.Second, func(ctx context.Context) error {
+		defer close(stopped)
+		return srv.Shutdown(ctx)
+	})
+
+	// Catch SIGTERM in the test too, so one sent before Start listens for it can't kill the process
+	sink := make(chan os.Signal, 1)
+	signal.Notify(sink, syscall.SIGTERM)
+	defer signal.Stop(sink)
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Start(coordinator) }()
+
+	// Keep signalling until Start has installed its handler and acted on it
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Start returned %v", err)
+			}
+			select {
+			case <-stopped:
+			default:
+				t.Fatal("Start returned without running the shutdown sequence")
+			}
+			return
+		case <-ticker.C:
+			syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+		case <-timeout:
+			t.Fatal("Start did not return after SIGTERM")
+		}
+	}
+}
+
+// h2cClient speaks HTTP/2 over cleartext TCP, with prior knowledge
+var h2cClient = &http.Client{Transport: &http2.Transport{
+	AllowHTTP: true,
+	DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	},
+}}
+
+func TestH2C(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.H2C = true
+	srv := New(cfg)
+	srv.RegisterHandler("/health", func(w http.ResponseWriter, r *http.Request) {})
+	ts := httptest.NewServer(srv.httpServer.Handler)
+	defer ts.Close()
+
+	resp, err := h2cClient.Get(ts.URL + "/health")
+	if err != nil {
+		t.Fatalf("h2c request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Errorf("h2c request answered %d over %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+	}
+
+	resp, err = http.Get(ts.URL + "/health")
+	if err != nil {
+		t.Fatalf("HTTP/1.1 request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 {
+		t.Errorf("HTTP/1.1 request answered %d over %s, want 200 over HTTP/1.1", resp.StatusCode, resp.Proto)
+	}
+}
+
+func TestH2CDisabledByDefault(t *testing.T) {
+	srv := New(testConfig())
+	srv.RegisterHandler("/health", func(w http.ResponseWriter, r *http.Request) {})
+	ts := httptest.NewServer(srv.httpServer.Handler)
+	defer ts.Close()
+
+	if resp, err := h2cClient.Get(ts.URL + "/health"); err == nil {
+		resp.Body.Close()
+		t.Errorf("h2c request answered %d over %s although h2c is off", resp.StatusCode, resp.Proto)
+	}
+}
+
+func TestInvalidRoutesAreSkipped(t *testing.T) {
+	srv := New(testConfig())
+	served := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) }
+	}
+
+	srv.RegisterHandler("/ping", served("first"))
+	srv.RegisterHandler("/ping", served("duplicate"))
+	srv.RegisterHandlerWithMiddleware("GET /documents/{id", served("malformed"))
+	srv.RegisterHandler("GET /info", served("info"))
+
+	if routes := srv.Routes(); !slices.Equal(routes, []string{"/ping", "GET /info"}) {
+		t.Errorf("routes = %v, want /ping and GET /info", routes)
+	}
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	if w.Body.String() != "first" {
+		t.Errorf("/ping served %q, want the first registration", w.Body)
+	}
+}
+
+// unixSocketConfig returns a configuration listening on a Unix domain socket in a temporary
+// directory, kept short as socket paths are limited to about 100 bytes
+func unixSocketConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "gw")
+	if err != nil {
+		t.Fatalf("MkdirTemp failed: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := testConfig()
+	cfg.Server.UnixSocket = filepath.Join(dir, "gateway.sock")
+	return cfg
+}
+
+// unixClient returns an HTTP client sending every request over the given Unix domain socket
+func unixClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+func TestServeOnUnixSocket(t *testing.T) {
+	cfg := unixSocketConfig(t)
+	srv := New(cfg)
+	srv.RegisterHandler("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("OK")) })
+	srv.Serve()
+
+	client := unixClient(cfg.Server.UnixSocket)
+	var resp *http.Response
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var err error
+		if resp, err = client.Get("http://gateway/health"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("request over the socket failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("/health answered %d %q over the socket, want 200 OK", resp.StatusCode, body)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if _, err := os.Lstat(cfg.Server.UnixSocket); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file left behind after shutdown: %v", err)
+	}
+}
+
+func TestListenReplacesStaleSocket(t *testing.T) {
+	cfg := unixSocketConfig(t)
+	stale, err := net.Listen("unix", cfg.Server.UnixSocket)
+	if err != nil {
+		t.Fatalf("failed to create the stale socket: %v", err)
+	}
+	// Leave the file behind, as a crashed process would
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := New(cfg).listen()
+	if err != nil {
+		t.Fatalf("listen over a stale socket failed: %v", err)
+	}
+	listener.Close()
+}
+
+func TestListenRefusesToReplaceAFile(t *testing.T) {
+	cfg := unixSocketConfig(t)
+	if err := os.WriteFile(cfg.Server.UnixSocket, []byte("data"), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if listener, err := New(cfg).listen(); err == nil {
+		listener.Close()
+		t.Fatal("listen replaced a regular file")
+	}
+	if data, err := os.ReadFile(cfg.Server.UnixSocket); err != nil || string(data) != "data" {
+		t.Errorf("the file was changed: %q, %v", data, err)
+	}
+}
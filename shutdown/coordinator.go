@@ -0,0 +1,83 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// Stage is one step of the shutdown sequence
+type Stage struct {
+	Name string
+	// Timeout bounds the stage; once it passes the sequence moves on without waiting for Run to return
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+}
+
+// Coordinator tears the gateway down in a fixed order, e.g. stop accepting connections, drain the
+// WebSockets, drain NATS, close NATS. Stages run one after another, each bounded by its own timeout,
+// and a failing or late stage doesn't keep the following ones from running.
+type Coordinator struct {
+	stages []Stage
+}
+
+// NewCoordinator creates a coordinator with no stages
+func NewCoordinator() *Coordinator {
+	return &Coordinator{}
+}
+
+// Add appends a stage to the sequence
+func (c *Coordinator) Add(name string, timeout time.Duration, run func(ctx context.Context) error) {
+	c.stages = append(c.stages, Stage{Name: name, Timeout: timeout, Run: run})
+}
+
+// Shutdown runs the stages in the order they were added, returning the errors of those that failed or timed out
+func (c *Coordinator) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, stage := range c.stages {
+		start := time.Now()
+		if err := runStage(ctx, stage); err != nil {
+			log.Printf("Shutdown stage %q failed after %v: %v", stage.Name, time.Since(start), err)
+			errs = append(errs, fmt.Errorf("%s: %w", stage.Name, err))
+			continue
+		}
+		log.Printf("Shutdown stage %q done in %v", stage.Name, time.Since(start))
+	}
+	return errors.Join(errs...)
+}
+
+// WaitForSignal blocks until one of the signals is received, then runs Shutdown
+func (c *Coordinator) WaitForSignal(signals ...os.Signal) error {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, signals...)
+	defer signal.Stop(quit)
+
+	sig := <-quit
+	log.Printf("Received %v, shutting down...", sig)
+	return c.Shutdown(context.Background())
+}
+
+// runStage runs a stage with its timeout, giving up on it when the timeout passes
+func runStage(ctx context.Context, stage Stage) error {
+	if stage.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, stage.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- stage.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
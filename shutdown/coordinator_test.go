@@ -0,0 +1,141 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/eventbus"
+	"github.com/emaforlin/ce-realtime-gateway/nats"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+func TestShutdownRunsStagesInOrder(t *testing.T) {
+	var ran []string
+	coordinator := NewCoordinator()
+	for _, name := range []string{"http server", "websockets", "nats"} {
+		coordinator.Add(name, time.Second, func(context.Context) error {
+			ran = append(ran, name)
+			return nil
+		})
+	}
+
+	if err := coordinator.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if want := []string{"http server", "websockets", "nats"}; !slices.Equal(ran, want) {
+		t.Errorf("stages ran as %v, want %v", ran, want)
+	}
+}
+
+func TestFailingStageDoesNotStopTheSequence(t *testing.T) {
+	failure := errors.New("drain failed")
+	ran := false
+	coordinator := NewCoordinator()
+	coordinator.Add("websockets", time.Second, func(context.Context) error { return failure })
+	coordinator.Add("nats", time.Second, func(context.Context) error {
+		ran = true
+		return nil
+	})
+
+	err := coordinator.Shutdown(context.Background())
+
+	if !errors.Is(err, failure) || !strings.Contains(err.Error(), "websockets") {
+		t.Errorf("Shutdown = %v, want the failure of the websockets stage", err)
+	}
+	if !ran {
+		t.Error("the stage after a failing one did not run")
+	}
+}
+
+func TestLateStageTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ran := false
+	coordinator := NewCoordinator()
+	coordinator.Add("stuck", 50*time.Millisecond, func(context.Context) error {
+		// Ignores its context, as a stage blocked on I/O would
+		<-release
+		return nil
+	})
+	coordinator.Add("nats", time.Second, func(context.Context) error {
+		ran = true
+		return nil
+	})
+
+	start := time.Now()
+	err := coordinator.Shutdown(context.Background())
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want the stuck stage to time out", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %v, want it to move on after the stage timeout", elapsed)
+	}
+	if !ran {
+		t.Error("the stage after a late one did not run")
+	}
+}
+
+func TestStageSeesItsDeadline(t *testing.T) {
+	coordinator := NewCoordinator()
+	var deadline time.Time
+	var hasDeadline bool
+	coordinator.Add("nats", time.Minute, func(ctx context.Context) error {
+		deadline, hasDeadline = ctx.Deadline()
+		return nil
+	})
+
+	coordinator.Shutdown(context.Background())
+
+	if !hasDeadline || time.Until(deadline) > time.Minute {
+		t.Errorf("stage deadline = %v (set %v), want within its timeout", deadline, hasDeadline)
+	}
+}
+
+func TestEventBusStagePublishesQueuedEventsBeforeNATSStages(t *testing.T) {
+	cfg := config.Load().NATS
+	natsManager, err := nats.NewInProcessManager(cfg)
+	if err != nil {
+		t.Fatalf("failed to start NATS: %v", err)
+	}
+	defer natsManager.Close()
+	bus := eventbus.New(1024, time.Second)
+	published := natsManager.PublishEvents(bus.Subscribe(eventbus.TopicEdit))
+
+	const queued = 1000
+	for i := 0; i < queued; i++ {
+		event := publisher.DocumentEvent{DocumentID: "doc1", UserID: "alice", Payload: publisher.DocumentEventPayload{Action: "insert", Data: "x"}}
+		if err := bus.Publish(event); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+
+	// The same stages as main, the NATS one recording what was published by the time it ran
+	var sent uint64
+	coordinator := NewCoordinator()
+	coordinator.Add("event bus", time.Second, func(ctx context.Context) error {
+		bus.Close()
+		select {
+		case <-published:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	coordinator.Add("nats drain", time.Second, func(ctx context.Context) error {
+		sent = natsManager.GetConnection().Stats().OutMsgs
+		return natsManager.Drain(ctx)
+	})
+
+	if err := coordinator.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if sent != queued {
+		t.Errorf("%d events published when the NATS stages ran, want all %d queued", sent, queued)
+	}
+}
@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/instance"
+	"github.com/emaforlin/ce-realtime-gateway/metrics"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// Observer POSTs document events to an external HTTP endpoint, for indexing or notifications, next
+// to the NATS fan-out. Events wait in a bounded queue and are delivered one at a time, in order.
+type Observer struct {
+	url          string
+	client       *http.Client
+	maxRetries   int
+	retryBackoff time.Duration
+	queue        chan publisher.DocumentEvent
+	done         chan struct{}
+}
+
+// statusError is returned when the endpoint answers with an unsuccessful status
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("webhook responded with status %d", e.code)
+}
+
+// NewObserver creates an observer delivering to the configured webhook
+func NewObserver(cfg config.WebhookConfig) *Observer {
+	return &Observer{
+		url:          cfg.URL,
+		client:       &http.Client{Timeout: cfg.Timeout},
+		maxRetries:   cfg.MaxRetries,
+		retryBackoff: cfg.RetryBackoff,
+		queue:        make(chan publisher.DocumentEvent, cfg.QueueSize),
+		done:         make(chan struct{}),
+	}
+}
+
+// Run queues the events for delivery until the channel is closed. Events arriving while the queue
+// is full are dropped rather than slowing down the producer.
+func (o *Observer) Run(events <-chan publisher.DocumentEvent) {
+	go o.deliverQueued()
+
+	for event := range events {
+		select {
+		case o.queue <- event:
+		default:
+			metrics.IncWebhookDrop("queue_full")
+			log.Printf("Webhook queue full, dropping %s event for document %s", event.Payload.Action, event.DocumentID)
+		}
+	}
+	close(o.queue)
+}
+
+// Done is closed once the events channel is closed and every queued event was delivered or given up on
+func (o *Observer) Done() <-chan struct{} {
+	return o.done
+}
+
+// deliverQueued delivers the queued events until the queue is closed and empty
+func (o *Observer) deliverQueued() {
+	defer close(o.done)
+
+	for event := range o.queue {
+		if err := o.deliver(event); err != nil {
+			metrics.IncWebhookDrop("delivery_failed")
+			log.Printf("Failed to deliver %s event for document %s to the webhook: %v", event.Payload.Action, event.DocumentID, err)
+		}
+	}
+}
+
+// deliver posts an event, retrying with exponential backoff on network errors, 429 and 5xx responses
+func (o *Observer) deliver(event publisher.DocumentEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	backoff := o.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err = o.post(body)
+		if err == nil || !retryable(err) || attempt >= o.maxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt
+func (o *Observer) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(instance.HeaderKey, instance.ID())
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// retryable reports whether a failed attempt may succeed later; other client errors never will
+func retryable(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code == http.StatusTooManyRequests || status.code >= 500
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/instance"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// endpoint is a webhook receiver answering each attempt with the next of its statuses, then 200
+type endpoint struct {
+	mutex    sync.Mutex
+	statuses []int
+	attempts int
+	received []publisher.DocumentEvent
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.attempts++
+	if r.Header.Get("Content-Type") != "application/json" || r.Header.Get(instance.HeaderKey) != instance.ID() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(e.statuses) > 0 {
+		status := e.statuses[0]
+		e.statuses = e.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var event publisher.DocumentEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e.received = append(e.received, event)
+}
+
+// results returns the number of attempts and the data of the events delivered
+func (e *endpoint) results() (int, []string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var data []string
+	for _, event := range e.received {
+		data = append(data, event.Payload.Data)
+	}
+	return e.attempts, data
+}
+
+// deliverAll runs an observer delivering to handler until every event was handled
+func deliverAll(t *testing.T, handler http.Handler, maxRetries int, events ...string) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	observer := NewObserver(config.WebhookConfig{URL: server.URL, QueueSize: 16, MaxRetries: maxRetries, RetryBackoff: time.Millisecond, Timeout: time.Second})
+
+	queued := make(chan publisher.DocumentEvent)
+	go observer.Run(queued)
+	for _, data := range events {
+		queued <- event(data)
+	}
+	close(queued)
+
+	select {
+	case <-observer.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("events not delivered")
+	}
+}
+
+// event returns an insert of data on doc1
+func event(data string) publisher.DocumentEvent {
+	return publisher.DocumentEvent{DocumentID: "doc1", UserID: "alice", Payload: publisher.DocumentEventPayload{Action: "insert", Data: data}}
+}
+
+func TestEventsDeliveredInOrder(t *testing.T) {
+	receiver := &endpoint{}
+	deliverAll(t, receiver, 0, "a", "b", "c")
+
+	if attempts, data := receiver.results(); attempts != 3 || len(data) != 3 || data[0] != "a" || data[1] != "b" || data[2] != "c" {
+		t.Errorf("delivered %v in %d attempts, want a, b and c once each", data, attempts)
+	}
+}
+
+func TestFailedDeliveriesRetried(t *testing.T) {
+	receiver := &endpoint{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	deliverAll(t, receiver, 3, "a")
+
+	if attempts, data := receiver.results(); attempts != 3 || len(data) != 1 {
+		t.Errorf("delivered %v in %d attempts, want the event on the third", data, attempts)
+	}
+}
+
+func TestRetriesGiveUp(t *testing.T) {
+	receiver := &endpoint{statuses: []int{500, 500, 500}}
+	deliverAll(t, receiver, 2, "a", "b")
+
+	if attempts, data := receiver.results(); attempts != 4 || len(data) != 1 || data[0] != "b" {
+		t.Errorf("delivered %v in %d attempts, want a given up after 3 attempts and b delivered", data, attempts)
+	}
+}
+
+func TestClientErrorsNotRetried(t *testing.T) {
+	receiver := &endpoint{statuses: []int{http.StatusBadRequest}}
+	deliverAll(t, receiver, 3, "a")
+
+	if attempts, data := receiver.results(); attempts != 1 || len(data) != 0 {
+		t.Errorf("delivered %v in %d attempts, want a single failed attempt", data, attempts)
+	}
+}
+
+func TestFullQueueDropsEvents(t *testing.T) {
+	arrived := make(chan struct{}, 8)
+	release := make(chan struct{})
+	receiver := &endpoint{}
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		receiver.ServeHTTP(w, r)
+	})
+	server := httptest.NewServer(blocking)
+	t.Cleanup(server.Close)
+	observer := NewObserver(config.WebhookConfig{URL: server.URL, QueueSize: 1, Timeout: 5 * time.Second})
+
+	queued := make(chan publisher.DocumentEvent)
+	go observer.Run(queued)
+	queued <- event("in flight")
+	<-arrived
+	for _, data := range []string{"queued", "dropped 1", "dropped 2"} {
+		queued <- event(data)
+	}
+	close(queued)
+	close(release)
+	<-observer.Done()
+
+	if _, data := receiver.results(); len(data) != 2 || data[0] != "in flight" || data[1] != "queued" {
+		t.Errorf("delivered %v, want the events beyond the queue size dropped", data)
+	}
+}
@@ -0,0 +1,42 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/nats"
+	"github.com/gorilla/websocket"
+)
+
+// AnnouncementMessage is an operator message pushed to participants
+type AnnouncementMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// HandleAdminCommand executes an admin command received on the admin subject
+func (h *DocumentHandler) HandleAdminCommand(cmd nats.AdminCommand) {
+	switch cmd.Action {
+	case nats.AdminActionAnnounce:
+		data, err := json.Marshal(AnnouncementMessage{Type: "announcement", Message: cmd.Message})
+		if err != nil {
+			return
+		}
+		// Without a document the announcement goes to everyone on this instance
+		if cmd.DocumentID == "" {
+			h.hub.Broadcast(DocumentMessage{Type: TextMessage, Data: data})
+		} else {
+			h.hub.BroadcastToDocument(cmd.DocumentID, data)
+		}
+	case nats.AdminActionCloseDocument:
+		h.CloseDocument(cmd.DocumentID)
+	case nats.AdminActionKick:
+		kicked := h.hub.KickUser(cmd.UserID, websocket.ClosePolicyViolation, "kicked")
+		log.Printf("Kicked user %s (%d connections)", cmd.UserID, kicked)
+	case nats.AdminActionRevokeToken:
+		middleware.RevokeToken(cmd.Token)
+	default:
+		log.Printf("Ignoring unknown admin command %q", cmd.Action)
+	}
+}
@@ -0,0 +1,41 @@
+package websocket
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/nats"
+	"github.com/gorilla/websocket"
+)
+
+func TestAnnouncementAdminCommand(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc2")
+
+	gateway.handler.HandleAdminCommand(nats.AdminCommand{Action: nats.AdminActionAnnounce, DocumentID: "doc1", Message: "read only soon"})
+	alice.expect("announcement", isNotice("announcement"))
+	bob.refuseWithin(300*time.Millisecond, "an announcement for another document", isNotice("announcement"))
+
+	gateway.handler.HandleAdminCommand(nats.AdminCommand{Action: nats.AdminActionAnnounce, Message: "restarting"})
+	alice.expect("announcement", isNotice("announcement"))
+	bob.expect("announcement", isNotice("announcement"))
+}
+
+func TestRevokeTokenAdminCommand(t *testing.T) {
+	gateway := newTestGateway(t)
+	// The token ID tells it apart from the identical tokens other tests sign in the same second
+	claims := testClaims("alice")
+	claims.ID = "revoked"
+	token := signToken(t, claims)
+	gateway.dialToken(token, "/ws/document/doc1").expect("welcome", isNotice("welcome"))
+
+	gateway.handler.HandleAdminCommand(nats.AdminCommand{Action: nats.AdminActionRevokeToken, Token: token})
+
+	_, resp, err := websocket.DefaultDialer.Dial(gateway.url("/ws/document/doc1?token="+token), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("dial with the revoked token = %v, want 401", err)
+	}
+	gateway.dial("bob", "doc1")
+}
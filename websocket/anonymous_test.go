@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAnonymousViewerIsReadOnly(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+
+	viewer := dialURL(t, websocket.DefaultDialer, gateway.url("/ws/document/doc1/view"))
+	welcome := viewer.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	if !welcome.ReadOnly {
+		t.Error("anonymous viewer is not read-only")
+	}
+	if !strings.HasPrefix(welcome.ClientID, "anon-") {
+		t.Errorf("anonymous viewer got client ID %q, want a generated anon- one", welcome.ClientID)
+	}
+
+	viewer.edit("vandalism")
+	viewer.expect("read_only error", func(m testMessage) bool { return m.Type == "error" && m.Code == "read_only" })
+
+	alice.edit("hello")
+	viewer.expectEdit("hello")
+}
+
+func TestIDsComeFromTheHubGenerator(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	gateway.dial("alice", "doc1")
+	viewer := dialURL(t, websocket.DefaultDialer, gateway.url("/ws/document/doc1/view"))
+
+	if id := gateway.connectionOf("alice").GetID(); id != "conn-1" {
+		t.Errorf("alice's connection ID = %q, want conn-1", id)
+	}
+	welcome := viewer.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	if welcome.ClientID != "anon-conn-2" {
+		t.Errorf("anonymous client ID = %q, want anon-conn-2", welcome.ClientID)
+	}
+	if id := gateway.connectionOf("anon-conn-2").GetID(); id != "conn-3" {
+		t.Errorf("anonymous connection ID = %q, want conn-3", id)
+	}
+}
@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// crdtUpdate is not valid JSON nor UTF-8, like the updates of CRDT libraries
+var crdtUpdate = []byte{0x00, 0x01, 0xff, 0xfe, '{', 0x80}
+
+// isBinary matches any binary frame
+func isBinary(m testMessage) bool {
+	return m.binary
+}
+
+// sendBinary writes data as a binary frame
+func (c *testClient) sendBinary(data []byte) {
+	c.t.Helper()
+
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		c.t.Fatalf("failed to send: %v", err)
+	}
+}
+
+func TestBinaryUpdatesRelayedUnmodified(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.binaryPassthrough = true })
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+	carol := gateway.dial("carol", "doc2")
+
+	alice.sendBinary(crdtUpdate)
+
+	if got := bob.expect("binary update", isBinary); !bytes.Equal(got.raw, crdtUpdate) {
+		t.Errorf("received % x, want % x", got.raw, crdtUpdate)
+	}
+	alice.refuseWithin(300*time.Millisecond, "its own binary update", isBinary)
+	carol.refuseWithin(100*time.Millisecond, "a binary update of another document", isBinary)
+}
+
+func TestBinaryUpdatesRejectedWhileDraining(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.binaryPassthrough = true })
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	gateway.handler.Drain("doc1")
+	alice.sendBinary(crdtUpdate)
+
+	alice.expect("document_draining error", func(m testMessage) bool { return m.Type == "error" && m.Code == "document_draining" })
+	bob.refuseWithin(300*time.Millisecond, "a binary update of a draining document", isBinary)
+}
+
+func TestBinaryFramesParsedWithoutPassthrough(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	alice.sendBinary(crdtUpdate)
+
+	bob.refuseWithin(300*time.Millisecond, "a binary frame relayed without passthrough", isBinary)
+}
@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	"strings"
+	"sync"
+)
+
+// DefaultCursorPalette is the set of cursor colors handed out to participants
+var DefaultCursorPalette = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231",
+	"#911eb4", "#42d4f4", "#f032e6", "#bfef45",
+	"#469990", "#9a6324", "#800000", "#000075",
+}
+
+// ColorAllocator assigns each participant of a document a cursor color distinct from the others
+type ColorAllocator struct {
+	palette   []string
+	documents map[string]map[string]*colorAllocation // documentID -> clientID -> color
+	mutex     sync.Mutex
+}
+
+// colorAllocation is the color of a client in a document, held by each of its connections there
+type colorAllocation struct {
+	color   string
+	holders int
+}
+
+// NewColorAllocator creates a color allocator over the given palette
+func NewColorAllocator(palette []string) *ColorAllocator {
+	return &ColorAllocator{
+		palette:   palette,
+		documents: make(map[string]map[string]*colorAllocation),
+	}
+}
+
+// Assign picks a color for a client in a document. The preferred color is honored when it is
+// in the palette and not taken; otherwise the least used palette color is chosen, so colors
+// only repeat once the palette is exhausted. Every connection of the client in the document
+// gets the same color, and holds it until it calls Release.
+func (a *ColorAllocator) Assign(documentID, clientID, preferred string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	assigned, exists := a.documents[documentID]
+	if !exists {
+		assigned = make(map[string]*colorAllocation)
+		a.documents[documentID] = assigned
+	}
+	if allocation, ok := assigned[clientID]; ok {
+		allocation.holders++
+		return allocation.color
+	}
+
+	usage := make(map[string]int, len(a.palette))
+	for _, allocation := range assigned {
+		usage[allocation.color]++
+	}
+
+	color := ""
+	for _, candidate := range a.palette {
+		if preferred != "" && strings.EqualFold(candidate, preferred) && usage[candidate] == 0 {
+			color = candidate
+			break
+		}
+	}
+	if color == "" {
+		for _, candidate := range a.palette {
+			if color == "" || usage[candidate] < usage[color] {
+				color = candidate
+			}
+		}
+	}
+
+	assigned[clientID] = &colorAllocation{color: color, holders: 1}
+	return color
+}
+
+// Release drops one connection's hold on a client's color in a document; the color is freed
+// once the client's last connection there releases it
+func (a *ColorAllocator) Release(documentID, clientID string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	allocation, exists := a.documents[documentID][clientID]
+	if !exists {
+		return
+	}
+	allocation.holders--
+	if allocation.holders > 0 {
+		return
+	}
+	delete(a.documents[documentID], clientID)
+	if len(a.documents[documentID]) == 0 {
+		delete(a.documents, documentID)
+	}
+}
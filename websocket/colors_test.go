@@ -0,0 +1,64 @@
+package websocket
+
+import "testing"
+
+func TestColorAllocatorHonorsPreference(t *testing.T) {
+	colors := NewColorAllocator([]string{"#111111", "#222222"})
+
+	if got := colors.Assign("doc1", "alice", "#222222"); got != "#222222" {
+		t.Errorf("alice got %s, want the preferred #222222", got)
+	}
+	if got := colors.Assign("doc1", "bob", "#222222"); got != "#111111" {
+		t.Errorf("bob got %s, want the free #111111 since the preferred one is taken", got)
+	}
+}
+
+func TestColorAllocatorKeepsColorUntilLastConnectionReleases(t *testing.T) {
+	colors := NewColorAllocator([]string{"#111111", "#222222"})
+
+	first := colors.Assign("doc1", "alice", "")
+	if second := colors.Assign("doc1", "alice", ""); second != first {
+		t.Fatalf("alice's second tab got %s, want the first tab's %s", second, first)
+	}
+
+	// Closing one tab must not hand the color of alice's other tab to someone else
+	colors.Release("doc1", "alice")
+	if got := colors.Assign("doc1", "bob", first); got == first {
+		t.Errorf("bob got %s while alice still holds it", got)
+	}
+
+	colors.Release("doc1", "alice")
+	if got := colors.Assign("doc1", "carol", first); got != first {
+		t.Errorf("carol got %s, want %s freed by alice's last tab", got, first)
+	}
+}
+
+func TestColorAllocatorCyclesOnceExhausted(t *testing.T) {
+	colors := NewColorAllocator([]string{"#111111", "#222222"})
+
+	first := colors.Assign("doc1", "alice", "")
+	second := colors.Assign("doc1", "bob", "")
+	if first == second {
+		t.Fatalf("alice and bob both got %s", first)
+	}
+	if third := colors.Assign("doc1", "carol", ""); third != first && third != second {
+		t.Errorf("carol got %s, want a palette color", third)
+	}
+	if other := colors.Assign("doc2", "dave", first); other != first {
+		t.Errorf("dave got %s in another document, want the preferred %s", other, first)
+	}
+}
+
+func TestParticipantsGetDistinctColors(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	seen := make(map[string]string)
+	for _, userID := range []string{"alice", "bob", "carol"} {
+		client := gateway.dialPath(userID, "/ws/document/doc1")
+		welcome := client.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+		if other, taken := seen[welcome.Color]; taken || welcome.Color == "" {
+			t.Errorf("%s got color %q, already held by %q", userID, welcome.Color, other)
+		}
+		seen[welcome.Color] = userID
+	}
+}
@@ -0,0 +1,69 @@
+package websocket
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// countingConn counts the bytes written to the underlying network connection
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// BytesWritten returns the total number of bytes written to the network so far
+func (c *countingConn) BytesWritten() int64 {
+	return c.written.Load()
+}
+
+// countingResponseWriter hands a countingConn to the upgrader when the connection is hijacked
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+// Hijack implements http.Hijacker wrapping the hijacked connection in a countingConn
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.Hijacker interface not supported")
+	}
+
+	netConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &countingConn{Conn: netConn}
+	return w.conn, brw, nil
+}
+
+// compressionPreferred reports whether the client wants its messages compressed: true unless it
+// passed ?compress=false, e.g. on a device short on CPU
+func compressionPreferred(r *http.Request) bool {
+	preferred, err := strconv.ParseBool(r.URL.Query().Get("compress"))
+	return err != nil || preferred
+}
+
+// compressionRequested reports whether the client offered permessage-deflate during the handshake
+func compressionRequested(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(ext), ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package websocket
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/metrics"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/gorilla/websocket"
+)
+
+// scrapeMetric returns the value of an unlabelled metric served by the metrics endpoint
+func scrapeMetric(t *testing.T, name string) float64 {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), name+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("metric %s has value %q: %v", name, value, err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("metric %s not served", name)
+	return 0
+}
+
+// compressedURL serves the gateway's hub and handler behind an upgrader negotiating compression,
+// returning the WebSocket URL of a document on it
+func compressedURL(gateway *testGateway, userID, documentID string) string {
+	upgrader := NewUpgrader(config.Load())
+	upgrader.EnableCompression = true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/document/{id}", middleware.AuthJWT(HandleWebSocket(upgrader, gateway.hub, gateway.handler)))
+	server := httptest.NewServer(mux)
+	gateway.t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/document/" + documentID + "?token=" + testToken(gateway.t, userID)
+}
+
+func TestCompressionRatioRecorded(t *testing.T) {
+	gateway := newTestGateway(t)
+	payloadBefore := scrapeMetric(t, "gateway_websocket_compression_payload_bytes_total")
+
+	client := dialURL(t, &websocket.Dialer{EnableCompression: true}, compressedURL(gateway, "alice", "doc1"))
+
+	welcome := client.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	if !welcome.Compressed {
+		t.Fatal("welcome reports an uncompressed connection")
+	}
+	if payload := scrapeMetric(t, "gateway_websocket_compression_payload_bytes_total"); payload <= payloadBefore {
+		t.Errorf("compressed payload bytes stayed at %v after the welcome", payload)
+	}
+	if ratio := scrapeMetric(t, "gateway_websocket_compression_ratio"); ratio <= 0 {
+		t.Errorf("compression ratio = %v, want it populated", ratio)
+	}
+}
+
+func TestNegotiatedCompressionRecorded(t *testing.T) {
+	gateway := newTestGateway(t)
+	dialURL(t, &websocket.Dialer{EnableCompression: true}, compressedURL(gateway, "alice", "doc1")).
+		expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	gateway.dial("bob", "doc1")
+
+	if compressed, ok := gateway.connectionOf("alice").GetMetadata(config.MetaCompressionKey).(bool); !ok || !compressed {
+		t.Errorf("alice's compression metadata = %v, want true", gateway.connectionOf("alice").GetMetadata(config.MetaCompressionKey))
+	}
+	if compressed, ok := gateway.connectionOf("bob").GetMetadata(config.MetaCompressionKey).(bool); !ok || compressed {
+		t.Errorf("bob's compression metadata = %v, want false", gateway.connectionOf("bob").GetMetadata(config.MetaCompressionKey))
+	}
+	if _, ok := gateway.connectionOf("bob").GetMetadata(config.MetaSubprotocolKey).(string); !ok {
+		t.Error("bob's subprotocol not recorded")
+	}
+	if stats := gateway.hub.ConnectionStats(); stats.Connections != 2 || stats.CompressedConnections != 1 {
+		t.Errorf("stats = %+v, want 1 of 2 connections compressed", stats)
+	}
+}
+
+func TestCompressionPreferred(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"?compress=true", true},
+		{"?compress=1", true},
+		{"?compress=false", false},
+		{"?compress=0", false},
+		{"?compress=maybe", true},
+	}
+	for _, tt := range tests {
+		if got := compressionPreferred(httptest.NewRequest(http.MethodGet, "/ws/document/doc1"+tt.query, nil)); got != tt.want {
+			t.Errorf("compressionPreferred(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionOptOut(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	client := dialURL(t, &websocket.Dialer{EnableCompression: true}, compressedURL(gateway, "alice", "doc1")+"&compress=false")
+
+	welcome := client.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	if welcome.Compressed {
+		t.Error("welcome reports a compressed connection although the client opted out")
+	}
+	if sessions := gateway.hub.UserSessions("alice"); len(sessions) != 1 || sessions[0].Compressed {
+		t.Errorf("sessions = %+v, want one uncompressed session", sessions)
+	}
+}
@@ -1,58 +1,299 @@
 package websocket
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/emaforlin/ce-realtime-gateway/clock"
 	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/eventbus"
+	"github.com/emaforlin/ce-realtime-gateway/logging"
+	"github.com/emaforlin/ce-realtime-gateway/metrics"
 	"github.com/emaforlin/ce-realtime-gateway/nats"
+	"github.com/emaforlin/ce-realtime-gateway/presence"
 	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/gorilla/websocket"
 	natsPkg "github.com/nats-io/nats.go"
 )
 
+// editLog logs inbound edits and their fan-out
+var editLog = logging.For(logging.CategoryEdit)
+
+// ErrReadOnlyConnection is returned when a read-only connection attempts to edit a document
+var ErrReadOnlyConnection = errors.New("connection is read-only")
+
+// inboundMessage is a client edit message, optionally tagged with the schema version it was written against
+type inboundMessage struct {
+	SchemaVersion int `json:"schema_version"`
+	publisher.DocumentEventPayload
+}
+
+// WelcomeMessage is the first message a client receives after joining a document
+type WelcomeMessage struct {
+	Type       string `json:"type"`
+	ClientID   string `json:"client_id"`
+	DocumentID string `json:"document_id"`
+	Color      string `json:"color"`
+	Protocol   int    `json:"protocol"`
+	Compressed bool   `json:"compressed"`
+	// ReadOnly tells the client its edits are refused, e.g. after an unauthorized user was downgraded
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Encrypted tells the client to encrypt its payloads end to end; the gateway only relays them
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Members lists the users present in the document across all instances, the joining one included;
+	// presence_join and presence_leave events keep it current afterwards
+	Members []string `json:"members"`
+}
+
+// CatchUpMessage carries the edits a rejoining client missed since its last-seen revision
+type CatchUpMessage struct {
+	Type     string                    `json:"type"`
+	Revision int64                     `json:"revision"`
+	Events   []publisher.DocumentEvent `json:"events"`
+}
+
+// SnapshotMessage carries the full document when the client is too far behind for a delta
+type SnapshotMessage struct {
+	Type string `json:"type"`
+	document.Snapshot
+}
+
 type DocumentHandler struct {
 	natsManager *nats.Manager
 	hub         *Hub
+	bus         *eventbus.Bus
+	states      *document.Registry
+	colors      *ColorAllocator
+	presence    *presence.Store
+	clock       clock.Clock
+	drains      map[string]*drainState
+	closing     map[string]struct{}
+	drainMode   string
+	drainMutex  sync.Mutex
+	// statsSubs stops the stats push of each subscribed connection, by connection ID
+	statsSubs     map[string]chan struct{}
+	statsInterval time.Duration
+	statsMutex    sync.Mutex
+	// replayFilters select which history events a rejoining client is sent
+	replayFilters []document.ReplayFilter
+	// binaryPassthrough relays binary frames without parsing them
+	binaryPassthrough bool
+	// transient throttles cursor and presence messages per connection
+	transient *transientThrottle
+	// authorize checks access to the documents connections join, unauthorizedStrategy handles denials
+	authorize            DocumentAuthorizer
+	unauthorizedStrategy UnauthorizedStrategy
+	// typing ends typing indicators that stopped being refreshed
+	typing *typingTracker
+	// senderExclusion decides per topic which of the sender's connections don't get an event back
+	senderExclusion map[eventbus.Topic]SenderExclusion
+	// middlewares run before the built-in message stages, handleMessage is the whole chain
+	middlewares   []MessageMiddleware
+	handleMessage MessageHandlerFunc
 }
 
-func NewDocumentHandler(natsManager *nats.Manager, hub *Hub) *DocumentHandler {
-	return &DocumentHandler{
-		natsManager: natsManager,
-		hub:         hub,
+func NewDocumentHandler(natsManager *nats.Manager, hub *Hub, bus *eventbus.Bus, states *document.Registry, clk clock.Clock) *DocumentHandler {
+	wsCfg := config.Load().WebSocket
+	h := &DocumentHandler{
+		natsManager:       natsManager,
+		hub:               hub,
+		bus:               bus,
+		states:            states,
+		colors:            NewColorAllocator(DefaultCursorPalette),
+		presence:          presence.NewStore(wsCfg.PresenceTTL),
+		clock:             clk,
+		drains:            make(map[string]*drainState),
+		closing:           make(map[string]struct{}),
+		drainMode:         wsCfg.DrainMode,
+		statsSubs:         make(map[string]chan struct{}),
+		statsInterval:     clampStatsInterval(wsCfg.StatsInterval),
+		replayFilters:     []document.ReplayFilter{document.EditsOnly},
+		binaryPassthrough: wsCfg.BinaryPassthrough,
+		transient:         newTransientThrottle(wsCfg.TransientRateLimit, time.Second),
+		typing:            newTypingTracker(wsCfg.TypingTimeout),
+	}
+	h.unauthorizedStrategy = parseUnauthorizedStrategy(wsCfg.UnauthorizedStrategy)
+	h.senderExclusion, _ = ParseSenderExclusion(DefaultSenderExclusion)
+	if exclusions, err := ParseSenderExclusion(wsCfg.SenderExclusion); err != nil {
+		log.Printf("Ignoring WS_SENDER_EXCLUSION: %v", err)
+	} else {
+		for topic, exclusion := range exclusions {
+			h.senderExclusion[topic] = exclusion
+		}
 	}
+	h.buildMessageChain()
+	return h
+}
+
+// Use adds message middlewares running ahead of the handler's own stages, in the order given.
+// It must be called before the handler starts serving connections.
+func (h *DocumentHandler) Use(middlewares ...MessageMiddleware) {
+	h.middlewares = append(h.middlewares, middlewares...)
+	h.buildMessageChain()
+}
+
+// buildMessageChain assembles the message stages: registered middlewares, then binary relay,
+// keepalives, control messages, the read-only guard, validation and throttling, and finally publishing
+func (h *DocumentHandler) buildMessageChain() {
+	stages := append([]MessageMiddleware{}, h.middlewares...)
+	stages = append(stages,
+		h.relayEncrypted,
+		h.relayBinaryFrames,
+		skipKeepalives,
+		h.handleControlMessages,
+		rejectReadOnly,
+		validateEdits,
+		h.throttleTransient,
+	)
+	h.handleMessage = ChainMessages(stages...)(h.publishEdit)
 }
 
 func (h *DocumentHandler) HandleMessage(conn *Connection, message DocumentMessage) error {
-	documentID, ok := conn.GetMetadata(config.MetaDocumentIDKey).(string)
-	if !ok {
-		documentID = ""
+	return h.handleMessage(conn, message)
+}
+
+// relayEncrypted relays every frame of an end-to-end encrypted document untouched: the payload is
+// ciphertext, so it is never parsed, validated, applied to the document state or logged
+func (h *DocumentHandler) relayEncrypted(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(conn *Connection, message DocumentMessage) error {
+		documentID := connectionDocumentID(conn)
+		if !h.hub.overrides.encrypted(documentID) {
+			return next(conn, message)
+		}
+		encoding := nats.EncodingEncrypted
+		if message.Type == BinaryMessage {
+			encoding = nats.EncodingBinary
+		}
+		return h.relayOpaque(conn, documentID, encoding, message.Data)
 	}
+}
+
+// relayBinaryFrames hands binary frames to the passthrough relay when it is enabled
+func (h *DocumentHandler) relayBinaryFrames(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(conn *Connection, message DocumentMessage) error {
+		if message.Type == BinaryMessage && h.binaryPassthrough {
+			return h.relayOpaque(conn, connectionDocumentID(conn), nats.EncodingBinary, message.Data)
+		}
+		return next(conn, message)
+	}
+}
 
-	userID := conn.GetClientID()
+// skipKeepalives treats empty frames as application-level keepalives, not malformed edits
+func skipKeepalives(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(conn *Connection, message DocumentMessage) error {
+		if len(bytes.TrimSpace(message.Data)) == 0 {
+			return nil
+		}
+		return next(conn, message)
+	}
+}
 
-	log.Printf("Received: %s from %s on %s", message.Data, userID, documentID)
+// handleControlMessages processes control messages, which are allowed on read-only connections too
+func (h *DocumentHandler) handleControlMessages(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(conn *Connection, message DocumentMessage) error {
+		if h.handleControl(conn, connectionDocumentID(conn), message.Data) {
+			return nil
+		}
+		return next(conn, message)
+	}
+}
 
-	var docMsg publisher.DocumentEventPayload
-	if err := json.Unmarshal(message.Data, &docMsg); err != nil {
-		log.Printf("failed to parse document message: %v", err)
-		return err
+// rejectReadOnly refuses edits from read-only connections
+func rejectReadOnly(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(conn *Connection, message DocumentMessage) error {
+		if conn.IsReadOnly() {
+			conn.SendError("read_only", "this connection cannot edit the document")
+			return ErrReadOnlyConnection
+		}
+		return next(conn, message)
+	}
+}
+
+// validateEdits parses an edit, upgrades it to the current schema and validates it, passing it on parsed
+func validateEdits(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(conn *Connection, message DocumentMessage) error {
+		if editLog.Enabled(logging.LevelDebug) {
+			conn.Log().Debugf("Received: %s", message.Data)
+		}
+
+		var inbound inboundMessage
+		if err := json.Unmarshal(message.Data, &inbound); err != nil {
+			editLog.Warnf("failed to parse document message: %v", err)
+			return err
+		}
+
+		docMsg, err := publisher.UpgradePayload(inbound.SchemaVersion, inbound.DocumentEventPayload)
+		if err != nil {
+			conn.SendError("unsupported_schema_version", err.Error())
+			return err
+		}
+
+		if err := document.Validate(docMsg); err != nil {
+			conn.SendError("invalid_edit", err.Error())
+			return err
+		}
+
+		message.edit = &docMsg
+		return next(conn, message)
+	}
+}
+
+// throttleTransient quietly drops excess cursor and presence updates; the next one supersedes them anyway
+func (h *DocumentHandler) throttleTransient(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(conn *Connection, message DocumentMessage) error {
+		if message.edit == nil || eventbus.TopicFor(message.edit.Action) == eventbus.TopicEdit {
+			return next(conn, message)
+		}
+
+		limit := h.hub.overrides.transientRateLimit(connectionDocumentID(conn), h.transient.limit)
+		if !h.transient.AllowWithLimit(conn.GetID(), h.clock.Now(), limit) {
+			return nil
+		}
+		return next(conn, message)
+	}
+}
+
+// publishEdit hands a validated edit to the bus, unless its document is draining
+func (h *DocumentHandler) publishEdit(conn *Connection, message DocumentMessage) error {
+	if message.edit == nil {
+		return errors.New("message reached publishing without being validated")
 	}
 
 	event := publisher.DocumentEvent{
-		DocumentID: documentID,
-		UserID:     userID,
-		Payload:    docMsg,
-		Timestamp:  time.Now().Unix(),
+		SchemaVersion: publisher.CurrentSchemaVersion,
+		DocumentID:    connectionDocumentID(conn),
+		UserID:        conn.GetClientID(),
+		Payload:       *message.edit,
+		Timestamp:     h.clock.Now().Unix(),
+		Color:         cursorColor(conn),
+		DisplayName:   conn.GetDisplayName(),
+		Service:       conn.IsService(),
+		// Lets receivers skip only the originating connection when the topic asks for it
+		SenderConnectionID: conn.GetID(),
 	}
 
-	go func() {
-		if err := h.natsManager.PublishDocumentEvent(event); err != nil {
-			log.Printf("Failed to publish document event: %v", err)
+	if held, err := h.holdIfDraining(event); held {
+		if err != nil {
+			conn.SendError("document_draining", "the document is temporarily not accepting edits")
 		}
-	}()
+		return err
+	}
 
-	log.Printf("Document event processed: type=%s, doc=%s, user=%s",
+	// Hand the event to the bus; NATS and any other consumers pick it up from there
+	if err := h.bus.Publish(event); err != nil {
+		conn.SendError("overloaded", "the edit could not be accepted, retry later")
+		return fmt.Errorf("failed to publish edit: %w", err)
+	}
+
+	editLog.Infof("Document event processed: type=%s, doc=%s, user=%s",
 		event.Payload.Action, event.DocumentID, event.UserID)
 
 	return nil
@@ -65,16 +306,71 @@ func (h *DocumentHandler) OnConnect(conn *Connection) error {
 		return nil
 	}
 
-	log.Printf("🔗 User %s joining document %s", conn.GetClientID(), documentID)
+	conn.Log().Infof("🔗 Joining document")
+
+	if h.isClosing(documentID) {
+		return ErrDocumentClosing
+	}
+	if err := h.applyAuthorization(conn, documentID); err != nil {
+		return err
+	}
+
+	// The joining connection is already registered, so it counts towards the limit
+	if overrides, _ := h.hub.overrides.Get(documentID); overrides.MaxConnections > 0 && h.hub.CountConnectionsForDocument(documentID) > overrides.MaxConnections {
+		return ErrDocumentFull
+	}
 
 	// Dynamically subscribe to the document's NATS subject
 	err := h.natsManager.Subscribe(documentID, h.createNATSHandler(documentID))
 	if err != nil {
-		log.Printf("❌ Failed to subscribe to NATS for document %s: %v", documentID, err)
+		conn.Log().Errorf("❌ Failed to subscribe to NATS: %v", err)
 		return err
 	}
+	conn.SetMetadata(config.MetaSubscribedKey, true)
+	state := h.states.Acquire(documentID)
+
+	// Services only publish: they take no color, presence or document content
+	if conn.IsService() {
+		conn.Log().Infof("✅ Service connected")
+		return nil
+	}
+
+	encrypted := h.hub.overrides.encrypted(documentID)
+	preferred, _ := conn.GetMetadata(config.MetaPreferredColorKey).(string)
+	color := h.colors.Assign(documentID, conn.GetClientID(), preferred)
+	conn.SetMetadata(config.MetaCursorColorKey, color)
+	h.presence.Touch(documentID, conn.GetClientID(), h.clock.Now())
+	members := h.presence.Members(documentID)
+	sort.Strings(members)
+
+	conn.SendJSON(WelcomeMessage{
+		Type:       "welcome",
+		ClientID:   conn.GetClientID(),
+		DocumentID: documentID,
+		Color:      color,
+		Protocol:   conn.GetProtocolVersion(),
+		Compressed: conn.IsCompressed(),
+		ReadOnly:   conn.IsReadOnly(),
+		Encrypted:  encrypted,
+		Members:    members,
+	})
+	h.bus.Publish(publisher.DocumentEvent{
+		DocumentID:    documentID,
+		UserID:        conn.GetClientID(),
+		SchemaVersion: publisher.CurrentSchemaVersion,
+		Payload:       publisher.DocumentEventPayload{Action: publisher.ActionPresenceJoin},
+		Timestamp:     h.clock.Now().Unix(),
+		Color:         color,
+		DisplayName:   conn.GetDisplayName(),
+	})
+	// The gateway can't read encrypted edits, so it has no document content to catch up from
+	if encrypted {
+		conn.awaitingState.Store(false)
+	} else {
+		h.sendCatchUp(conn, state)
+	}
 
-	log.Printf("✅ User %s successfully joined document %s", conn.GetClientID(), documentID)
+	conn.Log().Infof("✅ Successfully joined document")
 	return nil
 }
 
@@ -85,22 +381,222 @@ func (h *DocumentHandler) OnDisconnect(conn *Connection) error {
 		return nil
 	}
 
-	log.Printf("👋 User %s leaving document %s", conn.GetClientID(), documentID)
+	conn.Log().Infof("👋 Leaving document")
 
-	// Dynamically unsubscribe from the document's NATS subject
-	err := h.natsManager.Unsubscribe(documentID)
-	if err != nil {
-		log.Printf("❌ Failed to unsubscribe from NATS for document %s: %v", documentID, err)
+	// Let the other participants know right away, whether the client closed cleanly or its heartbeat
+	// was lost, unless the user is still there from another connection
+	if !conn.IsService() {
+		if !h.stillPresent(conn, documentID) {
+			h.bus.Publish(publisher.DocumentEvent{
+				DocumentID:    documentID,
+				UserID:        conn.GetClientID(),
+				SchemaVersion: publisher.CurrentSchemaVersion,
+				Payload:       publisher.DocumentEventPayload{Action: publisher.ActionPresenceLeave},
+				Timestamp:     h.clock.Now().Unix(),
+				Color:         cursorColor(conn),
+				DisplayName:   conn.GetDisplayName(),
+			})
+			h.presence.Remove(documentID, conn.GetClientID())
+		}
+		h.colors.Release(documentID, conn.GetClientID())
 	}
+	h.unsubscribeStats(conn)
+	h.stopTyping(conn, documentID)
+	h.transient.Forget(conn.GetID())
 
-	log.Printf("🚪 Document connection closed: %s from document %s", conn.clientID, documentID)
+	// Dynamically unsubscribe from the document's NATS subject, at most once per join so a
+	// repeated disconnect can't take another connection's count down
+	if subscribed, _ := conn.GetMetadata(config.MetaSubscribedKey).(bool); subscribed {
+		conn.SetMetadata(config.MetaSubscribedKey, false)
+		if err := h.natsManager.Unsubscribe(documentID); err != nil {
+			conn.Log().Errorf("❌ Failed to unsubscribe from NATS: %v", err)
+		}
+	}
+	h.states.Release(documentID)
+
+	conn.Log().Infof("🚪 Document connection closed")
 	return nil
 }
 
+// stillPresent reports whether the connection's user has another open connection in the document
+func (h *DocumentHandler) stillPresent(conn *Connection, documentID string) bool {
+	for _, other := range h.hub.userConnections(conn.GetClientID()) {
+		if other != conn && other.State() < StateClosing && !other.IsService() && connectionDocumentID(other) == documentID {
+			return true
+		}
+	}
+	return false
+}
+
+// relayOpaque publishes a binary or encrypted update untouched; edits still need a writable connection and an open document
+func (h *DocumentHandler) relayOpaque(conn *Connection, documentID, encoding string, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if conn.IsReadOnly() {
+		conn.SendError("read_only", "this connection cannot edit the document")
+		return ErrReadOnlyConnection
+	}
+	if h.isDraining(documentID) {
+		conn.SendError("document_draining", "the document is temporarily not accepting edits")
+		return ErrDocumentDraining
+	}
+
+	return h.natsManager.PublishOpaque(documentID, conn.GetClientID(), encoding, data)
+}
+
+// SetReplayFilters replaces the filters applied to catch-up replays; the default keeps edits only.
+// It must be called before the handler starts serving connections.
+func (h *DocumentHandler) SetReplayFilters(filters ...document.ReplayFilter) {
+	h.replayFilters = filters
+}
+
+// sendCatchUp brings a rejoining client up to date: only the edits after the revision it saw
+// when the history still covers it, the whole document otherwise.
+// The state is read and sent while no edit is applied, and edits broadcast before that skip the
+// connection, so it receives every edit exactly once: in the catch-up or snapshot, or after it.
+func (h *DocumentHandler) sendCatchUp(conn *Connection, state *document.State) {
+	if !conn.awaitingState.Load() {
+		// The client brings its own copy; it is taken to be current as of the join
+		conn.advanceRevision(state.Revision())
+		return
+	}
+
+	state.Sync(func() {
+		defer conn.awaitingState.Store(false)
+		conn.advanceRevision(state.Revision())
+
+		since, _ := conn.GetMetadata(config.MetaSinceRevisionKey).(string)
+		if revision, err := strconv.ParseInt(since, 10, 64); err == nil {
+			if events, ok := state.Since(revision); ok {
+				conn.SendJSON(CatchUpMessage{
+					Type:     "catch_up",
+					Revision: revision + int64(len(events)),
+					Events:   document.FilterReplay(events, h.replayFilters...),
+				})
+				return
+			}
+		}
+
+		conn.SendJSON(SnapshotMessage{
+			Type:     "snapshot",
+			Snapshot: state.Snapshot(),
+		})
+	})
+}
+
+// OnHeartbeat refreshes the connection's presence on every instance serving its document
+func (h *DocumentHandler) OnHeartbeat(conn *Connection) {
+	documentID, ok := conn.GetMetadata(config.MetaDocumentIDKey).(string)
+	if !ok || conn.IsService() {
+		return
+	}
+
+	h.bus.Publish(publisher.DocumentEvent{
+		DocumentID:    documentID,
+		UserID:        conn.GetClientID(),
+		SchemaVersion: publisher.CurrentSchemaVersion,
+		Payload:       publisher.DocumentEventPayload{Action: publisher.ActionPresenceHeartbeat},
+		Timestamp:     h.clock.Now().Unix(),
+	})
+}
+
+// SweepPresence periodically expires participants whose heartbeats stopped, telling the local
+// participants of their document that they left. It never returns unless expiry is disabled.
+func (h *DocumentHandler) SweepPresence() {
+	if h.presence.TTL() <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.presence.TTL() / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.expirePresence()
+	}
+}
+
+// expirePresence expires the participants not refreshed within the presence TTL and broadcasts their leave
+func (h *DocumentHandler) expirePresence() {
+	for _, entry := range h.presence.Expire(h.clock.Now()) {
+		log.Printf("Presence of user %s in document %s expired", entry.UserID, entry.DocumentID)
+
+		data, err := json.Marshal(publisher.DocumentEvent{
+			DocumentID:    entry.DocumentID,
+			UserID:        entry.UserID,
+			SchemaVersion: publisher.CurrentSchemaVersion,
+			Payload:       publisher.DocumentEventPayload{Action: publisher.ActionPresenceLeave},
+			Timestamp:     h.clock.Now().Unix(),
+		})
+		if err != nil {
+			continue
+		}
+		h.hub.BroadcastToDocument(entry.DocumentID, data)
+	}
+}
+
+// ReconcileSubscriptions periodically fixes NATS subscriptions that drifted from the open connections,
+// such as one leaked by a failed unsubscribe. It never returns unless the interval is not positive.
+func (h *DocumentHandler) ReconcileSubscriptions(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.reconcileSubscriptions()
+	}
+}
+
+// reconcileSubscriptions runs a single reconciliation of the NATS subscriptions with the open connections
+func (h *DocumentHandler) reconcileSubscriptions() {
+	present, joined := h.hub.documentConnections()
+	result := h.natsManager.Reconcile(present, joined, func(documentID string) natsPkg.MsgHandler {
+		return h.createNATSHandler(documentID)
+	})
+	if len(result.Orphaned) > 0 || len(result.Missing) > 0 || len(result.Restored) > 0 {
+		log.Printf("Reconciled NATS subscriptions: %d orphaned removed, %d missing restored, %d dead restored",
+			len(result.Orphaned), len(result.Missing), len(result.Restored))
+	}
+
+	// Connections of a document whose subscription is gone would silently miss every update:
+	// close them so their clients reconnect, which subscribes again
+	for _, documentID := range result.Lost {
+		closed := h.hub.CloseDocument(documentID, websocket.CloseTryAgainLater, "subscription_lost")
+		log.Printf("Lost NATS subscription for document %s, closed %d connections", documentID, closed)
+	}
+}
+
+// connectionDocumentID returns the document a connection is on, "" if it has none
+func connectionDocumentID(conn *Connection) string {
+	documentID, _ := conn.GetMetadata(config.MetaDocumentIDKey).(string)
+	return documentID
+}
+
+// cursorColor returns the cursor color assigned to a connection, if any
+func cursorColor(conn *Connection) string {
+	color, _ := conn.GetMetadata(config.MetaCursorColorKey).(string)
+	return color
+}
+
 // createNATSHandler creates a NATS message handler for a specific document
 func (h *DocumentHandler) createNATSHandler(documentID string) func(*natsPkg.Msg) {
 	return func(msg *natsPkg.Msg) {
-		log.Printf("📥 Received NATS message for document %s on subject %s", documentID, msg.Subject)
+		broadcastLog.Debugf("📥 Received NATS message for document %s on subject %s", documentID, msg.Subject)
+
+		// Binary and encrypted updates are opaque: fan them out as is, the sender comes from the header
+		switch msg.Header.Get(nats.EncodingHeaderKey) {
+		case nats.EncodingBinary:
+			h.natsManager.RecordEdit(documentID)
+			h.hub.BroadcastBinaryToDocument(documentID, msg.Data, msg.Header.Get(nats.SenderHeaderKey))
+			return
+		case nats.EncodingEncrypted:
+			h.natsManager.RecordEdit(documentID)
+			h.hub.BroadcastToDocument(documentID, msg.Data, msg.Header.Get(nats.SenderHeaderKey))
+			return
+		}
 
 		// Parse the NATS message to extract the original sender
 		var event publisher.DocumentEvent
@@ -110,10 +606,68 @@ func (h *DocumentHandler) createNATSHandler(documentID string) func(*natsPkg.Msg
 			return
 		}
 
-		originalSenderID := event.UserID
+		// Keep the in-memory document state in step with every edit, local or remote. An edit is
+		// applied and its recipients picked in one step, so joiners get it exactly once: either in
+		// their catch-up or as a recipient (see sendCatchUp). The fan-out itself happens once the
+		// document is unlocked, so a slow consumer can't hold up the document.
+		state, ok := h.states.Get(documentID)
+		if !ok || !document.ChangesContent(event.Payload.Action) {
+			h.deliverEvent(documentID, msg, event, 0, nil)
+			return
+		}
+		var revision int64
+		var recipients []*Connection
+		state.Sync(func() {
+			if err := state.Apply(event); err != nil {
+				editLog.Warnf("Failed to apply event to document %s state: %v", documentID, err)
+			} else {
+				revision = state.Revision()
+			}
+			recipients = h.hub.readyConnections(documentID)
+		})
+		h.deliverEvent(documentID, msg, event, revision, recipients)
+	}
+}
+
+// deliverEvent accounts for a document event received from NATS and broadcasts it to the local
+// connections. revision is the one an applied edit produced, 0 for other events. recipients are
+// the connections picked along with the revision, nil to broadcast to the document's current ones.
+func (h *DocumentHandler) deliverEvent(documentID string, msg *natsPkg.Msg, event publisher.DocumentEvent, revision int64, recipients []*Connection) {
+	if eventbus.TopicFor(event.Payload.Action) == eventbus.TopicEdit {
+		h.natsManager.RecordEdit(documentID)
+	}
 
-		h.hub.BroadcastToDocument(documentID, msg.Data, originalSenderID)
+	// Any event proves its sender is still around; heartbeats only refresh presence.
+	// Services are not participants.
+	switch {
+	case event.Payload.Action == publisher.ActionPresenceHeartbeat:
+		h.presence.Touch(documentID, event.UserID, h.clock.Now())
+		return
+	case event.Payload.Action == publisher.ActionPresenceLeave:
+		h.presence.Remove(documentID, event.UserID)
+	case !event.Service:
+		h.presence.Touch(documentID, event.UserID, h.clock.Now())
+	}
 
-		log.Printf("📡 Forwarded NATS message to WebSocket clients in document %s (excluded sender: %s)", documentID, originalSenderID)
+	// The subscription may outlive the last local connection (idle TTL), skip the broadcast work
+	if h.hub.CountConnectionsForDocument(documentID) == 0 {
+		metrics.IncNoopDelivery()
+		return
 	}
+
+	originalSenderID := event.UserID
+	topic := eventbus.TopicFor(event.Payload.Action)
+	excluded := h.senderExclusion[topic].excluding(originalSenderID, msg.Header.Get(nats.SenderConnectionHeaderKey))
+	message := DocumentMessage{Type: TextMessage, Data: msg.Data, revision: revision}
+	if recipients != nil {
+		h.hub.broadcastTo(documentID, recipients, message, topic != eventbus.TopicEdit, excluded)
+	} else {
+		// Joiners waiting for their initial state get the edit with it instead
+		if document.ChangesContent(event.Payload.Action) {
+			excluded = excludeAwaitingState(excluded)
+		}
+		h.hub.broadcastToDocument(documentID, message, topic != eventbus.TopicEdit, excluded)
+	}
+
+	broadcastLog.Infof("📡 Forwarded NATS message to WebSocket clients in document %s (excluded sender: %s)", documentID, originalSenderID)
 }
@@ -0,0 +1,327 @@
+package websocket
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/clock"
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	natsPkg "github.com/nats-io/nats.go"
+)
+
+// isLeaveOf matches the presence_leave event of a user
+func isLeaveOf(userID string) func(testMessage) bool {
+	return func(m testMessage) bool {
+		return m.Payload.Action == publisher.ActionPresenceLeave && m.UserID == userID
+	}
+}
+
+func TestLeaveOnlyAfterLastConnection(t *testing.T) {
+	gateway := newTestGateway(t)
+	bob := gateway.dial("bob", "doc1")
+	firstTab := gateway.dial("alice", "doc1")
+	secondTab := gateway.dial("alice", "doc1")
+
+	firstTab.conn.Close()
+
+	bob.refuseWithin(300*time.Millisecond, "presence_leave while alice still has a tab open", isLeaveOf("alice"))
+	if members := gateway.handler.presence.Members("doc1"); len(members) != 2 {
+		t.Errorf("members after closing one tab: %v, want alice and bob", members)
+	}
+
+	secondTab.conn.Close()
+
+	bob.expect("presence_leave of alice", isLeaveOf("alice"))
+}
+
+func TestLeaveWhenPongsStop(t *testing.T) {
+	gateway := newTestGateway(t)
+	bob := gateway.dial("bob", "doc1")
+
+	// A client that never reads never answers a ping either
+	conn, _, err := websocket.DefaultDialer.Dial(gateway.url("/ws/document/doc1?token="+testToken(t, "carol")), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	bob.expect("presence_join of carol", func(m testMessage) bool {
+		return m.Payload.Action == publisher.ActionPresenceJoin && m.UserID == "carol"
+	})
+
+	start := time.Now()
+	bob.expect("presence_leave of carol", isLeaveOf("carol"))
+	if pongTimeout := config.Load().WebSocket.PongTimeout; time.Since(start) > 2*pongTimeout {
+		t.Errorf("presence_leave took %v, want it within about the pong timeout (%v)", time.Since(start), pongTimeout)
+	}
+}
+
+func TestUnrefreshedPresenceExpires(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.clock = clk })
+	bob := gateway.dial("bob", "doc1")
+
+	// carol is connected to another instance, which stops sending her heartbeats
+	heartbeat := publisher.DocumentEvent{DocumentID: "doc1", UserID: "carol", Payload: publisher.DocumentEventPayload{Action: publisher.ActionPresenceHeartbeat}}
+	gateway.handler.createNATSHandler("doc1")(natsEvent(t, heartbeat))
+	clk.Advance(gateway.handler.presence.TTL() / 2)
+	gateway.handler.expirePresence()
+	bob.refuseWithin(100*time.Millisecond, "presence_leave of carol within the TTL", isLeaveOf("carol"))
+
+	clk.Advance(gateway.handler.presence.TTL())
+	gateway.handler.presence.Touch("doc1", "bob", clk.Now())
+	gateway.handler.expirePresence()
+
+	bob.expect("presence_leave of carol", isLeaveOf("carol"))
+	if members := gateway.handler.presence.Members("doc1"); len(members) != 1 || members[0] != "bob" {
+		t.Errorf("members after the expiry: %v, want bob", members)
+	}
+}
+
+func TestSlowConsumerDoesNotHoldUpCatchUp(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.hub.slowConsumerGrace = 3 * time.Second })
+	alice := gateway.dial("alice", "doc1")
+
+	// A connection whose buffer is full keeps the edit's fan-out waiting for the whole grace period
+	stuck := newHubConnection(gateway.hub, "stuck", "carol", "doc1", 1)
+	stuck.send <- DocumentMessage{Type: TextMessage, Data: []byte("unread")}
+	gateway.hub.register <- stuck
+	// It has no network connection to write a close frame to, so it must be gone before the gateway shuts down
+	t.Cleanup(func() {
+		stuck.unregister()
+		waitFor(t, "the stuck connection to close", func() bool { return stuck.State() == StateClosed })
+	})
+	waitFor(t, "the stuck connection to register", func() bool { return gateway.hub.CountConnectionsForDocument("doc1") == 2 })
+
+	alice.edit("hello")
+	state, _ := gateway.states.Get("doc1")
+	waitFor(t, "the edit to be applied", func() bool { return state.Revision() == 1 })
+
+	bob := gateway.dialPath("bob", "/ws/document/doc1?since=0")
+	deadline := time.Now().Add(time.Second)
+	for {
+		message, err := bob.read(time.Until(deadline))
+		if err != nil {
+			t.Fatalf("no catch_up while the edit is waiting on a slow consumer: %v", err)
+		}
+		if message.Type == "catch_up" {
+			if len(message.Events) != 1 || message.Events[0].Payload.Data != "hello" {
+				t.Errorf("catch_up events = %+v, want the hello edit", message.Events)
+			}
+			break
+		}
+	}
+	bob.refuseWithin(300*time.Millisecond, "the caught up edit again", func(m testMessage) bool { return m.Payload.Action == "insert" })
+}
+
+func TestRejoinCatchesUpFromRevision(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	for _, data := range []string{"c", "b", "a"} {
+		alice.edit(data)
+	}
+	state, _ := gateway.states.Get("doc1")
+	waitFor(t, "the edits to be applied", func() bool { return state.Revision() == 3 })
+
+	bob := gateway.dialPath("bob", "/ws/document/doc1?since=1")
+	catchUp := bob.expect("catch_up", func(m testMessage) bool { return m.Type == "catch_up" })
+	if catchUp.Revision != 3 || len(catchUp.Events) != 2 || catchUp.Events[0].Payload.Data != "b" || catchUp.Events[1].Payload.Data != "a" {
+		t.Errorf("catch_up at revision %d with %+v, want edits b and a up to revision 3", catchUp.Revision, catchUp.Events)
+	}
+
+	// A revision the document never reached can't be caught up from
+	carol := gateway.dialPath("carol", "/ws/document/doc1?since=7")
+	snapshot := carol.expect("snapshot", func(m testMessage) bool { return m.Type == "snapshot" })
+	if snapshot.Revision != 3 || snapshot.Content != "abc" {
+		t.Errorf("snapshot %q at revision %d, want \"abc\" at 3", snapshot.Content, snapshot.Revision)
+	}
+}
+
+func TestCatchUpReplayFiltered(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.SetReplayFilters(document.ExcludeUser("alice")) })
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+	alice.edit("a")
+	bob.expectEdit("a")
+	bob.edit("b")
+	alice.expectEdit("b")
+
+	carol := gateway.dialPath("carol", "/ws/document/doc1?since=0")
+
+	catchUp := carol.expect("catch_up", func(m testMessage) bool { return m.Type == "catch_up" })
+	if len(catchUp.Events) != 1 || catchUp.Events[0].UserID != "bob" {
+		t.Errorf("catch_up events = %+v, want only bob's edit", catchUp.Events)
+	}
+}
+
+func TestEmptyFramesAreKeepalives(t *testing.T) {
+	gateway := newTestGateway(t)
+	conn := newHubConnection(gateway.hub, "conn-1", "alice", "doc1", 4)
+
+	for _, data := range []string{"", " ", "\n\t"} {
+		if err := gateway.handler.HandleMessage(conn, DocumentMessage{Type: TextMessage, Data: []byte(data)}); err != nil {
+			t.Errorf("frame %q: %v, want it ignored", data, err)
+		}
+	}
+	if len(conn.send) != 0 {
+		t.Errorf("keepalives were answered with %d messages", len(conn.send))
+	}
+
+	if err := gateway.handler.HandleMessage(conn, DocumentMessage{Type: TextMessage, Data: []byte("{not json")}); err == nil {
+		t.Error("malformed frame accepted")
+	}
+}
+
+func TestEditSchemaVersion(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	alice.send(map[string]any{"schema_version": publisher.CurrentSchemaVersion + 1, "action": "insert", "position": 0, "data": "future"})
+	alice.expect("unsupported_schema_version error", func(m testMessage) bool { return m.Type == "error" && m.Code == "unsupported_schema_version" })
+
+	alice.send(map[string]any{"action": "insert", "position": 0, "data": "unversioned"})
+	edit := bob.expectEdit("unversioned")
+	if edit.SchemaVersion != publisher.CurrentSchemaVersion {
+		t.Errorf("edit published with schema version %d, want %d", edit.SchemaVersion, publisher.CurrentSchemaVersion)
+	}
+	bob.refuseWithin(300*time.Millisecond, "the edit of an unsupported schema version", func(m testMessage) bool { return m.Payload.Data == "future" })
+}
+
+// natsEvent returns the NATS message carrying an event, as received by a document subscription
+func natsEvent(t *testing.T, event publisher.DocumentEvent) *natsPkg.Msg {
+	t.Helper()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("failed to marshal event: %v", err)
+	}
+	return &natsPkg.Msg{Subject: "document." + event.DocumentID + ".edit", Data: data, Header: natsPkg.Header{}}
+}
+
+func TestDeliveryWithoutLocalConnectionsIsNoop(t *testing.T) {
+	gateway := newTestGateway(t)
+	deliver := gateway.handler.createNATSHandler("doc1")
+	event := publisher.DocumentEvent{DocumentID: "doc1", UserID: "alice", Payload: publisher.DocumentEventPayload{Action: "insert", Data: "hello"}}
+
+	before := scrapeMetric(t, "gateway_nats_noop_deliveries_total")
+	deliver(natsEvent(t, event))
+	if got := scrapeMetric(t, "gateway_nats_noop_deliveries_total"); got != before+1 {
+		t.Errorf("noop deliveries went from %v to %v, want one more", before, got)
+	}
+
+	bob := gateway.dial("bob", "doc1")
+	deliver(natsEvent(t, event))
+	bob.expectEdit("hello")
+	if got := scrapeMetric(t, "gateway_nats_noop_deliveries_total"); got != before+1 {
+		t.Errorf("a delivery to a local connection counted as a noop (%v, want %v)", got, before+1)
+	}
+}
+
+func TestServiceConnectionPublishesOnly(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	indexer := gateway.dialToken(testToken(t, "indexer", middleware.ScopeService), "/ws/document/doc1")
+	waitFor(t, "the service to join", func() bool { return gateway.connectionOf("indexer") != nil })
+
+	indexer.edit("indexed")
+	alice.expectEdit("indexed")
+
+	bob := gateway.dialPath("bob", "/ws/document/doc1")
+	if welcome := bob.expect("welcome", isNotice("welcome")); slices.Contains(welcome.Members, "indexer") {
+		t.Errorf("welcome lists members %v, want the service left out", welcome.Members)
+	}
+	alice.edit("typed")
+	bob.expectEdit("typed")
+	gateway.hub.Broadcast(DocumentMessage{Type: TextMessage, Data: []byte(`{"type":"notice"}`)})
+	alice.expect("notice", isNotice("notice"))
+	indexer.refuseWithin(300*time.Millisecond, "a broadcast", func(testMessage) bool { return true })
+
+	if members := gateway.handler.presence.Members("doc1"); slices.Contains(members, "indexer") {
+		t.Errorf("presence lists %v, want the service left out", members)
+	}
+}
+
+func TestRepeatedDisconnectUnsubscribesOnce(t *testing.T) {
+	gateway := newTestGateway(t)
+	gateway.dial("alice", "doc1")
+	gateway.dial("bob", "doc1")
+	alice := gateway.connectionOf("alice")
+
+	for i := 0; i < 2; i++ {
+		if err := gateway.handler.OnDisconnect(alice); err != nil {
+			t.Fatalf("OnDisconnect failed: %v", err)
+		}
+	}
+
+	if got := gateway.nats.GetStats()["doc1"]; got != 1 {
+		t.Errorf("doc1 counts %d connections, want bob's only", got)
+	}
+}
+
+func TestDisplayNameSurfacedWithSubAsKey(t *testing.T) {
+	gateway := newTestGateway(t)
+	bob := gateway.dial("bob", "doc1")
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":  "u-42",
+		"iss":  config.Load().JWT.Issuer,
+		"name": "Alice Liddell",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(config.Load().JWT.SecretKey))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	alice := gateway.dialToken(token, "/ws/document/doc1")
+	alice.expect("welcome", isNotice("welcome"))
+
+	join := bob.expect("join of u-42", func(m testMessage) bool { return m.Payload.Action == publisher.ActionPresenceJoin })
+	if join.UserID != "u-42" || join.DisplayName != "Alice Liddell" {
+		t.Errorf("join of %q named %q, want u-42 named Alice Liddell", join.UserID, join.DisplayName)
+	}
+	alice.edit("hello")
+	if edit := bob.expectEdit("hello"); edit.UserID != "u-42" || edit.DisplayName != "Alice Liddell" {
+		t.Errorf("edit by %q named %q, want u-42 named Alice Liddell", edit.UserID, edit.DisplayName)
+	}
+	if got := gateway.connectionOf("u-42").GetDisplayName(); got != "Alice Liddell" {
+		t.Errorf("connection display name = %q", got)
+	}
+}
+
+func TestLostSubscriptionClosesConnections(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	release := make(chan struct{})
+	defer close(release)
+	handling := make(chan struct{}, 1)
+	err := gateway.nats.Subscribe("blocker", func(*natsPkg.Msg) {
+		handling <- struct{}{}
+		<-release
+	})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// Draining ends doc1's subscription, and a handler blocked on another document keeps the
+	// connection draining, so it can't be subscribed again
+	if err := gateway.nats.PublishDocumentEvent(publisher.DocumentEvent{DocumentID: "blocker", Payload: publisher.DocumentEventPayload{Action: "insert", Data: "x"}}); err != nil {
+		t.Fatalf("PublishDocumentEvent failed: %v", err)
+	}
+	<-handling
+	if err := gateway.nats.GetConnection().Drain(); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	waitFor(t, "the subscription to be lost", func() bool {
+		gateway.handler.reconcileSubscriptions()
+		return gateway.hub.count() == 0
+	})
+
+	if closeErr := alice.expectClose(); closeErr.Code != websocket.CloseTryAgainLater || closeErr.Text != "subscription_lost" {
+		t.Errorf("closed with %d %q, want %d subscription_lost", closeErr.Code, closeErr.Text, websocket.CloseTryAgainLater)
+	}
+}
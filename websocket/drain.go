@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"errors"
+	"log"
+
+	"github.com/emaforlin/ce-realtime-gateway/eventbus"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/gorilla/websocket"
+)
+
+// Drain modes deciding what happens to edits sent to a draining document
+const (
+	DrainModeReject = "reject"
+	DrainModeQueue  = "queue"
+)
+
+// maxDrainQueue bounds the edits held per document while it is draining in queue mode
+const maxDrainQueue = 1000
+
+// ErrDocumentDraining is returned when an edit is refused because its document is draining
+var ErrDocumentDraining = errors.New("document is draining")
+
+var (
+	drainingNotice = []byte(`{"type":"draining"}`)
+	resumedNotice  = []byte(`{"type":"resumed"}`)
+)
+
+// drainState holds the edits queued while a document is draining
+type drainState struct {
+	queue []publisher.DocumentEvent
+}
+
+// Drain pauses edits on a document and notifies its participants.
+// It reports false if the document was already draining.
+func (h *DocumentHandler) Drain(documentID string) bool {
+	h.drainMutex.Lock()
+	if _, exists := h.drains[documentID]; exists {
+		h.drainMutex.Unlock()
+		return false
+	}
+	h.drains[documentID] = &drainState{}
+	h.drainMutex.Unlock()
+
+	log.Printf("Draining document %s (mode: %s)", documentID, h.drainMode)
+	h.hub.BroadcastToDocument(documentID, drainingNotice)
+	return true
+}
+
+// Undrain resumes edits on a document, publishing any queued edits in order.
+// It returns the number of released edits and false if the document wasn't draining.
+func (h *DocumentHandler) Undrain(documentID string) (int, bool) {
+	h.drainMutex.Lock()
+	state, exists := h.drains[documentID]
+	delete(h.drains, documentID)
+	h.drainMutex.Unlock()
+
+	if !exists {
+		return 0, false
+	}
+
+	released := 0
+	for _, event := range state.queue {
+		if err := h.bus.Publish(event); err != nil {
+			log.Printf("Failed to release a queued edit of document %s: %v", documentID, err)
+			continue
+		}
+		released++
+	}
+
+	log.Printf("Resumed document %s (released %d of %d queued edits)", documentID, released, len(state.queue))
+	h.hub.BroadcastToDocument(documentID, resumedNotice)
+	return released, true
+}
+
+// holdIfDraining keeps an edit away from the bus while its document is draining.
+// It reports whether the event was held back; the error is set when it was refused.
+func (h *DocumentHandler) holdIfDraining(event publisher.DocumentEvent) (bool, error) {
+	if eventbus.TopicFor(event.Payload.Action) != eventbus.TopicEdit {
+		return false, nil
+	}
+
+	h.drainMutex.Lock()
+	defer h.drainMutex.Unlock()
+
+	state, draining := h.drains[event.DocumentID]
+	if !draining {
+		return false, nil
+	}
+	if h.drainMode != DrainModeQueue || len(state.queue) >= maxDrainQueue {
+		return true, ErrDocumentDraining
+	}
+
+	state.queue = append(state.queue, event)
+	return true, nil
+}
+
+// ErrDocumentClosing is returned when a client tries to join a document that is being closed
+var ErrDocumentClosing = errors.New("document is closing")
+
+// CloseDocument disconnects every local participant of a document. Joins are refused while the
+// close is in progress: a join registered before that is caught by the hub sweep, a later one
+// is rejected in OnConnect, so no connection is left behind in the closed document.
+func (h *DocumentHandler) CloseDocument(documentID string) int {
+	h.drainMutex.Lock()
+	h.closing[documentID] = struct{}{}
+	h.drainMutex.Unlock()
+
+	defer func() {
+		h.drainMutex.Lock()
+		delete(h.closing, documentID)
+		h.drainMutex.Unlock()
+	}()
+
+	closed := h.hub.CloseDocument(documentID, websocket.CloseGoingAway, "document closed")
+	log.Printf("Closed document %s (%d connections)", documentID, closed)
+	return closed
+}
+
+// isDraining reports whether edits to a document are paused
+func (h *DocumentHandler) isDraining(documentID string) bool {
+	h.drainMutex.Lock()
+	defer h.drainMutex.Unlock()
+
+	_, draining := h.drains[documentID]
+	return draining
+}
+
+// isClosing reports whether a document is in the middle of being closed
+func (h *DocumentHandler) isClosing(documentID string) bool {
+	h.drainMutex.Lock()
+	defer h.drainMutex.Unlock()
+
+	_, closing := h.closing[documentID]
+	return closing
+}
@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// isNotice matches a server notice of the given type
+func isNotice(noticeType string) func(testMessage) bool {
+	return func(m testMessage) bool { return m.Type == noticeType }
+}
+
+// isInsert matches any insert
+func isInsert(m testMessage) bool {
+	return m.Payload.Action == "insert"
+}
+
+func TestDrainRejectsEditsUntilUndrain(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	if !gateway.handler.Drain("doc1") {
+		t.Fatal("Drain reported the document as already draining")
+	}
+	if gateway.handler.Drain("doc1") {
+		t.Error("a second Drain reported the document as newly draining")
+	}
+	alice.expect("draining notice", isNotice("draining"))
+	bob.expect("draining notice", isNotice("draining"))
+
+	alice.edit("blocked")
+	alice.expect("document_draining error", func(m testMessage) bool { return m.Type == "error" && m.Code == "document_draining" })
+	bob.refuseWithin(300*time.Millisecond, "an edit of a draining document", isInsert)
+
+	if released, ok := gateway.handler.Undrain("doc1"); !ok || released != 0 {
+		t.Errorf("Undrain = %d, %v; want nothing released from a rejecting drain", released, ok)
+	}
+	bob.expect("resumed notice", isNotice("resumed"))
+
+	alice.edit("resumed")
+	bob.expectEdit("resumed")
+}
+
+func TestDrainQueuesEditsUntilUndrain(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.drainMode = DrainModeQueue })
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	gateway.handler.Drain("doc1")
+	alice.edit("queued")
+	bob.refuseWithin(300*time.Millisecond, "an edit of a draining document", isInsert)
+	alice.refuseWithin(100*time.Millisecond, "an error for a queued edit", isNotice("error"))
+
+	if released, ok := gateway.handler.Undrain("doc1"); !ok || released != 1 {
+		t.Errorf("Undrain = %d, %v; want the queued edit released", released, ok)
+	}
+	bob.expectEdit("queued")
+
+	if _, ok := gateway.handler.Undrain("doc1"); ok {
+		t.Error("Undrain reported a document that wasn't draining as drained")
+	}
+}
+
+func TestCloseDocumentDisconnectsParticipants(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+	carol := gateway.dial("carol", "doc2")
+
+	if closed := gateway.handler.CloseDocument("doc1"); closed != 2 {
+		t.Errorf("CloseDocument closed %d connections, want 2", closed)
+	}
+
+	for _, client := range []*testClient{alice, bob} {
+		if closeErr := client.expectClose(); closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "document closed" {
+			t.Errorf("closed with %d %q, want %d \"document closed\"", closeErr.Code, closeErr.Text, websocket.CloseGoingAway)
+		}
+	}
+	carol.refuseWithin(100*time.Millisecond, "a notice about another document", func(testMessage) bool { return true })
+	waitFor(t, "doc1 to empty", func() bool { return gateway.hub.CountConnectionsForDocument("doc1") == 0 })
+	if count := gateway.hub.CountConnectionsForDocument("doc2"); count != 1 {
+		t.Errorf("doc2 has %d connections, want carol's", count)
+	}
+}
+
+// closedWithin reports whether the client's connection gets closed within wait, failing the test
+// if it ends any other way
+func closedWithin(t *testing.T, client *testClient, wait time.Duration) (*websocket.CloseError, bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(wait)
+	for {
+		_, err := client.read(time.Until(deadline))
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, errNoMessage):
+			return nil, false
+		}
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Fatalf("connection ended without a close frame: %v", err)
+		}
+		return closeErr, true
+	}
+}
+
+func TestCloseDocumentWhileJoining(t *testing.T) {
+	gateway := newTestGateway(t)
+	stop := make(chan struct{})
+	closer := make(chan struct{})
+	go func() {
+		defer close(closer)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			gateway.handler.CloseDocument("doc1")
+		}
+	}()
+
+	clients := make([]*testClient, 10)
+	for i := range clients {
+		clients[i] = gateway.dialPath(fmt.Sprintf("user-%d", i), "/ws/document/doc1")
+	}
+	close(stop)
+	<-closer
+
+	// Every join was either refused, closed along with the document, or came after the last close
+	open := 0
+	for _, client := range clients {
+		closeErr, closed := closedWithin(t, client, 300*time.Millisecond)
+		if !closed {
+			open++
+			continue
+		}
+		if closeErr.Code != websocket.CloseGoingAway && closeErr.Code != websocket.CloseTryAgainLater {
+			t.Errorf("closed with %d %q, want going away or try again later", closeErr.Code, closeErr.Text)
+		}
+	}
+	waitFor(t, "the closed connections to leave", func() bool { return gateway.hub.CountConnectionsForDocument("doc1") == open })
+	if gateway.handler.isClosing("doc1") {
+		t.Error("doc1 still refuses joins after the close completed")
+	}
+}
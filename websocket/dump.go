@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"sort"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+)
+
+// ConnectionDump is the full state of a connection, for diagnostics
+type ConnectionDump struct {
+	ConnectionID string    `json:"connection_id"`
+	ClientID     string    `json:"client_id"`
+	DocumentID   string    `json:"document_id"`
+	State        string    `json:"state"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	Protocol     int       `json:"protocol"`
+	// Queued is the number of messages waiting in the send buffer
+	Queued   int                    `json:"queued"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// DumpConnections returns the state of every connection registered with the hub, ordered by connection ID
+func (h *Hub) DumpConnections() []ConnectionDump {
+	connections := h.snapshot()
+	dumps := make([]ConnectionDump, 0, len(connections))
+	for _, conn := range connections {
+		metadata := conn.metadataSnapshot()
+		documentID, _ := metadata[config.MetaDocumentIDKey].(string)
+		dumps = append(dumps, ConnectionDump{
+			ConnectionID: conn.GetID(),
+			ClientID:     conn.GetClientID(),
+			DocumentID:   documentID,
+			State:        conn.State().String(),
+			ConnectedAt:  conn.connectedAt,
+			Protocol:     conn.GetProtocolVersion(),
+			Queued:       len(conn.send),
+			Metadata:     metadata,
+		})
+	}
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].ConnectionID < dumps[j].ConnectionID })
+	return dumps
+}
+
+// metadataSnapshot returns a copy of the connection's metadata
+func (c *Connection) metadataSnapshot() map[string]interface{} {
+	c.metadataMutex.RLock()
+	defer c.metadataMutex.RUnlock()
+
+	metadata := make(map[string]interface{}, len(c.metadata))
+	for key, value := range c.metadata {
+		metadata[key] = value
+	}
+	return metadata
+}
@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/logging"
+	"github.com/gorilla/websocket"
+)
+
+// ciphertext stands in for an end-to-end encrypted edit; it would be a valid edit if the gateway parsed it
+const ciphertext = `{"action":"insert","position":0,"data":"s3cr3t-payload"}`
+
+func TestEncryptedDocumentRelaysWithoutReading(t *testing.T) {
+	gateway := newTestGateway(t)
+	gateway.hub.overrides.Set("doc1", DocumentOverrides{Encrypted: true})
+	logs := &logBuffer{}
+	output := log.Writer()
+	log.SetOutput(logs)
+	if err := logging.Configure("debug", ""); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	t.Cleanup(func() {
+		log.SetOutput(output)
+		logging.Configure("info", "")
+	})
+
+	alice := gateway.dialPath("alice", "/ws/document/doc1")
+	welcome := alice.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	if !welcome.Encrypted {
+		t.Error("welcome doesn't tell the client to encrypt")
+	}
+	bob := gateway.dial("bob", "doc1")
+
+	if err := alice.conn.WriteMessage(websocket.TextMessage, []byte(ciphertext)); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	got := bob.expect("the encrypted payload", func(m testMessage) bool { return strings.Contains(string(m.raw), "s3cr3t-payload") })
+	if !strings.Contains(string(got.raw), strings.TrimPrefix(ciphertext, "{")) {
+		t.Errorf("relayed %s, want the payload untouched", got.raw)
+	}
+	if got.UserID != "" {
+		t.Errorf("relayed payload gained user_id %q, want no server-side envelope", got.UserID)
+	}
+	alice.refuseWithin(300*time.Millisecond, "its own payload or an error", func(m testMessage) bool {
+		return m.Type == "error" || strings.Contains(string(m.raw), "s3cr3t-payload")
+	})
+
+	if state, ok := gateway.handler.states.Get("doc1"); ok && state.Snapshot().Revision != 0 {
+		t.Errorf("document state at revision %d, want the payload never applied", state.Snapshot().Revision)
+	}
+	if line, ok := logs.line("s3cr3t-payload"); ok {
+		t.Errorf("payload logged: %s", line)
+	}
+}
+
+func TestPlainDocumentsStillParsed(t *testing.T) {
+	gateway := newTestGateway(t)
+	gateway.hub.overrides.Set("doc2", DocumentOverrides{Encrypted: true})
+
+	alice := gateway.dialPath("alice", "/ws/document/doc1")
+	if welcome := alice.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" }); welcome.Encrypted {
+		t.Error("welcome of a plain document asks for encryption")
+	}
+	bob := gateway.dial("bob", "doc1")
+
+	alice.edit("hello")
+
+	if edit := bob.expectEdit("hello"); edit.UserID != "alice" {
+		t.Errorf("edit from %q, want the gateway to attribute it to alice", edit.UserID)
+	}
+}
@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emaforlin/ce-realtime-gateway/eventbus"
+)
+
+// SenderExclusion decides which connections of an event's sender don't get the event back
+type SenderExclusion string
+
+const (
+	// ExcludeSenderUser skips every connection of the sending user
+	ExcludeSenderUser SenderExclusion = "user"
+	// ExcludeSenderConnection only skips the connection the event came from, so the user's other tabs stay in sync
+	ExcludeSenderConnection SenderExclusion = "connection"
+	// ExcludeSenderNone delivers the event to everyone, the originating connection included
+	ExcludeSenderNone SenderExclusion = "none"
+)
+
+// DefaultSenderExclusion is used for topics the configuration leaves out
+const DefaultSenderExclusion = "edit=connection,cursor=connection,presence=user"
+
+// ParseSenderExclusion parses per-topic exclusions such as "edit=connection,cursor=none"
+func ParseSenderExclusion(spec string) (map[eventbus.Topic]SenderExclusion, error) {
+	exclusions := make(map[eventbus.Topic]SenderExclusion)
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		name, value, found := strings.Cut(field, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid sender exclusion %q, expected topic=policy", field)
+		}
+
+		topic, ok := topicNamed(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("unknown topic %q in sender exclusion", name)
+		}
+		switch exclusion := SenderExclusion(strings.TrimSpace(value)); exclusion {
+		case ExcludeSenderUser, ExcludeSenderConnection, ExcludeSenderNone:
+			exclusions[topic] = exclusion
+		default:
+			return nil, fmt.Errorf("unknown sender exclusion %q for topic %s", value, name)
+		}
+	}
+	return exclusions, nil
+}
+
+// topicNamed returns the bus topic with the given name
+func topicNamed(name string) (eventbus.Topic, bool) {
+	for _, topic := range []eventbus.Topic{eventbus.TopicEdit, eventbus.TopicPresence, eventbus.TopicCursor} {
+		if topic.String() == name {
+			return topic, true
+		}
+	}
+	return 0, false
+}
+
+// excluding returns the filter skipping the sender's connections under this policy
+func (e SenderExclusion) excluding(senderID, senderConnectionID string) func(*Connection) bool {
+	switch {
+	case e == ExcludeSenderNone:
+		return nil
+	case e == ExcludeSenderConnection && senderConnectionID != "":
+		return func(conn *Connection) bool { return conn.id == senderConnectionID }
+	default:
+		// Without the originating connection, fall back to skipping the whole user
+		return excludeClient(senderID)
+	}
+}
+
+// excludeAwaitingState extends a broadcast filter to also skip connections waiting for their initial document state
+func excludeAwaitingState(excluded func(*Connection) bool) func(*Connection) bool {
+	return func(conn *Connection) bool {
+		return conn.awaitingState.Load() || (excluded != nil && excluded(conn))
+	}
+}
+
+// excludeClient returns the filter skipping the connections of a client, nil for none
+func excludeClient(clientID string) func(*Connection) bool {
+	if clientID == "" {
+		return nil
+	}
+	return func(conn *Connection) bool { return conn.clientID == clientID }
+}
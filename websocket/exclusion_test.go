@@ -0,0 +1,71 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/eventbus"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+func TestParseSenderExclusion(t *testing.T) {
+	exclusions, err := ParseSenderExclusion(" edit=user, cursor = none ,")
+	if err != nil {
+		t.Fatalf("ParseSenderExclusion failed: %v", err)
+	}
+	if exclusions[eventbus.TopicEdit] != ExcludeSenderUser || exclusions[eventbus.TopicCursor] != ExcludeSenderNone {
+		t.Errorf("parsed %v, want edit=user and cursor=none", exclusions)
+	}
+	if _, ok := exclusions[eventbus.TopicPresence]; ok {
+		t.Error("a topic left out was given a policy")
+	}
+
+	for _, spec := range []string{"edit", "selection=none", "edit=everyone"} {
+		if _, err := ParseSenderExclusion(spec); err == nil {
+			t.Errorf("ParseSenderExclusion(%q) succeeded", spec)
+		}
+	}
+}
+
+// isCursor matches any cursor update
+func isCursor(m testMessage) bool {
+	return m.Payload.Action == "cursor"
+}
+
+func TestCursorEchoedToOtherTabsButNotEdits(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) {
+		h.senderExclusion[eventbus.TopicEdit] = ExcludeSenderUser
+		h.senderExclusion[eventbus.TopicCursor] = ExcludeSenderConnection
+	})
+	tab := gateway.dial("alice", "doc1")
+	otherTab := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	tab.send(publisher.DocumentEventPayload{Action: "cursor", Position: 3})
+	otherTab.expect("cursor update", isCursor)
+	bob.expect("cursor update", isCursor)
+	tab.refuseWithin(200*time.Millisecond, "its own cursor update", isCursor)
+
+	tab.edit("typed")
+	bob.expectEdit("typed")
+	otherTab.refuseWithin(200*time.Millisecond, "the edit of another tab", isInsert)
+	tab.refuseWithin(100*time.Millisecond, "its own edit", isInsert)
+}
+
+func TestSenderExclusionNoneEchoesToSender(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.senderExclusion[eventbus.TopicCursor] = ExcludeSenderNone })
+	alice := gateway.dial("alice", "doc1")
+
+	alice.send(publisher.DocumentEventPayload{Action: "cursor", Position: 3})
+	alice.expect("its own cursor update", isCursor)
+}
+
+func TestDefaultSenderExclusion(t *testing.T) {
+	gateway := newTestGateway(t)
+	tab := gateway.dial("alice", "doc1")
+	otherTab := gateway.dial("alice", "doc1")
+
+	tab.edit("typed")
+	otherTab.expectEdit("typed")
+	tab.refuseWithin(200*time.Millisecond, "its own edit", isInsert)
+}
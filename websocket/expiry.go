@@ -0,0 +1,27 @@
+package websocket
+
+import "time"
+
+// CloseTokenExpired is the close code sent when a connection's token expires mid-session
+const CloseTokenExpired = 4002
+
+// tokenExpiredReason is the close reason sent with CloseTokenExpired. Its JSON tells clients to
+// refresh their token and reconnect quietly instead of reporting an error.
+const tokenExpiredReason = `{"code":"token_expired","reconnect":true}`
+
+// closeAtExpiry schedules the connection to be closed when its token expires. The JWT middleware
+// accepts tokens up to the clock skew past their expiry, so the connection is given the same leeway.
+func (c *Connection) closeAtExpiry(expiresAt time.Time) {
+	c.expiryTimer = time.AfterFunc(time.Until(expiresAt.Add(c.hub.tokenExpiryLeeway)), func() {
+		c.Log().Infof("Token expired, closing connection")
+		c.writeClose(CloseTokenExpired, tokenExpiredReason)
+		c.unregister()
+	})
+}
+
+// stopExpiry cancels a pending token expiry close
+func (c *Connection) stopExpiry() {
+	if c.expiryTimer != nil {
+		c.expiryTimer.Stop()
+	}
+}
@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// withTokenExpiryLeeway sets how long past their token's expiry the gateway's connections are kept
+func withTokenExpiryLeeway(leeway time.Duration) func(*DocumentHandler) {
+	return func(h *DocumentHandler) {
+		h.hub.tokenExpiryLeeway = leeway
+	}
+}
+
+func TestStructuredCloseAtTokenExpiry(t *testing.T) {
+	gateway := newTestGateway(t, withTokenExpiryLeeway(time.Second))
+	claims := testClaims("alice")
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(2 * time.Second))
+	alice := gateway.dialToken(signToken(t, claims), "/ws/document/doc1")
+	alice.expect("welcome", isNotice("welcome"))
+
+	closeErr := alice.expectClose()
+	if closedAt, due := time.Now(), claims.ExpiresAt.Add(time.Second); closedAt.Before(due) {
+		t.Errorf("closed %v before the expiry plus the clock skew", due.Sub(closedAt))
+	}
+	if closeErr.Code != CloseTokenExpired {
+		t.Errorf("close code = %d, want %d", closeErr.Code, CloseTokenExpired)
+	}
+	var reason struct {
+		Code      string `json:"code"`
+		Reconnect bool   `json:"reconnect"`
+	}
+	if err := json.Unmarshal([]byte(closeErr.Text), &reason); err != nil {
+		t.Fatalf("close reason %q is not JSON: %v", closeErr.Text, err)
+	}
+	if reason.Code != "token_expired" || !reason.Reconnect {
+		t.Errorf("close reason = %+v, want token_expired with reconnect", reason)
+	}
+	waitFor(t, "the connection to be removed", func() bool { return gateway.hub.count() == 0 })
+}
+
+func TestTokenExpiredWithinClockSkewKeepsConnection(t *testing.T) {
+	gateway := newTestGateway(t, withTokenExpiryLeeway(time.Minute))
+	bob := gateway.dial("bob", "doc1")
+	claims := testClaims("alice")
+	// The middleware still accepts the token, so the connection must not be closed right away
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Second))
+	alice := gateway.dialToken(signToken(t, claims), "/ws/document/doc1")
+	alice.expect("welcome", isNotice("welcome"))
+
+	alice.refuseWithin(500*time.Millisecond, "a message", func(testMessage) bool { return false })
+	alice.edit("hello")
+	bob.expectEdit("hello")
+}
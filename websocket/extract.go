@@ -0,0 +1,90 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+)
+
+// Document ID sources selectable for the /ws/document endpoint
+const (
+	DocumentIDFromQuery        = "query"
+	DocumentIDFromClaim        = "claim"
+	DocumentIDFromFirstMessage = "first_message"
+)
+
+// ErrMissingDocumentID is returned when no document ID could be extracted for a connection
+var ErrMissingDocumentID = errors.New("missing document id")
+
+// ErrHandshakeTimeout is returned when a client doesn't send its initial message in time
+var ErrHandshakeTimeout = errors.New("no initial message before the handshake timeout")
+
+// DocumentIDExtractor finds the document a connection joins. It runs right after the upgrade;
+// firstMessage reads the client's first message, for strategies that need one.
+type DocumentIDExtractor func(r *http.Request, firstMessage func() ([]byte, error)) (string, error)
+
+// PathDocumentID takes the document ID from a path wildcard, as in /ws/document/{id}
+func PathDocumentID(name string) DocumentIDExtractor {
+	return func(r *http.Request, _ func() ([]byte, error)) (string, error) {
+		return requireDocumentID(r.PathValue(name))
+	}
+}
+
+// QueryDocumentID takes the document ID from a query parameter, as in /ws/document?document_id=1234
+func QueryDocumentID(param string) DocumentIDExtractor {
+	return func(r *http.Request, _ func() ([]byte, error)) (string, error) {
+		return requireDocumentID(r.URL.Query().Get(param))
+	}
+}
+
+// ClaimDocumentID takes the document ID from the document_id claim of the request's JWT
+func ClaimDocumentID() DocumentIDExtractor {
+	return func(r *http.Request, _ func() ([]byte, error)) (string, error) {
+		documentID, _ := middleware.GetDocumentClaim(r)
+		return requireDocumentID(documentID)
+	}
+}
+
+// FirstMessageDocumentID waits for the client to send {"document_id":"..."} as its first message
+func FirstMessageDocumentID() DocumentIDExtractor {
+	return func(_ *http.Request, firstMessage func() ([]byte, error)) (string, error) {
+		data, err := firstMessage()
+		if err != nil {
+			return "", fmt.Errorf("reading first message: %w", err)
+		}
+
+		var join struct {
+			DocumentID string `json:"document_id"`
+		}
+		if err := json.Unmarshal(data, &join); err != nil {
+			return "", fmt.Errorf("parsing first message: %w", err)
+		}
+		return requireDocumentID(join.DocumentID)
+	}
+}
+
+// DocumentIDExtractorFor returns the extractor for a configured source: query, claim or first_message
+func DocumentIDExtractorFor(source string) (DocumentIDExtractor, error) {
+	switch source {
+	case DocumentIDFromQuery:
+		return QueryDocumentID("document_id"), nil
+	case DocumentIDFromClaim:
+		return ClaimDocumentID(), nil
+	case DocumentIDFromFirstMessage:
+		return FirstMessageDocumentID(), nil
+	default:
+		return nil, fmt.Errorf("unknown document ID source %q", source)
+	}
+}
+
+// requireDocumentID rejects empty document IDs
+func requireDocumentID(documentID string) (string, error) {
+	if strings.TrimSpace(documentID) == "" {
+		return "", ErrMissingDocumentID
+	}
+	return documentID, nil
+}
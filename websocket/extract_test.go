@@ -0,0 +1,137 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/gorilla/websocket"
+)
+
+// sends returns a first message reader yielding data
+func sends(data string) func() ([]byte, error) {
+	return func() ([]byte, error) { return []byte(data), nil }
+}
+
+// noFirstMessage fails the test if an extractor reads the first message
+func noFirstMessage(t *testing.T) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		t.Error("the first message was read")
+		return nil, errors.New("unexpected read")
+	}
+}
+
+func TestPathDocumentID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/ws/document/doc1", nil)
+	r.SetPathValue("id", "doc1")
+
+	if got, err := PathDocumentID("id")(r, noFirstMessage(t)); err != nil || got != "doc1" {
+		t.Errorf("extracted %q, %v; want doc1", got, err)
+	}
+	if _, err := PathDocumentID("other")(r, noFirstMessage(t)); !errors.Is(err, ErrMissingDocumentID) {
+		t.Errorf("unknown wildcard: %v, want ErrMissingDocumentID", err)
+	}
+}
+
+func TestQueryDocumentID(t *testing.T) {
+	extract := QueryDocumentID("document_id")
+
+	r := httptest.NewRequest(http.MethodGet, "/ws/document?document_id=doc1", nil)
+	if got, err := extract(r, noFirstMessage(t)); err != nil || got != "doc1" {
+		t.Errorf("extracted %q, %v; want doc1", got, err)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/ws/document?document_id=%20", nil)
+	if _, err := extract(r, noFirstMessage(t)); !errors.Is(err, ErrMissingDocumentID) {
+		t.Errorf("blank parameter: %v, want ErrMissingDocumentID", err)
+	}
+}
+
+func TestClaimDocumentID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/ws/document", nil)
+	if _, err := ClaimDocumentID()(r, noFirstMessage(t)); !errors.Is(err, ErrMissingDocumentID) {
+		t.Errorf("no claim: %v, want ErrMissingDocumentID", err)
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), middleware.DocumentClaimKey, "doc1"))
+	if got, err := ClaimDocumentID()(r, noFirstMessage(t)); err != nil || got != "doc1" {
+		t.Errorf("extracted %q, %v; want doc1", got, err)
+	}
+}
+
+func TestFirstMessageDocumentID(t *testing.T) {
+	extract := FirstMessageDocumentID()
+	r := httptest.NewRequest(http.MethodGet, "/ws/document", nil)
+
+	if got, err := extract(r, sends(`{"document_id":"doc1"}`)); err != nil || got != "doc1" {
+		t.Errorf("extracted %q, %v; want doc1", got, err)
+	}
+	if _, err := extract(r, sends(`{}`)); !errors.Is(err, ErrMissingDocumentID) {
+		t.Errorf("no document_id: %v, want ErrMissingDocumentID", err)
+	}
+	if _, err := extract(r, sends(`doc1`)); err == nil {
+		t.Error("a message that isn't JSON was accepted")
+	}
+	if _, err := extract(r, func() ([]byte, error) { return nil, ErrHandshakeTimeout }); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Errorf("read failure: %v, want it passed on", err)
+	}
+}
+
+func TestDocumentIDExtractorFor(t *testing.T) {
+	for _, source := range []string{DocumentIDFromQuery, DocumentIDFromClaim, DocumentIDFromFirstMessage} {
+		if _, err := DocumentIDExtractorFor(source); err != nil {
+			t.Errorf("DocumentIDExtractorFor(%q) failed: %v", source, err)
+		}
+	}
+	if _, err := DocumentIDExtractorFor("header"); err == nil {
+		t.Error("an unknown source was accepted")
+	}
+}
+
+// firstMessageURL serves the gateway's document handler expecting the document ID as the first
+// message, returning the URL to which a token is appended
+func firstMessageURL(gateway *testGateway) string {
+	server := httptest.NewServer(middleware.AuthJWT(HandleWebSocketWithExtractor(NewUpgrader(config.Load()), gateway.hub, gateway.handler, FirstMessageDocumentID())))
+	gateway.t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "?token="
+}
+
+func TestJoinWithFirstMessage(t *testing.T) {
+	gateway := newTestGateway(t)
+	url := firstMessageURL(gateway)
+
+	alice := dialURL(t, websocket.DefaultDialer, url+testToken(t, "alice"))
+	alice.send(map[string]string{"document_id": "doc1"})
+	if welcome := alice.expect("welcome", isNotice("welcome")); welcome.DocumentID != "doc1" {
+		t.Errorf("joined %q, want doc1", welcome.DocumentID)
+	}
+
+	bob := dialURL(t, websocket.DefaultDialer, url+testToken(t, "bob"))
+	bob.send(map[string]string{"document": "doc1"})
+	if closeErr := bob.expectClose(); closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "document_id_required" {
+		t.Errorf("closed with %d %q, want %d document_id_required", closeErr.Code, closeErr.Text, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestSilentClientClosedAfterInitialMessageTimeout(t *testing.T) {
+	gateway := newTestGateway(t)
+	timeout := config.Load().WebSocket.InitialMessageTimeout
+	start := time.Now()
+	alice := dialURL(t, websocket.DefaultDialer, firstMessageURL(gateway)+testToken(t, "alice"))
+
+	closeErr := alice.expectClose()
+	if closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "handshake_timeout" {
+		t.Errorf("closed with %d %q, want %d handshake_timeout", closeErr.Code, closeErr.Text, websocket.ClosePolicyViolation)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("closed after %v, before the %v timeout", elapsed, timeout)
+	}
+	if n := gateway.hub.count(); n != 0 {
+		t.Errorf("%d connections registered, want the silent client never joined", n)
+	}
+}
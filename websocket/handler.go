@@ -1,11 +1,23 @@
 package websocket
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+	"github.com/emaforlin/ce-realtime-gateway/logging"
+	"github.com/emaforlin/ce-realtime-gateway/metrics"
 	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
 	"github.com/gorilla/websocket"
 )
 
@@ -19,28 +31,126 @@ const (
 	BinaryMessage MessageType = websocket.BinaryMessage
 )
 
+// IsData reports whether the type is a data frame that may be handed to a Handler.
+// Control frames (ping, pong, close) are handled by the connection itself.
+func (t MessageType) IsData() bool {
+	return t == TextMessage || t == BinaryMessage
+}
+
+// defaultCloseWriteWait bounds how long writing a close frame may take when WS_CLOSE_WRITE_TIMEOUT isn't positive
+const defaultCloseWriteWait = time.Second
+
+// defaultWriteWait bounds message and ping writes when WS_WRITE_WAIT isn't positive
+const defaultWriteWait = 10 * time.Second
+
 // Message represents a WebSocket message
 type DocumentMessage struct {
 	Type       MessageType `json:"type"`
 	DocumentID string      `json:"document_id"`
 	Data       []byte      `json:"data"`
+	// edit is the parsed edit, set once the document handler's validation has accepted the message
+	edit *publisher.DocumentEventPayload
+	// sequenced marks document broadcasts, which get a message ID when written
+	sequenced bool
+	// revision is the document revision an edit broadcast produced, 0 for other messages
+	revision int64
 }
 
 // Connection wraps a WebSocket connection with additional functionality
 type Connection struct {
-	conn     *websocket.Conn
-	clientID string
-	metadata map[string]interface{}
-	send     chan DocumentMessage
-	hub      *Hub
+	conn *websocket.Conn
+	// id uniquely identifies this connection, clientID is the user behind it
+	id          string
+	clientID    string
+	connectedAt time.Time
+	// metadata is read by broadcasts while handlers write it, metadataMutex guards it
+	metadata      map[string]interface{}
+	metadataMutex sync.RWMutex
+	send          chan DocumentMessage
+	// sendMutex orders closing send against SendMessage, so late sends fail instead of panicking
+	sendMutex sync.RWMutex
+	hub       *Hub
+	// registered is closed once the hub has indexed the connection, when someone waits for it
+	registered chan struct{}
+	// wire counts outbound network bytes, set only when compression was negotiated
+	wire *countingConn
+	// pingInterval and pongTimeout drive the heartbeat; zero disables it
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	// readLimit is the largest inbound message accepted, 0 for no limit
+	readLimit int64
+	// lastRevision is the latest document revision written to the client, resync tracks
+	// whether messages were dropped since (resyncNone, resyncPending, resyncNotified)
+	lastRevision atomic.Int64
+	resync       atomic.Int32
+	// appPingInterval and appPongTimeout drive the application-level keepalive (WS_APP_KEEPALIVE);
+	// lastAppPong is when the client last answered, in Unix nanoseconds
+	appPingInterval time.Duration
+	appPongTimeout  time.Duration
+	lastAppPong     atomic.Int64
+	// protocolVersion is the protocol version negotiated during the handshake
+	protocolVersion int
+	// state tracks the lifecycle and guards sending, unregistering and closing
+	state connectionState
+	// expiryTimer closes the connection when its token expires
+	expiryTimer *time.Timer
+	// writerDone is set once the write pump has exited; nothing sent afterwards would be delivered
+	writerDone atomic.Bool
+	// deadlineCap bounds every read deadline once shutdown has begun, in Unix nanoseconds; 0 means none
+	deadlineCap atomic.Int64
+	// awaitingState is set while the connection waits for the catch-up or snapshot of its document;
+	// edits are not broadcast to it meanwhile since they will be part of it
+	awaitingState atomic.Bool
+	// logger has the user and connection bound; Log adds the current document
+	logger logging.Logger
 }
 
+// broadcastLog logs per-message fan-out, which is very chatty on busy documents
+var broadcastLog = logging.For(logging.CategoryBroadcast)
+
 // Hub manages WebSocket connections
 type Hub struct {
+	// connections is keyed by connection ID, users and documents index them by client and document
+	// ID. The hub loop changes them while broadcasts and stats read them from other goroutines,
+	// mutex guards all three.
 	connections map[string]*Connection
+	users       map[string]map[string]*Connection
+	documents   map[string]map[string]*Connection
+	mutex       sync.RWMutex
 	register    chan *Connection
 	unregister  chan *Connection
 	broadcast   chan DocumentMessage
+	// ids mints connection and anonymous client IDs
+	ids idgen.Generator
+	// lowPriorityQueueLimit is the send buffer fill above which transient messages are dropped
+	lowPriorityQueueLimit int
+	// slowConsumerGrace is how long a document broadcast waits for a full send buffer to drain
+	slowConsumerGrace time.Duration
+	// overrides holds per-document limits taking precedence over the global settings
+	overrides *OverrideRegistry
+	// upgrades holds a slot per upgrade and join in flight, nil when they are unlimited
+	upgrades            chan struct{}
+	upgradeQueueTimeout time.Duration
+	// messageSeq numbers document broadcasts as they are written. Each connection writes in order,
+	// so the IDs it receives always increase.
+	messageSeq atomic.Uint64
+	// closeWriteWait bounds writing a close frame, so an unresponsive peer can't hold up closing its connection
+	closeWriteWait time.Duration
+	// writeWait bounds every message and ping write, so a stalled client can't block its write pump forever
+	writeWait time.Duration
+	// overflowPolicy decides between closing a connection whose send buffer overflows and dropping the message
+	overflowPolicy string
+	// shuttingDown is set once Shutdown began, new connections are refused from then on
+	shuttingDown atomic.Bool
+	// singleSession closes a user's previous connections when they open a new one
+	singleSession bool
+	// maxBufferedMessages is the total of queued outbound messages above which upgrades are refused, 0 disables it
+	maxBufferedMessages int
+	// appPingInterval and appPongTimeout drive the application-level keepalive of new connections, 0 disables it
+	appPingInterval time.Duration
+	appPongTimeout  time.Duration
+	// tokenExpiryLeeway delays closing a connection at token expiry by the clock skew the JWT middleware tolerates
+	tokenExpiryLeeway time.Duration
 }
 
 // Handler represents a WebSocket message handler
@@ -50,13 +160,108 @@ type Handler interface {
 	OnDisconnect(conn *Connection) error
 }
 
-// NewHub creates a new WebSocket hub
-func NewHub() *Hub {
+// HeartbeatHandler is implemented by handlers that want to know when a connection answers a heartbeat ping
+type HeartbeatHandler interface {
+	OnHeartbeat(conn *Connection)
+}
+
+// NewHub creates a new WebSocket hub minting connection IDs with the given generator
+func NewHub(ids idgen.Generator) *Hub {
+	cfg := config.Load()
+	wsCfg := cfg.WebSocket
+
+	closeWriteWait := wsCfg.CloseWriteTimeout
+	if closeWriteWait <= 0 {
+		closeWriteWait = defaultCloseWriteWait
+	}
+	writeWait := wsCfg.WriteWait
+	if writeWait <= 0 {
+		writeWait = defaultWriteWait
+	}
+
+	var appPingInterval, appPongTimeout time.Duration
+	if wsCfg.AppKeepalive {
+		appPingInterval, appPongTimeout = wsCfg.AppKeepaliveInterval, wsCfg.AppKeepaliveTimeout
+	}
+
+	var upgrades chan struct{}
+	if wsCfg.MaxConcurrentUpgrades > 0 {
+		upgrades = make(chan struct{}, wsCfg.MaxConcurrentUpgrades)
+	}
+
 	return &Hub{
-		connections: make(map[string]*Connection),
-		register:    make(chan *Connection),
-		unregister:  make(chan *Connection),
-		broadcast:   make(chan DocumentMessage),
+		connections:           make(map[string]*Connection),
+		users:                 make(map[string]map[string]*Connection),
+		documents:             make(map[string]map[string]*Connection),
+		register:              make(chan *Connection),
+		unregister:            make(chan *Connection),
+		broadcast:             make(chan DocumentMessage),
+		ids:                   ids,
+		slowConsumerGrace:     wsCfg.SlowConsumerGrace,
+		lowPriorityQueueLimit: wsCfg.LowPriorityQueueLimit,
+		upgrades:              upgrades,
+		upgradeQueueTimeout:   wsCfg.UpgradeQueueTimeout,
+		maxBufferedMessages:   wsCfg.MaxBufferedMessages,
+		singleSession:         wsCfg.SingleSessionPerUser,
+		overflowPolicy:        parseOverflowPolicy(wsCfg.OverflowPolicy),
+		closeWriteWait:        closeWriteWait,
+		writeWait:             writeWait,
+		appPingInterval:       appPingInterval,
+		appPongTimeout:        appPongTimeout,
+		tokenExpiryLeeway:     cfg.JWT.ClockSkew,
+		overrides:             NewOverrideRegistry(),
+	}
+}
+
+// Overrides returns the per-document overrides applied to the hub's connections
+func (h *Hub) Overrides() *OverrideRegistry {
+	return h.overrides
+}
+
+// acquireUpgrade takes an upgrade slot, waiting up to the queue timeout or until the request is
+// abandoned. It reports false if no slot was free in time.
+func (h *Hub) acquireUpgrade(r *http.Request) bool {
+	if h.upgrades == nil {
+		return true
+	}
+
+	select {
+	case h.upgrades <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(h.upgradeQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case h.upgrades <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// BufferedMessages returns the number of outbound messages queued in the send buffers of all connections
+func (h *Hub) BufferedMessages() int {
+	total := 0
+	for _, conn := range h.snapshot() {
+		total += len(conn.send)
+	}
+	return total
+}
+
+// overloaded reports whether so many messages are waiting to be written that new connections would only add to the backlog
+func (h *Hub) overloaded() bool {
+	return h.maxBufferedMessages > 0 && h.BufferedMessages() > h.maxBufferedMessages
+}
+
+// releaseUpgrade frees an upgrade slot taken by acquireUpgrade
+func (h *Hub) releaseUpgrade() {
+	if h.upgrades != nil {
+		<-h.upgrades
 	}
 }
 
@@ -65,113 +270,555 @@ func (h *Hub) Run() {
 	for {
 		select {
 		case conn := <-h.register:
-			h.connections[conn.clientID] = conn
+			h.mutex.Lock()
+			h.connections[conn.id] = conn
+			if h.users[conn.clientID] == nil {
+				h.users[conn.clientID] = make(map[string]*Connection)
+			}
+			h.users[conn.clientID][conn.id] = conn
+			h.indexDocument(conn)
+			h.mutex.Unlock()
+			if conn.registered != nil {
+				close(conn.registered)
+			}
 			docID := conn.GetMetadata(config.MetaDocumentIDKey)
-			log.Printf("Connection registered: %s (Document: %v)", conn.clientID, docID)
+			log.Printf("Connection registered: %s/%s (Document: %v)", conn.clientID, conn.id, docID)
 
 		case conn := <-h.unregister:
-			if _, ok := h.connections[conn.clientID]; ok {
-				delete(h.connections, conn.clientID)
-				close(conn.send)
+			if h.remove(conn) {
 				docID := conn.GetMetadata(config.MetaDocumentIDKey)
-				log.Printf("Connection unregistered: %s (Document: %v)", conn.clientID, docID)
+				log.Printf("Connection unregistered: %s/%s (Document: %v)", conn.clientID, conn.id, docID)
 			}
 
 		case message := <-h.broadcast:
-			for clientID, conn := range h.connections {
-				select {
-				case conn.send <- message:
-				default:
-					delete(h.connections, clientID)
-					close(conn.send)
+			for _, conn := range h.snapshot() {
+				if conn.IsService() {
+					continue
+				}
+				if !conn.alive() || !conn.trySend(message) {
+					h.remove(conn)
 				}
 			}
 		}
 	}
 }
 
+// Broadcast sends a message to every connection on the hub, regardless of document.
+// Delivery happens on the hub loop, which drops connections whose send buffer is full.
+func (h *Hub) Broadcast(message DocumentMessage) {
+	h.broadcast <- message
+}
+
 // BroadcastToDocument sends a message to all the connections on a specific document
 func (h *Hub) BroadcastToDocument(documentID string, data []byte, excludeClientID ...string) {
+	h.broadcastToDocument(documentID, DocumentMessage{Type: TextMessage, Data: data}, false, excludeClient(firstOf(excludeClientID)))
+}
+
+// BroadcastBinaryToDocument sends a binary message to all the connections on a specific document
+func (h *Hub) BroadcastBinaryToDocument(documentID string, data []byte, excludeClientID ...string) {
+	h.broadcastToDocument(documentID, DocumentMessage{Type: BinaryMessage, Data: data}, false, excludeClient(firstOf(excludeClientID)))
+}
+
+// BroadcastTransientToDocument sends a low-priority message (cursor, presence) to a document.
+// Connections with a busy send buffer skip it rather than being slowed down or dropped, so
+// transient chatter never crowds out edits.
+func (h *Hub) BroadcastTransientToDocument(documentID string, data []byte, excludeClientID ...string) {
+	h.broadcastToDocument(documentID, DocumentMessage{Type: TextMessage, Data: data}, true, excludeClient(firstOf(excludeClientID)))
+}
+
+// firstOf returns the first of optional values, "" if there is none
+func firstOf(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// broadcastToDocument delivers a message to the document's connections, skipping those excluded (if set)
+func (h *Hub) broadcastToDocument(documentID string, message DocumentMessage, lowPriority bool, excluded func(*Connection) bool) {
+	h.broadcastTo(documentID, h.inDocument(documentID), message, lowPriority, excluded)
+}
+
+// broadcastTo delivers a message of a document to some of its connections, skipping those excluded
+// (if set) and those that have since moved to another document
+func (h *Hub) broadcastTo(documentID string, connections []*Connection, message DocumentMessage, lowPriority bool, excluded func(*Connection) bool) {
 	count := 0
-	log.Printf("🔍 Broadcasting to document: %s", documentID)
-	log.Printf("🔍 Total connections: %d", len(h.connections))
+	message.sequenced = true
+	broadcastLog.Debugf("🔍 Broadcasting to document: %s", documentID)
+	broadcastLog.Debugf("🔍 Document connections: %d", len(connections))
+
+	for _, conn := range connections {
+		if (excluded != nil && excluded(conn)) || conn.IsService() || connectionDocumentID(conn) != documentID {
+			continue
+		}
+		// Already on its way out, the hub drops it shortly
+		if conn.State() >= StateClosing {
+			continue
+		}
+		// The write pump is gone but the connection is still registered: don't let messages pile up
+		if !conn.alive() {
+			broadcastLog.Warnf("💀 Skipping connection %s with a dead write pump", conn.clientID)
+			go conn.unregister()
+			continue
+		}
+		if lowPriority && len(conn.send) >= h.lowPriorityQueueLimit {
+			metrics.IncLowPriorityDrop()
+			continue
+		}
+
+		if conn.trySend(message) {
+			count++
+			broadcastLog.Debugf("✅ Sent message to connection %s", conn.clientID)
+			continue
+		}
+		if lowPriority {
+			metrics.IncLowPriorityDrop()
+			continue
+		}
+		// Give a stalled connection a moment to catch up before giving up on it
+		if conn.deliverWithGrace(message, h.slowConsumerGrace) {
+			count++
+			broadcastLog.Warnf("🐢 Slow connection %s caught up", conn.clientID)
+			continue
+		}
+		// Closed while we were waiting, nothing left to do
+		if conn.State() >= StateClosing {
+			continue
+		}
+		// Keep the connection, it is told to resync once its buffer drains
+		if h.overflowPolicy == OverflowDropMessage {
+			metrics.IncOverflowDrop()
+			conn.dropped()
+			continue
+		}
+		// Locked connection, close it
+		h.remove(conn)
+		broadcastLog.Warnf("❌ Closed blocked connection: %s", conn.clientID)
+	}
+	metrics.ObserveFanout(count)
+	broadcastLog.Infof("📡 Broadcasted message to %d connections in document %s", count, documentID)
+}
+
+// CloseDocument closes every connection on a document with the given close code and reason,
+// returning how many were closed
+func (h *Hub) CloseDocument(documentID string, code int, reason string) int {
+	closing := h.inDocument(documentID)
+	for _, conn := range closing {
+		conn.writeClose(code, reason)
+		conn.unregister()
+	}
+	return len(closing)
+}
 
-	excludeID := ""
-	if len(excludeClientID) > 0 {
-		excludeID = excludeClientID[0]
+// KickUser closes every connection of a user with the given close code and reason,
+// returning how many were closed
+func (h *Hub) KickUser(clientID string, code int, reason string) int {
+	closing := h.userConnections(clientID)
+	for _, conn := range closing {
+		conn.writeClose(code, reason)
+		conn.unregister()
 	}
+	return len(closing)
+}
+
+// remove forgets a connection and closes its send channel, reporting whether it was still registered
+func (h *Hub) remove(conn *Connection) bool {
+	h.mutex.Lock()
+	_, registered := h.connections[conn.id]
+	delete(h.connections, conn.id)
+	if sessions := h.users[conn.clientID]; sessions != nil {
+		delete(sessions, conn.id)
+		if len(sessions) == 0 {
+			delete(h.users, conn.clientID)
+		}
+	}
+	if registered {
+		h.unindexDocument(conn)
+	}
+	h.mutex.Unlock()
+
+	conn.closeSend()
+	return registered
+}
 
+// snapshot returns the registered connections. Callers iterate the copy without holding the lock,
+// so slow work on a connection never holds up registrations.
+func (h *Hub) snapshot() []*Connection {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	connections := make([]*Connection, 0, len(h.connections))
 	for _, conn := range h.connections {
+		connections = append(connections, conn)
+	}
+	return connections
+}
 
-		// Verify if the connection belongs to the document
-		connDocID, ok := conn.GetMetadata(config.MetaDocumentIDKey).(string)
-		log.Printf("🔍 Connection %s has document ID: %v (type: %T)", conn.clientID, connDocID, conn.GetMetadata(config.MetaDocumentIDKey))
+// userConnections returns the registered connections of a user
+func (h *Hub) userConnections(clientID string) []*Connection {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
 
-		if ok && connDocID == documentID {
-			if excludeID != "" && conn.clientID == excludeID {
-				continue
-			}
+	connections := make([]*Connection, 0, len(h.users[clientID]))
+	for _, conn := range h.users[clientID] {
+		connections = append(connections, conn)
+	}
+	return connections
+}
+
+// inDocument returns the registered connections of a document
+func (h *Hub) inDocument(documentID string) []*Connection {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	connections := make([]*Connection, 0, len(h.documents[documentID]))
+	for _, conn := range h.documents[documentID] {
+		connections = append(connections, conn)
+	}
+	return connections
+}
+
+// readyConnections returns the connections of a document that are not waiting for their initial state
+func (h *Hub) readyConnections(documentID string) []*Connection {
+	connections := h.inDocument(documentID)
+	ready := connections[:0]
+	for _, conn := range connections {
+		if !conn.awaitingState.Load() {
+			ready = append(ready, conn)
+		}
+	}
+	return ready
+}
+
+// moveDocument switches a connection to another document, keeping the document index in step
+func (h *Hub) moveDocument(conn *Connection, documentID string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	_, registered := h.connections[conn.id]
+	if registered {
+		h.unindexDocument(conn)
+	}
+	conn.SetMetadata(config.MetaDocumentIDKey, documentID)
+	if registered {
+		h.indexDocument(conn)
+	}
+}
+
+// indexDocument adds a connection to the index of its document; h.mutex must be held
+func (h *Hub) indexDocument(conn *Connection) {
+	documentID, ok := conn.GetMetadata(config.MetaDocumentIDKey).(string)
+	if !ok {
+		return
+	}
+	if h.documents[documentID] == nil {
+		h.documents[documentID] = make(map[string]*Connection)
+	}
+	h.documents[documentID][conn.id] = conn
+}
+
+// unindexDocument removes a connection from the index of its document; h.mutex must be held
+func (h *Hub) unindexDocument(conn *Connection) {
+	documentID, _ := conn.GetMetadata(config.MetaDocumentIDKey).(string)
+	if connections := h.documents[documentID]; connections != nil {
+		delete(connections, conn.id)
+		if len(connections) == 0 {
+			delete(h.documents, documentID)
+		}
+	}
+}
+
+// count returns the number of registered connections
+func (h *Hub) count() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.connections)
+}
+
+// closeSend closes the send channel, which makes the write pump close the connection
+func (c *Connection) closeSend() {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	if c.state.advance(StateClosed) {
+		close(c.send)
+	}
+}
 
-			select {
-			case conn.send <- DocumentMessage{
-				Type: TextMessage,
-				Data: data,
-			}:
-				count++
-				log.Printf("✅ Sent message to connection %s", conn.clientID)
-			default:
-				// Locked connection, close it
-				delete(h.connections, conn.clientID)
-				close(conn.send)
-				log.Printf("❌ Closed blocked connection: %s", conn.clientID)
+// Session describes one active connection of a user
+type Session struct {
+	ConnectionID string    `json:"connection_id"`
+	DocumentID   string    `json:"document_id"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	ReadOnly     bool      `json:"read_only"`
+	Compressed   bool      `json:"compressed"`
+}
+
+// UserSessions returns the active connections of a user
+func (h *Hub) UserSessions(clientID string) []Session {
+	connections := h.userConnections(clientID)
+	sessions := make([]Session, 0, len(connections))
+	for _, conn := range connections {
+		documentID, _ := conn.GetMetadata(config.MetaDocumentIDKey).(string)
+		remoteAddr, _ := conn.GetMetadata(config.MetaRemoteAddrKey).(string)
+		sessions = append(sessions, Session{
+			ConnectionID: conn.id,
+			DocumentID:   documentID,
+			ConnectedAt:  conn.connectedAt,
+			RemoteAddr:   remoteAddr,
+			ReadOnly:     conn.IsReadOnly(),
+			Compressed:   conn.IsCompressed(),
+		})
+	}
+	return sessions
+}
+
+// CountConnectionsForDocument returns the number of connections on a specific document
+func (h *Hub) CountConnectionsForDocument(documentID string) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	count := 0
+	for _, conn := range h.documents[documentID] {
+		if !conn.IsService() {
+			count++
+		}
+	}
+	return count
+}
+
+// ListDocumentMembers returns the IDs of the clients connected to a document on this instance, sorted
+// and without duplicates for users with several connections. Services are not members.
+func (h *Hub) ListDocumentMembers(documentID string) []string {
+	seen := make(map[string]struct{})
+	members := []string{}
+	for _, conn := range h.inDocument(documentID) {
+		if conn.IsService() {
+			continue
+		}
+		if _, dup := seen[conn.GetClientID()]; dup {
+			continue
+		}
+		seen[conn.GetClientID()] = struct{}{}
+		members = append(members, conn.GetClientID())
+	}
+	sort.Strings(members)
+	return members
+}
+
+// documentConnections counts the connections of each document: present includes every connection
+// registered with the hub, joined only those whose OnConnect completed
+func (h *Hub) documentConnections() (present, joined map[string]int) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	present = make(map[string]int, len(h.documents))
+	joined = make(map[string]int, len(h.documents))
+	for documentID, connections := range h.documents {
+		present[documentID] = len(connections)
+		for _, conn := range connections {
+			if conn.State() == StateActive {
+				joined[documentID]++
 			}
-		} else {
-			log.Printf("❌ Connection %s doesn't match document %s (has: %s)", conn.clientID, documentID, connDocID)
 		}
 	}
-	log.Printf("📡 Broadcasted message to %d connections in document %s", count, documentID)
+	return present, joined
+}
+
+// ConnectionStats summarizes the capabilities negotiated by the hub's connections
+type ConnectionStats struct {
+	Connections           int `json:"connections"`
+	CompressedConnections int `json:"compressed_connections"`
+}
+
+// ConnectionCount returns the number of open connections
+func (h *Hub) ConnectionCount() int {
+	return h.count()
+}
+
+// ConnectionStats returns how many connections are open and how many negotiated compression
+func (h *Hub) ConnectionStats() ConnectionStats {
+	connections := h.snapshot()
+	stats := ConnectionStats{Connections: len(connections)}
+	for _, conn := range connections {
+		if conn.IsCompressed() {
+			stats.CompressedConnections++
+		}
+	}
+	return stats
 }
 
 // SendMessage sends a message to a specific connection
 func (c *Connection) SendMessage(message DocumentMessage) error {
+	if !c.alive() || !c.trySend(message) {
+		return &websocket.CloseError{Code: websocket.CloseGoingAway, Text: "connection closed"}
+	}
+	return nil
+}
+
+// trySend queues a message without blocking. It fails once the connection is closing or when
+// the send buffer is full; holding sendMutex keeps closeSend from closing the channel under it.
+func (c *Connection) trySend(message DocumentMessage) bool {
+	c.sendMutex.RLock()
+	defer c.sendMutex.RUnlock()
+
+	if c.State() >= StateClosing {
+		return false
+	}
 	select {
 	case c.send <- message:
-		return nil
+		return true
 	default:
-		return &websocket.CloseError{Code: websocket.CloseGoingAway, Text: "connection closed"}
+		return false
 	}
 }
 
+// sendWithin is trySend waiting up to timeout for room in the send buffer
+func (c *Connection) sendWithin(message DocumentMessage, timeout time.Duration) bool {
+	c.sendMutex.RLock()
+	defer c.sendMutex.RUnlock()
+
+	if c.State() >= StateClosing {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case c.send <- message:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// deliverWithGrace waits up to grace for room in a full send buffer. On success the client is
+// also warned that it is falling behind, if there is room left for the warning.
+func (c *Connection) deliverWithGrace(message DocumentMessage, grace time.Duration) bool {
+	if grace <= 0 || !c.sendWithin(message, grace) {
+		return false
+	}
+	c.SendError("slow_consumer", "the connection is falling behind and may be closed")
+	return true
+}
+
+// SendJSON encodes v as JSON and sends it to the connection as a text message
+func (c *Connection) SendJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return c.SendMessage(DocumentMessage{Type: TextMessage, Data: data})
+}
+
+// SendError notifies the client that one of its messages was rejected
+func (c *Connection) SendError(code, message string) error {
+	return c.SendJSON(ErrorMessage{Type: "error", Code: code, Message: message})
+}
+
+// ErrorMessage is sent to a client when the server rejects one of its messages
+type ErrorMessage struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// IsReadOnly reports whether the connection may only receive broadcasts, either for good or
+// because it was downgraded in its current document
+func (c *Connection) IsReadOnly() bool {
+	readOnly, _ := c.GetMetadata(config.MetaReadOnlyKey).(bool)
+	downgraded, _ := c.GetMetadata(config.MetaDowngradedKey).(bool)
+	return readOnly || downgraded
+}
+
+// IsCompressed reports whether messages to the connection are compressed: permessage-deflate was
+// negotiated and the client didn't opt out with ?compress=false
+func (c *Connection) IsCompressed() bool {
+	compressed, _ := c.GetMetadata(config.MetaCompressionKey).(bool)
+	return compressed
+}
+
+// IsService reports whether the connection is a publish-only backend service that receives no broadcasts
+func (c *Connection) IsService() bool {
+	service, _ := c.GetMetadata(config.MetaServiceKey).(bool)
+	return service
+}
+
 // GetMetadata returns connection metadata
 func (c *Connection) GetMetadata(key string) interface{} {
+	c.metadataMutex.RLock()
+	defer c.metadataMutex.RUnlock()
 	return c.metadata[key]
 }
 
 // SetMetadata sets connection metadata
 func (c *Connection) SetMetadata(key string, value interface{}) {
+	c.metadataMutex.Lock()
+	defer c.metadataMutex.Unlock()
 	c.metadata[key] = value
 }
 
+// GetDisplayName returns the human-readable identity of the user, "" when there is none
+func (c *Connection) GetDisplayName() string {
+	displayName, _ := c.GetMetadata(config.MetaDisplayNameKey).(string)
+	return displayName
+}
+
+// describe names the connection's user for logs, with the display name when there is one
+func (c *Connection) describe() string {
+	if displayName := c.GetDisplayName(); displayName != "" {
+		return c.clientID + " (" + displayName + ")"
+	}
+	return c.clientID
+}
+
+// Log returns the connection's logger, with its user, connection and current document bound
+func (c *Connection) Log() logging.Logger {
+	return c.logger.With("doc", c.GetMetadata(config.MetaDocumentIDKey))
+}
+
 // GetClientID returns the client ID
 func (c *Connection) GetClientID() string {
 	return c.clientID
 }
 
+// GetProtocolVersion returns the protocol version negotiated with the client
+func (c *Connection) GetProtocolVersion() int {
+	return c.protocolVersion
+}
+
+// GetID returns the unique ID of this connection
+func (c *Connection) GetID() string {
+	return c.id
+}
+
 // NewUpgrader creates a WebSocket upgrader with the given configuration
 func NewUpgrader(cfg *config.Config) websocket.Upgrader {
+	var subprotocols []string
+	if middleware.AcceptsTokenSubprotocol(cfg.JWT.TokenSources) {
+		subprotocols = []string{middleware.TokenSubprotocol}
+	}
 	return websocket.Upgrader{
+		Subprotocols: subprotocols,
 		CheckOrigin: func(r *http.Request) bool {
 			return !cfg.WebSocket.CheckOrigin // Allow all origins when CheckOrigin is false
 		},
-		ReadBufferSize:   cfg.WebSocket.ReadBufferSize,
-		WriteBufferSize:  cfg.WebSocket.WriteBufferSize,
-		HandshakeTimeout: cfg.WebSocket.HandshakeTimeout,
-		//EnableCompression:  cfg.WebSocket.EnableCompression,
+		ReadBufferSize:    cfg.WebSocket.ReadBufferSize,
+		WriteBufferSize:   cfg.WebSocket.WriteBufferSize,
+		HandshakeTimeout:  cfg.WebSocket.HandshakeTimeout,
+		EnableCompression: cfg.WebSocket.EnableCompression,
 	}
 }
 
-// HandleWebSocket creates a WebSocket handler function
+// HandleWebSocket creates a WebSocket handler function taking the document ID from the {id} path wildcard
 func HandleWebSocket(upgrader websocket.Upgrader, hub *Hub, handler Handler) http.HandlerFunc {
+	return HandleWebSocketWithExtractor(upgrader, hub, handler, PathDocumentID("id"))
+}
+
+// HandleWebSocketWithExtractor creates a WebSocket handler function finding the document ID with the given extractor
+func HandleWebSocketWithExtractor(upgrader websocket.Upgrader, hub *Hub, handler Handler, extract DocumentIDExtractor) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		clientId, ok := middleware.GetUserID(r)
 		if !ok || clientId == "" {
@@ -179,77 +826,359 @@ func HandleWebSocket(upgrader websocket.Upgrader, hub *Hub, handler Handler) htt
 			return
 		}
 
-		docId := r.PathValue("id")
+		serveConnection(upgrader, hub, handler, extract, w, r, clientId, false)
+	}
+}
 
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Printf("Failed to upgrade connection: %v", err)
-			return
+// HandleAnonymousWebSocket creates a WebSocket handler function for unauthenticated viewers.
+// Each connection gets a generated client ID and is read-only.
+func HandleAnonymousWebSocket(upgrader websocket.Upgrader, hub *Hub, handler Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveConnection(upgrader, hub, handler, PathDocumentID("id"), w, r, "anon-"+hub.ids.NewID(), true)
+	}
+}
+
+// serveConnection upgrades the request and runs the connection until it is closed
+func serveConnection(upgrader websocket.Upgrader, hub *Hub, handler Handler, extract DocumentIDExtractor, w http.ResponseWriter, r *http.Request, clientId string, readOnly bool) {
+
+	if hub.shuttingDown.Load() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Shed load while existing connections can't keep up with what is already queued for them
+	if hub.overloaded() {
+		log.Printf("Refusing upgrade for %s: send buffers are backed up", clientId)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Server overloaded, retry later", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Smooth out reconnection storms: only so many upgrades and joins (NATS subscribe included) run at once
+	if !hub.acquireUpgrade(r) {
+		log.Printf("Refusing upgrade for %s: too many upgrades in flight", clientId)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many connections in progress, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	defer hub.releaseUpgrade()
+
+	connectionID := hub.ids.NewID()
+
+	// Count wire bytes so the compression ratio of outbound frames can be measured
+	counter := &countingResponseWriter{ResponseWriter: w}
+	conn, err := upgrader.Upgrade(counter, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade connection: %v", err)
+		return
+	}
+
+	// Don't buffer arbitrarily large frames; the read fails once a message passes the limit
+	wsCfg := config.Load().WebSocket
+	if wsCfg.MaxMessageSize > 0 {
+		conn.SetReadLimit(wsCfg.MaxMessageSize)
+	}
+
+	// Refuse clients that share no protocol version with us before they join anything
+	protocolVersion, ok := negotiateProtocol(r.URL.Query().Get("protocol"))
+	if !ok {
+		log.Printf("Rejecting client %s: no common protocol version in %q", clientId, r.URL.Query().Get("protocol"))
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(CloseUnsupportedProtocol, "unsupported_protocol"), time.Now().Add(hub.closeWriteWait))
+		conn.Close()
+		return
+	}
+
+	// Find the document to join; a client sending it as its first message must do so before the
+	// initial message timeout, so silent clients don't hold on to the connection
+	docId, err := extract(r, func() ([]byte, error) {
+		if wsCfg.InitialMessageTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(wsCfg.InitialMessageTimeout))
+			defer conn.SetReadDeadline(time.Time{})
 		}
+		_, data, err := conn.ReadMessage()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, ErrHandshakeTimeout
+		}
+		return data, err
+	})
+	if err != nil {
+		log.Printf("Rejecting client %s: %v", clientId, err)
+		reason := "document_id_required"
+		if errors.Is(err, ErrHandshakeTimeout) {
+			reason = "handshake_timeout"
+		}
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(hub.closeWriteWait))
+		conn.Close()
+		return
+	}
 
-		// Create connection wrapper
-		wsConn := &Connection{
-			conn:     conn,
-			clientID: clientId,
-			metadata: make(map[string]interface{}),
-			send:     make(chan DocumentMessage, 256),
-			hub:      hub,
+	// Create connection wrapper
+	wsConn := &Connection{
+		conn:            conn,
+		id:              connectionID,
+		clientID:        clientId,
+		connectedAt:     time.Now(),
+		metadata:        make(map[string]interface{}),
+		send:            make(chan DocumentMessage, hub.overrides.sendBufferSize(docId)),
+		hub:             hub,
+		registered:      make(chan struct{}),
+		pingInterval:    wsCfg.PingInterval,
+		pongTimeout:     wsCfg.PongTimeout,
+		readLimit:       wsCfg.MaxMessageSize,
+		protocolVersion: protocolVersion,
+	}
+	// permessage-deflate stays negotiated either way, a client preferring no compression just gets uncompressed frames
+	if hub.appPingInterval > 0 {
+		wsConn.appPingInterval = hub.appPingInterval
+		wsConn.appPongTimeout = hub.appPongTimeout
+		wsConn.lastAppPong.Store(time.Now().UnixNano())
+	}
+	compressed := upgrader.EnableCompression && compressionRequested(r) && compressionPreferred(r)
+	conn.EnableWriteCompression(compressed)
+	if compressed {
+		wsConn.wire = counter.conn
+	}
+	wsConn.SetMetadata(config.MetaCompressionKey, compressed)
+	wsConn.SetMetadata(config.MetaSubprotocolKey, conn.Subprotocol())
+	wsConn.SetMetadata(config.MetaRemoteAddrKey, r.RemoteAddr)
+	wsConn.SetMetadata(config.MetaDocumentIDKey, docId)
+	wsConn.SetMetadata(config.MetaReadOnlyKey, readOnly)
+	wsConn.SetMetadata(config.MetaServiceKey, middleware.HasScope(r, middleware.ScopeService))
+	if color := r.URL.Query().Get("color"); color != "" {
+		wsConn.SetMetadata(config.MetaPreferredColorKey, color)
+	}
+	if displayName, ok := middleware.GetDisplayName(r); ok {
+		wsConn.SetMetadata(config.MetaDisplayNameKey, displayName)
+	}
+	if claimed, ok := middleware.GetDocumentClaim(r); ok && claimed != "" {
+		wsConn.SetMetadata(config.MetaDocumentClaimKey, claimed)
+	}
+	if since := r.URL.Query().Get("since"); since != "" {
+		wsConn.SetMetadata(config.MetaSinceRevisionKey, since)
+		wsConn.awaitingState.Store(true)
+	}
+	wsConn.logger = logging.For(logging.CategoryConnection).With("user", wsConn.describe()).With("conn", connectionID)
+
+	// Only one session per user: the previous one makes way for the new one
+	if hub.singleSession && !wsConn.IsService() {
+		if superseded := hub.supersedeSessions(clientId); superseded > 0 {
+			wsConn.Log().Infof("Took over from %d previous connection(s)", superseded)
 		}
-		wsConn.SetMetadata(config.MetaRemoteAddrKey, r.RemoteAddr)
-		wsConn.SetMetadata(config.MetaDocumentIDKey, docId)
+	}
 
-		// Register connection with hub
-		hub.register <- wsConn
+	// Register connection with hub, waiting until it is indexed so OnConnect counts it in its document
+	hub.register <- wsConn
+	<-wsConn.registered
 
-		// Call connect handler
-		if err := handler.OnConnect(wsConn); err != nil {
-			log.Printf("Connection handler error: %v", err)
-			return
+	// Shutdown only closes the connections registered when it starts: one that got past the
+	// shutdown check before then is turned away here
+	if hub.shuttingDown.Load() {
+		wsConn.writeClose(websocket.CloseServiceRestart, shutdownReason)
+		wsConn.unregister()
+		conn.Close()
+		return
+	}
+
+	// Start writing before OnConnect so whatever it sends (welcome, catch-up, ...) is drained
+	// right away instead of filling the send buffer
+	go wsConn.writePump()
+
+	// Call connect handler, refusing the connection if it fails
+	if err := handler.OnConnect(wsConn); err != nil {
+		wsConn.Log().Warnf("Connection handler error: %v", err)
+		if errors.Is(err, ErrDocumentAccessDenied) {
+			wsConn.writeClose(websocket.ClosePolicyViolation, "forbidden")
+		} else {
+			wsConn.writeClose(websocket.CloseTryAgainLater, "connection rejected")
 		}
+		wsConn.unregister()
+		conn.Close()
+		return
+	}
 
-		// Start goroutines for reading and writing
-		go wsConn.writePump()
-		go wsConn.readPump(handler)
+	if !wsConn.state.advance(StateActive) {
+		wsConn.Log().Infof("Connection was closed while joining")
 	}
+	if expiresAt, ok := middleware.GetTokenExpiry(r); ok && wsCfg.CloseOnTokenExpiry {
+		wsConn.closeAtExpiry(expiresAt)
+	}
+	go wsConn.readPump(handler)
 }
 
 // readPump handles incoming messages from the WebSocket connection
 func (c *Connection) readPump(handler Handler) {
 	defer func() {
-		c.hub.unregister <- c
+		c.stopExpiry()
+		c.unregister()
 		c.conn.Close()
 		handler.OnDisconnect(c)
 	}()
 
+	// Every pong pushes the read deadline forward; a peer that stops answering pings
+	// hits the deadline and is disconnected without waiting for the TCP timeout
+	heartbeats, _ := handler.(HeartbeatHandler)
+	if c.pingInterval > 0 && c.pongTimeout > 0 {
+		c.conn.SetReadDeadline(c.readDeadline(time.Now().Add(c.pongTimeout)))
+		c.conn.SetPongHandler(func(string) error {
+			if heartbeats != nil {
+				heartbeats.OnHeartbeat(c)
+			}
+			return c.conn.SetReadDeadline(c.readDeadline(time.Now().Add(c.pongTimeout)))
+		})
+	}
+
 	for {
 		messageType, data, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+			var netErr net.Error
+			if errors.Is(err, websocket.ErrReadLimit) {
+				c.Log().Warnf("Message larger than %d bytes, closing", c.readLimit)
+				c.writeClose(websocket.CloseMessageTooBig, "message too big")
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				c.Log().Infof("Heartbeat lost, closing")
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				c.Log().Warnf("WebSocket error: %v", err)
 			}
 			break
 		}
 
+		if !MessageType(messageType).IsData() {
+			c.Log().Debugf("Ignoring non-data frame (type %d)", messageType)
+			continue
+		}
+		metrics.IncMessage(metrics.DirectionReceived)
+
+		// An application-level pong counts like a protocol one, which a proxy may have stripped
+		if c.appPingInterval > 0 && isAppPong(data) {
+			c.lastAppPong.Store(time.Now().UnixNano())
+			if heartbeats != nil {
+				heartbeats.OnHeartbeat(c)
+			}
+			if c.pingInterval > 0 && c.pongTimeout > 0 {
+				c.conn.SetReadDeadline(c.readDeadline(time.Now().Add(c.pongTimeout)))
+			}
+			continue
+		}
+
 		message := DocumentMessage{
 			Type: MessageType(messageType),
 			Data: data,
 		}
 
 		if err := handler.HandleMessage(c, message); err != nil {
-			log.Printf("Message handler error: %v", err)
+			c.Log().Warnf("Message handler error: %v", err)
 		}
 	}
 }
 
 // writePump handles outgoing messages to the WebSocket connection
 func (c *Connection) writePump() {
+	var pings <-chan time.Time
+	if c.pingInterval > 0 {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	var appPings <-chan time.Time
+	if c.appPingInterval > 0 {
+		ticker := time.NewTicker(c.appPingInterval)
+		defer ticker.Stop()
+		appPings = ticker.C
+	}
+
 	defer c.conn.Close()
+	defer c.writerDone.Store(true)
 
-	for message := range c.send {
-		if err := c.conn.WriteMessage(int(message.Type), message.Data); err != nil {
-			log.Printf("Write error: %v", err)
-			return
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				c.writeClose(websocket.CloseNormalClosure, "")
+				return
+			}
+			err := c.writeMessage(message)
+			if err == nil {
+				c.written(message)
+				err = c.writeResyncNotice()
+			}
+			if err != nil {
+				c.Log().Warnf("Write error: %v", err)
+				// After a timeout the connection is unusable, there is no point in writing a close frame
+				if !isTimeout(err) {
+					c.writeClose(websocket.CloseInternalServerErr, "write failed")
+				}
+				// Leave the hub right away; closing the conn (deferred) also stops the read pump
+				c.unregister()
+				return
+			}
+		case <-pings:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.hub.writeWait)); err != nil {
+				c.Log().Warnf("Ping error: %v", err)
+				c.writeClose(websocket.CloseGoingAway, "heartbeat failed")
+				return
+			}
+		case now := <-appPings:
+			if c.appPongOverdue(now) {
+				c.Log().Infof("Application keepalive lost, closing")
+				c.writeClose(websocket.CloseGoingAway, "keepalive_timeout")
+				return
+			}
+			if err := c.writeMessage(DocumentMessage{Type: TextMessage, Data: appPing}); err != nil {
+				c.Log().Warnf("Keepalive error: %v", err)
+				c.writeClose(websocket.CloseGoingAway, "heartbeat failed")
+				return
+			}
 		}
 	}
-	c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+}
+
+// alive reports whether the write pump is still running, so messages sent to the connection get delivered
+func (c *Connection) alive() bool {
+	return !c.writerDone.Load()
+}
+
+// unregister removes the connection from the hub. Only the first call does anything, and none
+// does once the hub has already dropped the connection.
+func (c *Connection) unregister() {
+	if c.state.advance(StateClosing) {
+		c.hub.unregister <- c
+	}
+}
+
+// writeClose sends a close frame with the given code and reason. It is best effort: the peer may already
+// be gone, and it gives up after the hub's close write timeout rather than waiting on the TCP timeout.
+func (c *Connection) writeClose(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(c.hub.closeWriteWait))
+}
+
+// isTimeout reports whether a write failed because its deadline passed
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeMessage writes a single message within the write wait, recording compression stats when compression is in use
+func (c *Connection) writeMessage(message DocumentMessage) error {
+	var before int64
+	if c.wire != nil {
+		before = c.wire.BytesWritten()
+	}
+
+	data := message.Data
+	if message.sequenced && message.Type == TextMessage {
+		data = withMessageID(data, c.hub.messageSeq.Add(1))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.hub.writeWait))
+	if err := c.conn.WriteMessage(int(message.Type), data); err != nil {
+		return err
+	}
+	metrics.IncMessage(metrics.DirectionSent)
+
+	if c.wire != nil {
+		metrics.ObserveCompressedWrite(len(data), int(c.wire.BytesWritten()-before))
+	}
+	return nil
 }
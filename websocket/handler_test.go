@@ -0,0 +1,716 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/gorilla/websocket"
+)
+
+// newHubConnection returns a connection on a document that is not backed by a network connection.
+// Nothing reads its send buffer unless the test does.
+func newHubConnection(hub *Hub, id, userID, documentID string, buffer int) *Connection {
+	conn := &Connection{
+		id:          id,
+		clientID:    userID,
+		connectedAt: time.Now(),
+		metadata:    map[string]interface{}{config.MetaDocumentIDKey: documentID},
+		send:        make(chan DocumentMessage, buffer),
+		hub:         hub,
+	}
+	conn.state.advance(StateActive)
+	return conn
+}
+
+// drain reads the connection's send buffer until the hub closes it
+func drain(conn *Connection) {
+	for range conn.send {
+	}
+}
+
+func TestRegisterWhileBroadcasting(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	hub.slowConsumerGrace = time.Millisecond
+	go hub.Run()
+
+	stop := make(chan struct{})
+	var broadcasters sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		broadcasters.Add(1)
+		go func() {
+			defer broadcasters.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				hub.BroadcastToDocument("doc1", []byte("edit"))
+				hub.BroadcastTransientToDocument("doc1", []byte("cursor"))
+				hub.Broadcast(DocumentMessage{Type: TextMessage, Data: []byte("notice")})
+			}
+		}()
+	}
+
+	// Slow connections overflow and are closed by one broadcast while the others send to them,
+	// and every third one leaves on its own
+	conns := make([]*Connection, 100)
+	for i := range conns {
+		conn := newHubConnection(hub, fmt.Sprintf("conn-%d", i), fmt.Sprintf("user-%d", i%10), "doc1", 2)
+		if i%2 == 0 {
+			go drain(conn)
+		}
+		hub.register <- conn
+		if i%3 == 0 {
+			go conn.unregister()
+		}
+		conns[i] = conn
+	}
+
+	close(stop)
+	broadcasters.Wait()
+
+	for _, conn := range conns {
+		conn.unregister()
+	}
+	waitFor(t, "every connection to be removed", func() bool { return hub.count() == 0 })
+	for _, conn := range conns {
+		if state := conn.State(); state != StateClosed {
+			t.Errorf("connection %s is %s, want closed", conn.id, state)
+		}
+	}
+}
+
+func TestSendMessageAfterClose(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	conn := newHubConnection(hub, "conn-1", "alice", "doc1", 1)
+	hub.connections[conn.id] = conn
+
+	hub.remove(conn)
+
+	if err := conn.SendMessage(DocumentMessage{Type: TextMessage, Data: []byte("late")}); err == nil {
+		t.Error("SendMessage succeeded on a closed connection")
+	}
+	if conn.trySend(DocumentMessage{Type: TextMessage, Data: []byte("late")}) {
+		t.Error("trySend succeeded on a closed connection")
+	}
+	if conn.deliverWithGrace(DocumentMessage{Type: TextMessage, Data: []byte("late")}, time.Millisecond) {
+		t.Error("deliverWithGrace succeeded on a closed connection")
+	}
+}
+
+func TestDocumentIndex(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	go hub.Run()
+
+	alice := newHubConnection(hub, "conn-1", "alice", "doc1", 1)
+	aliceTab := newHubConnection(hub, "conn-2", "alice", "doc1", 1)
+	bob := newHubConnection(hub, "conn-3", "bob", "doc2", 1)
+	service := newHubConnection(hub, "conn-4", "indexer", "doc1", 1)
+	service.SetMetadata(config.MetaServiceKey, true)
+	for _, conn := range []*Connection{alice, aliceTab, bob, service} {
+		hub.register <- conn
+	}
+	waitFor(t, "every connection to register", func() bool { return hub.count() == 4 })
+
+	if got := hub.CountConnectionsForDocument("doc1"); got != 2 {
+		t.Errorf("doc1 has %d connections, want 2 without the service", got)
+	}
+	if got := hub.ListDocumentMembers("doc1"); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("doc1 members = %v, want [alice]", got)
+	}
+
+	hub.moveDocument(aliceTab, "doc2")
+	if got := hub.CountConnectionsForDocument("doc2"); got != 2 {
+		t.Errorf("doc2 has %d connections after the move, want 2", got)
+	}
+	if got := hub.CountConnectionsForDocument("doc1"); got != 1 {
+		t.Errorf("doc1 has %d connections after the move, want 1", got)
+	}
+
+	bob.unregister()
+	aliceTab.unregister()
+	waitFor(t, "doc2 to empty", func() bool { return hub.CountConnectionsForDocument("doc2") == 0 })
+	present, _ := hub.documentConnections()
+	if _, ok := present["doc2"]; ok {
+		t.Errorf("doc2 still indexed after its last connection left: %v", present)
+	}
+	if present["doc1"] != 2 {
+		t.Errorf("doc1 counted %d connections, want 2 with the service", present["doc1"])
+	}
+}
+
+func TestMoveDocumentOfRemovedConnection(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	conn := newHubConnection(hub, "conn-1", "alice", "doc1", 1)
+
+	hub.moveDocument(conn, "doc2")
+
+	if got := connectionDocumentID(conn); got != "doc2" {
+		t.Errorf("document is %q, want doc2", got)
+	}
+	if got := hub.CountConnectionsForDocument("doc2"); got != 0 {
+		t.Errorf("an unregistered connection was indexed in doc2")
+	}
+}
+
+// connectionOf returns the hub's connection of a user, failing the test unless there is exactly one
+func (g *testGateway) connectionOf(userID string) *Connection {
+	g.t.Helper()
+
+	var found []*Connection
+	for _, conn := range g.hub.snapshot() {
+		if conn.GetClientID() == userID {
+			found = append(found, conn)
+		}
+	}
+	if len(found) != 1 {
+		g.t.Fatalf("%s has %d connections, want 1", userID, len(found))
+	}
+	return found[0]
+}
+
+func TestRemovedConnectionClosesNormally(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+
+	gateway.connectionOf("alice").unregister()
+
+	if closeErr := alice.expectClose(); closeErr.Code != websocket.CloseNormalClosure {
+		t.Errorf("close code = %d, want %d", closeErr.Code, websocket.CloseNormalClosure)
+	}
+}
+
+func TestRejectedConnectionClosesWithTryAgainLater(t *testing.T) {
+	gateway := newTestGateway(t)
+	gateway.handler.drainMutex.Lock()
+	gateway.handler.closing["doc1"] = struct{}{}
+	gateway.handler.drainMutex.Unlock()
+
+	alice := gateway.dialPath("alice", "/ws/document/doc1")
+
+	closeErr := alice.expectClose()
+	if closeErr.Code != websocket.CloseTryAgainLater || closeErr.Text != "connection rejected" {
+		t.Errorf("closed with %d %q, want %d \"connection rejected\"", closeErr.Code, closeErr.Text, websocket.CloseTryAgainLater)
+	}
+}
+
+func TestBroadcastReachesEveryDocument(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	go hub.Run()
+	alice := newHubConnection(hub, "conn-1", "alice", "doc1", 1)
+	bob := newHubConnection(hub, "conn-2", "bob", "doc2", 1)
+	service := newHubConnection(hub, "conn-3", "indexer", "doc1", 1)
+	service.SetMetadata(config.MetaServiceKey, true)
+	for _, conn := range []*Connection{alice, bob, service} {
+		hub.register <- conn
+	}
+	waitFor(t, "every connection to register", func() bool { return hub.count() == 3 })
+
+	hub.Broadcast(DocumentMessage{Type: TextMessage, Data: []byte("maintenance")})
+
+	for _, conn := range []*Connection{alice, bob} {
+		select {
+		case message := <-conn.send:
+			if string(message.Data) != "maintenance" {
+				t.Errorf("%s received %q, want maintenance", conn.clientID, message.Data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s did not receive the broadcast", conn.clientID)
+		}
+	}
+	// The hub loop only takes the next broadcast once it is done with the first
+	hub.Broadcast(DocumentMessage{Type: TextMessage, Data: []byte("over")})
+	if len(service.send) != 0 {
+		t.Error("the broadcast reached a service connection")
+	}
+}
+
+// recordingHandler records the messages passed to it
+type recordingHandler struct {
+	messages chan DocumentMessage
+}
+
+func (h *recordingHandler) HandleMessage(_ *Connection, message DocumentMessage) error {
+	h.messages <- message
+	return nil
+}
+
+func (h *recordingHandler) OnConnect(*Connection) error    { return nil }
+func (h *recordingHandler) OnDisconnect(*Connection) error { return nil }
+
+// dialHandler connects to doc1 on a server running handler on a hub of its own
+func dialHandler(t *testing.T, handler Handler) *websocket.Conn {
+	t.Helper()
+
+	hub := NewHub(idgen.NewSequential("conn"))
+	go hub.Run()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/{id}", HandleAnonymousWebSocket(websocket.Upgrader{}, hub, handler))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/doc1", nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestControlFramesNotPassedToHandler(t *testing.T) {
+	handler := &recordingHandler{messages: make(chan DocumentMessage, 4)}
+	conn := dialHandler(t, handler)
+
+	deadline := time.Now().Add(time.Second)
+	if err := conn.WriteControl(websocket.PingMessage, []byte("ping"), deadline); err != nil {
+		t.Fatalf("failed to send ping: %v", err)
+	}
+	if err := conn.WriteControl(websocket.PongMessage, []byte("pong"), deadline); err != nil {
+		t.Fatalf("failed to send pong: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("edit")); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	select {
+	case message := <-handler.messages:
+		if message.Type != TextMessage || string(message.Data) != "edit" {
+			t.Errorf("handler received %d %q, want the text message", message.Type, message.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not receive the text message")
+	}
+	select {
+	case message := <-handler.messages:
+		t.Errorf("handler unexpectedly received %d %q", message.Type, message.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// greetingHandler sends a greeting on connect and waits for it to leave the send buffer
+type greetingHandler struct {
+	recordingHandler
+	drained chan bool
+}
+
+func (h *greetingHandler) OnConnect(conn *Connection) error {
+	conn.SendMessage(DocumentMessage{Type: TextMessage, Data: []byte("welcome")})
+
+	deadline := time.Now().Add(time.Second)
+	for len(conn.send) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	h.drained <- len(conn.send) == 0
+	return nil
+}
+
+func TestMessagesSentOnConnectAreDelivered(t *testing.T) {
+	handler := &greetingHandler{drained: make(chan bool, 1)}
+	conn := dialHandler(t, handler)
+
+	if !<-handler.drained {
+		t.Error("the send buffer was not drained while OnConnect ran")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "welcome" {
+		t.Errorf("received %q, %v; want the welcome", data, err)
+	}
+}
+
+func TestMessageTypeIsData(t *testing.T) {
+	for _, messageType := range []int{websocket.TextMessage, websocket.BinaryMessage} {
+		if !MessageType(messageType).IsData() {
+			t.Errorf("type %d is not data", messageType)
+		}
+	}
+	for _, messageType := range []int{websocket.CloseMessage, websocket.PingMessage, websocket.PongMessage} {
+		if MessageType(messageType).IsData() {
+			t.Errorf("control type %d is data", messageType)
+		}
+	}
+}
+
+func TestWriteErrorRemovesConnection(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	conn := gateway.connectionOf("alice")
+
+	// Gorilla refuses to write frames of an unknown type, failing the write without touching the network
+	if err := conn.SendMessage(DocumentMessage{Type: MessageType(99), Data: []byte("bad")}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	waitFor(t, "alice to be removed", func() bool { return gateway.hub.CountConnectionsForDocument("doc1") == 0 })
+	if closeErr := alice.expectClose(); closeErr.Code != websocket.CloseInternalServerErr {
+		t.Errorf("close code = %d, want %d", closeErr.Code, websocket.CloseInternalServerErr)
+	}
+	waitFor(t, "alice to be closed", func() bool { return conn.State() == StateClosed })
+}
+
+func TestBrieflyStalledConsumerRecovers(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	hub.slowConsumerGrace = time.Second
+	go hub.Run()
+	stalled := newHubConnection(hub, "conn-1", "alice", "doc1", 1)
+	stuck := newHubConnection(hub, "conn-2", "bob", "doc1", 1)
+	for _, conn := range []*Connection{stalled, stuck} {
+		hub.register <- conn
+		conn.send <- DocumentMessage{Type: TextMessage, Data: []byte("backlog")}
+	}
+	waitFor(t, "both connections to register", func() bool { return hub.count() == 2 })
+
+	// alice catches up within the grace period, bob never does
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-stalled.send
+	}()
+	hub.BroadcastToDocument("doc1", []byte("edit"))
+
+	if state := stalled.State(); state != StateActive {
+		t.Errorf("briefly stalled connection is %s, want it kept active", state)
+	}
+	if message := <-stalled.send; string(message.Data) != "edit" {
+		t.Errorf("briefly stalled connection received %q, want the edit", message.Data)
+	}
+	waitFor(t, "the stuck connection to be closed", func() bool { return stuck.State() == StateClosed })
+}
+
+// joinGate holds OnConnect until released, recording how many joins ran at once
+type joinGate struct {
+	recordingHandler
+	release chan struct{}
+	mutex   sync.Mutex
+	running int
+	peak    int
+}
+
+func (h *joinGate) OnConnect(*Connection) error {
+	h.mutex.Lock()
+	h.running++
+	h.peak = max(h.peak, h.running)
+	h.mutex.Unlock()
+
+	<-h.release
+
+	h.mutex.Lock()
+	h.running--
+	h.mutex.Unlock()
+	return nil
+}
+
+// peakJoins returns the most joins seen running at once
+func (h *joinGate) peakJoins() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.peak
+}
+
+// dialConcurrently dials doc1 n times at once on a server running handler on hub, returning the
+// number of connections upgraded and the number refused with 503
+func dialConcurrently(t *testing.T, hub *Hub, handler Handler, n int) (upgraded, refused int) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/{id}", HandleAnonymousWebSocket(websocket.Upgrader{}, hub, handler))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/doc1", nil)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case err == nil:
+				upgraded++
+				t.Cleanup(func() { conn.Close() })
+			case resp != nil && resp.StatusCode == http.StatusServiceUnavailable:
+				refused++
+			default:
+				t.Errorf("dial failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return upgraded, refused
+}
+
+func TestConcurrentUpgradesCapped(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	hub.upgrades = make(chan struct{}, 3)
+	hub.upgradeQueueTimeout = 200 * time.Millisecond
+	go hub.Run()
+	handler := &joinGate{release: make(chan struct{})}
+	time.AfterFunc(time.Second, func() { close(handler.release) })
+
+	upgraded, refused := dialConcurrently(t, hub, handler, 20)
+
+	if upgraded != 3 || refused != 17 {
+		t.Errorf("%d upgraded and %d refused, want 3 and 17 as joins were held past the queue timeout", upgraded, refused)
+	}
+	if peak := handler.peakJoins(); peak > 3 {
+		t.Errorf("%d joins ran at once, want at most 3", peak)
+	}
+}
+
+func TestQueuedUpgradesProceed(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	hub.upgrades = make(chan struct{}, 3)
+	hub.upgradeQueueTimeout = testTimeout
+	go hub.Run()
+	handler := &joinGate{release: make(chan struct{})}
+	close(handler.release)
+
+	upgraded, refused := dialConcurrently(t, hub, handler, 20)
+
+	if upgraded != 20 || refused != 0 {
+		t.Errorf("%d upgraded and %d refused, want every queued upgrade to proceed", upgraded, refused)
+	}
+	if peak := handler.peakJoins(); peak > 3 {
+		t.Errorf("%d joins ran at once, want at most 3", peak)
+	}
+}
+
+func TestUpgradesRefusedWhileBuffersBackedUp(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	hub.maxBufferedMessages = 3
+	go hub.Run()
+	stuck := newHubConnection(hub, "conn-stuck", "alice", "doc1", 8)
+	hub.register <- stuck
+	waitFor(t, "the connection to be registered", func() bool { return hub.count() == 1 })
+	for i := 0; i < 4; i++ {
+		hub.BroadcastToDocument("doc1", []byte("edit"))
+	}
+	waitFor(t, "the edits to be queued", func() bool { return hub.BufferedMessages() == 4 })
+	handler := &recordingHandler{messages: make(chan DocumentMessage, 4)}
+
+	if upgraded, refused := dialConcurrently(t, hub, handler, 2); upgraded != 0 || refused != 2 {
+		t.Errorf("%d upgraded and %d refused while 4 messages were queued, want every upgrade refused", upgraded, refused)
+	}
+
+	for len(stuck.send) > 0 {
+		<-stuck.send
+	}
+	if upgraded, refused := dialConcurrently(t, hub, handler, 2); upgraded != 2 || refused != 0 {
+		t.Errorf("%d upgraded and %d refused once the buffers drained, want every upgrade to proceed", upgraded, refused)
+	}
+}
+
+// Run with -race: metadata is written by handlers while broadcasts and stats read it
+func TestConcurrentMetadataAccess(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	go hub.Run()
+	conn := newHubConnection(hub, "conn-1", "alice", "doc1", 64)
+	go drain(conn)
+	hub.register <- conn
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				conn.SetMetadata(config.MetaCursorColorKey, fmt.Sprintf("#%06x", j))
+				conn.SetMetadata(fmt.Sprintf("key-%d", j%8), j)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				conn.GetMetadata(config.MetaCursorColorKey)
+				conn.GetMetadata(fmt.Sprintf("key-%d", j%8))
+				conn.IsService()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				hub.BroadcastToDocument("doc1", []byte("edit"))
+				hub.CountConnectionsForDocument("doc1")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, ok := conn.GetMetadata("key-7").(int); !ok {
+		t.Error("metadata written concurrently was lost")
+	}
+}
+
+func TestDeadWritePumpCleanedUpOnBroadcast(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	go hub.Run()
+	dead := newHubConnection(hub, "conn-1", "alice", "doc1", 8)
+	live := newHubConnection(hub, "conn-2", "bob", "doc1", 8)
+	hub.register <- dead
+	hub.register <- live
+	waitFor(t, "the connections to be registered", func() bool { return hub.count() == 2 })
+
+	// The write pump exits without unregistering, as when it fails before the read pump notices
+	dead.writerDone.Store(true)
+	hub.BroadcastToDocument("doc1", []byte("edit"))
+
+	waitFor(t, "the dead connection to be removed", func() bool { return hub.count() == 1 })
+	if len(dead.send) != 0 {
+		t.Errorf("%d messages queued for a dead connection", len(dead.send))
+	}
+	if len(live.send) != 1 {
+		t.Errorf("the live connection got %d messages, want the edit", len(live.send))
+	}
+	if err := dead.SendMessage(DocumentMessage{Type: TextMessage, Data: []byte("late")}); err == nil {
+		t.Error("SendMessage succeeded on a dead connection")
+	}
+}
+
+func TestDeadWritePumpCleanedUpOnHubBroadcast(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	go hub.Run()
+	dead := newHubConnection(hub, "conn-1", "alice", "doc1", 8)
+	hub.register <- dead
+	waitFor(t, "the connection to be registered", func() bool { return hub.count() == 1 })
+
+	dead.writerDone.Store(true)
+	hub.Broadcast(DocumentMessage{Type: TextMessage, Data: []byte("notice")})
+
+	waitFor(t, "the dead connection to be removed", func() bool { return hub.count() == 0 })
+	if len(dead.send) != 0 {
+		t.Errorf("%d messages queued for a dead connection", len(dead.send))
+	}
+}
+
+// upgradedPeer returns the server and the client side of a WebSocket connection. Nothing reads on
+// the client side unless the test does.
+func upgradedPeer(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+
+	upgraded := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		upgraded <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	conn := <-upgraded
+	t.Cleanup(func() { conn.Close() })
+	return conn, client
+}
+
+func TestCloseWriteGivesUpOnUnresponsivePeer(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	hub.closeWriteWait = 200 * time.Millisecond
+	peer, _ := upgradedPeer(t)
+	conn := &Connection{id: "conn-1", clientID: "alice", conn: peer, hub: hub}
+
+	// A message far larger than the socket buffers blocks its writer, as the peer never reads
+	go conn.conn.WriteMessage(websocket.BinaryMessage, make([]byte, 64<<20))
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	conn.writeClose(websocket.CloseGoingAway, "shutting down")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writing the close frame took %v, want it to give up after about 200ms", elapsed)
+	}
+}
+
+func TestOversizedMessageClosesWith1009(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+
+	// The server may close before the whole frame is written, so a write error is expected
+	alice.conn.WriteMessage(websocket.TextMessage, make([]byte, config.Load().WebSocket.MaxMessageSize+1))
+
+	if closeErr := alice.expectClose(); closeErr.Code != websocket.CloseMessageTooBig {
+		t.Errorf("closed with %d %q, want %d", closeErr.Code, closeErr.Text, websocket.CloseMessageTooBig)
+	}
+	waitFor(t, "the connection to be removed", func() bool { return gateway.hub.count() == 0 })
+}
+
+func TestMessageAtTheSizeLimitAccepted(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	limit := int(config.Load().WebSocket.MaxMessageSize)
+	edit := `{"action":"insert","position":0,"data":"` + strings.Repeat("a", limit-len(`{"action":"insert","position":0,"data":""}`)) + `"}`
+
+	if err := alice.conn.WriteMessage(websocket.TextMessage, []byte(edit)); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	// Whatever becomes of the edit, reading it must not end the connection
+	alice.refuseWithin(300*time.Millisecond, "a close", func(testMessage) bool { return false })
+	if n := gateway.hub.count(); n != 1 {
+		t.Errorf("%d connections open, want alice's kept", n)
+	}
+}
+
+func TestStalledClientWriteTimesOut(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	hub.writeWait = 200 * time.Millisecond
+	go hub.Run()
+	conn := newHubConnection(hub, "conn-1", "alice", "doc1", 8)
+	conn.conn, _ = upgradedPeer(t)
+	hub.register <- conn
+	waitFor(t, "the connection to be registered", func() bool { return hub.count() == 1 })
+	go conn.writePump()
+
+	// The client never reads, so a message far larger than the socket buffers can't be written
+	start := time.Now()
+	if err := conn.SendMessage(DocumentMessage{Type: BinaryMessage, Data: make([]byte, 64<<20)}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	waitFor(t, "the stalled connection to be removed", func() bool { return !conn.alive() && hub.count() == 0 })
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the write pump gave up after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestTokenSubprotocolSelected(t *testing.T) {
+	gateway := newTestGateway(t)
+	dialer := &websocket.Dialer{Subprotocols: []string{middleware.TokenSubprotocol, testToken(t, "alice")}}
+
+	client := dialURL(t, dialer, gateway.url("/ws/document/doc1"))
+
+	client.expect("welcome", isNotice("welcome"))
+	if protocol := client.conn.Subprotocol(); protocol != middleware.TokenSubprotocol {
+		t.Errorf("selected subprotocol %q, want %s as browsers require", protocol, middleware.TokenSubprotocol)
+	}
+}
+
+func TestAuthorizationHeaderAccepted(t *testing.T) {
+	gateway := newTestGateway(t)
+	header := http.Header{"Authorization": {"Bearer " + testToken(t, "alice")}}
+
+	conn, _, err := websocket.DefaultDialer.Dial(gateway.url("/ws/document/doc1"), header)
+	if err != nil {
+		t.Fatalf("dial with an Authorization header failed: %v", err)
+	}
+	conn.Close()
+
+	if _, resp, err := websocket.DefaultDialer.Dial(gateway.url("/ws/document/doc1"), nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("dial without a token = %v, want 401", err)
+	}
+}
@@ -0,0 +1,30 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// appPing is the application-level keepalive, for clients behind proxies that strip control frames.
+// Clients answer it with {"type":"pong"}.
+var appPing = []byte(`{"type":"ping"}`)
+
+// maxAppPongSize bounds the frames inspected for an application-level pong, so edits aren't parsed twice
+const maxAppPongSize = 64
+
+// isAppPong reports whether a frame is the client's answer to an application-level ping
+func isAppPong(data []byte) bool {
+	if len(data) > maxAppPongSize {
+		return false
+	}
+	var message struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(data, &message) == nil && message.Type == "pong"
+}
+
+// appPongOverdue reports whether the client has let an application-level ping go unanswered for longer than the timeout
+func (c *Connection) appPongOverdue(now time.Time) bool {
+	last := time.Unix(0, c.lastAppPong.Load())
+	return now.Sub(last) > c.appPingInterval+c.appPongTimeout
+}
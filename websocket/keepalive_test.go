@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withAppKeepalive turns the application-level keepalive on for the gateway's connections
+func withAppKeepalive(interval, timeout time.Duration) func(*DocumentHandler) {
+	return func(h *DocumentHandler) {
+		h.hub.appPingInterval = interval
+		h.hub.appPongTimeout = timeout
+	}
+}
+
+func TestIsAppPong(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{`{"type":"pong"}`, true},
+		{` {"type": "pong"} `, true},
+		{`{"type":"ping"}`, false},
+		{`{"action":"insert","data":"pong"}`, false},
+		{`pong`, false},
+		{`{"type":"pong","padding":"` + string(make([]byte, maxAppPongSize)) + `"}`, false},
+	}
+	for _, tt := range tests {
+		if got := isAppPong([]byte(tt.data)); got != tt.want {
+			t.Errorf("isAppPong(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestAppKeepaliveKeepsAnsweringClients(t *testing.T) {
+	gateway := newTestGateway(t, withAppKeepalive(100*time.Millisecond, 300*time.Millisecond))
+	alice := gateway.dial("alice", "doc1")
+
+	for i := 0; i < 8; i++ {
+		alice.expect("application-level ping", isNotice("ping"))
+		alice.send(map[string]string{"type": "pong"})
+	}
+
+	if n := gateway.hub.count(); n != 1 {
+		t.Errorf("%d connections open, want alice's kept alive by her pongs", n)
+	}
+}
+
+func TestAppKeepaliveClosesUnresponsiveClients(t *testing.T) {
+	gateway := newTestGateway(t, withAppKeepalive(100*time.Millisecond, 300*time.Millisecond))
+	alice := gateway.dial("alice", "doc1")
+
+	alice.expect("application-level ping", isNotice("ping"))
+
+	if closeErr := alice.expectClose(); closeErr.Code != websocket.CloseGoingAway || closeErr.Text != "keepalive_timeout" {
+		t.Errorf("closed with %d %q, want %d keepalive_timeout", closeErr.Code, closeErr.Text, websocket.CloseGoingAway)
+	}
+}
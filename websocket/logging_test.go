@@ -0,0 +1,56 @@
+package websocket
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logBuffer collects the lines of the standard logger, which connections write from their own goroutines
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// line returns the first logged line containing the given text
+func (b *logBuffer) line(text string) (string, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, line := range strings.Split(b.buf.String(), "\n") {
+		if strings.Contains(line, text) {
+			return line, true
+		}
+	}
+	return "", false
+}
+
+func TestConnectionLogLinesCarryBoundFields(t *testing.T) {
+	gateway := newTestGateway(t)
+	logs := &logBuffer{}
+	output := log.Writer()
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	gateway.dial("alice", "doc1")
+	conn := gateway.connectionOf("alice")
+
+	var line string
+	waitFor(t, "the join to be logged", func() bool {
+		var ok bool
+		line, ok = logs.line("Successfully joined document")
+		return ok
+	})
+	for _, field := range []string{"user=alice", "conn=" + conn.id, "doc=doc1"} {
+		if !strings.Contains(line, field) {
+			t.Errorf("log line %q lacks %s", line, field)
+		}
+	}
+}
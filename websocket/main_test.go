@@ -0,0 +1,17 @@
+package websocket
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain shortens the heartbeat and the initial message timeout so tests of silent clients don't
+// wait for the production timeouts, and names the display claim.
+// The configuration is loaded once per process, so it is set before any test runs.
+func TestMain(m *testing.M) {
+	os.Setenv("WS_PING_INTERVAL", "100ms")
+	os.Setenv("WS_PONG_TIMEOUT", "1s")
+	os.Setenv("WS_INITIAL_MESSAGE_TIMEOUT", "500ms")
+	os.Setenv("JWT_DISPLAY_CLAIM", "name")
+	os.Exit(m.Run())
+}
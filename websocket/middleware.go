@@ -0,0 +1,45 @@
+package websocket
+
+// MessageHandlerFunc processes a message received on a connection
+type MessageHandlerFunc func(conn *Connection, message DocumentMessage) error
+
+// MessageMiddleware wraps message handling with a cross-cutting concern (logging, metrics,
+// validation, rate limiting, ...). It may handle the message itself instead of calling next.
+type MessageMiddleware func(next MessageHandlerFunc) MessageHandlerFunc
+
+// ChainMessages combines message middlewares; the first one sees each message first
+func ChainMessages(middlewares ...MessageMiddleware) MessageMiddleware {
+	return func(final MessageHandlerFunc) MessageHandlerFunc {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			final = middlewares[i](final)
+		}
+		return final
+	}
+}
+
+// WithMessageMiddleware returns a handler running the given handler's HandleMessage behind the
+// middlewares. Connect, disconnect and heartbeat calls go straight to the handler.
+func WithMessageMiddleware(handler Handler, middlewares ...MessageMiddleware) Handler {
+	return &middlewareHandler{
+		Handler: handler,
+		handle:  ChainMessages(middlewares...)(handler.HandleMessage),
+	}
+}
+
+// middlewareHandler is a Handler whose messages go through a middleware chain
+type middlewareHandler struct {
+	Handler
+	handle MessageHandlerFunc
+}
+
+// HandleMessage implements Handler
+func (m *middlewareHandler) HandleMessage(conn *Connection, message DocumentMessage) error {
+	return m.handle(conn, message)
+}
+
+// OnHeartbeat implements HeartbeatHandler for the handlers that support it
+func (m *middlewareHandler) OnHeartbeat(conn *Connection) {
+	if heartbeats, ok := m.Handler.(HeartbeatHandler); ok {
+		heartbeats.OnHeartbeat(conn)
+	}
+}
@@ -0,0 +1,94 @@
+package websocket
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tracing returns a middleware appending its name to trace before passing the message on
+func tracing(name string, trace *[]string) MessageMiddleware {
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(conn *Connection, message DocumentMessage) error {
+			*trace = append(*trace, name)
+			return next(conn, message)
+		}
+	}
+}
+
+func TestChainMessagesOrder(t *testing.T) {
+	var trace []string
+	handle := ChainMessages(tracing("logging", &trace), tracing("metrics", &trace))(func(*Connection, DocumentMessage) error {
+		trace = append(trace, "handler")
+		return nil
+	})
+
+	if err := handle(nil, DocumentMessage{Type: TextMessage, Data: []byte("edit")}); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	if want := []string{"logging", "metrics", "handler"}; !slices.Equal(trace, want) {
+		t.Errorf("ran %v, want %v", trace, want)
+	}
+}
+
+func TestMessageMiddlewareShortCircuits(t *testing.T) {
+	errRejected := errors.New("rejected")
+	var trace []string
+	reject := func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(conn *Connection, message DocumentMessage) error {
+			if strings.Contains(string(message.Data), "spam") {
+				return errRejected
+			}
+			return next(conn, message)
+		}
+	}
+	handler := &recordingHandler{messages: make(chan DocumentMessage, 4)}
+	wrapped := WithMessageMiddleware(handler, tracing("logging", &trace), reject)
+
+	if err := wrapped.HandleMessage(nil, DocumentMessage{Type: TextMessage, Data: []byte("spam")}); !errors.Is(err, errRejected) {
+		t.Errorf("HandleMessage = %v, want the middleware's error", err)
+	}
+	if err := wrapped.HandleMessage(nil, DocumentMessage{Type: TextMessage, Data: []byte("edit")}); err != nil {
+		t.Errorf("HandleMessage failed: %v", err)
+	}
+
+	if len(trace) != 2 {
+		t.Errorf("the first middleware ran %d times, want 2", len(trace))
+	}
+	if len(handler.messages) != 1 || string((<-handler.messages).Data) != "edit" {
+		t.Error("the handler did not receive exactly the accepted message")
+	}
+}
+
+func TestDocumentHandlerUse(t *testing.T) {
+	var seen atomic.Int32
+	gateway := newTestGateway(t, func(h *DocumentHandler) {
+		h.Use(func(next MessageHandlerFunc) MessageHandlerFunc {
+			return func(conn *Connection, message DocumentMessage) error {
+				seen.Add(1)
+				return next(conn, message)
+			}
+		}, func(next MessageHandlerFunc) MessageHandlerFunc {
+			return func(conn *Connection, message DocumentMessage) error {
+				if strings.Contains(string(message.Data), "blocked") {
+					return nil
+				}
+				return next(conn, message)
+			}
+		})
+	})
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	alice.edit("blocked")
+	alice.edit("allowed")
+
+	bob.expectEdit("allowed")
+	bob.refuseWithin(100*time.Millisecond, "the blocked edit", func(m testMessage) bool { return m.Payload.Data == "blocked" })
+	if n := seen.Load(); n != 2 {
+		t.Errorf("the first registered middleware saw %d messages, want 2", n)
+	}
+}
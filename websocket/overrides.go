@@ -0,0 +1,91 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrDocumentFull is returned when a document already has as many connections as its override allows
+var ErrDocumentFull = errors.New("document has reached its connection limit")
+
+// defaultSendBufferSize is the number of outbound messages buffered per connection
+const defaultSendBufferSize = 256
+
+// DocumentOverrides adjusts limits and modes for a single document. Zero fields fall back to the global settings.
+type DocumentOverrides struct {
+	// MaxConnections caps the local connections to the document; globally there is no cap
+	MaxConnections int `json:"max_connections,omitempty"`
+	// TransientRateLimit replaces WS_TRANSIENT_RATE_LIMIT for the document's connections
+	TransientRateLimit int `json:"transient_rate_limit,omitempty"`
+	// SendBufferSize replaces the outbound buffer size of connections joining the document
+	SendBufferSize int `json:"send_buffer_size,omitempty"`
+	// Encrypted marks the document's payloads as end-to-end encrypted: they are relayed as is, with
+	// no validation, control messages, document state or payload logging
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// OverrideRegistry holds the per-document overrides; it is safe for concurrent use
+type OverrideRegistry struct {
+	overrides map[string]DocumentOverrides
+	mutex     sync.RWMutex
+}
+
+// NewOverrideRegistry creates an empty override registry
+func NewOverrideRegistry() *OverrideRegistry {
+	return &OverrideRegistry{
+		overrides: make(map[string]DocumentOverrides),
+	}
+}
+
+// Get returns the overrides of a document, reporting whether it has any
+func (o *OverrideRegistry) Get(documentID string) (DocumentOverrides, bool) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	overrides, ok := o.overrides[documentID]
+	return overrides, ok
+}
+
+// Set replaces the overrides of a document; setting the zero value removes them
+func (o *OverrideRegistry) Set(documentID string, overrides DocumentOverrides) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if overrides == (DocumentOverrides{}) {
+		delete(o.overrides, documentID)
+		return
+	}
+	o.overrides[documentID] = overrides
+}
+
+// Delete removes the overrides of a document, reporting whether it had any
+func (o *OverrideRegistry) Delete(documentID string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	_, ok := o.overrides[documentID]
+	delete(o.overrides, documentID)
+	return ok
+}
+
+// encrypted reports whether the document's payloads are end-to-end encrypted
+func (o *OverrideRegistry) encrypted(documentID string) bool {
+	overrides, _ := o.Get(documentID)
+	return overrides.Encrypted
+}
+
+// sendBufferSize returns the outbound buffer size for a connection joining a document
+func (o *OverrideRegistry) sendBufferSize(documentID string) int {
+	if overrides, _ := o.Get(documentID); overrides.SendBufferSize > 0 {
+		return overrides.SendBufferSize
+	}
+	return defaultSendBufferSize
+}
+
+// transientRateLimit returns the transient message limit of a document, given the global one
+func (o *OverrideRegistry) transientRateLimit(documentID string, global int) int {
+	if overrides, _ := o.Get(documentID); overrides.TransientRateLimit > 0 {
+		return overrides.TransientRateLimit
+	}
+	return global
+}
@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOverrideRegistry(t *testing.T) {
+	registry := NewOverrideRegistry()
+
+	registry.Set("doc1", DocumentOverrides{MaxConnections: 2})
+	if got, ok := registry.Get("doc1"); !ok || got.MaxConnections != 2 {
+		t.Errorf("Get = %+v, %v; want the overrides set", got, ok)
+	}
+	if _, ok := registry.Get("doc2"); ok {
+		t.Error("a document without overrides reported some")
+	}
+
+	registry.Set("doc1", DocumentOverrides{})
+	if _, ok := registry.Get("doc1"); ok {
+		t.Error("setting the zero value kept the overrides")
+	}
+
+	registry.Set("doc1", DocumentOverrides{Encrypted: true})
+	if !registry.Delete("doc1") || registry.Delete("doc1") {
+		t.Error("Delete did not report the removal exactly once")
+	}
+}
+
+func TestOverridesTakePrecedence(t *testing.T) {
+	registry := NewOverrideRegistry()
+	registry.Set("busy", DocumentOverrides{TransientRateLimit: 100, SendBufferSize: 1024})
+
+	if got := registry.transientRateLimit("busy", 30); got != 100 {
+		t.Errorf("overridden rate limit = %d, want 100", got)
+	}
+	if got := registry.transientRateLimit("quiet", 30); got != 30 {
+		t.Errorf("default rate limit = %d, want the global 30", got)
+	}
+	if got := registry.sendBufferSize("busy"); got != 1024 {
+		t.Errorf("overridden send buffer = %d, want 1024", got)
+	}
+	if got := registry.sendBufferSize("quiet"); got != defaultSendBufferSize {
+		t.Errorf("default send buffer = %d, want %d", got, defaultSendBufferSize)
+	}
+}
+
+func TestOverriddenSendBufferSize(t *testing.T) {
+	gateway := newTestGateway(t)
+	gateway.hub.Overrides().Set("doc1", DocumentOverrides{SendBufferSize: 8})
+	gateway.dial("alice", "doc1")
+	gateway.dial("bob", "doc2")
+
+	if got := cap(gateway.connectionOf("alice").send); got != 8 {
+		t.Errorf("overridden send buffer holds %d messages, want 8", got)
+	}
+	if got := cap(gateway.connectionOf("bob").send); got != defaultSendBufferSize {
+		t.Errorf("default send buffer holds %d messages, want %d", got, defaultSendBufferSize)
+	}
+}
+
+func TestOverriddenConnectionLimit(t *testing.T) {
+	gateway := newTestGateway(t)
+	gateway.hub.Overrides().Set("doc1", DocumentOverrides{MaxConnections: 1})
+	gateway.dial("alice", "doc1")
+
+	bob := gateway.dialPath("bob", "/ws/document/doc1")
+	if closeErr := bob.expectClose(); closeErr.Code != websocket.CloseTryAgainLater {
+		t.Errorf("close code = %d, want %d", closeErr.Code, websocket.CloseTryAgainLater)
+	}
+
+	// Other documents keep the global setting: no limit
+	for _, userID := range []string{"bob", "carol"} {
+		gateway.dial(userID, "doc2")
+	}
+}
+
+func TestOverriddenTransientRateLimit(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.transient = newTransientThrottle(1, time.Minute) })
+	gateway.hub.Overrides().Set("doc1", DocumentOverrides{TransientRateLimit: 3})
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	for i := 0; i < 3; i++ {
+		alice.send(map[string]any{"action": "cursor", "position": i})
+	}
+	for i := 0; i < 3; i++ {
+		bob.expect("cursor update", func(m testMessage) bool { return m.Payload.Action == "cursor" })
+	}
+}
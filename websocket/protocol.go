@@ -0,0 +1,37 @@
+package websocket
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SupportedProtocolVersions lists the protocol versions this server speaks, oldest first
+var SupportedProtocolVersions = []int{1}
+
+// DefaultProtocolVersion is assumed for clients that don't announce a version
+const DefaultProtocolVersion = 1
+
+// CloseUnsupportedProtocol is the close code sent when client and server share no protocol version
+const CloseUnsupportedProtocol = 4001
+
+// negotiateProtocol picks the highest supported version among the ones offered by the client as
+// a comma-separated list (e.g. "1,2"). An empty offer means the default version.
+func negotiateProtocol(offer string) (int, bool) {
+	if strings.TrimSpace(offer) == "" {
+		return DefaultProtocolVersion, true
+	}
+
+	negotiated := 0
+	for _, field := range strings.Split(offer, ",") {
+		version, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			continue
+		}
+		for _, supported := range SupportedProtocolVersions {
+			if version == supported && version > negotiated {
+				negotiated = version
+			}
+		}
+	}
+	return negotiated, negotiated > 0
+}
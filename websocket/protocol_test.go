@@ -0,0 +1,52 @@
+package websocket
+
+import "testing"
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		offer  string
+		want   int
+		wantOK bool
+	}{
+		{"", DefaultProtocolVersion, true},
+		{"1", 1, true},
+		{"2, 1", 1, true},
+		{"1,x", 1, true},
+		{"2,3", 0, false},
+		{"x", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := negotiateProtocol(tt.offer)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("negotiateProtocol(%q) = %d, %v; want %d, %v", tt.offer, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestCompatibleProtocolHandshake(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	alice := gateway.dialPath("alice", "/ws/document/doc1?protocol=1,2")
+
+	welcome := alice.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	if welcome.Protocol != 1 {
+		t.Errorf("negotiated protocol %d, want 1", welcome.Protocol)
+	}
+	if got := gateway.connectionOf("alice").GetProtocolVersion(); got != 1 {
+		t.Errorf("connection protocol version = %d, want 1", got)
+	}
+}
+
+func TestIncompatibleProtocolHandshake(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	alice := gateway.dialPath("alice", "/ws/document/doc1?protocol=2,3")
+
+	closeErr := alice.expectClose()
+	if closeErr.Code != CloseUnsupportedProtocol || closeErr.Text != "unsupported_protocol" {
+		t.Errorf("closed with %d %q, want %d unsupported_protocol", closeErr.Code, closeErr.Text, CloseUnsupportedProtocol)
+	}
+	if count := gateway.hub.CountConnectionsForDocument("doc1"); count != 0 {
+		t.Errorf("%d connections joined doc1, want none", count)
+	}
+}
@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Policies for a connection whose send buffer is still full once the slow consumer grace passed
+const (
+	// OverflowClose drops the connection, the client reconnects and catches up
+	OverflowClose = "close"
+	// OverflowDropMessage drops the message and tells the client with a resync_required message
+	OverflowDropMessage = "drop_message"
+)
+
+// Connection resync states, see Connection.resync
+const (
+	resyncNone int32 = iota
+	resyncPending
+	resyncNotified
+)
+
+// ResyncRequiredMessage tells a client that messages were dropped for it. It has every edit up to
+// LastRevision; it should ignore what follows and reconnect with ?since=<LastRevision>.
+type ResyncRequiredMessage struct {
+	Type         string `json:"type"`
+	LastRevision int64  `json:"last_revision"`
+}
+
+// parseOverflowPolicy parses WS_OVERFLOW_POLICY, falling back to closing the connection
+func parseOverflowPolicy(value string) string {
+	switch value {
+	case OverflowClose, OverflowDropMessage:
+		return value
+	default:
+		log.Printf("Unknown WS_OVERFLOW_POLICY %q, closing overflowing connections", value)
+		return OverflowClose
+	}
+}
+
+// written records that a message was written to the client. Edits advance the revision the client
+// is known to have until it was told to resync; what follows the notice may have gaps.
+func (c *Connection) written(message DocumentMessage) {
+	if message.revision > 0 && c.resync.Load() != resyncNotified {
+		c.advanceRevision(message.revision)
+	}
+}
+
+// advanceRevision raises the revision the client is known to have, never lowering it: a join
+// racing an edit broadcast must not take it back below that edit
+func (c *Connection) advanceRevision(revision int64) {
+	for {
+		current := c.lastRevision.Load()
+		if revision <= current || c.lastRevision.CompareAndSwap(current, revision) {
+			return
+		}
+	}
+}
+
+// dropped records that a message was dropped for the connection, which from now on misses edits
+func (c *Connection) dropped() {
+	if c.resync.CompareAndSwap(resyncNone, resyncPending) {
+		c.Log().Warnf("Send buffer overflowed, dropping messages until the client resyncs from revision %d", c.lastRevision.Load())
+	}
+}
+
+// writeResyncNotice sends the resync_required message once, right after the first write following a
+// drop. The send buffer was full when the message was dropped, so that write is of a message queued
+// before the drop, and the notice's revision has no gap behind it. Later drops are covered by the
+// same notice.
+func (c *Connection) writeResyncNotice() error {
+	if !c.resync.CompareAndSwap(resyncPending, resyncNotified) {
+		return nil
+	}
+	data, err := json.Marshal(ResyncRequiredMessage{Type: "resync_required", LastRevision: c.lastRevision.Load()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal resync notice: %w", err)
+	}
+	return c.writeMessage(DocumentMessage{Type: TextMessage, Data: data})
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for value, want := range map[string]string{
+		"close":        OverflowClose,
+		"drop_message": OverflowDropMessage,
+		"":             OverflowClose,
+		"drop":         OverflowClose,
+	} {
+		if got := parseOverflowPolicy(value); got != want {
+			t.Errorf("parseOverflowPolicy(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+// overflowingHub returns a hub with the given overflow policy and a registered connection with
+// room for a single message, which nothing reads
+func overflowingHub(t *testing.T, policy string) (*Hub, *Connection) {
+	t.Helper()
+
+	hub := NewHub(idgen.NewSequential("conn"))
+	hub.overflowPolicy = policy
+	hub.slowConsumerGrace = 10 * time.Millisecond
+	go hub.Run()
+	conn := newHubConnection(hub, "conn-1", "alice", "doc1", 1)
+	hub.register <- conn
+	waitFor(t, "the connection to be registered", func() bool { return hub.count() == 1 })
+
+	for i := 0; i < 3; i++ {
+		hub.BroadcastToDocument("doc1", []byte("edit"))
+	}
+	return hub, conn
+}
+
+func TestOverflowDropMessageKeepsTheConnection(t *testing.T) {
+	hub, conn := overflowingHub(t, OverflowDropMessage)
+
+	waitFor(t, "the overflow to be recorded", func() bool { return conn.resync.Load() == resyncPending })
+	if n := hub.count(); n != 1 {
+		t.Errorf("%d connections registered, want the overflowing one kept", n)
+	}
+	if len(conn.send) != 1 {
+		t.Errorf("%d messages queued, want the first one only", len(conn.send))
+	}
+}
+
+func TestOverflowCloseDropsTheConnection(t *testing.T) {
+	hub, conn := overflowingHub(t, OverflowClose)
+
+	waitFor(t, "the overflowing connection to be removed", func() bool { return hub.count() == 0 })
+	if conn.resync.Load() != resyncNone {
+		t.Error("a closed connection was marked for a resync")
+	}
+}
+
+func TestResyncNoticeSentOnceWithTheLastRevision(t *testing.T) {
+	server, client := upgradedPeer(t)
+	conn := &Connection{id: "conn-1", clientID: "alice", conn: server, hub: NewHub(idgen.NewSequential("conn"))}
+
+	conn.written(DocumentMessage{Type: TextMessage, revision: 5})
+	conn.dropped()
+	conn.dropped()
+	if err := conn.writeResyncNotice(); err != nil {
+		t.Fatalf("writeResyncNotice failed: %v", err)
+	}
+	if err := conn.writeResyncNotice(); err != nil {
+		t.Fatalf("second writeResyncNotice failed: %v", err)
+	}
+	// Edits written after the notice may follow a gap, so they don't count
+	conn.written(DocumentMessage{Type: TextMessage, revision: 7})
+
+	client.SetReadDeadline(time.Now().Add(testTimeout))
+	var notice ResyncRequiredMessage
+	if err := client.ReadJSON(&notice); err != nil {
+		t.Fatalf("failed to read the notice: %v", err)
+	}
+	if notice.Type != "resync_required" || notice.LastRevision != 5 {
+		t.Errorf("notice = %+v, want resync_required from revision 5", notice)
+	}
+	if revision := conn.lastRevision.Load(); revision != 5 {
+		t.Errorf("last revision = %d, want 5 as of the notice", revision)
+	}
+
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := client.ReadMessage(); err == nil {
+		t.Errorf("received %s after the notice, want a single notice", data)
+	}
+}
+
+func TestAdvanceRevisionNeverLowers(t *testing.T) {
+	var conn Connection
+	conn.advanceRevision(4)
+	conn.advanceRevision(2)
+
+	if revision := conn.lastRevision.Load(); revision != 4 {
+		t.Errorf("last revision = %d, want 4", revision)
+	}
+}
@@ -0,0 +1,366 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/clock"
+	"github.com/emaforlin/ce-realtime-gateway/config"
+	"github.com/emaforlin/ce-realtime-gateway/document"
+	"github.com/emaforlin/ce-realtime-gateway/eventbus"
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+	"github.com/emaforlin/ce-realtime-gateway/nats"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// testTimeout bounds every wait for a message in the tests
+const testTimeout = 5 * time.Second
+
+// testGateway is a hub and document handler served over HTTP, fanning out through an in-process NATS server
+type testGateway struct {
+	t       *testing.T
+	hub     *Hub
+	handler *DocumentHandler
+	nats    *nats.Manager
+	bus     *eventbus.Bus
+	states  *document.Registry
+	server  *httptest.Server
+}
+
+// newTestGateway starts a gateway serving /ws/document/{id} behind the JWT middleware and the
+// anonymous /ws/document/{id}/view, with the document handler set up as in main then adjusted by options
+func newTestGateway(t *testing.T, options ...func(*DocumentHandler)) *testGateway {
+	t.Helper()
+
+	cfg := config.Load()
+	natsManager, err := nats.NewInProcessManager(cfg.NATS)
+	if err != nil {
+		t.Fatalf("failed to start NATS: %v", err)
+	}
+
+	hub := NewHub(idgen.NewSequential("conn"))
+	go hub.Run()
+
+	bus := eventbus.New(256, cfg.NATS.PublishTimeout)
+	natsManager.PublishEvents(bus.Subscribe(eventbus.TopicEdit, eventbus.TopicPresence, eventbus.TopicCursor))
+
+	states := document.NewRegistry(nil, 0)
+	handler := NewDocumentHandler(natsManager, hub, bus, states, clock.Real{})
+	handler.SetAuthorizer(AuthorizeDocumentClaim)
+	for _, option := range options {
+		option(handler)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/document/{id}", middleware.AuthJWT(HandleWebSocket(NewUpgrader(cfg), hub, handler)))
+	mux.HandleFunc("/ws/document/{id}/view", HandleAnonymousWebSocket(NewUpgrader(cfg), hub, handler))
+	server := httptest.NewServer(mux)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+		server.Close()
+		bus.Close()
+		natsManager.Close()
+	})
+
+	return &testGateway{
+		t:       t,
+		hub:     hub,
+		handler: handler,
+		nats:    natsManager,
+		bus:     bus,
+		states:  states,
+		server:  server,
+	}
+}
+
+// testClaims returns the claims of a token for a user from the configured issuer, valid for an hour
+func testClaims(userID string, scopes ...string) middleware.Claims {
+	return middleware.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			Issuer:    config.Load().JWT.Issuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Scope: strings.Join(scopes, " "),
+	}
+}
+
+// testToken signs a token for a user with the configured secret
+func testToken(t *testing.T, userID string, scopes ...string) string {
+	t.Helper()
+	return signToken(t, testClaims(userID, scopes...))
+}
+
+// signToken signs claims with the configured secret
+func signToken(t *testing.T, claims middleware.Claims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.Load().JWT.SecretKey))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+// url returns the WebSocket URL of a path on the gateway
+func (g *testGateway) url(path string) string {
+	return "ws" + strings.TrimPrefix(g.server.URL, "http") + path
+}
+
+// dial connects a user to a document and waits for the welcome message
+func (g *testGateway) dial(userID, documentID string) *testClient {
+	g.t.Helper()
+
+	client := g.dialPath(userID, "/ws/document/"+documentID)
+	client.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	return client
+}
+
+// dialPath connects a user to a gateway path, query included, without waiting for any message
+func (g *testGateway) dialPath(userID, path string) *testClient {
+	g.t.Helper()
+	return g.dialToken(testToken(g.t, userID), path)
+}
+
+// dialToken connects to a gateway path with the given token, without waiting for any message
+func (g *testGateway) dialToken(token, path string) *testClient {
+	g.t.Helper()
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return dialURL(g.t, websocket.DefaultDialer, g.url(path+separator+"token="+token))
+}
+
+// dialURL connects to a WebSocket URL with dialer, without waiting for any message
+func dialURL(t *testing.T, dialer *websocket.Dialer, url string) *testClient {
+	t.Helper()
+
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v (response: %v)", url, err, resp)
+	}
+	client := &testClient{t: t, conn: conn, messages: make(chan testMessage, 256)}
+	go client.readLoop()
+	t.Cleanup(func() { conn.Close() })
+	return client
+}
+
+// waitFor polls cond until it holds, failing the test after testTimeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testMessage holds the fields of the server messages the tests look at
+type testMessage struct {
+	Type          string                         `json:"type"`
+	MessageID     uint64                         `json:"message_id"`
+	SchemaVersion int                            `json:"schema_version"`
+	UserID        string                         `json:"user_id"`
+	ClientID      string                         `json:"client_id"`
+	DocumentID    string                         `json:"document_id"`
+	Color         string                         `json:"color"`
+	DisplayName   string                         `json:"display_name"`
+	Members       []string                       `json:"members"`
+	ReadOnly      bool                           `json:"read_only"`
+	Compressed    bool                           `json:"compressed"`
+	Encrypted     bool                           `json:"encrypted"`
+	Protocol      int                            `json:"protocol"`
+	Participants  int                            `json:"participants"`
+	Code          string                         `json:"code"`
+	Revision      int64                          `json:"revision"`
+	LastRevision  int64                          `json:"last_revision"`
+	Content       string                         `json:"content"`
+	Events        []publisher.DocumentEvent      `json:"events"`
+	Payload       publisher.DocumentEventPayload `json:"payload"`
+	raw           []byte
+	// binary is set for binary frames, whose data is only in raw
+	binary bool
+}
+
+// testClient is a WebSocket client of the test gateway. A read error is final with gorilla, so
+// messages are read in the background and waited for on a channel instead of with read deadlines.
+type testClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	messages chan testMessage
+	// err is the error that ended the read loop, set before messages is closed
+	err error
+}
+
+// readLoop decodes incoming messages until the connection fails
+func (c *testClient) readLoop() {
+	defer close(c.messages)
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			c.messages <- testMessage{raw: data, binary: true}
+			continue
+		}
+		message := testMessage{raw: data}
+		if err := json.Unmarshal(data, &message); err != nil {
+			c.err = fmt.Errorf("received invalid JSON %q: %w", data, err)
+			return
+		}
+		c.messages <- message
+	}
+}
+
+// send writes v as a JSON text message
+func (c *testClient) send(v any) {
+	c.t.Helper()
+
+	if err := c.conn.WriteJSON(v); err != nil {
+		c.t.Fatalf("failed to send: %v", err)
+	}
+}
+
+// edit sends an insert of data at position 0
+func (c *testClient) edit(data string) {
+	c.t.Helper()
+	c.send(publisher.DocumentEventPayload{Action: "insert", Position: 0, Data: data})
+}
+
+// errNoMessage is returned by read when no message arrived in time
+var errNoMessage = errors.New("no message received in time")
+
+// read returns the next message, or an error when none arrives within timeout
+func (c *testClient) read(timeout time.Duration) (testMessage, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case message, ok := <-c.messages:
+		if !ok {
+			return testMessage{}, c.err
+		}
+		return message, nil
+	case <-timer.C:
+		return testMessage{}, errNoMessage
+	}
+}
+
+// expect skips messages until one matches, failing the test if none does in time
+func (c *testClient) expect(what string, match func(testMessage) bool) testMessage {
+	c.t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		message, err := c.read(time.Until(deadline))
+		if err != nil {
+			c.t.Fatalf("no %s received: %v", what, err)
+		}
+		if match(message) {
+			return message
+		}
+	}
+}
+
+// expectEdit waits for the edit inserting data
+func (c *testClient) expectEdit(data string) testMessage {
+	c.t.Helper()
+	return c.expect("edit "+data, func(m testMessage) bool { return m.Payload.Action == "insert" && m.Payload.Data == data })
+}
+
+// refuseWithin fails the test if a matching message arrives within wait
+func (c *testClient) refuseWithin(wait time.Duration, what string, match func(testMessage) bool) {
+	c.t.Helper()
+
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		message, err := c.read(time.Until(deadline))
+		if errors.Is(err, errNoMessage) {
+			return
+		}
+		if err != nil {
+			c.t.Fatalf("connection failed while checking for %s: %v", what, err)
+		}
+		if match(message) {
+			c.t.Fatalf("unexpectedly received %s: %s", what, message.raw)
+		}
+	}
+}
+
+// expectClose skips messages until the connection is closed, returning the close error
+func (c *testClient) expectClose() *websocket.CloseError {
+	c.t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		_, err := c.read(time.Until(deadline))
+		if err == nil {
+			continue
+		}
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok {
+			c.t.Fatalf("connection ended without a close frame: %v", err)
+		}
+		return closeErr
+	}
+}
+
+func TestEditRoundTrip(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	alice.edit("hello")
+
+	edit := bob.expectEdit("hello")
+	if edit.UserID != "alice" || edit.DocumentID != "doc1" {
+		t.Errorf("edit from %q on %q, want alice on doc1", edit.UserID, edit.DocumentID)
+	}
+	if edit.MessageID == 0 {
+		t.Error("edit has no message ID")
+	}
+	alice.refuseWithin(300*time.Millisecond, "the sender's own edit", func(m testMessage) bool { return m.Payload.Action == "insert" })
+}
+
+func TestEditStaysInItsDocument(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	alice := gateway.dial("alice", "doc1")
+	carol := gateway.dial("carol", "doc2")
+
+	alice.edit("hello")
+
+	carol.refuseWithin(300*time.Millisecond, "an edit of another document", func(m testMessage) bool { return m.Payload.Action == "insert" })
+}
+
+func TestEditRejectedWhenBusRefusesIt(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	alice := gateway.dial("alice", "doc1")
+	gateway.bus.Close()
+
+	alice.edit("hello")
+
+	alice.expect("overloaded error", func(m testMessage) bool { return m.Type == "error" && m.Code == "overloaded" })
+}
@@ -0,0 +1,80 @@
+package websocket
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+)
+
+// documentTypeSeparator separates the document type from the rest of a document ID, as in "sheet:1234"
+const documentTypeSeparator = ":"
+
+// Router dispatches each connection to the handler registered for its document type.
+// The type is the prefix of the document ID before documentTypeSeparator; IDs without
+// a registered prefix go to the default handler.
+type Router struct {
+	fallback Handler
+	handlers map[string]Handler
+	mutex    sync.RWMutex
+}
+
+// NewRouter creates a router sending documents of unknown type to the given handler
+func NewRouter(fallback Handler) *Router {
+	return &Router{
+		fallback: fallback,
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Register routes documents of the given type to a handler
+func (r *Router) Register(documentType string, handler Handler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.handlers[documentType] = handler
+}
+
+// DocumentType returns the type prefix of a document ID, or "" when it has none
+func DocumentType(documentID string) string {
+	documentType, _, found := strings.Cut(documentID, documentTypeSeparator)
+	if !found {
+		return ""
+	}
+	return documentType
+}
+
+// resolve returns the handler for the connection's document
+func (r *Router) resolve(conn *Connection) Handler {
+	documentID, _ := conn.GetMetadata(config.MetaDocumentIDKey).(string)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if handler, ok := r.handlers[DocumentType(documentID)]; ok {
+		return handler
+	}
+	return r.fallback
+}
+
+// HandleMessage implements Handler
+func (r *Router) HandleMessage(conn *Connection, message DocumentMessage) error {
+	return r.resolve(conn).HandleMessage(conn, message)
+}
+
+// OnConnect implements Handler
+func (r *Router) OnConnect(conn *Connection) error {
+	return r.resolve(conn).OnConnect(conn)
+}
+
+// OnDisconnect implements Handler
+func (r *Router) OnDisconnect(conn *Connection) error {
+	return r.resolve(conn).OnDisconnect(conn)
+}
+
+// OnHeartbeat implements HeartbeatHandler for the handlers that support it
+func (r *Router) OnHeartbeat(conn *Connection) {
+	if heartbeats, ok := r.resolve(conn).(HeartbeatHandler); ok {
+		heartbeats.OnHeartbeat(conn)
+	}
+}
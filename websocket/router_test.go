@@ -0,0 +1,42 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+)
+
+func TestDocumentType(t *testing.T) {
+	for documentID, want := range map[string]string{
+		"sheet:1234": "sheet",
+		"board:a:b":  "board",
+		"1234":       "",
+		":1234":      "",
+	} {
+		if got := DocumentType(documentID); got != want {
+			t.Errorf("DocumentType(%q) = %q, want %q", documentID, got, want)
+		}
+	}
+}
+
+func TestRouterDispatchesByDocumentType(t *testing.T) {
+	text := &recordingHandler{messages: make(chan DocumentMessage, 4)}
+	sheets := &recordingHandler{messages: make(chan DocumentMessage, 4)}
+	router := NewRouter(text)
+	router.Register("sheet", sheets)
+
+	hub := NewHub(idgen.NewSequential("conn"))
+	for _, documentID := range []string{"sheet:1", "notes", "board:2"} {
+		conn := newHubConnection(hub, "conn-"+documentID, "alice", documentID, 1)
+		if err := router.HandleMessage(conn, DocumentMessage{Type: TextMessage, Data: []byte(documentID)}); err != nil {
+			t.Fatalf("HandleMessage failed: %v", err)
+		}
+	}
+
+	if got := len(sheets.messages); got != 1 || string((<-sheets.messages).Data) != "sheet:1" {
+		t.Errorf("the sheet handler got %d messages, want only sheet:1's", got)
+	}
+	if got := len(text.messages); got != 2 {
+		t.Errorf("the default handler got %d messages, want notes' and board:2's", got)
+	}
+}
@@ -0,0 +1,23 @@
+package websocket
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// withMessageID adds a "message_id" field to a JSON object, leaving anything else untouched
+func withMessageID(data []byte, id uint64) []byte {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return data
+	}
+	body := trimmed[1:]
+
+	stamped := make([]byte, 0, len(data)+32)
+	stamped = append(stamped, `{"message_id":`...)
+	stamped = strconv.AppendUint(stamped, id, 10)
+	if rest := bytes.TrimLeft(body, " \t\r\n"); len(rest) > 0 && rest[0] != '}' {
+		stamped = append(stamped, ',')
+	}
+	return append(stamped, body...)
+}
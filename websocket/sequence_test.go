@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWithMessageID(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"object", `{"type":"edit"}`, `{"message_id":7,"type":"edit"}`},
+		{"empty object", `{}`, `{"message_id":7}`},
+		{"empty object with spaces", ` { } `, `{"message_id":7 } `},
+		{"leading whitespace", "\n {\"a\":1}", `{"message_id":7,"a":1}`},
+		{"array untouched", `[1,2]`, `[1,2]`},
+		{"plain text untouched", `hello`, `hello`},
+		{"empty untouched", ``, ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(withMessageID([]byte(tt.data), 7)); got != tt.want {
+				t.Errorf("withMessageID(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageIDsIncreaseOnAConnection(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	alice := gateway.dial("alice", "doc1")
+	carol := gateway.dial("carol", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	var last uint64
+	for i := 0; i < 6; i++ {
+		sender := alice
+		if i%2 == 1 {
+			sender = carol
+		}
+		data := fmt.Sprintf("edit %d", i)
+		sender.edit(data)
+
+		edit := bob.expectEdit(data)
+		if edit.MessageID <= last {
+			t.Errorf("%q has message ID %d after %d, want increasing IDs", data, edit.MessageID, last)
+		}
+		last = edit.MessageID
+	}
+}
@@ -0,0 +1,93 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownReason is the close reason sent with CloseServiceRestart when the server shuts down
+const shutdownReason = "server_shutdown"
+
+// SetDeadlineFromContext ties the connection to a shutdown context: reads must complete by the
+// context's deadline and fail at once when it is cancelled. A failed read tears the connection
+// down through the usual path, so idle connections don't hold up shutdown until their own timeouts.
+func (c *Connection) SetDeadlineFromContext(ctx context.Context) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.capDeadline(deadline)
+	}
+	context.AfterFunc(ctx, func() {
+		c.capDeadline(time.Now())
+	})
+}
+
+// capDeadline makes t the latest read deadline the connection may have from now on
+func (c *Connection) capDeadline(t time.Time) {
+	for {
+		current := c.deadlineCap.Load()
+		if current != 0 && current <= t.UnixNano() {
+			return
+		}
+		if c.deadlineCap.CompareAndSwap(current, t.UnixNano()) {
+			break
+		}
+	}
+	c.conn.SetReadDeadline(t)
+}
+
+// readDeadline returns t, or the deadline cap when that comes first
+func (c *Connection) readDeadline(t time.Time) time.Time {
+	if limit := c.deadlineCap.Load(); limit != 0 && limit < t.UnixNano() {
+		return time.Unix(0, limit)
+	}
+	return t
+}
+
+// Drain cuts the connections short as SetDeadlinesFromContext does, then waits until they have all
+// left the hub or ctx expires
+func (h *Hub) Drain(ctx context.Context) error {
+	h.SetDeadlinesFromContext(ctx)
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for h.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d connections still open: %w", h.count(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Shutdown refuses new connections and tells every open one that the server is going away with a
+// CloseServiceRestart (1012) close frame, so clients reconnect right away instead of waiting on
+// their TCP timeout. It then drains the hub: reads are cut short at ctx's deadline, so clients
+// that don't answer the close frame can't hold it up. It should run before the HTTP server shuts down.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.shuttingDown.Store(true)
+	connections := h.snapshot()
+
+	// An unresponsive peer can hold up writing its close frame, don't let it delay the others
+	var wg sync.WaitGroup
+	for _, conn := range connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.writeClose(websocket.CloseServiceRestart, shutdownReason)
+		}()
+	}
+	wg.Wait()
+
+	return h.Drain(ctx)
+}
+
+// SetDeadlinesFromContext applies SetDeadlineFromContext to every connection on the hub
+func (h *Hub) SetDeadlinesFromContext(ctx context.Context) {
+	for _, conn := range h.snapshot() {
+		conn.SetDeadlineFromContext(ctx)
+	}
+}
@@ -0,0 +1,146 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdownSendsServiceRestart(t *testing.T) {
+	gateway := newTestGateway(t)
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := gateway.hub.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	for _, client := range []*testClient{alice, bob} {
+		closeErr := client.expectClose()
+		if closeErr.Code != websocket.CloseServiceRestart || closeErr.Text != shutdownReason {
+			t.Errorf("closed with %d %q, want %d %s", closeErr.Code, closeErr.Text, websocket.CloseServiceRestart, shutdownReason)
+		}
+	}
+	if open := gateway.hub.count(); open != 0 {
+		t.Errorf("%d connections left on the hub after Shutdown", open)
+	}
+}
+
+func TestShutdownRefusesNewConnections(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	gateway.hub.Shutdown(ctx)
+
+	_, resp, err := websocket.DefaultDialer.Dial(gateway.url("/ws/document/doc1?token="+testToken(t, "alice")), nil)
+	if err == nil {
+		t.Fatal("connected to a hub that is shutting down")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("response %v, want %d", resp, http.StatusServiceUnavailable)
+	}
+}
+
+func TestShutdownClosesConnectionsRegisteredAfterItStarts(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) {
+		h.hub.upgrades = make(chan struct{}, 1)
+		h.hub.upgradeQueueTimeout = testTimeout
+	})
+	// Hold the only upgrade slot so alice's upgrade waits past the shutdown check
+	gateway.hub.upgrades <- struct{}{}
+	dialed := make(chan *websocket.Conn, 1)
+	go func() {
+		conn, _, err := websocket.DefaultDialer.Dial(gateway.url("/ws/document/doc1?token="+testToken(t, "alice")), nil)
+		if err != nil {
+			t.Errorf("failed to connect: %v", err)
+		}
+		dialed <- conn
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := gateway.hub.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	<-gateway.hub.upgrades
+
+	conn := <-dialed
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	_, data, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseServiceRestart {
+		t.Fatalf("read %q, %v; want a %d close", data, err, websocket.CloseServiceRestart)
+	}
+	waitFor(t, "the connection to leave the hub", func() bool { return gateway.hub.count() == 0 })
+}
+
+func TestShutdownCutsShortUnresponsiveClients(t *testing.T) {
+	gateway := newTestGateway(t)
+	// Never reads, so never answers the close frame
+	conn, _, err := websocket.DefaultDialer.Dial(gateway.url("/ws/document/doc1?token="+testToken(t, "alice")), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	waitFor(t, "the connection to join", func() bool { return gateway.hub.count() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	gateway.hub.Shutdown(ctx)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown took %v with a 200ms context", elapsed)
+	}
+	waitFor(t, "the connection to leave the hub", func() bool { return gateway.hub.count() == 0 })
+}
+
+func TestCancelledContextTearsDownIdleConnections(t *testing.T) {
+	gateway := newTestGateway(t)
+	for _, userID := range []string{"alice", "bob", "carol"} {
+		gateway.dial(userID, "doc1")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gateway.hub.SetDeadlinesFromContext(ctx)
+	time.Sleep(300 * time.Millisecond)
+	if n := gateway.hub.count(); n != 3 {
+		t.Fatalf("%d connections left before the cancellation, want 3", n)
+	}
+
+	// The clients answer pings, so only the cancellation can end them before the test does
+	start := time.Now()
+	cancel()
+	waitFor(t, "the connections to be torn down", func() bool { return gateway.hub.count() == 0 })
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("teardown took %v, want it prompt", elapsed)
+	}
+}
+
+func TestReadDeadlineCapped(t *testing.T) {
+	var conn Connection
+	now := time.Now()
+	if got := conn.readDeadline(now.Add(time.Minute)); !got.Equal(now.Add(time.Minute)) {
+		t.Errorf("uncapped deadline = %v, want it unchanged", got)
+	}
+
+	conn.deadlineCap.Store(now.Add(time.Second).UnixNano())
+	if got := conn.readDeadline(now.Add(time.Minute)); !got.Equal(now.Add(time.Second)) {
+		t.Errorf("a pong extended the deadline to %v past the cap", got)
+	}
+	if got := conn.readDeadline(now.Add(time.Millisecond)); !got.Equal(now.Add(time.Millisecond)) {
+		t.Errorf("an earlier deadline was moved to %v", got)
+	}
+}
@@ -0,0 +1,62 @@
+package websocket
+
+import "sync/atomic"
+
+// ConnectionState is a stage of a connection's lifecycle. States only move forward:
+// connecting → active → closing → closed.
+type ConnectionState int32
+
+const (
+	// StateConnecting covers the time between the upgrade and a successful OnConnect
+	StateConnecting ConnectionState = iota
+	// StateActive connections exchange messages normally
+	StateActive
+	// StateClosing connections are leaving the hub and accept no new messages
+	StateClosing
+	// StateClosed connections have been removed from the hub and their send channel closed
+	StateClosed
+)
+
+// String returns the state name
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateActive:
+		return "active"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// connectionState holds a ConnectionState that can only advance
+type connectionState struct {
+	value atomic.Int32
+}
+
+// load returns the current state
+func (s *connectionState) load() ConnectionState {
+	return ConnectionState(s.value.Load())
+}
+
+// advance moves to the given state if it is later than the current one, reporting whether it did
+func (s *connectionState) advance(to ConnectionState) bool {
+	for {
+		current := s.value.Load()
+		if ConnectionState(current) >= to {
+			return false
+		}
+		if s.value.CompareAndSwap(current, int32(to)) {
+			return true
+		}
+	}
+}
+
+// State returns the lifecycle state of the connection
+func (c *Connection) State() ConnectionState {
+	return c.state.load()
+}
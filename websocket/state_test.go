@@ -0,0 +1,84 @@
+package websocket
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+)
+
+func TestConnectionStateOnlyAdvances(t *testing.T) {
+	var state connectionState
+
+	steps := []struct {
+		to   ConnectionState
+		want bool
+		then ConnectionState
+	}{
+		{StateConnecting, false, StateConnecting},
+		{StateActive, true, StateActive},
+		{StateActive, false, StateActive},
+		{StateClosed, true, StateClosed},
+		{StateClosing, false, StateClosed},
+		{StateActive, false, StateClosed},
+	}
+	for _, step := range steps {
+		if got := state.advance(step.to); got != step.want {
+			t.Errorf("advance(%s) = %v, want %v", step.to, got, step.want)
+		}
+		if got := state.load(); got != step.then {
+			t.Errorf("after advance(%s) the state is %s, want %s", step.to, got, step.then)
+		}
+	}
+}
+
+func TestConcurrentAdvanceHasOneWinner(t *testing.T) {
+	var state connectionState
+	var winners atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if state.advance(StateClosing) {
+				winners.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := winners.Load(); n != 1 {
+		t.Errorf("%d goroutines moved the connection to closing, want 1", n)
+	}
+}
+
+func TestClosingConnectionRejectsMessages(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	conn := newHubConnection(hub, "conn-1", "alice", "doc1", 1)
+	conn.state.advance(StateClosing)
+
+	if conn.trySend(DocumentMessage{Type: TextMessage, Data: []byte("late")}) {
+		t.Error("trySend succeeded on a closing connection")
+	}
+	if err := conn.SendMessage(DocumentMessage{Type: TextMessage, Data: []byte("late")}); err == nil {
+		t.Error("SendMessage succeeded on a closing connection")
+	}
+
+	// The hub isn't running: a second unregistration would block forever on its channel
+	conn.unregister()
+}
+
+func TestConnectionStateString(t *testing.T) {
+	for state, want := range map[ConnectionState]string{
+		StateConnecting: "connecting",
+		StateActive:     "active",
+		StateClosing:    "closing",
+		StateClosed:     "closed",
+		StateClosed + 1: "unknown",
+	} {
+		if got := state.String(); got != want {
+			t.Errorf("String() = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Bounds applied to the configured stats push interval
+const (
+	minStatsInterval = time.Second
+	maxStatsInterval = time.Minute
+)
+
+// Control messages toggling periodic document stats
+const (
+	controlSubscribeStats   = "subscribe_stats"
+	controlUnsubscribeStats = "unsubscribe_stats"
+)
+
+// controlMessage is a client message addressed to the server rather than to the document
+type controlMessage struct {
+	Type       string `json:"type"`
+	DocumentID string `json:"document_id,omitempty"`
+}
+
+// StatsMessage is pushed periodically to clients subscribed to document stats
+type StatsMessage struct {
+	Type         string `json:"type"`
+	DocumentID   string `json:"document_id"`
+	Participants int    `json:"participants"`
+}
+
+// clampStatsInterval keeps the configured interval within sane bounds
+func clampStatsInterval(interval time.Duration) time.Duration {
+	return min(max(interval, minStatsInterval), maxStatsInterval)
+}
+
+// handleControl processes control messages, reporting whether the data was one
+func (h *DocumentHandler) handleControl(conn *Connection, documentID string, data []byte) bool {
+	var control controlMessage
+	if err := json.Unmarshal(data, &control); err != nil {
+		return false
+	}
+
+	switch control.Type {
+	case controlSubscribeStats:
+		h.subscribeStats(conn, documentID)
+	case controlUnsubscribeStats:
+		h.unsubscribeStats(conn)
+	case controlTyping:
+		h.startTyping(conn, documentID)
+	case controlSwitchDocument:
+		if err := h.switchDocument(conn, documentID, control.DocumentID); err != nil {
+			conn.Log().Warnf("Failed to switch to document %s: %v", control.DocumentID, err)
+			conn.SendError("switch_failed", err.Error())
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// subscribeStats starts pushing stats to a connection; subscribing twice is a no-op
+func (h *DocumentHandler) subscribeStats(conn *Connection, documentID string) {
+	h.statsMutex.Lock()
+	defer h.statsMutex.Unlock()
+
+	if _, exists := h.statsSubs[conn.GetID()]; exists {
+		return
+	}
+	stop := make(chan struct{})
+	h.statsSubs[conn.GetID()] = stop
+
+	conn.Log().Infof("Subscribed to document stats")
+	go h.pushStats(conn, documentID, stop)
+}
+
+// unsubscribeStats stops pushing stats to a connection
+func (h *DocumentHandler) unsubscribeStats(conn *Connection) {
+	h.statsMutex.Lock()
+	defer h.statsMutex.Unlock()
+
+	if stop, exists := h.statsSubs[conn.GetID()]; exists {
+		close(stop)
+		delete(h.statsSubs, conn.GetID())
+	}
+}
+
+// pushStats sends the document's participant count every stats interval until stopped
+func (h *DocumentHandler) pushStats(conn *Connection, documentID string, stop <-chan struct{}) {
+	ticker := time.NewTicker(h.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			conn.SendJSON(StatsMessage{
+				Type:         "stats",
+				DocumentID:   documentID,
+				Participants: len(h.presence.Members(documentID)),
+			})
+		}
+	}
+}
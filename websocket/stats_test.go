@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClampStatsInterval(t *testing.T) {
+	for interval, want := range map[time.Duration]time.Duration{
+		0:               minStatsInterval,
+		5 * time.Second: 5 * time.Second,
+		time.Hour:       maxStatsInterval,
+	} {
+		if got := clampStatsInterval(interval); got != want {
+			t.Errorf("clampStatsInterval(%v) = %v, want %v", interval, got, want)
+		}
+	}
+}
+
+// isStats matches periodic stats messages
+func isStats(m testMessage) bool {
+	return m.Type == "stats"
+}
+
+func TestStatsPushedUntilUnsubscribed(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.statsInterval = 50 * time.Millisecond })
+	alice := gateway.dial("alice", "doc1")
+	gateway.dial("bob", "doc1")
+
+	alice.send(controlMessage{Type: controlSubscribeStats})
+	for i := 0; i < 2; i++ {
+		if stats := alice.expect("stats", isStats); stats.Participants != 2 || stats.DocumentID != "doc1" {
+			t.Errorf("stats for %s with %d participants, want doc1 with 2", stats.DocumentID, stats.Participants)
+		}
+	}
+
+	alice.send(controlMessage{Type: controlUnsubscribeStats})
+	// Let a push already on its way arrive before checking that they stopped
+	for {
+		if _, err := alice.read(100 * time.Millisecond); err != nil {
+			break
+		}
+	}
+	alice.refuseWithin(200*time.Millisecond, "stats after unsubscribing", isStats)
+}
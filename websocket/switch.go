@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/emaforlin/ce-realtime-gateway/config"
+)
+
+// controlSwitchDocument moves a connection to another document without reconnecting
+const controlSwitchDocument = "switch_document"
+
+// ErrDocumentAccessDenied is returned when a user may not join a document
+var ErrDocumentAccessDenied = errors.New("access to the document denied")
+
+// DocumentAuthorizer decides whether a connection's user may join a document
+type DocumentAuthorizer func(conn *Connection, documentID string) bool
+
+// AuthorizeDocumentClaim is a DocumentAuthorizer honoring the document_id claim: a token issued
+// for a document only grants access to that one, a token without the claim to every document.
+func AuthorizeDocumentClaim(conn *Connection, documentID string) bool {
+	claimed, _ := conn.GetMetadata(config.MetaDocumentClaimKey).(string)
+	return claimed == "" || claimed == documentID
+}
+
+// UnauthorizedStrategy decides what happens to a connection the authorizer denies
+type UnauthorizedStrategy string
+
+const (
+	// UnauthorizedReject refuses the connection (close code 1008, "forbidden")
+	UnauthorizedReject UnauthorizedStrategy = "reject"
+	// UnauthorizedDowngradeReadOnly lets the connection join as a read-only viewer
+	UnauthorizedDowngradeReadOnly UnauthorizedStrategy = "downgrade_readonly"
+)
+
+// parseUnauthorizedStrategy parses WS_UNAUTHORIZED_STRATEGY, falling back to reject
+func parseUnauthorizedStrategy(value string) UnauthorizedStrategy {
+	switch strategy := UnauthorizedStrategy(value); strategy {
+	case UnauthorizedReject, UnauthorizedDowngradeReadOnly:
+		return strategy
+	default:
+		log.Printf("Unknown WS_UNAUTHORIZED_STRATEGY %q, rejecting unauthorized users", value)
+		return UnauthorizedReject
+	}
+}
+
+// SetAuthorizer installs the access check applied when a connection joins or switches documents;
+// nil allows everything. It must be called before the handler starts serving connections.
+func (h *DocumentHandler) SetAuthorizer(authorize DocumentAuthorizer) {
+	h.authorize = authorize
+}
+
+// authorized reports whether the connection's user may access a document
+func (h *DocumentHandler) authorized(conn *Connection, documentID string) bool {
+	return h.authorize == nil || h.authorize(conn, documentID)
+}
+
+// applyAuthorization checks access to the document being joined. Denied connections are refused,
+// or downgraded to read-only with the downgrade strategy; a downgrade only lasts for that document.
+func (h *DocumentHandler) applyAuthorization(conn *Connection, documentID string) error {
+	allowed := h.authorized(conn, documentID)
+	if !allowed && h.unauthorizedStrategy == UnauthorizedReject {
+		return ErrDocumentAccessDenied
+	}
+	if !allowed {
+		conn.Log().Infof("Not authorized to edit, joining read-only")
+	}
+	conn.SetMetadata(config.MetaDowngradedKey, !allowed)
+	return nil
+}
+
+// switchDocument leaves the connection's current document and joins another one, as if the client
+// had reconnected. If joining the target fails the connection goes back to its previous document.
+func (h *DocumentHandler) switchDocument(conn *Connection, from, to string) error {
+	if to == "" || to == from {
+		return fmt.Errorf("invalid target document %q", to)
+	}
+	// The router picked this handler for the current document type, it can't hand the connection over
+	if DocumentType(to) != DocumentType(from) {
+		return fmt.Errorf("cannot switch between document types %q and %q", DocumentType(from), DocumentType(to))
+	}
+	// Refuse before leaving the current document; a downgrade is applied when joining
+	if h.unauthorizedStrategy == UnauthorizedReject && !h.authorized(conn, to) {
+		return ErrDocumentAccessDenied
+	}
+
+	conn.Log().Infof("Switching to document %s", to)
+
+	h.OnDisconnect(conn)
+	// A revision seen in the previous document means nothing in the new one: joining sends a snapshot
+	conn.SetMetadata(config.MetaSinceRevisionKey, nil)
+	conn.awaitingState.Store(true)
+	conn.lastRevision.Store(0)
+	conn.resync.Store(resyncNone)
+	h.hub.moveDocument(conn, to)
+
+	if err := h.OnConnect(conn); err != nil {
+		h.hub.moveDocument(conn, from)
+		if rejoinErr := h.OnConnect(conn); rejoinErr != nil {
+			conn.Log().Errorf("Could not rejoin document: %v", rejoinErr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialClaimed connects alice to a document with a token issued for claimedDocument
+func (g *testGateway) dialClaimed(claimedDocument, documentID string) *testClient {
+	g.t.Helper()
+
+	claims := testClaims("alice")
+	claims.DocumentID = claimedDocument
+	return g.dialToken(signToken(g.t, claims), "/ws/document/"+documentID)
+}
+
+func TestJoinWithinDocumentClaim(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	client := gateway.dialClaimed("doc1", "doc1")
+
+	welcome := client.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	if welcome.ReadOnly {
+		t.Error("joined the claimed document read-only")
+	}
+}
+
+func TestJoinOutsideDocumentClaimRejected(t *testing.T) {
+	gateway := newTestGateway(t)
+
+	client := gateway.dialClaimed("doc1", "doc2")
+
+	closeErr := client.expectClose()
+	if closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "forbidden" {
+		t.Errorf("closed with %d %q, want %d forbidden", closeErr.Code, closeErr.Text, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestJoinOutsideDocumentClaimDowngraded(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.unauthorizedStrategy = UnauthorizedDowngradeReadOnly })
+	bob := gateway.dial("bob", "doc2")
+
+	alice := gateway.dialClaimed("doc1", "doc2")
+
+	welcome := alice.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	if !welcome.ReadOnly {
+		t.Fatal("joined a document outside the claim without being downgraded")
+	}
+	alice.edit("hello")
+	alice.expect("read_only error", func(m testMessage) bool { return m.Type == "error" && m.Code == "read_only" })
+	bob.refuseWithin(300*time.Millisecond, "an edit of a read-only user", func(m testMessage) bool { return m.Payload.Action == "insert" })
+}
+
+func TestSwitchDocumentOutsideClaimRefused(t *testing.T) {
+	gateway := newTestGateway(t)
+	bob := gateway.dial("bob", "doc1")
+	alice := gateway.dialClaimed("doc1", "doc1")
+	alice.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+
+	alice.send(map[string]string{"type": "switch_document", "document_id": "doc2"})
+
+	alice.expect("switch_failed error", func(m testMessage) bool { return m.Type == "error" && m.Code == "switch_failed" })
+	alice.edit("still here")
+	bob.expectEdit("still here")
+}
+
+func TestSwitchDocument(t *testing.T) {
+	gateway := newTestGateway(t)
+	bob := gateway.dial("bob", "doc2")
+	alice := gateway.dial("alice", "doc1")
+
+	alice.send(map[string]string{"type": "switch_document", "document_id": "doc2"})
+
+	welcome := alice.expect("welcome", func(m testMessage) bool { return m.Type == "welcome" })
+	if welcome.DocumentID != "doc2" {
+		t.Fatalf("welcomed to %q, want doc2", welcome.DocumentID)
+	}
+	alice.edit("moved")
+	bob.expectEdit("moved")
+}
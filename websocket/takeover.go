@@ -0,0 +1,23 @@
+package websocket
+
+// CloseSessionSuperseded is the close code sent to a user's connection when a newer one replaces it
+const CloseSessionSuperseded = 4003
+
+// sessionSupersededReason is the close reason sent with CloseSessionSuperseded
+const sessionSupersededReason = "session_superseded"
+
+// supersedeSessions closes the open connections of a user ahead of registering a new one, leaving
+// service connections alone, and returns how many were closed
+func (h *Hub) supersedeSessions(clientID string) int {
+	closed := 0
+	for _, conn := range h.userConnections(clientID) {
+		if conn.IsService() {
+			continue
+		}
+		conn.Log().Infof("Superseded by a newer session, closing")
+		conn.writeClose(CloseSessionSuperseded, sessionSupersededReason)
+		conn.unregister()
+		closed++
+	}
+	return closed
+}
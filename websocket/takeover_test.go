@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/middleware"
+)
+
+// withSingleSession closes a user's previous connections when they open a new one
+func withSingleSession(h *DocumentHandler) {
+	h.hub.singleSession = true
+}
+
+func TestNewSessionSupersedesThePrevious(t *testing.T) {
+	gateway := newTestGateway(t, withSingleSession)
+	bob := gateway.dial("bob", "doc1")
+	old := gateway.dial("alice", "doc1")
+
+	current := gateway.dial("alice", "doc2")
+
+	if closeErr := old.expectClose(); closeErr.Code != CloseSessionSuperseded || closeErr.Text != sessionSupersededReason {
+		t.Errorf("previous session closed with %d %q, want %d %s", closeErr.Code, closeErr.Text, CloseSessionSuperseded, sessionSupersededReason)
+	}
+	waitFor(t, "the previous session to be removed", func() bool { return gateway.hub.count() == 2 })
+	if sessions := gateway.hub.UserSessions("alice"); len(sessions) != 1 || sessions[0].DocumentID != "doc2" {
+		t.Errorf("alice's sessions = %+v, want the doc2 one only", sessions)
+	}
+
+	carol := gateway.dial("carol", "doc2")
+	current.edit("hello")
+	carol.expectEdit("hello")
+	bob.refuseWithin(100*time.Millisecond, "an edit of another document", isInsert)
+}
+
+func TestServiceSessionsNotSuperseded(t *testing.T) {
+	gateway := newTestGateway(t, withSingleSession)
+	gateway.dialToken(testToken(t, "indexer", middleware.ScopeService), "/ws/document/doc1")
+	waitFor(t, "the service to join", func() bool { return gateway.hub.count() == 1 })
+
+	gateway.dialToken(testToken(t, "indexer", middleware.ScopeService), "/ws/document/doc2")
+	gateway.dial("indexer", "doc3")
+
+	waitFor(t, "every connection to join", func() bool { return gateway.hub.count() == 3 })
+	if sessions := gateway.hub.UserSessions("indexer"); len(sessions) != 3 {
+		t.Errorf("indexer has %d sessions, want its service connections kept", len(sessions))
+	}
+}
+
+func TestSessionsKeptWithoutSingleSession(t *testing.T) {
+	gateway := newTestGateway(t)
+	first := gateway.dial("alice", "doc1")
+	gateway.dial("alice", "doc1")
+
+	first.refuseWithin(300*time.Millisecond, "a close", func(testMessage) bool { return false })
+	if sessions := gateway.hub.UserSessions("alice"); len(sessions) != 2 {
+		t.Errorf("alice has %d sessions, want both kept", len(sessions))
+	}
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+// transientThrottle caps how many transient (cursor, presence) messages each connection may send
+// per window, so chatty clients can't flood the document; edits are never throttled
+type transientThrottle struct {
+	limit   int
+	window  time.Duration
+	clients map[string]*throttleWindow
+	mutex   sync.Mutex
+}
+
+type throttleWindow struct {
+	start time.Time
+	count int
+}
+
+// newTransientThrottle creates a throttle allowing limit messages per window; a limit of 0 allows everything
+func newTransientThrottle(limit int, window time.Duration) *transientThrottle {
+	return &transientThrottle{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string]*throttleWindow),
+	}
+}
+
+// Allow reports whether the connection may send one more transient message at now
+func (t *transientThrottle) Allow(connectionID string, now time.Time) bool {
+	return t.AllowWithLimit(connectionID, now, t.limit)
+}
+
+// AllowWithLimit is Allow with a different limit, such as a per-document override
+func (t *transientThrottle) AllowWithLimit(connectionID string, now time.Time, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	w, exists := t.clients[connectionID]
+	if !exists || now.Sub(w.start) > t.window {
+		t.clients[connectionID] = &throttleWindow{start: now, count: 1}
+		return true
+	}
+	w.count++
+	return w.count <= limit
+}
+
+// Forget drops the state of a closed connection
+func (t *transientThrottle) Forget(connectionID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.clients, connectionID)
+}
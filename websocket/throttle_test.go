@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/idgen"
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+func TestTransientThrottle(t *testing.T) {
+	throttle := newTransientThrottle(2, time.Second)
+	start := time.Now()
+
+	for i, want := range []bool{true, true, false, false} {
+		if got := throttle.Allow("conn-1", start.Add(time.Duration(i)*time.Millisecond)); got != want {
+			t.Errorf("message %d allowed = %v, want %v", i+1, got, want)
+		}
+	}
+	if !throttle.Allow("conn-2", start) {
+		t.Error("another connection was throttled by conn-1's messages")
+	}
+	if !throttle.Allow("conn-1", start.Add(2*time.Second)) {
+		t.Error("conn-1 still throttled in a new window")
+	}
+
+	throttle.Allow("conn-2", start)
+	throttle.Forget("conn-2")
+	if !throttle.Allow("conn-2", start) || !throttle.Allow("conn-2", start) {
+		t.Error("a forgotten connection kept its count")
+	}
+}
+
+func TestTransientThrottleUnlimited(t *testing.T) {
+	throttle := newTransientThrottle(0, time.Second)
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		if !throttle.Allow("conn-1", now) {
+			t.Fatalf("message %d throttled without a limit", i+1)
+		}
+	}
+	if throttle.AllowWithLimit("conn-1", now, 1) && throttle.AllowWithLimit("conn-1", now, 1) {
+		t.Error("a limit override was not applied")
+	}
+}
+
+func TestTransientBroadcastYieldsToEdits(t *testing.T) {
+	hub := NewHub(idgen.NewSequential("conn"))
+	hub.lowPriorityQueueLimit = 2
+	go hub.Run()
+	busy := newHubConnection(hub, "conn-1", "alice", "doc1", 4)
+	hub.register <- busy
+
+	for _, data := range []string{"edit 1", "edit 2"} {
+		hub.BroadcastToDocument("doc1", []byte(data))
+	}
+	hub.BroadcastTransientToDocument("doc1", []byte("cursor"))
+	hub.BroadcastToDocument("doc1", []byte("edit 3"))
+
+	for _, want := range []string{"edit 1", "edit 2", "edit 3"} {
+		if got := string((<-busy.send).Data); got != want {
+			t.Fatalf("received %q, want %q", got, want)
+		}
+	}
+	if len(busy.send) != 0 {
+		t.Errorf("%d messages left, want the cursor skipped", len(busy.send))
+	}
+	if state := busy.State(); state != StateActive {
+		t.Errorf("busy connection is %s, want it kept", state)
+	}
+
+	hub.BroadcastTransientToDocument("doc1", []byte("cursor"))
+	if got := string((<-busy.send).Data); got != "cursor" {
+		t.Errorf("received %q, want the cursor once the buffer emptied", got)
+	}
+}
+
+func TestCursorFloodThrottledEditsDelivered(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.transient = newTransientThrottle(5, time.Minute) })
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	for i := 0; i < 50; i++ {
+		alice.send(publisher.DocumentEventPayload{Action: "cursor", Position: i})
+		if i%10 == 0 {
+			alice.edit(string(rune('a' + i/10)))
+		}
+	}
+
+	cursors := 0
+	for _, data := range []string{"a", "b", "c", "d", "e"} {
+		bob.expect("edit "+data, func(m testMessage) bool {
+			if m.Payload.Action == "cursor" {
+				cursors++
+			}
+			return m.Payload.Action == "insert" && m.Payload.Data == data
+		})
+	}
+	bob.refuseWithin(300*time.Millisecond, "more cursor updates than allowed", func(m testMessage) bool {
+		if m.Payload.Action == "cursor" {
+			cursors++
+		}
+		return cursors > 5
+	})
+	if cursors != 5 {
+		t.Errorf("received %d cursor updates, want the 5 allowed", cursors)
+	}
+}
@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// controlTyping tells the server the client's user is typing; repeat it to keep the indicator up
+const controlTyping = "typing"
+
+// typingTracker holds a timer per user typing in a document; a timer firing means they stopped
+type typingTracker struct {
+	timeout time.Duration
+	timers  map[string]*time.Timer
+	mutex   sync.Mutex
+}
+
+// newTypingTracker creates a tracker ending typing indicators after timeout without a refresh
+func newTypingTracker(timeout time.Duration) *typingTracker {
+	return &typingTracker{
+		timeout: timeout,
+		timers:  make(map[string]*time.Timer),
+	}
+}
+
+// typingKey identifies a user in a document
+func typingKey(documentID, userID string) string {
+	return documentID + "\x00" + userID
+}
+
+// startTyping broadcasts that the connection's user is typing, unless already known, and
+// (re)starts the timer announcing typing_stopped once the refreshes stop
+func (h *DocumentHandler) startTyping(conn *Connection, documentID string) {
+	if conn.IsReadOnly() || conn.IsService() {
+		return
+	}
+
+	key := typingKey(documentID, conn.GetClientID())
+
+	h.typing.mutex.Lock()
+	timer, typing := h.typing.timers[key]
+	if typing && timer.Stop() {
+		timer.Reset(h.typing.timeout)
+		h.typing.mutex.Unlock()
+		return
+	}
+	h.typing.timers[key] = time.AfterFunc(h.typing.timeout, func() {
+		h.stopTyping(conn, documentID)
+	})
+	h.typing.mutex.Unlock()
+
+	h.publishTyping(conn, documentID, publisher.ActionTyping)
+}
+
+// stopTyping broadcasts typing_stopped for the connection's user if they were typing
+func (h *DocumentHandler) stopTyping(conn *Connection, documentID string) {
+	key := typingKey(documentID, conn.GetClientID())
+
+	h.typing.mutex.Lock()
+	timer, typing := h.typing.timers[key]
+	if typing {
+		timer.Stop()
+		delete(h.typing.timers, key)
+	}
+	h.typing.mutex.Unlock()
+
+	if typing {
+		h.publishTyping(conn, documentID, publisher.ActionTypingStopped)
+	}
+}
+
+// publishTyping shares a typing event with every instance
+func (h *DocumentHandler) publishTyping(conn *Connection, documentID, action string) {
+	h.bus.Publish(publisher.DocumentEvent{
+		SchemaVersion:      publisher.CurrentSchemaVersion,
+		DocumentID:         documentID,
+		UserID:             conn.GetClientID(),
+		Payload:            publisher.DocumentEventPayload{Action: action},
+		Timestamp:          h.clock.Now().Unix(),
+		Color:              cursorColor(conn),
+		DisplayName:        conn.GetDisplayName(),
+		SenderConnectionID: conn.GetID(),
+	})
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emaforlin/ce-realtime-gateway/publisher"
+)
+
+// typingTimeout is the typing indicator timeout of the tests
+const typingTimeout = 300 * time.Millisecond
+
+// isTyping matches a typing event of a user with the given action
+func isTyping(userID, action string) func(testMessage) bool {
+	return func(m testMessage) bool { return m.UserID == userID && m.Payload.Action == action }
+}
+
+func TestTypingStopsAfterTimeout(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.typing = newTypingTracker(typingTimeout) })
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	start := time.Now()
+	alice.send(controlMessage{Type: controlTyping})
+	bob.expect("typing event", isTyping("alice", publisher.ActionTyping))
+	bob.expect("typing_stopped event", isTyping("alice", publisher.ActionTypingStopped))
+
+	if elapsed := time.Since(start); elapsed < typingTimeout {
+		t.Errorf("typing stopped after %v, before the %v timeout", elapsed, typingTimeout)
+	}
+}
+
+func TestTypingRefreshKeepsIndicator(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.typing = newTypingTracker(typingTimeout) })
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	alice.send(controlMessage{Type: controlTyping})
+	bob.expect("typing event", isTyping("alice", publisher.ActionTyping))
+	for i := 0; i < 6; i++ {
+		bob.refuseWithin(typingTimeout/3, "another typing event while refreshing", func(m testMessage) bool {
+			return m.Payload.Action == publisher.ActionTyping || m.Payload.Action == publisher.ActionTypingStopped
+		})
+		alice.send(controlMessage{Type: controlTyping})
+	}
+
+	bob.expect("typing_stopped event", isTyping("alice", publisher.ActionTypingStopped))
+}
+
+func TestLeavingStopsTyping(t *testing.T) {
+	gateway := newTestGateway(t, func(h *DocumentHandler) { h.typing = newTypingTracker(time.Minute) })
+	alice := gateway.dial("alice", "doc1")
+	bob := gateway.dial("bob", "doc1")
+
+	alice.send(controlMessage{Type: controlTyping})
+	bob.expect("typing event", isTyping("alice", publisher.ActionTyping))
+	alice.conn.Close()
+
+	bob.expect("typing_stopped event", isTyping("alice", publisher.ActionTypingStopped))
+}